@@ -0,0 +1,33 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/code-sleuth/vending-machine/config"
+)
+
+// ErrNotFound is returned when no blob is stored under a key
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps blobs, such as product images, under slash separated keys
+type Store interface {
+	// Put stores the content of r under key, replacing any blob already there
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the blob under key, the caller closes it
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob under key, removing a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// New creates the configured store
+func New(cfg *config.ImagesConfig) (Store, error) {
+	switch cfg.Store {
+	case config.BlobStoreLocal:
+		return NewLocalStore(cfg.Dir)
+	default:
+		return nil, fmt.Errorf("unknown blob store '%s'", cfg.Store)
+	}
+}
@@ -0,0 +1,186 @@
+// Package bus is the in-process event bus the db service publishes state changes to once they commit,
+// and the streams read from. Publishing never blocks: each subscription buffers its events, replacing a
+// pending event by a later one reporting the same state and dropping events once its buffer is full
+package bus
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	// EventStock reports the stock of a product, in the catalog or in a slot of a machine
+	EventStock = "stock"
+	// EventBalance reports the balance of a user, in the account or in a machine
+	EventBalance = "balance"
+	// EventMachineStatus reports the status of a machine
+	EventMachineStatus = "machine.status"
+	// EventMachineSession reports the state of the vend cycle of a machine
+	EventMachineSession = "machine.session"
+)
+
+// ProductTopic is the topic of the events of a product
+func ProductTopic(productUUID string) string {
+	return "product:" + productUUID
+}
+
+// UserTopic is the topic of the events of a user
+func UserTopic(userUUID string) string {
+	return "user:" + userUUID
+}
+
+// MachineTopic is the topic of the events of a machine
+func MachineTopic(machineUUID string) string {
+	return "machine:" + machineUUID
+}
+
+// Event is a change of state published to the subscribers of its topic
+type Event struct {
+	Topic string `json:"topic"`
+	Type  string `json:"type"`
+	// Key tells apart the states reported by the events of a topic and type, such as the slots of a
+	// product: a pending event is replaced by a later one with the same key
+	Key  string      `json:"-"`
+	Data interface{} `json:"data"`
+	Time time.Time   `json:"time"`
+}
+
+// Bus delivers the events published to the subscriptions of their topic
+type Bus struct {
+	bufferSize int
+
+	mu            sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+	closed        bool
+}
+
+// New creates a bus whose subscriptions buffer up to bufferSize events
+func New(bufferSize int) *Bus {
+	return &Bus{bufferSize: bufferSize, subscriptions: make(map[*Subscription]struct{})}
+}
+
+// Publish offers the event to the subscriptions of its topic without waiting for them. A nil bus
+// publishes nothing
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for subscription := range b.subscriptions {
+		if subscription.topics[event.Topic] {
+			subscription.offer(event)
+		}
+	}
+}
+
+// Subscribe subscribes to the events of topics until the subscription or the bus is closed
+func (b *Bus) Subscribe(topics ...string) *Subscription {
+	subscription := &Subscription{
+		bus:     b,
+		topics:  make(map[string]bool, len(topics)),
+		limit:   b.bufferSize,
+		pending: make(map[string]int),
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	for _, topic := range topics {
+		subscription.topics[topic] = true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		subscription.end()
+		return subscription
+	}
+	b.subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+// Close ends every subscription, the streams reading them stop
+func (b *Bus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for subscription := range b.subscriptions {
+		delete(b.subscriptions, subscription)
+		subscription.end()
+	}
+	return nil
+}
+
+// Subscription buffers the events of its topics until they are taken
+type Subscription struct {
+	bus    *Bus
+	topics map[string]bool
+	limit  int
+
+	mu      sync.Mutex
+	events  []Event
+	pending map[string]int
+	dropped int
+
+	ready   chan struct{}
+	done    chan struct{}
+	endOnce sync.Once
+}
+
+// offer buffers an event, replacing the pending event reporting the same state
+func (s *Subscription) offer(event Event) {
+	s.mu.Lock()
+	key := event.Topic + "\x00" + event.Type + "\x00" + event.Key
+	if i, ok := s.pending[key]; ok {
+		s.events[i] = event
+	} else if len(s.events) < s.limit {
+		s.pending[key] = len(s.events)
+		s.events = append(s.events, event)
+	} else {
+		s.dropped++
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is signalled when events are waiting to be taken
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Done is closed once the subscription is closed
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Take returns the events waiting, in the order they were first published, and how many events were
+// dropped since the last call because the buffer was full
+func (s *Subscription) Take() (events []Event, dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events, dropped = s.events, s.dropped
+	s.events, s.dropped = nil, 0
+	s.pending = make(map[string]int)
+	return events, dropped
+}
+
+// Close stops the subscription, the events still waiting are discarded
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	delete(s.bus.subscriptions, s)
+	s.end()
+}
+
+// end closes done, once
+func (s *Subscription) end() {
+	s.endOnce.Do(func() {
+		close(s.done)
+	})
+}
@@ -1,38 +1,856 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"gopkg.in/yaml.v2"
 )
 
+const redacted = "[REDACTED]"
+
 // Config structure
 type Config struct {
-	DB *DBConfig
+	Server        *ServerConfig       `yaml:"server" json:"server"`
+	DB            *DBConfig           `yaml:"db" json:"db"`
+	Redis         *RedisConfig        `yaml:"redis" json:"redis"`
+	Auth          *AuthConfig         `yaml:"auth" json:"auth"`
+	CORS          *CORSConfig         `yaml:"cors" json:"cors"`
+	Devices       *DevicesConfig      `yaml:"devices" json:"devices"`
+	Reservations  *ReservationsConfig `yaml:"reservations" json:"reservations"`
+	Alerts        *AlertsConfig       `yaml:"alerts" json:"alerts"`
+	Pricing       *PricingConfig      `yaml:"pricing" json:"pricing"`
+	Images        *ImagesConfig       `yaml:"images" json:"images"`
+	Webhooks      *WebhooksConfig     `yaml:"webhooks" json:"webhooks"`
+	Outbox        *OutboxConfig       `yaml:"outbox" json:"outbox"`
+	Streams       *StreamsConfig      `yaml:"streams" json:"streams"`
+	Denominations []int               `yaml:"denominations" json:"denominations"`
+	LogLevel      string              `yaml:"log_level" json:"log_level"`
+	LogLevels     map[string]string   `yaml:"log_levels" json:"log_levels"`
+}
+
+// ServerConfig structure
+type ServerConfig struct {
+	ListenAddress     string        `yaml:"listen_address" json:"listen_address"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" json:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" json:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" json:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
 }
 
 // DBConfig structure
 type DBConfig struct {
-	Dialect    string
-	Host       string
-	Port       string
-	Username   string
-	Password   string
-	DBName     string
-	TestDBName string
-	SSLMode    string
+	URL        string `yaml:"url" json:"url"`
+	Dialect    string `yaml:"dialect" json:"dialect"`
+	Host       string `yaml:"host" json:"host"`
+	Port       string `yaml:"port" json:"port"`
+	Username   string `yaml:"username" json:"username"`
+	Password   string `yaml:"password" json:"password"`
+	DBName     string `yaml:"db_name" json:"db_name"`
+	TestDBName string `yaml:"test_db_name" json:"test_db_name"`
+	SSLMode    string `yaml:"ssl_mode" json:"ssl_mode"`
+	// StatementTimeout bounds the statements run by a single db.Service call
+	StatementTimeout time.Duration `yaml:"statement_timeout" json:"statement_timeout"`
+}
+
+// RedisConfig structure
+type RedisConfig struct {
+	URL string `yaml:"url" json:"url"`
+}
+
+// AuthConfig structure
+type AuthConfig struct {
+	JWTSecret      string        `yaml:"jwt_secret" json:"jwt_secret"`
+	JWTTTL         time.Duration `yaml:"jwt_ttl" json:"jwt_ttl"`
+	SessionTTL     time.Duration `yaml:"session_ttl" json:"session_ttl"`
+	AdminUsernames []string      `yaml:"admin_usernames" json:"admin_usernames"`
+	// MachineKeys maps machine uuids to the key their firmware authenticates with
+	MachineKeys map[string]string `yaml:"machine_keys" json:"machine_keys"`
+}
+
+// CORSConfig structure
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins" json:"allowed_origins"`
+	Debug          bool     `yaml:"debug" json:"debug"`
+}
+
+// ReservationsConfig configures purchases held until the machine confirms the vend
+type ReservationsConfig struct {
+	// Timeout is how long a reservation waits for the confirmation before it is released
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// SweepInterval is how often abandoned reservations are looked for
+	SweepInterval time.Duration `yaml:"sweep_interval" json:"sweep_interval"`
+}
+
+// PricingConfig configures the pricing engine
+type PricingConfig struct {
+	// Timezone is the IANA zone the times of day of happy hours are read in
+	Timezone string `yaml:"timezone" json:"timezone"`
+}
+
+// Location returns the zone of the happy hours, UTC when the timezone is invalid
+func (p *PricingConfig) Location() *time.Location {
+	location, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// Blob stores
+const (
+	BlobStoreLocal = "local"
+)
+
+// ImagesConfig configures where product images are stored and how they are processed
+type ImagesConfig struct {
+	// Store is the blob store holding the images
+	Store string `yaml:"store" json:"store"`
+	// Dir is the directory of the local store
+	Dir string `yaml:"dir" json:"dir"`
+	// MaxUploadSize bounds an uploaded image, in bytes
+	MaxUploadSize int `yaml:"max_upload_size" json:"max_upload_size"`
+	// ThumbnailSize is the longest side of a thumbnail, in pixels
+	ThumbnailSize int `yaml:"thumbnail_size" json:"thumbnail_size"`
+}
+
+// WebhooksConfig configures the delivery of events to the webhook subscriptions
+type WebhooksConfig struct {
+	// PollInterval is how often the deliveries due are looked for
+	PollInterval time.Duration `yaml:"poll_interval" json:"poll_interval"`
+	// BatchSize bounds the deliveries sent per poll
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+	// Timeout bounds a single delivery attempt
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// MaxAttempts is the number of attempts before a delivery is given up
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts"`
+	// BackoffBase is the wait after the first failed attempt, doubled after each further one up to BackoffMax
+	BackoffBase time.Duration `yaml:"backoff_base" json:"backoff_base"`
+	BackoffMax  time.Duration `yaml:"backoff_max" json:"backoff_max"`
+}
+
+// Outbox sinks
+const (
+	SinkWebhook = "webhook"
+	SinkStdout  = "stdout"
+	SinkNATS    = "nats"
+)
+
+// OutboxConfig configures the relay publishing the events of the outbox to its sinks
+type OutboxConfig struct {
+	// PollInterval is how often the unpublished events are looked for
+	PollInterval time.Duration `yaml:"poll_interval" json:"poll_interval"`
+	// BatchSize bounds the events claimed per poll
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+	// Lease is how long a claimed event is left to its relay before another one may publish it
+	Lease time.Duration `yaml:"lease" json:"lease"`
+	// BackoffBase is the wait after the first failed attempt, doubled after each further one up to BackoffMax
+	BackoffBase time.Duration `yaml:"backoff_base" json:"backoff_base"`
+	BackoffMax  time.Duration `yaml:"backoff_max" json:"backoff_max"`
+	// Retention is how long published events are kept
+	Retention time.Duration  `yaml:"retention" json:"retention"`
+	Sinks     []string       `yaml:"sinks" json:"sinks"`
+	NATS      NATSSinkConfig `yaml:"nats" json:"nats"`
+}
+
+// NATSSinkConfig configures the sink publishing events to a NATS server
+type NATSSinkConfig struct {
+	// URL is nats://[user:password@]host:port
+	URL string `yaml:"url" json:"url"`
+	// Subject prefixes the event type in the subject of the messages
+	Subject string        `yaml:"subject" json:"subject"`
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+// StreamsConfig configures the server-sent event and websocket streams of stock, balances and machine states
+type StreamsConfig struct {
+	// BufferSize bounds the events waiting to be sent to a subscriber, a subscriber that falls behind
+	// misses the later events and is told to reload
+	BufferSize int `yaml:"buffer_size" json:"buffer_size"`
+	// MaxTopics bounds the products and machines a stream follows
+	MaxTopics int `yaml:"max_topics" json:"max_topics"`
+	// Heartbeat is how often an idle stream is pinged
+	Heartbeat time.Duration `yaml:"heartbeat" json:"heartbeat"`
+	// WriteTimeout bounds a write to a subscriber, one that takes longer is disconnected
+	WriteTimeout time.Duration `yaml:"write_timeout" json:"write_timeout"`
+}
+
+// Alert notifiers
+const (
+	NotifierLog     = "log"
+	NotifierWebhook = "webhook"
+	NotifierSMTP    = "smtp"
+)
+
+// AlertsConfig configures the low stock and coin tube alerts and where they are sent
+type AlertsConfig struct {
+	// LowStockThreshold applies to products without a threshold of their own
+	LowStockThreshold int `yaml:"low_stock_threshold" json:"low_stock_threshold"`
+	// CoinThreshold applies to denominations without a threshold of their own
+	CoinThreshold int      `yaml:"coin_threshold" json:"coin_threshold"`
+	Notifiers     []string `yaml:"notifiers" json:"notifiers"`
+	// QueueSize bounds the alerts waiting to be sent, alerts are dropped when it is full
+	QueueSize int                   `yaml:"queue_size" json:"queue_size"`
+	Webhook   WebhookNotifierConfig `yaml:"webhook" json:"webhook"`
+	SMTP      SMTPNotifierConfig    `yaml:"smtp" json:"smtp"`
+}
+
+// WebhookNotifierConfig configures the notifier posting alerts as json
+type WebhookNotifierConfig struct {
+	URL     string        `yaml:"url" json:"url"`
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+// SMTPNotifierConfig configures the notifier mailing alerts
+type SMTPNotifierConfig struct {
+	Addr     string   `yaml:"addr" json:"addr"`
+	Username string   `yaml:"username" json:"username"`
+	Password string   `yaml:"password" json:"password"`
+	From     string   `yaml:"from" json:"from"`
+	To       []string `yaml:"to" json:"to"`
+}
+
+// Device drivers
+const (
+	DeviceDriverNone      = "none"
+	DeviceDriverSimulator = "simulator"
+	DeviceDriverSerial    = "serial"
+)
+
+// DevicesConfig selects the driver for the coin mechanisms and dispensers of the machines
+type DevicesConfig struct {
+	Driver string `yaml:"driver" json:"driver"`
+	// Timeout bounds a single command sent to a device
+	Timeout   time.Duration   `yaml:"timeout" json:"timeout"`
+	Simulator SimulatorConfig `yaml:"simulator" json:"simulator"`
+	// SerialPorts maps machine uuids to the serial line their devices are attached to
+	SerialPorts map[string]string `yaml:"serial_ports" json:"serial_ports"`
+}
+
+// SimulatorConfig configures the faults of the simulated devices
+type SimulatorConfig struct {
+	Seed          int64    `yaml:"seed" json:"seed"`
+	JamRate       float64  `yaml:"jam_rate" json:"jam_rate"`
+	RejectRate    float64  `yaml:"reject_rate" json:"reject_rate"`
+	RejectedCoins []int    `yaml:"rejected_coins" json:"rejected_coins"`
+	EmptyTubes    []int    `yaml:"empty_tubes" json:"empty_tubes"`
+	JammedSlots   []string `yaml:"jammed_slots" json:"jammed_slots"`
+	EmptySlots    []string `yaml:"empty_slots" json:"empty_slots"`
 }
 
-// GetConfig function
+// GetConfig function returns the configuration built from defaults and environment variables only
 func GetConfig() *Config {
+	cfg := defaultConfig()
+	cfg.applyEnv()
+	return cfg
+}
+
+// Load function reads the configuration and validates it
+func Load(path string) (*Config, error) {
+	cfg, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Read function builds the configuration from defaults, the optional yaml file at path and
+// environment variables, in that order of precedence, without validating it
+func Read(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		switch ext := strings.ToLower(filepath.Ext(path)); ext {
+		case ".yaml", ".yml":
+		default:
+			return nil, fmt.Errorf("unsupported config file %s: only yaml files (.yaml or .yml) are read, not '%s'", path, ext)
+		}
+		fileBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config file %s: %v", path, err)
+		}
+		if err := yaml.UnmarshalStrict(fileBytes, cfg); err != nil {
+			return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+		}
+	}
+	cfg.applyEnv()
+	return cfg, nil
+}
+
+func defaultConfig() *Config {
 	return &Config{
+		Server: &ServerConfig{
+			ListenAddress:     ":3333",
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+		},
 		DB: &DBConfig{
-			Dialect:    helpers.GetEnv("DB_DIALECT", ""),
-			Host:       helpers.GetEnv("DB_HOST", ""),
-			Port:       helpers.GetEnv("DB_PORT", ""),
-			Username:   helpers.GetEnv("DB_USERNAME", ""),
-			Password:   helpers.GetEnv("DB_PASSWORD", ""),
-			DBName:     helpers.GetEnv("DB_NAME", ""),
-			TestDBName: helpers.GetEnv("TEST_DB_NAME", ""),
-			SSLMode:    helpers.GetEnv("DB_SSL_MODE", ""),
+			Dialect:          "postgres",
+			StatementTimeout: 10 * time.Second,
+		},
+		Redis: &RedisConfig{
+			URL: "redis://localhost",
 		},
+		Auth: &AuthConfig{
+			JWTTTL:     120 * time.Minute,
+			SessionTTL: 120 * time.Minute,
+		},
+		CORS: &CORSConfig{
+			AllowedOrigins: []string{"http://localhost:3000", "http://localhost"},
+		},
+		Devices: &DevicesConfig{
+			Driver:  DeviceDriverNone,
+			Timeout: 5 * time.Second,
+		},
+		Reservations: &ReservationsConfig{
+			Timeout:       30 * time.Second,
+			SweepInterval: 10 * time.Second,
+		},
+		Alerts: &AlertsConfig{
+			LowStockThreshold: 2,
+			CoinThreshold:     5,
+			Notifiers:         []string{NotifierLog},
+			QueueSize:         100,
+			Webhook: WebhookNotifierConfig{
+				Timeout: 5 * time.Second,
+			},
+			SMTP: SMTPNotifierConfig{
+				Addr: "localhost:1025",
+				From: "vending-machine@localhost",
+			},
+		},
+		Pricing: &PricingConfig{
+			Timezone: "UTC",
+		},
+		Images: &ImagesConfig{
+			Store:         BlobStoreLocal,
+			Dir:           "data/images",
+			MaxUploadSize: 5 << 20,
+			ThumbnailSize: 200,
+		},
+		Webhooks: &WebhooksConfig{
+			PollInterval: 2 * time.Second,
+			BatchSize:    20,
+			Timeout:      10 * time.Second,
+			MaxAttempts:  8,
+			BackoffBase:  10 * time.Second,
+			BackoffMax:   time.Hour,
+		},
+		Outbox: &OutboxConfig{
+			PollInterval: time.Second,
+			BatchSize:    100,
+			Lease:        30 * time.Second,
+			BackoffBase:  time.Second,
+			BackoffMax:   5 * time.Minute,
+			Retention:    7 * 24 * time.Hour,
+			Sinks:        []string{SinkWebhook},
+			NATS: NATSSinkConfig{
+				URL:     "nats://127.0.0.1:4222",
+				Subject: "vending",
+				Timeout: 5 * time.Second,
+			},
+		},
+		Streams: &StreamsConfig{
+			BufferSize:   64,
+			MaxTopics:    50,
+			Heartbeat:    15 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+		Denominations: []int{5, 10, 20, 50, 100},
+		LogLevel:      "info",
+	}
+}
+
+// applyEnv overrides values with any environment variable that is set
+func (c *Config) applyEnv() {
+	c.Server.ListenAddress = helpers.GetEnv("LISTEN_ADDRESS", c.Server.ListenAddress)
+	c.Server.ReadTimeout = envDuration("SERVER_READ_TIMEOUT", c.Server.ReadTimeout)
+	c.Server.ReadHeaderTimeout = envDuration("SERVER_READ_HEADER_TIMEOUT", c.Server.ReadHeaderTimeout)
+	c.Server.WriteTimeout = envDuration("SERVER_WRITE_TIMEOUT", c.Server.WriteTimeout)
+	c.Server.IdleTimeout = envDuration("SERVER_IDLE_TIMEOUT", c.Server.IdleTimeout)
+	c.Server.ShutdownTimeout = envDuration("SERVER_SHUTDOWN_TIMEOUT", c.Server.ShutdownTimeout)
+
+	c.DB.URL = helpers.GetEnv("DB_URL", c.DB.URL)
+	c.DB.Dialect = helpers.GetEnv("DB_DIALECT", c.DB.Dialect)
+	c.DB.Host = helpers.GetEnv("DB_HOST", c.DB.Host)
+	c.DB.Port = helpers.GetEnv("DB_PORT", c.DB.Port)
+	c.DB.Username = helpers.GetEnv("DB_USERNAME", c.DB.Username)
+	c.DB.Password = helpers.GetEnv("DB_PASSWORD", c.DB.Password)
+	c.DB.DBName = helpers.GetEnv("DB_NAME", c.DB.DBName)
+	c.DB.TestDBName = helpers.GetEnv("TEST_DB_NAME", c.DB.TestDBName)
+	c.DB.SSLMode = helpers.GetEnv("DB_SSL_MODE", c.DB.SSLMode)
+	c.DB.StatementTimeout = envDuration("DB_STATEMENT_TIMEOUT", c.DB.StatementTimeout)
+
+	c.Redis.URL = helpers.GetEnv("REDIS_URL", c.Redis.URL)
+
+	c.Auth.JWTSecret = helpers.GetEnv("JWT_SECRET", c.Auth.JWTSecret)
+	c.Auth.JWTTTL = envDuration("JWT_TTL", c.Auth.JWTTTL)
+	c.Auth.SessionTTL = envDuration("SESSION_TTL", c.Auth.SessionTTL)
+	c.Auth.AdminUsernames = envList("ADMIN_USERNAMES", c.Auth.AdminUsernames)
+	if keys := envMap("MACHINE_KEYS"); keys != nil {
+		c.Auth.MachineKeys = keys
+	}
+
+	c.CORS.AllowedOrigins = envList("CORS_ALLOWED_ORIGINS", c.CORS.AllowedOrigins)
+	c.CORS.Debug = envBool("CORS_DEBUG", c.CORS.Debug)
+
+	c.Devices.Driver = helpers.GetEnv("DEVICE_DRIVER", c.Devices.Driver)
+	c.Devices.Timeout = envDuration("DEVICE_TIMEOUT", c.Devices.Timeout)
+	c.Devices.Simulator.JamRate = envFloat("DEVICE_SIM_JAM_RATE", c.Devices.Simulator.JamRate)
+	c.Devices.Simulator.RejectRate = envFloat("DEVICE_SIM_REJECT_RATE", c.Devices.Simulator.RejectRate)
+	// DEVICE_SERIAL_PORTS maps machines to serial lines, e.g. "<machine uuid>=/dev/ttyUSB0"
+	if ports := envMap("DEVICE_SERIAL_PORTS"); ports != nil {
+		c.Devices.SerialPorts = ports
+	}
+
+	c.Reservations.Timeout = envDuration("RESERVATION_TIMEOUT", c.Reservations.Timeout)
+	c.Reservations.SweepInterval = envDuration("RESERVATION_SWEEP_INTERVAL", c.Reservations.SweepInterval)
+
+	c.Alerts.LowStockThreshold = envInt("ALERT_LOW_STOCK_THRESHOLD", c.Alerts.LowStockThreshold)
+	c.Alerts.CoinThreshold = envInt("ALERT_COIN_THRESHOLD", c.Alerts.CoinThreshold)
+	c.Alerts.Notifiers = envList("ALERT_NOTIFIERS", c.Alerts.Notifiers)
+	c.Alerts.QueueSize = envInt("ALERT_QUEUE_SIZE", c.Alerts.QueueSize)
+	c.Alerts.Webhook.URL = helpers.GetEnv("ALERT_WEBHOOK_URL", c.Alerts.Webhook.URL)
+	c.Alerts.Webhook.Timeout = envDuration("ALERT_WEBHOOK_TIMEOUT", c.Alerts.Webhook.Timeout)
+	c.Alerts.SMTP.Addr = helpers.GetEnv("ALERT_SMTP_ADDR", c.Alerts.SMTP.Addr)
+	c.Alerts.SMTP.Username = helpers.GetEnv("ALERT_SMTP_USERNAME", c.Alerts.SMTP.Username)
+	c.Alerts.SMTP.Password = helpers.GetEnv("ALERT_SMTP_PASSWORD", c.Alerts.SMTP.Password)
+	c.Alerts.SMTP.From = helpers.GetEnv("ALERT_SMTP_FROM", c.Alerts.SMTP.From)
+	c.Alerts.SMTP.To = envList("ALERT_SMTP_TO", c.Alerts.SMTP.To)
+
+	c.Pricing.Timezone = helpers.GetEnv("PRICING_TIMEZONE", c.Pricing.Timezone)
+
+	c.Images.Store = helpers.GetEnv("IMAGE_STORE", c.Images.Store)
+	c.Images.Dir = helpers.GetEnv("IMAGE_DIR", c.Images.Dir)
+	c.Images.MaxUploadSize = envInt("IMAGE_MAX_UPLOAD_SIZE", c.Images.MaxUploadSize)
+	c.Images.ThumbnailSize = envInt("IMAGE_THUMBNAIL_SIZE", c.Images.ThumbnailSize)
+
+	c.Webhooks.PollInterval = envDuration("WEBHOOK_POLL_INTERVAL", c.Webhooks.PollInterval)
+	c.Webhooks.BatchSize = envInt("WEBHOOK_BATCH_SIZE", c.Webhooks.BatchSize)
+	c.Webhooks.Timeout = envDuration("WEBHOOK_TIMEOUT", c.Webhooks.Timeout)
+	c.Webhooks.MaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", c.Webhooks.MaxAttempts)
+	c.Webhooks.BackoffBase = envDuration("WEBHOOK_BACKOFF_BASE", c.Webhooks.BackoffBase)
+	c.Webhooks.BackoffMax = envDuration("WEBHOOK_BACKOFF_MAX", c.Webhooks.BackoffMax)
+
+	c.Outbox.PollInterval = envDuration("OUTBOX_POLL_INTERVAL", c.Outbox.PollInterval)
+	c.Outbox.BatchSize = envInt("OUTBOX_BATCH_SIZE", c.Outbox.BatchSize)
+	c.Outbox.Lease = envDuration("OUTBOX_LEASE", c.Outbox.Lease)
+	c.Outbox.BackoffBase = envDuration("OUTBOX_BACKOFF_BASE", c.Outbox.BackoffBase)
+	c.Outbox.BackoffMax = envDuration("OUTBOX_BACKOFF_MAX", c.Outbox.BackoffMax)
+	c.Outbox.Retention = envDuration("OUTBOX_RETENTION", c.Outbox.Retention)
+	c.Outbox.Sinks = envList("OUTBOX_SINKS", c.Outbox.Sinks)
+	c.Outbox.NATS.URL = helpers.GetEnv("OUTBOX_NATS_URL", c.Outbox.NATS.URL)
+	c.Outbox.NATS.Subject = helpers.GetEnv("OUTBOX_NATS_SUBJECT", c.Outbox.NATS.Subject)
+	c.Outbox.NATS.Timeout = envDuration("OUTBOX_NATS_TIMEOUT", c.Outbox.NATS.Timeout)
+
+	c.Streams.BufferSize = envInt("STREAM_BUFFER_SIZE", c.Streams.BufferSize)
+	c.Streams.MaxTopics = envInt("STREAM_MAX_TOPICS", c.Streams.MaxTopics)
+	c.Streams.Heartbeat = envDuration("STREAM_HEARTBEAT", c.Streams.Heartbeat)
+	c.Streams.WriteTimeout = envDuration("STREAM_WRITE_TIMEOUT", c.Streams.WriteTimeout)
+
+	if value := helpers.GetEnv("DENOMINATIONS", ""); value != "" {
+		c.Denominations = nil
+		for _, item := range strings.Split(value, ",") {
+			denomination, err := helpers.ConvertStringToInt(strings.TrimSpace(item))
+			if err != nil {
+				// keep the invalid value so that Validate reports it
+				denomination = -1
+			}
+			c.Denominations = append(c.Denominations, denomination)
+		}
+	}
+
+	c.LogLevel = helpers.GetEnv("LOG_LEVEL", c.LogLevel)
+	// LOG_LEVELS holds per-package overrides, e.g. "db=debug,handlers=warn"
+	if levels := envMap("LOG_LEVELS"); levels != nil {
+		c.LogLevels = levels
+	}
+}
+
+// Validate checks that the configuration is usable before the server starts
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Server.ListenAddress == "" {
+		problems = append(problems, "server listen address must not be empty")
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.ReadHeaderTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 {
+		problems = append(problems, "server timeouts must not be negative")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		problems = append(problems, "server shutdown timeout (SERVER_SHUTDOWN_TIMEOUT) must be positive")
+	}
+	if c.DB.DSN() == "" {
+		problems = append(problems, "database url (DB_URL) or host (DB_HOST) must be set")
+	}
+	if c.DB.StatementTimeout < 0 {
+		problems = append(problems, "database statement timeout (DB_STATEMENT_TIMEOUT) must not be negative")
+	}
+	if c.Redis.URL == "" {
+		problems = append(problems, "redis url (REDIS_URL) must not be empty")
+	}
+	if strings.TrimSpace(c.Auth.JWTSecret) == "" {
+		problems = append(problems, "jwt secret (JWT_SECRET) must not be empty")
+	}
+	if c.Auth.JWTTTL <= 0 {
+		problems = append(problems, "jwt ttl (JWT_TTL) must be positive")
+	}
+	// sessions expire in redis with a ttl in whole seconds, SETEX rejects 0
+	if c.Auth.SessionTTL < time.Second {
+		problems = append(problems, "session ttl (SESSION_TTL) must be at least 1s")
+	}
+	for machine, key := range c.Auth.MachineKeys {
+		if strings.TrimSpace(key) == "" {
+			problems = append(problems, fmt.Sprintf("missing machine key for machine '%s' (MACHINE_KEYS)", machine))
+		}
+	}
+	if len(c.Denominations) == 0 {
+		problems = append(problems, "at least one coin denomination must be configured")
+	}
+	seen := make(map[int]bool, len(c.Denominations))
+	for _, denomination := range c.Denominations {
+		if denomination <= 0 {
+			problems = append(problems, fmt.Sprintf("invalid coin denomination %d", denomination))
+		}
+		if seen[denomination] {
+			problems = append(problems, fmt.Sprintf("duplicate coin denomination %d", denomination))
+		}
+		seen[denomination] = true
+	}
+	switch c.Devices.Driver {
+	case DeviceDriverNone, DeviceDriverSimulator:
+	case DeviceDriverSerial:
+		if len(c.Devices.SerialPorts) == 0 {
+			problems = append(problems, "the serial device driver needs at least one serial port (DEVICE_SERIAL_PORTS)")
+		}
+		for machine, port := range c.Devices.SerialPorts {
+			if port == "" {
+				problems = append(problems, fmt.Sprintf("missing serial port for machine '%s'", machine))
+			}
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("invalid device driver '%s': use one of %s, %s, %s", c.Devices.Driver, DeviceDriverNone, DeviceDriverSimulator, DeviceDriverSerial))
+	}
+	if c.Devices.Timeout <= 0 {
+		problems = append(problems, "device timeout (DEVICE_TIMEOUT) must be positive")
+	}
+	if c.Reservations.Timeout <= 0 {
+		problems = append(problems, "reservation timeout (RESERVATION_TIMEOUT) must be positive")
+	}
+	if c.Reservations.SweepInterval <= 0 {
+		problems = append(problems, "reservation sweep interval (RESERVATION_SWEEP_INTERVAL) must be positive")
+	}
+	if c.Alerts.LowStockThreshold < 0 || c.Alerts.CoinThreshold < 0 {
+		problems = append(problems, "alert thresholds (ALERT_LOW_STOCK_THRESHOLD, ALERT_COIN_THRESHOLD) must not be negative")
+	}
+	if c.Alerts.QueueSize <= 0 {
+		problems = append(problems, "alert queue size (ALERT_QUEUE_SIZE) must be positive")
+	}
+	for _, notifier := range c.Alerts.Notifiers {
+		switch notifier {
+		case NotifierLog:
+		case NotifierWebhook:
+			if u, err := url.Parse(c.Alerts.Webhook.URL); err != nil || u.Scheme == "" || u.Host == "" {
+				problems = append(problems, "the webhook notifier needs an absolute url (ALERT_WEBHOOK_URL)")
+			}
+			if c.Alerts.Webhook.Timeout <= 0 {
+				problems = append(problems, "alert webhook timeout (ALERT_WEBHOOK_TIMEOUT) must be positive")
+			}
+		case NotifierSMTP:
+			if c.Alerts.SMTP.Addr == "" || c.Alerts.SMTP.From == "" || len(c.Alerts.SMTP.To) == 0 {
+				problems = append(problems, "the smtp notifier needs an address, a sender and recipients (ALERT_SMTP_ADDR, ALERT_SMTP_FROM, ALERT_SMTP_TO)")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("invalid alert notifier '%s': use one of %s, %s, %s", notifier, NotifierLog, NotifierWebhook, NotifierSMTP))
+		}
+	}
+	if _, err := time.LoadLocation(c.Pricing.Timezone); err != nil || c.Pricing.Timezone == "" {
+		problems = append(problems, fmt.Sprintf("invalid pricing timezone (PRICING_TIMEZONE) '%s'", c.Pricing.Timezone))
+	}
+	switch c.Images.Store {
+	case BlobStoreLocal:
+		if c.Images.Dir == "" {
+			problems = append(problems, "the local image store needs a directory (IMAGE_DIR)")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("invalid image store '%s': use %s", c.Images.Store, BlobStoreLocal))
+	}
+	if c.Images.MaxUploadSize <= 0 || c.Images.ThumbnailSize <= 0 {
+		problems = append(problems, "image upload size and thumbnail size (IMAGE_MAX_UPLOAD_SIZE, IMAGE_THUMBNAIL_SIZE) must be positive")
+	}
+	if c.Webhooks.PollInterval <= 0 || c.Webhooks.Timeout <= 0 {
+		problems = append(problems, "webhook poll interval and timeout (WEBHOOK_POLL_INTERVAL, WEBHOOK_TIMEOUT) must be positive")
+	}
+	if c.Webhooks.BatchSize <= 0 || c.Webhooks.MaxAttempts <= 0 {
+		problems = append(problems, "webhook batch size and attempts (WEBHOOK_BATCH_SIZE, WEBHOOK_MAX_ATTEMPTS) must be positive")
+	}
+	if c.Webhooks.BackoffBase <= 0 || c.Webhooks.BackoffMax < c.Webhooks.BackoffBase {
+		problems = append(problems, "webhook backoff base (WEBHOOK_BACKOFF_BASE) must be positive and at most the backoff max (WEBHOOK_BACKOFF_MAX)")
+	}
+	if c.Outbox.PollInterval <= 0 || c.Outbox.BatchSize <= 0 || c.Outbox.Lease <= 0 || c.Outbox.Retention <= 0 {
+		problems = append(problems, "outbox poll interval, batch size, lease and retention (OUTBOX_POLL_INTERVAL, OUTBOX_BATCH_SIZE, OUTBOX_LEASE, OUTBOX_RETENTION) must be positive")
+	}
+	if c.Outbox.BackoffBase <= 0 || c.Outbox.BackoffMax < c.Outbox.BackoffBase {
+		problems = append(problems, "outbox backoff base (OUTBOX_BACKOFF_BASE) must be positive and at most the backoff max (OUTBOX_BACKOFF_MAX)")
+	}
+	for _, sink := range c.Outbox.Sinks {
+		switch sink {
+		case SinkWebhook, SinkStdout:
+		case SinkNATS:
+			if u, err := url.Parse(c.Outbox.NATS.URL); err != nil || u.Scheme != "nats" || u.Host == "" {
+				problems = append(problems, "the nats sink needs a nats://host:port url (OUTBOX_NATS_URL)")
+			}
+			if c.Outbox.NATS.Subject == "" || strings.ContainsAny(c.Outbox.NATS.Subject, " \t\r\n*>") {
+				problems = append(problems, "the nats sink needs a subject without spaces or wildcards (OUTBOX_NATS_SUBJECT)")
+			}
+			if c.Outbox.NATS.Timeout <= 0 {
+				problems = append(problems, "nats sink timeout (OUTBOX_NATS_TIMEOUT) must be positive")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("invalid outbox sink '%s': use one of %s, %s, %s", sink, SinkWebhook, SinkStdout, SinkNATS))
+		}
+	}
+	if c.Streams.BufferSize <= 0 || c.Streams.MaxTopics <= 0 {
+		problems = append(problems, "stream buffer size and topics (STREAM_BUFFER_SIZE, STREAM_MAX_TOPICS) must be positive")
+	}
+	if c.Streams.Heartbeat <= 0 || c.Streams.WriteTimeout <= 0 {
+		problems = append(problems, "stream heartbeat and write timeout (STREAM_HEARTBEAT, STREAM_WRITE_TIMEOUT) must be positive")
+	}
+	sim := c.Devices.Simulator
+	if sim.JamRate < 0 || sim.JamRate > 1 || sim.RejectRate < 0 || sim.RejectRate > 1 {
+		problems = append(problems, "simulator jam and reject rates must be between 0 and 1")
+	}
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid log level '%s'", c.LogLevel))
+	}
+	for pkg, level := range c.LogLevels {
+		if _, err := logger.ParseLevel(level); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid log level '%s' for package '%s'", level, pkg))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// DSN returns the database connection string, built from the individual fields when no url is set
+func (d *DBConfig) DSN() string {
+	if d.URL != "" {
+		return d.URL
+	}
+	if d.Host == "" {
+		return ""
+	}
+	parts := []string{"host=" + d.Host}
+	if d.Port != "" {
+		parts = append(parts, "port="+d.Port)
+	}
+	if d.Username != "" {
+		parts = append(parts, "user="+d.Username)
+	}
+	if d.Password != "" {
+		parts = append(parts, "password="+d.Password)
+	}
+	if d.DBName != "" {
+		parts = append(parts, "dbname="+d.DBName)
+	}
+	if d.SSLMode != "" {
+		parts = append(parts, "sslmode="+d.SSLMode)
+	}
+	return strings.Join(parts, " ")
+}
+
+// LoggerLevels returns the default log level and the per-package overrides
+func (c *Config) LoggerLevels() (logger.Level, map[string]logger.Level) {
+	level, _ := logger.ParseLevel(c.LogLevel)
+	levels := make(map[string]logger.Level, len(c.LogLevels))
+	for pkg, name := range c.LogLevels {
+		levels[pkg], _ = logger.ParseLevel(name)
+	}
+	return level, levels
+}
+
+// SortedDenominations returns the accepted denominations from the largest to the smallest
+func (c *Config) SortedDenominations() []int {
+	denominations := append([]int(nil), c.Denominations...)
+	sort.Sort(sort.Reverse(sort.IntSlice(denominations)))
+	return denominations
+}
+
+// Redacted returns a copy of the configuration that is safe to print
+func (c *Config) Redacted() *Config {
+	server := *c.Server
+	database := *c.DB
+	redis := *c.Redis
+	auth := *c.Auth
+	cors := *c.CORS
+	devices := *c.Devices
+	reservations := *c.Reservations
+	alerts := *c.Alerts
+	pricing := *c.Pricing
+	images := *c.Images
+	webhooks := *c.Webhooks
+	outbox := *c.Outbox
+	streams := *c.Streams
+
+	database.URL = redactConnectionString(database.URL)
+	if database.Password != "" {
+		database.Password = redacted
+	}
+	redis.URL = redactConnectionString(redis.URL)
+	if auth.JWTSecret != "" {
+		auth.JWTSecret = redacted
+	}
+	if auth.MachineKeys != nil {
+		auth.MachineKeys = make(map[string]string, len(c.Auth.MachineKeys))
+		for machine := range c.Auth.MachineKeys {
+			auth.MachineKeys[machine] = redacted
+		}
+	}
+	alerts.Webhook.URL = redactConnectionString(alerts.Webhook.URL)
+	if alerts.SMTP.Password != "" {
+		alerts.SMTP.Password = redacted
+	}
+	outbox.NATS.URL = redactConnectionString(outbox.NATS.URL)
+
+	return &Config{
+		Server:        &server,
+		DB:            &database,
+		Redis:         &redis,
+		Auth:          &auth,
+		CORS:          &cors,
+		Devices:       &devices,
+		Reservations:  &reservations,
+		Alerts:        &alerts,
+		Pricing:       &pricing,
+		Images:        &images,
+		Webhooks:      &webhooks,
+		Outbox:        &outbox,
+		Streams:       &streams,
+		Denominations: append([]int(nil), c.Denominations...),
+		LogLevel:      c.LogLevel,
+		LogLevels:     c.LogLevels,
+	}
+}
+
+var dsnPasswordRegex = regexp.MustCompile(`password=('[^']*'|\S+)`)
+
+// redactConnectionString hides the password of a url or key=value connection string
+func redactConnectionString(value string) string {
+	if value == "" {
+		return value
+	}
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			return strings.Replace(u.String(), url.QueryEscape(redacted), redacted, 1)
+		}
+		return value
+	}
+	return dsnPasswordRegex.ReplaceAllString(value, "password="+redacted)
+}
+
+func envDuration(key string, defaultVal time.Duration) time.Duration {
+	value := helpers.GetEnv(key, "")
+	if value == "" {
+		return defaultVal
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d
+	}
+	// plain integers are treated as seconds
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	// an invalid value is surfaced by Validate
+	return -1
+}
+
+func envBool(key string, defaultVal bool) bool {
+	value := helpers.GetEnv(key, "")
+	if value == "" {
+		return defaultVal
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return defaultVal
+	}
+	return b
+}
+
+func envList(key string, defaultVal []string) []string {
+	value := helpers.GetEnv(key, "")
+	if value == "" {
+		return defaultVal
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envInt(key string, defaultVal int) int {
+	value := helpers.GetEnv(key, "")
+	if value == "" {
+		return defaultVal
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		// an invalid value is surfaced by Validate
+		return -1
+	}
+	return i
+}
+
+func envFloat(key string, defaultVal float64) float64 {
+	value := helpers.GetEnv(key, "")
+	if value == "" {
+		return defaultVal
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		// an invalid value is surfaced by Validate
+		return -1
+	}
+	return f
+}
+
+// envMap reads a comma separated list of key=value pairs, an item without a value
+// is kept with an empty value so that Validate reports it
+func envMap(key string) map[string]string {
+	items := envList(key, nil)
+	if items == nil {
+		return nil
+	}
+	m := make(map[string]string, len(items))
+	for _, item := range items {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			m[item] = ""
+			continue
+		}
+		m[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 	}
+	return m
 }
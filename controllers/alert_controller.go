@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/gorilla/mux"
+)
+
+// AlertController struct
+type AlertController struct {
+	Router *mux.Router
+}
+
+// registerAlertRoutes registers the alert and threshold routes
+func (s *service) registerAlertRoutes() {
+	s.alertController.Router.HandleFunc("/api/admin/alerts", helpers.IsAuthorized(s.handlers.GetAlerts)).Methods("GET")
+	s.alertController.Router.HandleFunc("/api/admin/alerts/{alertId}/acknowledge", helpers.IsAuthorized(s.handlers.AcknowledgeAlert)).Methods("POST")
+	s.alertController.Router.HandleFunc("/api/admin/alerts/{alertId}/resolve", helpers.IsAuthorized(s.handlers.ResolveAlert)).Methods("POST")
+	s.alertController.Router.HandleFunc("/api/admin/coin-thresholds", helpers.IsAuthorized(s.handlers.GetCoinThresholds)).Methods("GET")
+	s.alertController.Router.HandleFunc("/api/admin/coin-thresholds/{denomination}", helpers.IsAuthorized(s.handlers.SetCoinThreshold)).Methods("PUT")
+	s.alertController.Router.HandleFunc("/api/admin/coin-thresholds/{denomination}", helpers.IsAuthorized(s.handlers.DeleteCoinThreshold)).Methods("DELETE")
+	s.alertController.Router.HandleFunc("/api/products/{id}/alert-threshold", helpers.IsAuthorized(s.handlers.GetStockThreshold)).Methods("GET")
+	s.alertController.Router.HandleFunc("/api/products/{id}/alert-threshold", helpers.IsAuthorized(s.handlers.SetStockThreshold)).Methods("PUT")
+	s.alertController.Router.HandleFunc("/api/products/{id}/alert-threshold", helpers.IsAuthorized(s.handlers.DeleteStockThreshold)).Methods("DELETE")
+}
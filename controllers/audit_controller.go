@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/gorilla/mux"
+)
+
+// AuditController struct
+type AuditController struct {
+	Router *mux.Router
+}
+
+// registerAuditRoutes registers the audit log routes and records the mutating requests of every route
+// in the audit log
+func (s *service) registerAuditRoutes() {
+	s.auditController.Router.Use(s.handlers.Audit)
+	s.auditController.Router.HandleFunc("/api/admin/audit", helpers.IsAuthorized(s.handlers.GetAuditLog)).Methods("GET")
+	s.auditController.Router.HandleFunc("/api/admin/audit/verify", helpers.IsAuthorized(s.handlers.VerifyAuditLog)).Methods("GET")
+}
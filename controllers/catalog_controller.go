@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/gorilla/mux"
+)
+
+// CatalogController struct
+type CatalogController struct {
+	Router *mux.Router
+}
+
+// registerCatalogRoutes registers the catalog, search, category, nutrition, product image and bulk import routes
+func (s *service) registerCatalogRoutes() {
+	s.catalogController.Router.HandleFunc("/api/products", s.handlers.GetProducts).Methods("GET")
+	s.catalogController.Router.HandleFunc("/api/products/search", s.handlers.SearchProducts).Methods("GET")
+	s.catalogController.Router.HandleFunc("/api/products/{id}/classification", helpers.IsAuthorized(s.handlers.SetProductClassification)).Methods("PUT")
+	s.catalogController.Router.HandleFunc("/api/products/{id}/nutrition", helpers.IsAuthorized(s.handlers.SetProductNutrition)).Methods("PUT")
+	s.catalogController.Router.HandleFunc("/api/products/{id}/images", helpers.IsAuthorized(s.handlers.UploadProductImage)).Methods("POST")
+	s.catalogController.Router.HandleFunc("/api/products/{id}/images", s.handlers.GetProductImages).Methods("GET")
+	s.catalogController.Router.HandleFunc("/api/products/{id}/images/{imageId}", s.handlers.GetProductImage).Methods("GET")
+	s.catalogController.Router.HandleFunc("/api/products/{id}/images/{imageId}", helpers.IsAuthorized(s.handlers.DeleteProductImage)).Methods("DELETE")
+	s.catalogController.Router.HandleFunc("/api/sellers/{id}/products/import", helpers.IsAuthorized(s.handlers.ImportProducts)).Methods("POST")
+	s.catalogController.Router.HandleFunc("/api/sellers/{id}/products/export", helpers.IsAuthorized(s.handlers.ExportProducts)).Methods("GET")
+	s.catalogController.Router.HandleFunc("/api/categories", s.handlers.GetCategories).Methods("GET")
+	s.catalogController.Router.HandleFunc("/api/categories/{categoryId}", s.handlers.GetCategory).Methods("GET")
+	s.catalogController.Router.HandleFunc("/api/admin/categories", helpers.IsAuthorized(s.handlers.CreateCategory)).Methods("POST")
+	s.catalogController.Router.HandleFunc("/api/admin/categories/{categoryId}", helpers.IsAuthorized(s.handlers.UpdateCategory)).Methods("PUT")
+	s.catalogController.Router.HandleFunc("/api/admin/categories/{categoryId}", helpers.IsAuthorized(s.handlers.DeleteCategory)).Methods("DELETE")
+}
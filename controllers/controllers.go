@@ -10,12 +10,30 @@ type Service interface {
 
 	registerUserRoutes()
 	registerProductRoutes()
+	registerHealthRoutes()
+	registerMachineRoutes()
+	registerAlertRoutes()
+	registerPricingRoutes()
+	registerCatalogRoutes()
+	registerReportRoutes()
+	registerAuditRoutes()
+	registerWebhookRoutes()
+	registerStreamRoutes()
 }
 
 type service struct {
 	handlers          handlers.Service
 	userController    UserController
 	productController ProductController
+	healthController  HealthController
+	machineController MachineController
+	alertController   AlertController
+	pricingController PricingController
+	catalogController CatalogController
+	reportController  ReportController
+	auditController   AuditController
+	webhookController WebhookController
+	streamController  StreamController
 }
 
 // New creates new instance of the handlers
@@ -24,11 +42,31 @@ func New(handlers handlers.Service, mux *mux.Router) Service {
 		handlers:          handlers,
 		userController:    UserController{mux},
 		productController: ProductController{mux},
+		healthController:  HealthController{mux},
+		machineController: MachineController{mux},
+		alertController:   AlertController{mux},
+		pricingController: PricingController{mux},
+		catalogController: CatalogController{mux},
+		reportController:  ReportController{mux},
+		auditController:   AuditController{mux},
+		webhookController: WebhookController{mux},
+		streamController:  StreamController{mux},
 	}
 }
 
 // StartUp function registers all routes
 func (s *service) StartUp() {
 	s.registerUserRoutes()
+	// before the product routes, whose /api/products/{id} and /api/products/{id}/{userId} would match
+	// the search and threshold routes
+	s.registerAlertRoutes()
+	s.registerCatalogRoutes()
 	s.registerProductRoutes()
+	s.registerHealthRoutes()
+	s.registerMachineRoutes()
+	s.registerPricingRoutes()
+	s.registerReportRoutes()
+	s.registerAuditRoutes()
+	s.registerWebhookRoutes()
+	s.registerStreamRoutes()
 }
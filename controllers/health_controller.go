@@ -0,0 +1,20 @@
+package controllers
+
+import (
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/metrics"
+	"github.com/gorilla/mux"
+)
+
+// HealthController struct
+type HealthController struct {
+	Router *mux.Router
+}
+
+// registerHealthRoutes registers the health, readiness, metrics and status routes
+func (s *service) registerHealthRoutes() {
+	s.healthController.Router.HandleFunc("/healthz", s.handlers.Healthz).Methods("GET", "HEAD")
+	s.healthController.Router.HandleFunc("/readyz", s.handlers.Readyz).Methods("GET", "HEAD")
+	s.healthController.Router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	s.healthController.Router.HandleFunc("/api/admin/status", helpers.IsAuthorized(s.handlers.Status)).Methods("GET")
+}
@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/gorilla/mux"
+)
+
+// MachineController struct
+type MachineController struct {
+	Router *mux.Router
+}
+
+// registerMachineRoutes registers the machine routes, purchases and deposits are scoped to a machine. The
+// routes the machine firmware calls also accept its machine key
+func (s *service) registerMachineRoutes() {
+	s.machineController.Router.HandleFunc("/api/machines", helpers.IsAuthorized(s.handlers.CreateMachine)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/machines", s.handlers.GetMachines).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}", s.handlers.GetMachine).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}", helpers.IsAuthorized(s.handlers.UpdateMachine)).Methods("PUT")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}", helpers.IsAuthorized(s.handlers.DeleteMachine)).Methods("DELETE")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/products", s.handlers.GetMachineProducts).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/planogram", s.handlers.GetPlanogram).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/slots/{slotCode}", helpers.IsAuthorized(s.handlers.SaveSlot)).Methods("PUT")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/slots/{slotCode}", helpers.IsAuthorized(s.handlers.DeleteSlot)).Methods("DELETE")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/slots/{slotCode}/product", helpers.IsAuthorized(s.handlers.FillSlot)).Methods("PUT")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/coins", helpers.IsAuthorized(s.handlers.GetMachineCoins)).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/cash", helpers.IsAuthorized(s.handlers.GetCashBox)).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/collections", helpers.IsAuthorized(s.handlers.CollectCash)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/collections", helpers.IsAuthorized(s.handlers.GetCashCollections)).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/collections/{collectionId}", helpers.IsAuthorized(s.handlers.GetCashCollection)).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/users/{id}/credit", helpers.IsAuthorized(s.handlers.GetMachineCredit)).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/users/deposit/{id}/{amount}", helpers.IsAuthorized(s.handlers.MachineDepositAmount)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/users/buy/{id}/{productId}/{amountOfProducts}", helpers.IsAuthorized(s.handlers.MachineBuy)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/users/buy/{id}/slots/{slotCode}/{amountOfProducts}", helpers.IsAuthorized(s.handlers.MachineBuySlot)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/users/reserve/{id}/{productId}/{amountOfProducts}", helpers.IsAuthorized(s.handlers.MachineReserve)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/reservations/{reservationId}", helpers.IsMachineOrAuthorized(s.handlers.GetReservation)).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/reservations/{reservationId}/confirm", helpers.IsMachineOrAuthorized(s.handlers.ConfirmReservation)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/admin/reservations", helpers.IsAuthorized(s.handlers.GetReservations)).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/users/reset/{id}", helpers.IsAuthorized(s.handlers.MachineReset)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/session", helpers.IsMachineOrAuthorized(s.handlers.GetMachineSession)).Methods("GET")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/session/users/{id}/events", helpers.IsMachineOrAuthorized(s.handlers.MachineSessionEvent)).Methods("POST")
+	s.machineController.Router.HandleFunc("/api/machines/{machineId}/session/clear", helpers.IsAuthorized(s.handlers.ClearMachineSession)).Methods("POST")
+}
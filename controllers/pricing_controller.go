@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/gorilla/mux"
+)
+
+// PricingController struct
+type PricingController struct {
+	Router *mux.Router
+}
+
+// registerPricingRoutes registers the price rule, voucher, price quote and basket routes
+func (s *service) registerPricingRoutes() {
+	s.pricingController.Router.HandleFunc("/api/price-rules", helpers.IsAuthorized(s.handlers.CreatePriceRule)).Methods("POST")
+	s.pricingController.Router.HandleFunc("/api/price-rules", helpers.IsAuthorized(s.handlers.GetPriceRules)).Methods("GET")
+	s.pricingController.Router.HandleFunc("/api/price-rules/{ruleId}", helpers.IsAuthorized(s.handlers.GetPriceRule)).Methods("GET")
+	s.pricingController.Router.HandleFunc("/api/price-rules/{ruleId}", helpers.IsAuthorized(s.handlers.UpdatePriceRule)).Methods("PUT")
+	s.pricingController.Router.HandleFunc("/api/price-rules/{ruleId}", helpers.IsAuthorized(s.handlers.DeletePriceRule)).Methods("DELETE")
+	s.pricingController.Router.HandleFunc("/api/admin/vouchers", helpers.IsAuthorized(s.handlers.CreateVoucher)).Methods("POST")
+	s.pricingController.Router.HandleFunc("/api/admin/vouchers", helpers.IsAuthorized(s.handlers.GetVouchers)).Methods("GET")
+	s.pricingController.Router.HandleFunc("/api/admin/vouchers/{voucherId}", helpers.IsAuthorized(s.handlers.GetVoucher)).Methods("GET")
+	s.pricingController.Router.HandleFunc("/api/admin/vouchers/{voucherId}", helpers.IsAuthorized(s.handlers.UpdateVoucher)).Methods("PUT")
+	s.pricingController.Router.HandleFunc("/api/admin/vouchers/{voucherId}", helpers.IsAuthorized(s.handlers.DeleteVoucher)).Methods("DELETE")
+	s.pricingController.Router.HandleFunc("/api/admin/vouchers/{voucherId}/redemptions", helpers.IsAuthorized(s.handlers.GetVoucherRedemptions)).Methods("GET")
+	s.pricingController.Router.HandleFunc("/api/price-quote", helpers.IsAuthorized(s.handlers.QuotePrices)).Methods("POST")
+	s.pricingController.Router.HandleFunc("/api/users/buy/{id}/basket", helpers.IsAuthorized(s.handlers.BuyBasket)).Methods("POST")
+}
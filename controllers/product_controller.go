@@ -13,8 +13,12 @@ type ProductController struct {
 // registerRoutes registers the user routes
 func (s *service) registerProductRoutes() {
 	s.productController.Router.HandleFunc("/api/products", helpers.IsAuthorized(s.handlers.CreateProduct)).Methods("POST")
-	//s.productController.Router.HandleFunc("/api/products", s.handlers.GetProducts).Methods("GET")
 	s.productController.Router.HandleFunc("/api/products/{id}", s.handlers.GetProduct).Methods("GET")
 	s.productController.Router.HandleFunc("/api/products/{id}", helpers.IsAuthorized(s.handlers.UpdateProduct)).Methods("PUT")
 	s.productController.Router.HandleFunc("/api/products/{id}/{userId}", helpers.IsAuthorized(s.handlers.DeleteProductHandler)).Methods("DELETE")
+	s.productController.Router.HandleFunc("/api/products/{id}/restock", helpers.IsAuthorized(s.handlers.RestockProduct)).Methods("POST")
+	s.productController.Router.HandleFunc("/api/products/{id}/stock-adjustments", helpers.IsAuthorized(s.handlers.AdjustProductStock)).Methods("POST")
+	s.productController.Router.HandleFunc("/api/products/{id}/stock-history", helpers.IsAuthorized(s.handlers.GetStockHistory)).Methods("GET")
+	s.productController.Router.HandleFunc("/api/products/{id}/batches", helpers.IsAuthorized(s.handlers.GetBatches)).Methods("GET")
+	s.productController.Router.HandleFunc("/api/sellers/{id}/expiring-batches", helpers.IsAuthorized(s.handlers.GetExpiringBatches)).Methods("GET")
 }
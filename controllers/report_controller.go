@@ -0,0 +1,18 @@
+package controllers
+
+import (
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/gorilla/mux"
+)
+
+// ReportController struct
+type ReportController struct {
+	Router *mux.Router
+}
+
+// registerReportRoutes registers the sales and stock report routes
+func (s *service) registerReportRoutes() {
+	s.reportController.Router.HandleFunc("/api/reports/sales", helpers.IsAuthorized(s.handlers.GetSalesReport)).Methods("GET")
+	s.reportController.Router.HandleFunc("/api/reports/top-sellers", helpers.IsAuthorized(s.handlers.GetTopSellers)).Methods("GET")
+	s.reportController.Router.HandleFunc("/api/reports/stock-turnover", helpers.IsAuthorized(s.handlers.GetStockTurnover)).Methods("GET")
+}
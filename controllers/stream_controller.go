@@ -0,0 +1,17 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// StreamController struct
+type StreamController struct {
+	Router *mux.Router
+}
+
+// registerStreamRoutes registers the event stream routes, public like the product and machine routes:
+// the balance of a user is only streamed to their session
+func (s *service) registerStreamRoutes() {
+	s.streamController.Router.HandleFunc("/api/stream", s.handlers.StreamEvents).Methods("GET")
+	s.streamController.Router.HandleFunc("/api/stream/ws", s.handlers.StreamWebSocket).Methods("GET")
+}
@@ -0,0 +1,23 @@
+package controllers
+
+import (
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/gorilla/mux"
+)
+
+// WebhookController struct
+type WebhookController struct {
+	Router *mux.Router
+}
+
+// registerWebhookRoutes registers the webhook subscription and delivery log routes
+func (s *service) registerWebhookRoutes() {
+	s.webhookController.Router.HandleFunc("/api/admin/webhooks", helpers.IsAuthorized(s.handlers.CreateWebhook)).Methods("POST")
+	s.webhookController.Router.HandleFunc("/api/admin/webhooks", helpers.IsAuthorized(s.handlers.GetWebhooks)).Methods("GET")
+	s.webhookController.Router.HandleFunc("/api/admin/webhooks/{webhookId}", helpers.IsAuthorized(s.handlers.GetWebhook)).Methods("GET")
+	s.webhookController.Router.HandleFunc("/api/admin/webhooks/{webhookId}", helpers.IsAuthorized(s.handlers.UpdateWebhook)).Methods("PUT")
+	s.webhookController.Router.HandleFunc("/api/admin/webhooks/{webhookId}", helpers.IsAuthorized(s.handlers.DeleteWebhook)).Methods("DELETE")
+	s.webhookController.Router.HandleFunc("/api/admin/webhooks/{webhookId}/deliveries", helpers.IsAuthorized(s.handlers.GetWebhookDeliveries)).Methods("GET")
+	s.webhookController.Router.HandleFunc("/api/admin/webhooks/{webhookId}/deliveries/{deliveryId}", helpers.IsAuthorized(s.handlers.GetWebhookDelivery)).Methods("GET")
+	s.webhookController.Router.HandleFunc("/api/admin/webhooks/{webhookId}/deliveries/{deliveryId}/replay", helpers.IsAuthorized(s.handlers.ReplayWebhookDelivery)).Methods("POST")
+}
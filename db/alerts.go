@@ -0,0 +1,467 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/notify"
+	uuid "github.com/satori/go.uuid"
+)
+
+// crossedLevel tells which alert, if any, a level falling from before to after raises: running out is
+// critical and reaching the threshold from above is a warning
+func crossedLevel(before, after, threshold int, lowKind, emptyKind string) (kind, level string) {
+	switch {
+	case after >= before:
+		return "", ""
+	case after <= 0:
+		return emptyKind, AlertCritical
+	case before > threshold && after <= threshold:
+		return lowKind, AlertWarning
+	}
+	return "", ""
+}
+
+// stockThreshold reads the name of a product with its low stock threshold
+func (s *service) stockThreshold(ctx context.Context, tr *sql.Tx, productUUID string) (name string, threshold *StockThreshold, err error) {
+	rows, err := s.Query(ctx, s.db, tr,
+		`select p.product_name, coalesce(t.threshold, $2), t.threshold is null
+		from products p left join stock_thresholds t on t.product_uuid = p.uuid
+		where p.uuid = $1`,
+		productUUID, s.defaultStockThreshold)
+	if err != nil {
+		return
+	}
+	threshold = &StockThreshold{ProductUUID: productUUID}
+	found, err := scanOne(rows, &name, &threshold.Threshold, &threshold.Default)
+	if err != nil {
+		return
+	}
+	if !found {
+		err = fmt.Errorf("cannot find product with uuid '%s'", productUUID)
+	}
+	return
+}
+
+// checkStockLevel raises an alert when the stock of a product, in a machine when machineUUID is set,
+// falls from before to after across its threshold
+func (s *service) checkStockLevel(ctx context.Context, tr *sql.Tx, machineUUID, productUUID string, before, after int) error {
+	if after >= before {
+		return nil
+	}
+	name, threshold, err := s.stockThreshold(ctx, tr, productUUID)
+	if err != nil {
+		return err
+	}
+	kind, level := crossedLevel(before, after, threshold.Threshold, AlertLowStock, AlertOutOfStock)
+	if kind == "" {
+		return nil
+	}
+	where := "in the catalog"
+	if machineUUID != "" {
+		where = fmt.Sprintf("in machine '%s'", machineUUID)
+	}
+	message := fmt.Sprintf("product '%s' is down to %d units %s", name, after, where)
+	if kind == AlertOutOfStock {
+		message = fmt.Sprintf("product '%s' is out of stock %s", name, where)
+		out := &StockOut{ProductUUID: productUUID, ProductName: name, MachineUUID: machineUUID, Stock: after}
+		if err := s.recordEvent(ctx, tr, AggregateProduct, productUUID, EventProductOutOfStock, out); err != nil {
+			return err
+		}
+	}
+	return s.raiseAlert(ctx, tr, &Alert{
+		Kind:        kind,
+		Level:       level,
+		MachineUUID: machineUUID,
+		ProductUUID: productUUID,
+		Value:       after,
+		Threshold:   threshold.Threshold,
+		Message:     message,
+	})
+}
+
+// checkMachineStock raises an alert when moving units out of a slot brings the stock of the product,
+// summed over the slots of the machine, across its threshold
+func (s *service) checkMachineStock(ctx context.Context, tr *sql.Tx, machineUUID, productUUID string, moved int) error {
+	if moved >= 0 {
+		return nil
+	}
+	rows, err := s.Query(ctx, s.db, tr,
+		"select coalesce(sum(amount), 0) from machine_slots where machine_uuid = $1 and product_uuid = $2",
+		machineUUID, productUUID)
+	if err != nil {
+		return err
+	}
+	var after int
+	if _, err = scanOne(rows, &after); err != nil {
+		return err
+	}
+	return s.checkStockLevel(ctx, tr, machineUUID, productUUID, after-moved, after)
+}
+
+// coinThreshold reads the coin tube threshold of a denomination
+func (s *service) coinThreshold(ctx context.Context, tr *sql.Tx, denomination int) (threshold *CoinThreshold, err error) {
+	rows, err := s.Query(ctx, s.db, tr, "select threshold from coin_thresholds where denomination = $1", denomination)
+	if err != nil {
+		return
+	}
+	threshold = &CoinThreshold{Denomination: denomination}
+	found, err := scanOne(rows, &threshold.Threshold)
+	if err != nil {
+		return
+	}
+	if !found {
+		threshold.Threshold = s.defaultCoinThreshold
+		threshold.Default = true
+	}
+	return
+}
+
+// checkCoinLevel raises an alert when paying change takes the coins of a tube from before to after
+// across its threshold
+func (s *service) checkCoinLevel(ctx context.Context, tr *sql.Tx, machineUUID string, denomination, before, after int) error {
+	if after >= before {
+		return nil
+	}
+	threshold, err := s.coinThreshold(ctx, tr, denomination)
+	if err != nil {
+		return err
+	}
+	kind, level := crossedLevel(before, after, threshold.Threshold, AlertCoinTubeLow, AlertCoinTubeEmpty)
+	if kind == "" {
+		return nil
+	}
+	message := fmt.Sprintf("the %d coin tube of machine '%s' is down to %d coins", denomination, machineUUID, after)
+	if kind == AlertCoinTubeEmpty {
+		message = fmt.Sprintf("the %d coin tube of machine '%s' is empty", denomination, machineUUID)
+	}
+	return s.raiseAlert(ctx, tr, &Alert{
+		Kind:         kind,
+		Level:        level,
+		MachineUUID:  machineUUID,
+		Denomination: denomination,
+		Value:        after,
+		Threshold:    threshold.Threshold,
+		Message:      message,
+	})
+}
+
+// raiseEmptyTube raises an alert for a tube the coin changer failed to pay out of, whatever its count says
+func (s *service) raiseEmptyTube(ctx context.Context, tr *sql.Tx, machineUUID string, denomination, count int) error {
+	threshold, err := s.coinThreshold(ctx, tr, denomination)
+	if err != nil {
+		return err
+	}
+	return s.raiseAlert(ctx, tr, &Alert{
+		Kind:         AlertCoinTubeEmpty,
+		Level:        AlertCritical,
+		MachineUUID:  machineUUID,
+		Denomination: denomination,
+		Value:        count,
+		Threshold:    threshold.Threshold,
+		Message:      fmt.Sprintf("the coin changer of machine '%s' could not pay out of the %d coin tube", machineUUID, denomination),
+	})
+}
+
+// raiseDeviceMismatch raises an alert for a device action whose record failed with cause, outside any
+// transaction
+func (s *service) raiseDeviceMismatch(ctx context.Context, machineUUID, level string, value int, message string, cause error) {
+	log.Error(ctx, message, logger.Fields{"machineUUID": machineUUID, "value": value, "err": cause})
+	s.raiseUnrecorded(ctx, &Alert{
+		Kind:        AlertDeviceMismatch,
+		Level:       level,
+		MachineUUID: machineUUID,
+		Value:       value,
+		Message:     fmt.Sprintf("%s: %v", message, cause),
+	})
+}
+
+// raiseUnrecorded raises an alert outside any transaction for something the database failed to record.
+// The notifier is told directly when the alert cannot be stored either
+func (s *service) raiseUnrecorded(ctx context.Context, a *Alert) {
+	err := s.raiseAlert(ctx, nil, a)
+	if err == nil {
+		return
+	}
+	log.Error(ctx, "unable to raise alert", logger.Fields{"kind": a.Kind, "machineUUID": a.MachineUUID, "err": err})
+	if s.notifier != nil {
+		a.CreatedAt = time.Now().UTC()
+		_ = s.notifier.Notify(ctx, alertMessage(a))
+	}
+}
+
+// alertKey identifies the condition an alert is raised for
+func alertKey(a *Alert) string {
+	if a.ProductUUID != "" {
+		return fmt.Sprintf("%s:%s:%s", a.Kind, a.MachineUUID, a.ProductUUID)
+	}
+	return fmt.Sprintf("%s:%s:%d", a.Kind, a.MachineUUID, a.Denomination)
+}
+
+// raiseAlert records an alert, or one more occurrence of the unresolved alert raised for the same
+// condition. A new alert is sent to the notifier once tr commits
+func (s *service) raiseAlert(ctx context.Context, tr *sql.Tx, a *Alert) (err error) {
+	upsert := `insert into alerts(uuid, kind, level, dedup_key, machine_uuid, product_uuid, denomination, value, threshold, message)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		on conflict (dedup_key) where status <> 'resolved' do update
+		set occurrences = alerts.occurrences + 1, last_seen_at = now(), value = excluded.value, message = excluded.message
+		returning uuid, status, occurrences, created_at, last_seen_at`
+	var denomination sql.NullInt64
+	if a.Denomination != 0 {
+		denomination = sql.NullInt64{Int64: int64(a.Denomination), Valid: true}
+	}
+	rows, err := s.Query(ctx, s.db, tr, upsert, uuid.NewV4().String(), a.Kind, a.Level, alertKey(a), nullString(a.MachineUUID),
+		nullString(a.ProductUUID), denomination, a.Value, a.Threshold, a.Message)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "raiseAlert"))
+	}
+	if _, err = scanOne(rows, &a.UUID, &a.Status, &a.Occurrences, &a.CreatedAt, &a.LastSeenAt); err != nil {
+		return
+	}
+	if a.Occurrences > 1 || s.notifier == nil {
+		return nil
+	}
+	msg := alertMessage(a)
+	s.onCommit(tr, func() {
+		_ = s.notifier.Notify(context.Background(), msg)
+	})
+	return nil
+}
+
+// alertMessage describes a new alert to the notifiers
+func alertMessage(a *Alert) *notify.Message {
+	fields := map[string]interface{}{
+		"alert_id":  a.UUID,
+		"value":     a.Value,
+		"threshold": a.Threshold,
+	}
+	if a.MachineUUID != "" {
+		fields["machine_id"] = a.MachineUUID
+	}
+	if a.ProductUUID != "" {
+		fields["product_id"] = a.ProductUUID
+	}
+	if a.Denomination != 0 {
+		fields["denomination"] = a.Denomination
+	}
+	return &notify.Message{
+		Event:   a.Kind,
+		Level:   a.Level,
+		Subject: a.Message,
+		Text:    fmt.Sprintf("%s (threshold %d), acknowledge or resolve alert %s once handled", a.Message, a.Threshold, a.UUID),
+		Fields:  fields,
+		Time:    a.CreatedAt,
+	}
+}
+
+const alertColumns = `uuid, kind, level, coalesce(machine_uuid, ''), coalesce(product_uuid, ''), coalesce(denomination, 0), value,
+	threshold, message, status, occurrences, created_at, last_seen_at, acknowledged_at, coalesce(acknowledged_by, ''),
+	resolved_at, coalesce(resolved_by, '')`
+
+// scanAlerts reads alerts selected with alertColumns
+func scanAlerts(rows *sql.Rows) (alerts []*Alert, err error) {
+	defer rows.Close()
+	alerts = make([]*Alert, 0)
+	for rows.Next() {
+		a := new(Alert)
+		var acknowledgedAt, resolvedAt sql.NullTime
+		err = rows.Scan(&a.UUID, &a.Kind, &a.Level, &a.MachineUUID, &a.ProductUUID, &a.Denomination, &a.Value,
+			&a.Threshold, &a.Message, &a.Status, &a.Occurrences, &a.CreatedAt, &a.LastSeenAt, &acknowledgedAt, &a.AcknowledgedBy,
+			&resolvedAt, &a.ResolvedBy)
+		if err != nil {
+			return nil, err
+		}
+		if acknowledgedAt.Valid {
+			a.AcknowledgedAt = &acknowledgedAt.Time
+		}
+		if resolvedAt.Valid {
+			a.ResolvedAt = &resolvedAt.Time
+		}
+		alerts = append(alerts, a)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetAlerts lists the latest alerts, optionally only those with a status or of a kind
+func (s *service) GetAlerts(ctx context.Context, status, kind string) (alerts []*Alert, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetAlerts(exit)", err, logger.Fields{"status": status, "kind": kind})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	switch status {
+	case "", AlertOpen, AlertAcknowledged, AlertResolved:
+	default:
+		return nil, fmt.Errorf("invalid status '%s': use one of %s, %s, %s", status, AlertOpen, AlertAcknowledged, AlertResolved)
+	}
+	switch kind {
+	case "", AlertLowStock, AlertOutOfStock, AlertCoinTubeLow, AlertCoinTubeEmpty, AlertCashDiscrepancy, AlertDeviceMismatch,
+		AlertAuditFailure:
+	default:
+		return nil, fmt.Errorf("invalid kind '%s': use one of %s, %s, %s, %s, %s, %s, %s", kind, AlertLowStock, AlertOutOfStock,
+			AlertCoinTubeLow, AlertCoinTubeEmpty, AlertCashDiscrepancy, AlertDeviceMismatch, AlertAuditFailure)
+	}
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+alertColumns+` from alerts
+		where ($1 = '' or status = $1) and ($2 = '' or kind = $2)
+		order by last_seen_at desc limit 500`,
+		status, kind)
+	if err != nil {
+		return
+	}
+	return scanAlerts(rows)
+}
+
+// AcknowledgeAlert marks an open alert as seen by actorUUID
+func (s *service) AcknowledgeAlert(ctx context.Context, alertUUID, actorUUID string) (alert *Alert, err error) {
+	defer func() {
+		log.Outcome(ctx, "AcknowledgeAlert(exit)", err, logger.Fields{"alertUUID": alertUUID, "actorUUID": actorUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.moveAlert(ctx, alertUUID, actorUUID, AlertAcknowledged,
+		"update alerts set status = 'acknowledged', acknowledged_at = now(), acknowledged_by = $2 where uuid = $1 and status = 'open'")
+}
+
+// ResolveAlert closes an alert, the next time its condition occurs raises a new one
+func (s *service) ResolveAlert(ctx context.Context, alertUUID, actorUUID string) (alert *Alert, err error) {
+	defer func() {
+		log.Outcome(ctx, "ResolveAlert(exit)", err, logger.Fields{"alertUUID": alertUUID, "actorUUID": actorUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.moveAlert(ctx, alertUUID, actorUUID, AlertResolved,
+		"update alerts set status = 'resolved', resolved_at = now(), resolved_by = $2 where uuid = $1 and status <> 'resolved'")
+}
+
+// moveAlert runs the update moving an alert to status, failing when the alert is missing or already there
+func (s *service) moveAlert(ctx context.Context, alertUUID, actorUUID, status, update string) (alert *Alert, err error) {
+	rows, err := s.Query(ctx, s.db, nil, update+" returning "+alertColumns, alertUUID, nullString(actorUUID))
+	if err != nil {
+		return
+	}
+	alerts, err := scanAlerts(rows)
+	if err != nil {
+		return
+	}
+	if len(alerts) > 0 {
+		return alerts[0], nil
+	}
+	rows, err = s.Query(ctx, s.db, nil, "select "+alertColumns+" from alerts where uuid = $1", alertUUID)
+	if err != nil {
+		return
+	}
+	if alerts, err = scanAlerts(rows); err != nil {
+		return
+	}
+	if len(alerts) == 0 {
+		return nil, fmt.Errorf("cannot find alert with uuid '%s'", alertUUID)
+	}
+	return nil, fmt.Errorf("cannot move alert '%s' to %s, it is %s", alertUUID, status, alerts[0].Status)
+}
+
+// GetStockThreshold returns the low stock threshold of a product
+func (s *service) GetStockThreshold(ctx context.Context, productUUID string) (threshold *StockThreshold, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetStockThreshold(exit)", err, logger.Fields{"productUUID": productUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, threshold, err = s.stockThreshold(ctx, nil, productUUID)
+	return
+}
+
+// SetStockThreshold sets the stock of a product at which a low stock alert is raised
+func (s *service) SetStockThreshold(ctx context.Context, productUUID string, value int) (threshold *StockThreshold, err error) {
+	defer func() {
+		log.Outcome(ctx, "SetStockThreshold(exit)", err, logger.Fields{"productUUID": productUUID, "threshold": value})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if value < 0 {
+		return nil, errors.New("threshold must not be negative")
+	}
+	if _, _, err = s.stockThreshold(ctx, nil, productUUID); err != nil {
+		return
+	}
+	upsert := `insert into stock_thresholds(product_uuid, threshold) values ($1, $2)
+		on conflict (product_uuid) do update set threshold = excluded.threshold`
+	if _, err = s.RunQuery(ctx, s.db, nil, upsert, productUUID, value); err != nil {
+		return nil, errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "SetStockThreshold"))
+	}
+	return &StockThreshold{ProductUUID: productUUID, Threshold: value}, nil
+}
+
+// DeleteStockThreshold makes a product use the configured low stock threshold again
+func (s *service) DeleteStockThreshold(ctx context.Context, productUUID string) (threshold *StockThreshold, err error) {
+	defer func() {
+		log.Outcome(ctx, "DeleteStockThreshold(exit)", err, logger.Fields{"productUUID": productUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.RunQuery(ctx, s.db, nil, "delete from stock_thresholds where product_uuid = $1", productUUID); err != nil {
+		return nil, errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "DeleteStockThreshold"))
+	}
+	_, threshold, err = s.stockThreshold(ctx, nil, productUUID)
+	return
+}
+
+// GetCoinThresholds returns the coin tube threshold of every accepted denomination
+func (s *service) GetCoinThresholds(ctx context.Context) (thresholds []*CoinThreshold, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetCoinThresholds(exit)", err, nil)
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	thresholds = make([]*CoinThreshold, 0, len(s.denominations))
+	for _, denomination := range s.denominations {
+		threshold, err := s.coinThreshold(ctx, nil, denomination)
+		if err != nil {
+			return nil, err
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	return thresholds, nil
+}
+
+// SetCoinThreshold sets the number of coins of a denomination at which a coin tube alert is raised
+func (s *service) SetCoinThreshold(ctx context.Context, denomination, value int) (threshold *CoinThreshold, err error) {
+	defer func() {
+		log.Outcome(ctx, "SetCoinThreshold(exit)", err, logger.Fields{"denomination": denomination, "threshold": value})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if ok := s.Find(s.denominations, denomination); !ok {
+		return nil, fmt.Errorf("[%+v] is not in the acceptable denominations: use one of the following %+v", denomination, s.denominations)
+	}
+	if value < 0 {
+		return nil, errors.New("threshold must not be negative")
+	}
+	upsert := `insert into coin_thresholds(denomination, threshold) values ($1, $2)
+		on conflict (denomination) do update set threshold = excluded.threshold`
+	if _, err = s.RunQuery(ctx, s.db, nil, upsert, denomination, value); err != nil {
+		return nil, errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "SetCoinThreshold"))
+	}
+	return &CoinThreshold{Denomination: denomination, Threshold: value}, nil
+}
+
+// DeleteCoinThreshold makes a denomination use the configured coin tube threshold again
+func (s *service) DeleteCoinThreshold(ctx context.Context, denomination int) (threshold *CoinThreshold, err error) {
+	defer func() {
+		log.Outcome(ctx, "DeleteCoinThreshold(exit)", err, logger.Fields{"denomination": denomination})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if ok := s.Find(s.denominations, denomination); !ok {
+		return nil, fmt.Errorf("[%+v] is not in the acceptable denominations: use one of the following %+v", denomination, s.denominations)
+	}
+	if _, err = s.RunQuery(ctx, s.db, nil, "delete from coin_thresholds where denomination = $1", denomination); err != nil {
+		return nil, errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "DeleteCoinThreshold"))
+	}
+	return s.coinThreshold(ctx, nil, denomination)
+}
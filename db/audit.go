@@ -0,0 +1,231 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+const (
+	// defaultAuditLimit is the length of a page of audit entries without limit
+	defaultAuditLimit = 100
+	// maxAuditLimit bounds a page of audit entries
+	maxAuditLimit = 1000
+)
+
+// genesisHash is the previous hash of the first audit entry
+var genesisHash = strings.Repeat("0", 64)
+
+// auditHash chains an entry to the previous one, hashing every recorded field after prevHash
+func auditHash(prevHash string, e *AuditEntry) (string, error) {
+	canonical, err := json.Marshal([]interface{}{
+		prevHash, e.CreatedAt.UTC().Format(time.RFC3339Nano), e.Actor, e.Action, e.Target, e.RequestID, e.Status,
+		string(e.Before), string(e.After),
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// nullJSON stores an empty snapshot as null
+func nullJSON(snapshot json.RawMessage) interface{} {
+	if len(snapshot) == 0 {
+		return nil
+	}
+	return string(snapshot)
+}
+
+// RecordAudit appends an entry to the audit log, linking it to the last entry. Entries are appended one
+// at a time so that the chain follows the ids. An entry that cannot be written raises an audit failure alert
+func (s *service) RecordAudit(ctx context.Context, entry *AuditEntry) (recorded *AuditEntry, err error) {
+	defer func() {
+		log.Outcome(ctx, "RecordAudit(exit)", err, logger.Fields{"action": entry.Action, "target": entry.Target, "actor": entry.Actor})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if entry.Action == "" || entry.Target == "" {
+		return nil, errors.New("audit entry should have an action and a target")
+	}
+
+	e := *entry
+	// the database keeps microseconds, the hash is of the time as stored
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.RunQuery(ctx, s.db, tr, "select pg_advisory_xact_lock(hashtext('audit_log'))"); err != nil {
+			return err
+		}
+		rows, err := s.Query(ctx, s.db, tr, "select hash from audit_log order by id desc limit 1")
+		if err != nil {
+			return err
+		}
+		found, err := scanOne(rows, &e.PrevHash)
+		if err != nil {
+			return err
+		}
+		if !found {
+			e.PrevHash = genesisHash
+		}
+		if e.Hash, err = auditHash(e.PrevHash, &e); err != nil {
+			return err
+		}
+		rows, err = s.Query(ctx, s.db, tr,
+			`insert into audit_log(actor, action, target, request_id, status, before_state, after_state, created_at, prev_hash, hash)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`,
+			e.Actor, e.Action, e.Target, e.RequestID, e.Status, nullJSON(e.Before), nullJSON(e.After), e.CreatedAt, e.PrevHash, e.Hash)
+		if err != nil {
+			return err
+		}
+		_, err = scanOne(rows, &e.ID)
+		return err
+	})
+	if err != nil {
+		alertCtx, cancel := s.detached(ctx)
+		defer cancel()
+		s.raiseUnrecorded(alertCtx, &Alert{
+			Kind:    AlertAuditFailure,
+			Level:   AlertCritical,
+			Value:   e.Status,
+			Message: fmt.Sprintf("%s on %s (request %s) is missing from the audit log", e.Action, e.Target, e.RequestID),
+		})
+		return nil, err
+	}
+	return &e, nil
+}
+
+const auditColumns = "id, actor, action, target, request_id, status, before_state, after_state, created_at, prev_hash, hash"
+
+// scanAuditEntry reads a row of audit_log
+func scanAuditEntry(rows *sql.Rows) (*AuditEntry, error) {
+	e := new(AuditEntry)
+	var before, after sql.NullString
+	err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.Target, &e.RequestID, &e.Status, &before, &after, &e.CreatedAt, &e.PrevHash, &e.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if before.Valid {
+		e.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		e.After = json.RawMessage(after.String)
+	}
+	return e, nil
+}
+
+// GetAuditLog lists the audit entries selected by filter, the newest first
+func (s *service) GetAuditLog(ctx context.Context, filter *AuditFilter) (entries []*AuditEntry, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetAuditLog(exit)", err, logger.Fields{"filter": filter})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	if filter.Limit > maxAuditLimit {
+		filter.Limit = maxAuditLimit
+	}
+
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = "+arg(filter.Actor))
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = "+arg(filter.Action))
+	}
+	if filter.Target != "" {
+		target := strings.TrimSuffix(filter.Target, "/")
+		conditions = append(conditions, fmt.Sprintf("(target = %s or left(target, length(%[1]s) + 1) = %[1]s || '/')", arg(target)))
+	}
+	if filter.RequestID != "" {
+		conditions = append(conditions, "request_id = "+arg(filter.RequestID))
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(filter.To))
+	}
+	if filter.BeforeID > 0 {
+		conditions = append(conditions, "id < "+arg(filter.BeforeID))
+	}
+	query := "select " + auditColumns + " from audit_log"
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	query += " order by id desc limit " + arg(filter.Limit)
+
+	rows, err := s.Query(ctx, s.db, nil, query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	entries = make([]*AuditEntry, 0)
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	return
+}
+
+// VerifyAuditLog walks the audit log in order, recomputing the hash of every entry and checking its link
+// to the one before, and reports the first entry breaking the chain
+func (s *service) VerifyAuditLog(ctx context.Context) (verification *AuditVerification, err error) {
+	defer func() {
+		log.Outcome(ctx, "VerifyAuditLog(exit)", err, nil)
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil, "select "+auditColumns+" from audit_log order by id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	verification = &AuditVerification{Valid: true}
+	prevHash := genesisHash
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		verification.Entries++
+		if e.PrevHash != prevHash {
+			verification.Valid, verification.BrokenAt = false, e.ID
+			verification.Error = fmt.Sprintf("entry %d does not follow the entry before it", e.ID)
+			return verification, nil
+		}
+		hash, err := auditHash(prevHash, e)
+		if err != nil {
+			return nil, err
+		}
+		if hash != e.Hash {
+			verification.Valid, verification.BrokenAt = false, e.ID
+			verification.Error = fmt.Sprintf("entry %d does not match its hash", e.ID)
+			return verification, nil
+		}
+		prevHash = e.Hash
+		verification.LastHash = e.Hash
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
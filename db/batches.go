@@ -0,0 +1,256 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+// defaultExpiryDays is the window of an expiry report when none is given
+const defaultExpiryDays = 7
+
+const batchColumns = `b.uuid, b.product_uuid, p.product_name, p.seller_id, coalesce(b.machine_uuid, ''), coalesce(b.slot_code, ''),
+	coalesce(b.lot, ''), b.quantity, b.remaining, b.expires_at, b.received_at, b.expires_at <= now()
+	from product_batches b join products p on p.uuid = b.product_uuid`
+
+// scanBatches reads batches selected with batchColumns
+func scanBatches(rows *sql.Rows) (batches []*Batch, err error) {
+	defer rows.Close()
+	batches = make([]*Batch, 0)
+	for rows.Next() {
+		b := new(Batch)
+		err = rows.Scan(&b.UUID, &b.ProductUUID, &b.ProductName, &b.SellerID, &b.MachineUUID, &b.SlotCode,
+			&b.Lot, &b.Quantity, &b.Remaining, &b.ExpiresAt, &b.ReceivedAt, &b.Expired)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, b)
+	}
+	err = rows.Err()
+	return
+}
+
+// validateBatch checks the expiry date of a batch about to be received
+func validateBatch(lot string, expiresAt *time.Time) error {
+	if expiresAt == nil {
+		if lot != "" {
+			return errors.New("a lot needs an expiry date (expires_at) to be tracked")
+		}
+		return nil
+	}
+	if !expiresAt.After(time.Now()) {
+		return fmt.Errorf("expiry date %s is not in the future", expiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// addBatch records units received in the catalog stock, or in a machine slot when b.MachineUUID is set
+func (s *service) addBatch(ctx context.Context, tr *sql.Tx, b *Batch, actorUUID string) (err error) {
+	b.UUID = uuid.NewV4().String()
+	b.Remaining = b.Quantity
+	insert := `insert into product_batches(uuid, product_uuid, machine_uuid, slot_code, lot, quantity, remaining, expires_at, actor_uuid)
+		values ($1, $2, $3, $4, $5, $6, $6, $7, $8)
+		returning received_at`
+	rows, err := s.Query(ctx, s.db, tr, insert, b.UUID, b.ProductUUID, nullString(b.MachineUUID), nullString(b.SlotCode),
+		nullString(b.Lot), b.Quantity, b.ExpiresAt, nullString(actorUUID))
+	if err != nil {
+		return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "addBatch"))
+	}
+	_, err = scanOne(rows, &b.ReceivedAt)
+	return
+}
+
+// lockBatches locks the batches of a product in the catalog stock, or in a machine slot, matching
+// condition, in the order given
+func (s *service) lockBatches(ctx context.Context, tr *sql.Tx, productUUID, machineUUID, code, condition, order string) ([]*Batch, error) {
+	rows, err := s.Query(ctx, s.db, tr,
+		"select "+batchColumns+`
+		where b.product_uuid = $1 and coalesce(b.machine_uuid, '') = $2 and coalesce(b.slot_code, '') = $3 and `+condition+`
+		order by `+order+` for update of b`,
+		productUUID, machineUUID, code)
+	if err != nil {
+		return nil, err
+	}
+	return scanBatches(rows)
+}
+
+// setBatchRemaining updates the units left in a batch
+func (s *service) setBatchRemaining(ctx context.Context, tr *sql.Tx, b *Batch, remaining int) error {
+	_, err := s.RunQuery(ctx, s.db, tr, "update product_batches set remaining = $1 where uuid = $2", remaining, b.UUID)
+	b.Remaining = remaining
+	return err
+}
+
+// moveBatches follows a change of stock, from stock units, in the batches of a product in the catalog or in
+// a machine slot. Removed units are taken from the oldest batch first: a sale only takes units that have
+// not expired and fails when too few are left, other removals take the expired units first. Units not
+// covered by any batch, such as stock received without an expiry date, are taken last and never expire.
+// Units coming back from a reversed sale are put back into the batches they were most likely taken from
+func (s *service) moveBatches(ctx context.Context, tr *sql.Tx, productUUID, machineUUID, code string, stock, change int, reason string) error {
+	if change > 0 {
+		if reason != MovementSaleReversal {
+			return nil
+		}
+		batches, err := s.lockBatches(ctx, tr, productUUID, machineUUID, code,
+			"b.remaining < b.quantity and b.expires_at > now()", "b.received_at desc, b.expires_at desc, b.uuid desc")
+		if err != nil {
+			return err
+		}
+		for _, b := range batches {
+			if change == 0 {
+				break
+			}
+			put := b.Quantity - b.Remaining
+			if put > change {
+				put = change
+			}
+			if err = s.setBatchRemaining(ctx, tr, b, b.Remaining+put); err != nil {
+				return err
+			}
+			change -= put
+		}
+		return nil
+	}
+
+	batches, err := s.lockBatches(ctx, tr, productUUID, machineUUID, code,
+		"b.remaining > 0", "b.received_at, b.expires_at, b.uuid")
+	if err != nil {
+		return err
+	}
+	tracked, expired := 0, 0
+	var fresh, stale []*Batch
+	for _, b := range batches {
+		tracked += b.Remaining
+		if b.Expired {
+			expired += b.Remaining
+			stale = append(stale, b)
+		} else {
+			fresh = append(fresh, b)
+		}
+	}
+	take := -change
+	order := append(stale, fresh...)
+	if reason == MovementSale {
+		if sellable := stock - expired; take > sellable {
+			return fmt.Errorf("requested amount %+v is greater than available amout %+v, %+v units expired", take, sellable, expired)
+		}
+		order = fresh
+	}
+	for _, b := range order {
+		if take == 0 {
+			break
+		}
+		taken := b.Remaining
+		if taken > take {
+			taken = take
+		}
+		if err = s.setBatchRemaining(ctx, tr, b, b.Remaining-taken); err != nil {
+			return err
+		}
+		take -= taken
+	}
+	return nil
+}
+
+// expiredStock returns the expired units of a product per slot code of a machine, or under the empty
+// code for the catalog stock when machineUUID is empty
+func (s *service) expiredStock(ctx context.Context, tr *sql.Tx, productUUID, machineUUID string) (expired map[string]int, err error) {
+	rows, err := s.Query(ctx, s.db, tr,
+		`select coalesce(slot_code, ''), sum(remaining) from product_batches
+		where product_uuid = $1 and coalesce(machine_uuid, '') = $2 and remaining > 0 and expires_at <= now()
+		group by coalesce(slot_code, '')`,
+		productUUID, machineUUID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	expired = make(map[string]int)
+	for rows.Next() {
+		var code string
+		var units int
+		if err = rows.Scan(&code, &units); err != nil {
+			return
+		}
+		expired[code] = units
+	}
+	err = rows.Err()
+	return
+}
+
+// sellableSlots returns copies of slots holding only the units of productUUID that have not expired
+func (s *service) sellableSlots(ctx context.Context, tr *sql.Tx, machineUUID, productUUID string, slots []*Slot) ([]*Slot, error) {
+	expired, err := s.expiredStock(ctx, tr, productUUID, machineUUID)
+	if err != nil {
+		return nil, err
+	}
+	sellable := make([]*Slot, 0, len(slots))
+	for _, slot := range slots {
+		copied := *slot
+		copied.Amount -= expired[slot.Code]
+		if copied.Amount < 0 {
+			copied.Amount = 0
+		}
+		sellable = append(sellable, &copied)
+	}
+	return sellable, nil
+}
+
+// GetBatches lists the batches of a product with units left, in the catalog stock or in a machine
+func (s *service) GetBatches(ctx context.Context, productUUID, machineUUID string) (batches []*Batch, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetBatches(exit)", err, logger.Fields{"productUUID": productUUID, "machineUUID": machineUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+batchColumns+`
+		where b.product_uuid = $1 and coalesce(b.machine_uuid, '') = $2 and b.remaining > 0
+		order by coalesce(b.slot_code, ''), b.received_at, b.expires_at, b.uuid`,
+		productUUID, machineUUID)
+	if err != nil {
+		return
+	}
+	return scanBatches(rows)
+}
+
+// GetExpiringBatches reports the batches of a seller's products with units left that expired or expire
+// within days days, the soonest first
+func (s *service) GetExpiringBatches(ctx context.Context, sellerID string, days int) (report *ExpiryReport, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetExpiringBatches(exit)", err, logger.Fields{"sellerID": sellerID, "days": days})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if days < 0 {
+		return nil, errors.New("days should not be negative")
+	}
+	if days == 0 {
+		days = defaultExpiryDays
+	}
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+batchColumns+`
+		where p.seller_id = $1 and b.remaining > 0 and b.expires_at <= now() + $2 * interval '1 day'
+		order by b.expires_at, p.product_name, b.uuid`,
+		sellerID, days)
+	if err != nil {
+		return
+	}
+	batches, err := scanBatches(rows)
+	if err != nil {
+		return
+	}
+	report = &ExpiryReport{SellerID: sellerID, Days: days, Batches: batches}
+	for _, b := range batches {
+		if b.Expired {
+			report.ExpiredUnits += b.Remaining
+		} else {
+			report.ExpiringUnits += b.Remaining
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,598 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// defaultCatalogLimit and maxCatalogLimit bound the products of a catalog page or a search
+	defaultCatalogLimit = 50
+	maxCatalogLimit     = 200
+	// maxSearchCandidates bounds the products ranked by the search fallback
+	maxSearchCandidates = 1000
+	// searchConfig is the text search configuration of the product search vectors
+	searchConfig = "english"
+)
+
+var tagRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9 _-]{0,49}$`)
+
+// productColumns selects the fields of a product aliased p, its tags, allergens and images are read by
+// loadProductDetails
+const productColumns = `p.uuid, p.amount_available, p.cost, p.product_name, p.seller_id, coalesce(p.category_uuid, ''),
+	coalesce(p.nutrition, ''), coalesce(p.sku, '')`
+
+// categoryTree selects the uuid of the category of the $n placeholder given to it and of all its subcategories
+const categoryTree = `with recursive tree as (
+		select uuid from categories where uuid = %[1]s
+		union all select c.uuid from categories c join tree t on c.parent_uuid = t.uuid
+	) select uuid from tree`
+
+// isPostgres reports whether the database supports the postgres only features such as text search
+func (s *service) isPostgres() bool {
+	return s.dialect == "" || s.dialect == "postgres"
+}
+
+// normalizeTags lower cases, sorts and deduplicates tags
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagRegex.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag '%s': use up to 50 letters, digits, spaces, '-' or '_'", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// scanProducts reads products selected with productColumns, followed by extra destinations per row
+func scanProducts(rows *sql.Rows, extra func() []interface{}) (products []*Product, err error) {
+	defer rows.Close()
+	products = make([]*Product, 0)
+	for rows.Next() {
+		p := new(Product)
+		var nutrition string
+		dest := []interface{}{&p.UUID, &p.AmountAvailable, &p.Cost, &p.ProductName, &p.SellerID, &p.CategoryUUID, &nutrition, &p.SKU}
+		if extra != nil {
+			dest = append(dest, extra()...)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if p.Nutrition, err = parseNutrition(nutrition); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+// productsIn returns the products by uuid and a condition on column selecting them
+func productsIn(products []*Product, column string) (byUUID map[string]*Product, condition string, args []interface{}) {
+	byUUID = make(map[string]*Product, len(products))
+	placeholders := make([]string, 0, len(products))
+	for _, p := range products {
+		byUUID[p.UUID] = p
+		args = append(args, p.UUID)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	return byUUID, column + " in (" + strings.Join(placeholders, ", ") + ")", args
+}
+
+// loadProductDetails reads the tags, allergens and images of products
+func (s *service) loadProductDetails(ctx context.Context, tr *sql.Tx, products []*Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	if err := s.loadProductLabels(ctx, tr, products, "product_tags", "tag", func(p *Product, tag string) { p.Tags = append(p.Tags, tag) }); err != nil {
+		return err
+	}
+	err := s.loadProductLabels(ctx, tr, products, "product_allergens", "allergen", func(p *Product, allergen string) { p.Allergens = append(p.Allergens, allergen) })
+	if err != nil {
+		return err
+	}
+	return s.loadProductImages(ctx, tr, products)
+}
+
+// loadProductLabels reads the column labels of products from table, in order, handing each to add
+func (s *service) loadProductLabels(ctx context.Context, tr *sql.Tx, products []*Product, table, column string, add func(p *Product, label string)) error {
+	byUUID, condition, args := productsIn(products, "product_uuid")
+	rows, err := s.Query(ctx, s.db, tr,
+		"select product_uuid, "+column+" from "+table+" where "+condition+" order by product_uuid, "+column,
+		args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var productUUID, label string
+		if err = rows.Scan(&productUUID, &label); err != nil {
+			return err
+		}
+		add(byUUID[productUUID], label)
+	}
+	return rows.Err()
+}
+
+// setProductTags replaces the tags of a product with tags, which are normalized
+func (s *service) setProductTags(ctx context.Context, tr *sql.Tx, productUUID string, tags []string) error {
+	if _, err := s.RunQuery(ctx, s.db, tr, "delete from product_tags where product_uuid = $1", productUUID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := s.RunQuery(ctx, s.db, tr, "insert into product_tags(product_uuid, tag) values ($1, $2)", productUUID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshSearch rebuilds the search vectors of the products matching condition, a condition on products p
+// whose placeholders take args. Only postgres keeps search vectors, other databases search the text itself
+func (s *service) refreshSearch(ctx context.Context, tr *sql.Tx, condition string, args ...interface{}) error {
+	if !s.isPostgres() {
+		return nil
+	}
+	update := `update products p set search_vector =
+		setweight(to_tsvector('` + searchConfig + `', p.product_name), 'A') ||
+		setweight(to_tsvector('` + searchConfig + `', coalesce((select string_agg(t.tag, ' ') from product_tags t where t.product_uuid = p.uuid), '')), 'B') ||
+		setweight(to_tsvector('` + searchConfig + `', coalesce((
+			with recursive path as (
+				select uuid, name, parent_uuid from categories where uuid = p.category_uuid
+				union all select c.uuid, c.name, c.parent_uuid from categories c join path on c.uuid = path.parent_uuid
+			) select string_agg(name, ' ') from path), '')), 'C')
+		where ` + condition
+	_, err := s.RunQuery(ctx, s.db, tr, update, args...)
+	return err
+}
+
+// checkCategory checks that a category exists
+func (s *service) checkCategory(ctx context.Context, tr *sql.Tx, categoryUUID string) error {
+	rows, err := s.Query(ctx, s.db, tr, "select 1 from categories where uuid = $1", categoryUUID)
+	if err != nil {
+		return err
+	}
+	var one int
+	found, err := scanOne(rows, &one)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("cannot find category with uuid '%s'", categoryUUID)
+	}
+	return nil
+}
+
+// loadCategories reads all categories as a tree, returning its roots and every category by uuid
+func (s *service) loadCategories(ctx context.Context, tr *sql.Tx) (roots []*Category, byUUID map[string]*Category, err error) {
+	rows, err := s.Query(ctx, s.db, tr, "select uuid, name, coalesce(parent_uuid, ''), created_at from categories order by lower(name), uuid")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	var all []*Category
+	byUUID = make(map[string]*Category)
+	for rows.Next() {
+		c := new(Category)
+		if err = rows.Scan(&c.UUID, &c.Name, &c.ParentUUID, &c.CreatedAt); err != nil {
+			return nil, nil, err
+		}
+		all = append(all, c)
+		byUUID[c.UUID] = c
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	roots = make([]*Category, 0)
+	for _, c := range all {
+		if parent, ok := byUUID[c.ParentUUID]; ok {
+			parent.Children = append(parent.Children, c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+	var setPath func(c *Category, path []string)
+	setPath = func(c *Category, path []string) {
+		c.Path = append(append([]string{}, path...), c.Name)
+		for _, child := range c.Children {
+			setPath(child, c.Path)
+		}
+	}
+	for _, root := range roots {
+		setPath(root, nil)
+	}
+	return roots, byUUID, nil
+}
+
+// validateCategory checks the editable fields of a category, a category cannot be moved under itself
+// or one of its subcategories
+func validateCategory(c *Category, byUUID map[string]*Category) error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" || len(c.Name) > 100 {
+		return errors.New("category name should not be empty or longer than 100 characters")
+	}
+	if c.ParentUUID != "" {
+		parent, ok := byUUID[c.ParentUUID]
+		if !ok {
+			return fmt.Errorf("cannot find category with uuid '%s'", c.ParentUUID)
+		}
+		for ; parent != nil; parent = byUUID[parent.ParentUUID] {
+			if parent.UUID == c.UUID {
+				return errors.New("a category cannot be moved under itself or one of its subcategories")
+			}
+		}
+	}
+	for _, sibling := range byUUID {
+		if sibling.UUID != c.UUID && sibling.ParentUUID == c.ParentUUID && strings.EqualFold(sibling.Name, c.Name) {
+			return fmt.Errorf("category '%s' already exists", c.Name)
+		}
+	}
+	return nil
+}
+
+// CreateCategory adds a category, under its parent when ParentUUID is set
+func (s *service) CreateCategory(ctx context.Context, cInput *Category) (category *Category, err error) {
+	defer func() {
+		log.Outcome(ctx, "CreateCategory(exit)", err, logger.Fields{"name": cInput.Name, "parentUUID": cInput.ParentUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	cInput.UUID = uuid.NewV4().String()
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		_, byUUID, err := s.loadCategories(ctx, tr)
+		if err != nil {
+			return err
+		}
+		if err = validateCategory(cInput, byUUID); err != nil {
+			return err
+		}
+		_, err = s.RunQuery(ctx, s.db, tr, "insert into categories(uuid, name, parent_uuid) values ($1, $2, $3)",
+			cInput.UUID, cInput.Name, nullString(cInput.ParentUUID))
+		if err != nil {
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateCategory"))
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	return s.GetCategory(ctx, cInput.UUID)
+}
+
+// GetCategories returns the category tree
+func (s *service) GetCategories(ctx context.Context) (categories []*Category, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetCategories(exit)", err, nil)
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	categories, _, err = s.loadCategories(ctx, nil)
+	return
+}
+
+// GetCategory returns a category with its path and subcategories
+func (s *service) GetCategory(ctx context.Context, categoryUUID string) (category *Category, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetCategory(exit)", err, logger.Fields{"categoryUUID": categoryUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, byUUID, err := s.loadCategories(ctx, nil)
+	if err != nil {
+		return
+	}
+	category, ok := byUUID[categoryUUID]
+	if !ok {
+		return nil, fmt.Errorf("cannot find category with uuid '%s'", categoryUUID)
+	}
+	return category, nil
+}
+
+// UpdateCategory renames a category or moves it under another parent, the products it holds are
+// searched under its new path
+func (s *service) UpdateCategory(ctx context.Context, cInput *Category) (category *Category, err error) {
+	defer func() {
+		log.Outcome(ctx, "UpdateCategory(exit)", err, logger.Fields{"categoryUUID": cInput.UUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		_, byUUID, err := s.loadCategories(ctx, tr)
+		if err != nil {
+			return err
+		}
+		if _, ok := byUUID[cInput.UUID]; !ok {
+			return fmt.Errorf("cannot find category with uuid '%s'", cInput.UUID)
+		}
+		if err = validateCategory(cInput, byUUID); err != nil {
+			return err
+		}
+		_, err = s.RunQuery(ctx, s.db, tr, "update categories set name = $1, parent_uuid = $2 where uuid = $3",
+			cInput.Name, nullString(cInput.ParentUUID), cInput.UUID)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateCategory"))
+		}
+		return s.refreshSearch(ctx, tr, "p.category_uuid in ("+fmt.Sprintf(categoryTree, "$1")+")", cInput.UUID)
+	})
+	if err != nil {
+		return
+	}
+	return s.GetCategory(ctx, cInput.UUID)
+}
+
+// DeleteCategory removes a category without subcategories, its products are left uncategorized
+func (s *service) DeleteCategory(ctx context.Context, categoryUUID string) (err error) {
+	defer func() {
+		log.Outcome(ctx, "DeleteCategory(exit)", err, logger.Fields{"categoryUUID": categoryUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.inTransaction(ctx, func(tr *sql.Tx) error {
+		_, byUUID, err := s.loadCategories(ctx, tr)
+		if err != nil {
+			return err
+		}
+		category, ok := byUUID[categoryUUID]
+		if !ok {
+			return fmt.Errorf("cannot find category with uuid '%s'", categoryUUID)
+		}
+		if len(category.Children) > 0 {
+			return errors.New("category has subcategories, move or delete them first")
+		}
+		// the cleared search vectors mark the products to search without the category
+		_, err = s.RunQuery(ctx, s.db, tr, "update products set category_uuid = null, search_vector = null where category_uuid = $1", categoryUUID)
+		if err != nil {
+			return err
+		}
+		if _, err = s.RunQuery(ctx, s.db, tr, "delete from categories where uuid = $1", categoryUUID); err != nil {
+			return err
+		}
+		return s.refreshSearch(ctx, tr, "p.search_vector is null")
+	})
+}
+
+// SetProductClassification replaces the category and the tags of a product, an empty categoryUUID leaves
+// the product uncategorized
+func (s *service) SetProductClassification(ctx context.Context, productUUID, categoryUUID string, tags []string) (product *Product, err error) {
+	defer func() {
+		log.Outcome(ctx, "SetProductClassification(exit)", err, logger.Fields{"productUUID": productUUID, "categoryUUID": categoryUUID, "tags": tags})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if tags, err = normalizeTags(tags); err != nil {
+		return
+	}
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if err := s.classifyProduct(ctx, tr, productUUID, categoryUUID, tags); err != nil {
+			return err
+		}
+		return s.refreshSearch(ctx, tr, "p.uuid = $1", productUUID)
+	})
+	if err != nil {
+		return
+	}
+	return s.GetProduct(ctx, productUUID)
+}
+
+// classifyProduct sets the category and the normalized tags of a product
+func (s *service) classifyProduct(ctx context.Context, tr *sql.Tx, productUUID, categoryUUID string, tags []string) error {
+	if categoryUUID != "" {
+		if err := s.checkCategory(ctx, tr, categoryUUID); err != nil {
+			return err
+		}
+	}
+	res, err := s.RunQuery(ctx, s.db, tr, "update products set category_uuid = $1 where uuid = $2", nullString(categoryUUID), productUUID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("cannot find product with uuid '%s'", productUUID)
+	}
+	return s.setProductTags(ctx, tr, productUUID, tags)
+}
+
+// catalogLimit applies the default and the maximum to the limit of a filter
+func catalogLimit(limit int) int {
+	if limit <= 0 {
+		return defaultCatalogLimit
+	}
+	if limit > maxCatalogLimit {
+		return maxCatalogLimit
+	}
+	return limit
+}
+
+// filterConditions returns the conditions on products p selecting the products of filter, their
+// placeholders numbered after those of args
+func filterConditions(filter *ProductFilter, args []interface{}) ([]string, []interface{}, error) {
+	var conditions []string
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if filter.CategoryUUID != "" {
+		conditions = append(conditions, "p.category_uuid in ("+fmt.Sprintf(categoryTree, arg(filter.CategoryUUID))+")")
+	}
+	tags, err := normalizeTags(filter.Tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, tag := range tags {
+		conditions = append(conditions, "exists (select 1 from product_tags t where t.product_uuid = p.uuid and t.tag = "+arg(tag)+")")
+	}
+	if filter.SellerID != "" {
+		conditions = append(conditions, "p.seller_id = "+arg(filter.SellerID))
+	}
+	allergens, err := normalizeAllergens(filter.ExcludeAllergens)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, allergen := range allergens {
+		conditions = append(conditions, "not exists (select 1 from product_allergens a where a.product_uuid = p.uuid and a.allergen = "+arg(allergen)+")")
+	}
+	return conditions, args, nil
+}
+
+// GetProducts lists the products of the catalog selected by filter, by name
+func (s *service) GetProducts(ctx context.Context, filter *ProductFilter) (products []*Product, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetProducts(exit)", err, logger.Fields{"filter": filter})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	conditions, args, err := filterConditions(filter, nil)
+	if err != nil {
+		return
+	}
+	query := "select " + productColumns + " from products p"
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	args = append(args, catalogLimit(filter.Limit))
+	query += fmt.Sprintf(" order by p.product_name, p.uuid limit $%d", len(args))
+	rows, err := s.Query(ctx, s.db, nil, query, args...)
+	if err != nil {
+		return
+	}
+	if products, err = scanProducts(rows, nil); err != nil {
+		return
+	}
+	return products, s.loadProductDetails(ctx, nil, products)
+}
+
+// SearchProducts returns the products of the catalog selected by filter that match its query, the most
+// relevant first. Postgres ranks them with its text search, other databases by where the words appear
+func (s *service) SearchProducts(ctx context.Context, filter *ProductFilter) (results []*SearchResult, err error) {
+	defer func() {
+		log.Outcome(ctx, "SearchProducts(exit)", err, logger.Fields{"filter": filter})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	terms := strings.Fields(strings.ToLower(filter.Query))
+	if len(terms) == 0 {
+		return nil, errors.New("search query should not be empty")
+	}
+	if s.isPostgres() {
+		return s.searchText(ctx, filter)
+	}
+	return s.searchLike(ctx, filter, terms)
+}
+
+// searchText ranks the products matching a query with the postgres text search
+func (s *service) searchText(ctx context.Context, filter *ProductFilter) ([]*SearchResult, error) {
+	args := []interface{}{filter.Query}
+	conditions, args, err := filterConditions(filter, args)
+	if err != nil {
+		return nil, err
+	}
+	conditions = append([]string{"p.search_vector @@ q.query"}, conditions...)
+	args = append(args, catalogLimit(filter.Limit))
+	query := "select " + productColumns + ", ts_rank(p.search_vector, q.query) as rank" +
+		" from products p, plainto_tsquery('" + searchConfig + "', $1) q(query)" +
+		" where " + strings.Join(conditions, " and ") +
+		fmt.Sprintf(" order by rank desc, p.product_name, p.uuid limit $%d", len(args))
+	rows, err := s.Query(ctx, s.db, nil, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ranks []*float64
+	products, err := scanProducts(rows, func() []interface{} {
+		rank := new(float64)
+		ranks = append(ranks, rank)
+		return []interface{}{rank}
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*SearchResult, 0, len(products))
+	for i, p := range products {
+		results = append(results, &SearchResult{Product: p, Rank: *ranks[i]})
+	}
+	return results, s.loadProductDetails(ctx, nil, products)
+}
+
+// searchLike finds the products whose name, tags or category contain any of terms and ranks them by
+// where the terms appear, for databases without text search
+func (s *service) searchLike(ctx context.Context, filter *ProductFilter, terms []string) ([]*SearchResult, error) {
+	var args []interface{}
+	var matches []string
+	for _, term := range terms {
+		args = append(args, "%"+term+"%")
+		n := len(args)
+		matches = append(matches, fmt.Sprintf(`lower(p.product_name) like $%[1]d
+			or exists (select 1 from product_tags t where t.product_uuid = p.uuid and t.tag like $%[1]d)
+			or lower(coalesce(c.name, '')) like $%[1]d`, n))
+	}
+	conditions, args, err := filterConditions(filter, args)
+	if err != nil {
+		return nil, err
+	}
+	conditions = append([]string{"(" + strings.Join(matches, " or ") + ")"}, conditions...)
+	args = append(args, maxSearchCandidates)
+	query := "select " + productColumns + ", coalesce(c.name, '')" +
+		" from products p left join categories c on c.uuid = p.category_uuid" +
+		" where " + strings.Join(conditions, " and ") +
+		fmt.Sprintf(" limit $%d", len(args))
+	rows, err := s.Query(ctx, s.db, nil, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var categories []*string
+	products, err := scanProducts(rows, func() []interface{} {
+		category := new(string)
+		categories = append(categories, category)
+		return []interface{}{category}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = s.loadProductDetails(ctx, nil, products); err != nil {
+		return nil, err
+	}
+
+	results := make([]*SearchResult, 0, len(products))
+	for i, p := range products {
+		tags := strings.Join(p.Tags, " ")
+		name, category := strings.ToLower(p.ProductName), strings.ToLower(*categories[i])
+		rank := 0.0
+		for _, term := range terms {
+			switch {
+			case strings.Contains(name, term):
+				rank += 1
+			case strings.Contains(tags, term):
+				rank += 0.4
+			case strings.Contains(category, term):
+				rank += 0.2
+			}
+		}
+		results = append(results, &SearchResult{Product: p, Rank: rank / float64(len(terms))})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ProductName < results[j].ProductName
+	})
+	if limit := catalogLimit(filter.Limit); len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,327 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+// defaultCollectionLimit is the length of a machine's collection history without limit
+const defaultCollectionLimit = 50
+
+// coinCounts reads coin counts into counts per denomination, each an accepted denomination listed once
+func (s *service) coinCounts(name string, coins []*CoinCount) (map[int]int, error) {
+	counts := make(map[int]int, len(coins))
+	for _, c := range coins {
+		if !s.Find(s.denominations, c.Denomination) {
+			return nil, fmt.Errorf("%s: [%+v] is not in the acceptable denominations: use one of the following %+v", name, c.Denomination, s.denominations)
+		}
+		if c.Count < 0 {
+			return nil, fmt.Errorf("%s: the count of %d coins should not be negative", name, c.Denomination)
+		}
+		if _, ok := counts[c.Denomination]; ok {
+			return nil, fmt.Errorf("%s: %d coins are listed twice", name, c.Denomination)
+		}
+		counts[c.Denomination] = c.Count
+	}
+	return counts, nil
+}
+
+// cashBox reads what the coin box of a machine should hold since its last collection. Expected is the
+// running count of machine_coins, locked for the rest of tr when forUpdate
+func (s *service) cashBox(ctx context.Context, tr *sql.Tx, machineUUID string, forUpdate bool) (box *CashBox, err error) {
+	expected, err := s.getMachineCoins(ctx, tr, machineUUID, forUpdate)
+	if err != nil {
+		return
+	}
+	box = &CashBox{MachineUUID: machineUUID, Coins: make([]*CashBoxCoins, 0, len(s.denominations))}
+
+	rows, err := s.Query(ctx, s.db, tr,
+		"select uuid, created_at from cash_collections where machine_uuid = $1 order by created_at desc, uuid limit 1", machineUUID)
+	if err != nil {
+		return
+	}
+	var last string
+	var since time.Time
+	found, err := scanOne(rows, &last, &since)
+	if err != nil {
+		return
+	}
+	opening := make(map[int]int)
+	if found {
+		box.Since = &since
+		if rows, err = s.Query(ctx, s.db, tr, "select denomination, left_in_box from cash_collection_coins where collection_uuid = $1", last); err != nil {
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var denomination, left int
+			if err = rows.Scan(&denomination, &left); err != nil {
+				return
+			}
+			opening[denomination] = left
+		}
+		if err = rows.Err(); err != nil {
+			return
+		}
+	}
+
+	rows, err = s.Query(ctx, s.db, tr,
+		`select denomination, coalesce(sum(case when reason = $2 then change end), 0), coalesce(-sum(case when reason = $3 then change end), 0)
+		from coin_movements where machine_uuid = $1 and ($4::timestamptz is null or created_at > $4)
+		group by denomination`,
+		machineUUID, CoinDeposit, CoinChange, box.Since)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	deposited, paidOut := make(map[int]int), make(map[int]int)
+	for rows.Next() {
+		var denomination, in, out int
+		if err = rows.Scan(&denomination, &in, &out); err != nil {
+			return
+		}
+		deposited[denomination], paidOut[denomination] = in, out
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, denomination := range s.denominations {
+		box.Coins = append(box.Coins, &CashBoxCoins{
+			Denomination: denomination,
+			Opening:      opening[denomination],
+			Deposited:    deposited[denomination],
+			PaidOut:      paidOut[denomination],
+			Expected:     expected[denomination],
+		})
+		box.ExpectedTotal += denomination * expected[denomination]
+	}
+	return box, nil
+}
+
+// GetCashBox returns what the coin box of a machine should hold since its last collection
+func (s *service) GetCashBox(ctx context.Context, machineUUID string) (box *CashBox, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetCashBox(exit)", err, logger.Fields{"machineUUID": machineUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.getMachine(ctx, nil, machineUUID, false); err != nil {
+		return
+	}
+	return s.cashBox(ctx, nil, machineUUID, false)
+}
+
+// CollectCash records the emptying of a machine's coin box: the counted coins are compared with those
+// expected, a discrepancy raises an alert, and the box counters are reset to the coins left in it
+func (s *service) CollectCash(ctx context.Context, machineUUID, actorUUID string, input *CashCollectionInput) (collection *CashCollection, err error) {
+	defer func() {
+		log.Outcome(ctx, "CollectCash(exit)", err, logger.Fields{"machineUUID": machineUUID, "actorUUID": actorUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	counted, err := s.coinCounts("counted", input.Counted)
+	if err != nil {
+		return
+	}
+	left, err := s.coinCounts("left", input.Left)
+	if err != nil {
+		return
+	}
+	for denomination, count := range left {
+		if count > counted[denomination] {
+			return nil, fmt.Errorf("cannot leave %d coins of %d in the box, only %d were counted", count, denomination, counted[denomination])
+		}
+	}
+	if len(input.Note) > 255 {
+		return nil, errors.New("note should not exceed 255 characters")
+	}
+
+	collection = &CashCollection{
+		UUID:        uuid.NewV4().String(),
+		MachineUUID: machineUUID,
+		Note:        input.Note,
+		CollectedBy: actorUUID,
+	}
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.getMachine(ctx, tr, machineUUID, true); err != nil {
+			return err
+		}
+		box, err := s.cashBox(ctx, tr, machineUUID, true)
+		if err != nil {
+			return err
+		}
+		collection.Coins = box.Coins
+		collection.ExpectedTotal = box.ExpectedTotal
+		for _, c := range collection.Coins {
+			c.Counted, c.Left = counted[c.Denomination], left[c.Denomination]
+			c.Difference = c.Counted - c.Expected
+			collection.CountedTotal += c.Denomination * c.Counted
+			collection.LeftTotal += c.Denomination * c.Left
+		}
+		collection.Difference = collection.CountedTotal - collection.ExpectedTotal
+		collection.Status = CollectionBalanced
+		for _, c := range collection.Coins {
+			if c.Difference != 0 {
+				collection.Status = CollectionDiscrepancy
+			}
+		}
+
+		rows, err := s.Query(ctx, s.db, tr,
+			`insert into cash_collections(uuid, machine_uuid, expected_total, counted_total, left_total, status, note, collected_by)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning created_at`,
+			collection.UUID, machineUUID, collection.ExpectedTotal, collection.CountedTotal, collection.LeftTotal,
+			collection.Status, nullString(collection.Note), nullString(actorUUID))
+		if err != nil {
+			return err
+		}
+		if _, err = scanOne(rows, &collection.CreatedAt); err != nil {
+			return err
+		}
+		for _, c := range collection.Coins {
+			_, err = s.RunQuery(ctx, s.db, tr,
+				`insert into cash_collection_coins(collection_uuid, denomination, opening, deposited, paid_out, expected, counted, left_in_box)
+				values ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				collection.UUID, c.Denomination, c.Opening, c.Deposited, c.PaidOut, c.Expected, c.Counted, c.Left)
+			if err != nil {
+				return err
+			}
+			// the box now holds the coins left in it
+			if c.Left != c.Expected {
+				if err = s.addMachineCoins(ctx, tr, machineUUID, c.Denomination, c.Left-c.Expected, CoinCollection, collection.UUID); err != nil {
+					return err
+				}
+			}
+			if err = s.checkCoinLevel(ctx, tr, machineUUID, c.Denomination, c.Expected, c.Left); err != nil {
+				return err
+			}
+		}
+
+		if collection.Status != CollectionDiscrepancy {
+			return nil
+		}
+		return s.raiseAlert(ctx, tr, &Alert{
+			Kind:        AlertCashDiscrepancy,
+			Level:       AlertWarning,
+			MachineUUID: machineUUID,
+			Value:       collection.CountedTotal,
+			Threshold:   collection.ExpectedTotal,
+			Message: fmt.Sprintf("cash collection '%s' of machine '%s' counted %d where %d was expected",
+				collection.UUID, machineUUID, collection.CountedTotal, collection.ExpectedTotal),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+const cashCollectionColumns = `uuid, coalesce(machine_uuid, ''), expected_total, counted_total, left_total, status, coalesce(note, ''),
+	coalesce(collected_by, ''), created_at`
+
+// scanCashCollections reads the rows of cash_collections, with their coins
+func (s *service) scanCashCollections(ctx context.Context, rows *sql.Rows) (collections []*CashCollection, err error) {
+	defer rows.Close()
+	collections = make([]*CashCollection, 0)
+	byUUID := make(map[string]*CashCollection)
+	for rows.Next() {
+		c := &CashCollection{Coins: make([]*CashBoxCoins, 0)}
+		err = rows.Scan(&c.UUID, &c.MachineUUID, &c.ExpectedTotal, &c.CountedTotal, &c.LeftTotal, &c.Status, &c.Note,
+			&c.CollectedBy, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		c.Difference = c.CountedTotal - c.ExpectedTotal
+		collections = append(collections, c)
+		byUUID[c.UUID] = c
+	}
+	if err = rows.Err(); err != nil || len(collections) == 0 {
+		return
+	}
+	if err = rows.Close(); err != nil {
+		return
+	}
+
+	args := make([]interface{}, 0, len(collections))
+	placeholders := ""
+	for _, c := range collections {
+		args = append(args, c.UUID)
+		if placeholders != "" {
+			placeholders += ", "
+		}
+		placeholders += fmt.Sprintf("$%d", len(args))
+	}
+	coins, err := s.Query(ctx, s.db, nil,
+		`select collection_uuid, denomination, opening, deposited, paid_out, expected, counted, left_in_box
+		from cash_collection_coins where collection_uuid in (`+placeholders+`) order by collection_uuid, denomination`, args...)
+	if err != nil {
+		return
+	}
+	defer coins.Close()
+	for coins.Next() {
+		var collectionUUID string
+		c := new(CashBoxCoins)
+		if err = coins.Scan(&collectionUUID, &c.Denomination, &c.Opening, &c.Deposited, &c.PaidOut, &c.Expected, &c.Counted, &c.Left); err != nil {
+			return nil, err
+		}
+		c.Difference = c.Counted - c.Expected
+		collection := byUUID[collectionUUID]
+		collection.Coins = append(collection.Coins, c)
+	}
+	err = coins.Err()
+	return
+}
+
+// GetCashCollections lists the latest cash collections of a machine, optionally only those with a status
+func (s *service) GetCashCollections(ctx context.Context, machineUUID, status string, limit int) (collections []*CashCollection, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetCashCollections(exit)", err, logger.Fields{"machineUUID": machineUUID, "status": status, "limit": limit})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	switch status {
+	case "", CollectionBalanced, CollectionDiscrepancy:
+	default:
+		return nil, fmt.Errorf("invalid status '%s': use %s or %s", status, CollectionBalanced, CollectionDiscrepancy)
+	}
+	if limit <= 0 {
+		limit = defaultCollectionLimit
+	}
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+cashCollectionColumns+` from cash_collections
+		where machine_uuid = $1 and ($2 = '' or status = $2)
+		order by created_at desc, uuid limit $3`,
+		machineUUID, status, limit)
+	if err != nil {
+		return
+	}
+	return s.scanCashCollections(ctx, rows)
+}
+
+// GetCashCollection returns a cash collection of a machine
+func (s *service) GetCashCollection(ctx context.Context, machineUUID, collectionUUID string) (collection *CashCollection, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetCashCollection(exit)", err, logger.Fields{"machineUUID": machineUUID, "collectionUUID": collectionUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+cashCollectionColumns+" from cash_collections where uuid = $1 and machine_uuid = $2", collectionUUID, machineUUID)
+	if err != nil {
+		return
+	}
+	collections, err := s.scanCashCollections(ctx, rows)
+	if err != nil {
+		return
+	}
+	if len(collections) == 0 {
+		return nil, fmt.Errorf("cannot find cash collection with uuid '%s'", collectionUUID)
+	}
+	return collections[0], nil
+}
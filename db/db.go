@@ -1,127 +1,436 @@
 package db
 
 import (
+	"context"
 	"crypto/sha1"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/code-sleuth/vending-machine/blob"
+	"github.com/code-sleuth/vending-machine/bus"
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/device"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/metrics"
+	"github.com/code-sleuth/vending-machine/notify"
+	"github.com/code-sleuth/vending-machine/pricing"
 	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Service interface {
-	RunQuery(db *sqlx.DB, tr *sql.Tx, query string, args ...interface{}) (sql.Result, error)
-	ExecuteQuery(db *sqlx.DB, query string, args ...interface{}) (res sql.Result, err error)
-	ExecuteTransaction(tr *sql.Tx, query string, args ...interface{}) (res sql.Result, err error)
-	PrintQuery(query string, args ...interface{})
-	Query(db *sqlx.DB, tr *sql.Tx, query string, args ...interface{}) (*sql.Rows, error)
-	QueryNoTr(db *sqlx.DB, query string, args ...interface{}) (rows *sql.Rows, err error)
-	QueryWithTr(tr *sql.Tx, query string, args ...interface{}) (rows *sql.Rows, err error)
-
-	CreateUser(userInput *User) (user *User, err error)
-	GetUser(uuid string) (user *User, err error)
-	UpdateUser(userInput *User) (user *User, err error)
-	DeleteUser(uuid string) (err error)
-	GetUserPasswordByUsername(username string) (user *User, err error)
-	Login(username, password string) (user *User, err error)
-
-	GetProduct(uuid string) (product *Product, err error)
-	CreateProduct(pInput *Product) (product *Product, err error)
-	UpdateProduct(pInput *Product) (product *Product, err error)
-	DeleteProduct(uuid string) (err error)
-
-	Deposit(userUUID string, amount int) (*User, error)
-	Buy(userUUID, productUUID string, numberOfProducts int) (buyRes *BuyResponse, err error)
-	Reset(userUUID string) (user *User, err error)
+	RunQuery(ctx context.Context, db *sqlx.DB, tr *sql.Tx, query string, args ...interface{}) (sql.Result, error)
+	ExecuteQuery(ctx context.Context, db *sqlx.DB, query string, args ...interface{}) (res sql.Result, err error)
+	ExecuteTransaction(ctx context.Context, tr *sql.Tx, query string, args ...interface{}) (res sql.Result, err error)
+	PrintQuery(ctx context.Context, query string, args ...interface{})
+	Query(ctx context.Context, db *sqlx.DB, tr *sql.Tx, query string, args ...interface{}) (*sql.Rows, error)
+	QueryNoTr(ctx context.Context, db *sqlx.DB, query string, args ...interface{}) (rows *sql.Rows, err error)
+	QueryWithTr(ctx context.Context, tr *sql.Tx, query string, args ...interface{}) (rows *sql.Rows, err error)
+	Ping(ctx context.Context) error
+	CheckSchema(ctx context.Context) error
+
+	CreateUser(ctx context.Context, userInput *User) (user *User, err error)
+	GetUser(ctx context.Context, uuid string) (user *User, err error)
+	UpdateUser(ctx context.Context, userInput *User) (user *User, err error)
+	DeleteUser(ctx context.Context, uuid string) (err error)
+	GetUserPasswordByUsername(ctx context.Context, username string) (user *User, err error)
+	Login(ctx context.Context, username, password string) (user *User, err error)
+
+	GetProduct(ctx context.Context, uuid string) (product *Product, err error)
+	CreateProduct(ctx context.Context, pInput *Product) (product *Product, err error)
+	UpdateProduct(ctx context.Context, pInput *Product) (product *Product, err error)
+	DeleteProduct(ctx context.Context, uuid string) (err error)
+	AdjustProductStock(ctx context.Context, productUUID, actorUUID string, adjustment *StockAdjustment) (product *Product, err error)
+	GetStockHistory(ctx context.Context, productUUID, machineUUID string, limit int) (movements []*InventoryMovement, err error)
+	GetBatches(ctx context.Context, productUUID, machineUUID string) (batches []*Batch, err error)
+	GetExpiringBatches(ctx context.Context, sellerID string, days int) (report *ExpiryReport, err error)
+
+	Deposit(ctx context.Context, userUUID string, amount int) (*User, error)
+	Buy(ctx context.Context, userUUID, productUUID string, numberOfProducts int, voucherCode string) (buyRes *BuyResponse, err error)
+	Reset(ctx context.Context, userUUID string) (user *User, err error)
+
+	CreateMachine(ctx context.Context, mInput *Machine) (machine *Machine, err error)
+	GetMachine(ctx context.Context, uuid string) (machine *Machine, err error)
+	GetMachines(ctx context.Context) (machines []*Machine, err error)
+	UpdateMachine(ctx context.Context, mInput *Machine) (machine *Machine, err error)
+	DeleteMachine(ctx context.Context, uuid string) (err error)
+	GetMachineProducts(ctx context.Context, machineUUID string) (products []*MachineProduct, err error)
+	GetPlanogram(ctx context.Context, machineUUID string) (planogram *Planogram, err error)
+	SaveSlot(ctx context.Context, slotInput *Slot) (slot *Slot, err error)
+	DeleteSlot(ctx context.Context, machineUUID, code string) (err error)
+	FillSlot(ctx context.Context, machineUUID, code, productUUID, actorUUID string, amount int, batch *Batch) (slot *Slot, err error)
+	GetMachineCoins(ctx context.Context, machineUUID string) (coins []*CoinCount, err error)
+	GetMachineCredit(ctx context.Context, machineUUID, userUUID string) (credit *MachineCredit, err error)
+	MachineDeposit(ctx context.Context, machineUUID, userUUID string, amount int) (credit *MachineCredit, err error)
+	MachineBuy(ctx context.Context, machineUUID, userUUID, productUUID string, numberOfProducts int) (buyRes *BuyResponse, err error)
+	MachineBuySlot(ctx context.Context, machineUUID, userUUID, slotCode string, numberOfProducts int) (buyRes *BuyResponse, err error)
+	MachineReset(ctx context.Context, machineUUID, userUUID string) (credit *MachineCredit, err error)
+	GetMachineSession(ctx context.Context, machineUUID string) (session *MachineSession, err error)
+	SessionEvent(ctx context.Context, machineUUID, userUUID string, event *SessionEvent) (session *MachineSession, err error)
+	ClearMachineSession(ctx context.Context, machineUUID string) (session *MachineSession, err error)
+	ReserveMachineProduct(ctx context.Context, machineUUID, userUUID, productUUID string, numberOfProducts int) (reservation *Reservation, err error)
+	GetReservation(ctx context.Context, reservationUUID string) (reservation *Reservation, err error)
+	GetReservations(ctx context.Context, machineUUID, status string) (reservations []*Reservation, err error)
+	ConfirmReservation(ctx context.Context, reservationUUID string, success bool, reason string) (reservation *Reservation, err error)
+	SweepReservations(ctx context.Context) (expired int, err error)
+
+	GetAlerts(ctx context.Context, status, kind string) (alerts []*Alert, err error)
+	AcknowledgeAlert(ctx context.Context, alertUUID, actorUUID string) (alert *Alert, err error)
+	ResolveAlert(ctx context.Context, alertUUID, actorUUID string) (alert *Alert, err error)
+	GetStockThreshold(ctx context.Context, productUUID string) (threshold *StockThreshold, err error)
+	SetStockThreshold(ctx context.Context, productUUID string, value int) (threshold *StockThreshold, err error)
+	DeleteStockThreshold(ctx context.Context, productUUID string) (threshold *StockThreshold, err error)
+	GetCoinThresholds(ctx context.Context) (thresholds []*CoinThreshold, err error)
+	SetCoinThreshold(ctx context.Context, denomination, value int) (threshold *CoinThreshold, err error)
+	DeleteCoinThreshold(ctx context.Context, denomination int) (threshold *CoinThreshold, err error)
+
+	BuyBasket(ctx context.Context, userUUID string, items []*BasketItem, voucherCode string) (basket *BasketResponse, err error)
+	QuotePrices(ctx context.Context, items []*BasketItem) (quote *pricing.Quote, err error)
+	CreatePriceRule(ctx context.Context, rule *pricing.Rule) (created *pricing.Rule, err error)
+	GetPriceRule(ctx context.Context, ruleUUID string) (rule *pricing.Rule, err error)
+	GetPriceRules(ctx context.Context, productUUID, sellerID string) (rules []*pricing.Rule, err error)
+	UpdatePriceRule(ctx context.Context, rule *pricing.Rule) (updated *pricing.Rule, err error)
+	DeletePriceRule(ctx context.Context, ruleUUID string) (err error)
+
+	CreateVoucher(ctx context.Context, vInput *Voucher, actorUUID string) (voucher *Voucher, err error)
+	GetVoucher(ctx context.Context, voucherUUID string) (voucher *Voucher, err error)
+	GetVouchers(ctx context.Context) (vouchers []*Voucher, err error)
+	UpdateVoucher(ctx context.Context, vInput *Voucher) (voucher *Voucher, err error)
+	DeleteVoucher(ctx context.Context, voucherUUID string) (err error)
+	GetVoucherRedemptions(ctx context.Context, voucherUUID string) (redemptions []*VoucherRedemption, err error)
+
+	CreateCategory(ctx context.Context, cInput *Category) (category *Category, err error)
+	GetCategories(ctx context.Context) (categories []*Category, err error)
+	GetCategory(ctx context.Context, categoryUUID string) (category *Category, err error)
+	UpdateCategory(ctx context.Context, cInput *Category) (category *Category, err error)
+	DeleteCategory(ctx context.Context, categoryUUID string) (err error)
+	SetProductClassification(ctx context.Context, productUUID, categoryUUID string, tags []string) (product *Product, err error)
+	GetProducts(ctx context.Context, filter *ProductFilter) (products []*Product, err error)
+	SearchProducts(ctx context.Context, filter *ProductFilter) (results []*SearchResult, err error)
+
+	SetProductNutrition(ctx context.Context, productUUID string, nutrition *Nutrition, allergens []string) (product *Product, err error)
+	AddProductImage(ctx context.Context, productUUID, actorUUID string, data []byte) (img *ProductImage, err error)
+	GetProductImages(ctx context.Context, productUUID string) (images []*ProductImage, err error)
+	OpenProductImage(ctx context.Context, productUUID, imageUUID string, thumbnail bool) (content io.ReadCloser, img *ProductImage, err error)
+	DeleteProductImage(ctx context.Context, productUUID, imageUUID string) (err error)
+
+	ImportProducts(ctx context.Context, sellerID, actorUUID, mode string, rows []*ProductImportRow, dryRun bool) (result *ImportResult, err error)
+	ExportProducts(ctx context.Context, sellerID string) (rows []*ProductImportRow, err error)
+
+	GetSalesReport(ctx context.Context, filter *SalesFilter) (report *SalesReport, err error)
+	GetStockTurnover(ctx context.Context, filter *SalesFilter) (report *TurnoverReport, err error)
+
+	GetCashBox(ctx context.Context, machineUUID string) (box *CashBox, err error)
+	CollectCash(ctx context.Context, machineUUID, actorUUID string, input *CashCollectionInput) (collection *CashCollection, err error)
+	GetCashCollections(ctx context.Context, machineUUID, status string, limit int) (collections []*CashCollection, err error)
+	GetCashCollection(ctx context.Context, machineUUID, collectionUUID string) (collection *CashCollection, err error)
+
+	RecordAudit(ctx context.Context, entry *AuditEntry) (recorded *AuditEntry, err error)
+	GetAuditLog(ctx context.Context, filter *AuditFilter) (entries []*AuditEntry, err error)
+	VerifyAuditLog(ctx context.Context) (verification *AuditVerification, err error)
+
+	CreateWebhook(ctx context.Context, input *WebhookSubscription, actorUUID string) (webhook *WebhookSubscription, err error)
+	GetWebhook(ctx context.Context, webhookUUID string) (webhook *WebhookSubscription, err error)
+	GetWebhooks(ctx context.Context) (webhooks []*WebhookSubscription, err error)
+	UpdateWebhook(ctx context.Context, input *WebhookSubscription) (webhook *WebhookSubscription, err error)
+	DeleteWebhook(ctx context.Context, webhookUUID string) (err error)
+	GetWebhookDeliveries(ctx context.Context, webhookUUID, status string, limit int) (deliveries []*WebhookDelivery, err error)
+	GetWebhookDelivery(ctx context.Context, webhookUUID, deliveryUUID string) (delivery *WebhookDelivery, err error)
+	ReplayWebhookDelivery(ctx context.Context, webhookUUID, deliveryUUID string) (delivery *WebhookDelivery, err error)
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) (deliveries []*WebhookDelivery, err error)
+	CompleteWebhookDelivery(ctx context.Context, delivery *WebhookDelivery, outcome *WebhookOutcome) (err error)
+	QueueWebhookEvent(ctx context.Context, event *OutboxEvent) (err error)
+
+	ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) (events []*OutboxEvent, err error)
+	CompleteOutboxEvent(ctx context.Context, event *OutboxEvent, publishErr error, retryAt time.Time) (err error)
+	PruneOutbox(ctx context.Context, before time.Time) (pruned int64, err error)
 }
 
+var log = logger.New("db")
+
 type service struct {
-	db *sqlx.DB
+	db               *sqlx.DB
+	denominations    []int
+	statementTimeout time.Duration
+	// dialect is the sql dialect of db, features only postgres has are skipped for the others
+	dialect string
+	devices device.Provider
+	// reservationTimeout is how long a reservation waits for the machine to confirm the vend
+	reservationTimeout time.Duration
+	notifier           notify.Notifier
+	// pricing prices sales with the price rules in force
+	pricing *pricing.Engine
+	// location is the local time of the machines, of the happy hours and of the report buckets
+	location *time.Location
+	// defaultStockThreshold and defaultCoinThreshold apply when no threshold of their own is set
+	defaultStockThreshold int
+	defaultCoinThreshold  int
+	// blobs stores the product images, their thumbnails fit in a square of thumbnailSize pixels
+	blobs         blob.Store
+	thumbnailSize int
+	// events is the bus the changes of stock, balances and machine states are published to
+	events *bus.Bus
+
+	// afterCommit holds the functions to run once a transaction commits
+	hooksMu     sync.Mutex
+	afterCommit map[*sql.Tx][]func()
 }
 
-// New creates new instance of the database
-func New(db *sqlx.DB) Service {
+// New creates new instance of the database, devices is nil for machines run without hardware,
+// notifier is nil when alerts are only recorded and blobs stores the product images
+func New(db *sqlx.DB, cfg *config.Config, devices device.Provider, notifier notify.Notifier, blobs blob.Store, events *bus.Bus) Service {
 	return &service{
-		db: db,
+		db:               db,
+		denominations:    cfg.SortedDenominations(),
+		statementTimeout: cfg.DB.StatementTimeout,
+		dialect:          cfg.DB.Dialect,
+		devices:          devices,
+
+		reservationTimeout: cfg.Reservations.Timeout,
+		notifier:           notifier,
+		afterCommit:        make(map[*sql.Tx][]func()),
+		pricing:            pricing.New(cfg.Pricing.Location()),
+		location:           cfg.Pricing.Location(),
+
+		defaultStockThreshold: cfg.Alerts.LowStockThreshold,
+		defaultCoinThreshold:  cfg.Alerts.CoinThreshold,
+
+		blobs:         blobs,
+		thumbnailSize: cfg.Images.ThumbnailSize,
+		events:        events,
+	}
+}
+
+// withTimeout bounds the statements run by a single service call with the configured
+// statement timeout, on top of any deadline or cancellation already carried by ctx. A statement
+// cut short fails with an error wrapping context.Canceled or context.DeadlineExceeded
+func (s *service) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.statementTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.statementTimeout)
+}
+
+// detached returns a context for the statements recording what a device already did, which have to run
+// even when the request that made it act was cancelled
+func (s *service) detached(ctx context.Context) (context.Context, context.CancelFunc) {
+	return s.withTimeout(logger.WithRequestID(context.Background(), logger.RequestID(ctx)))
+}
+
+// schemaTables lists the tables created by db/sql/init_schema.sql
+var schemaTables = []string{
+	"users",
+	"products",
+	"machines",
+	"machine_slots",
+	"machine_credits",
+	"machine_coins",
+	"purchases",
+	"reservations",
+	"reservation_slots",
+	"machine_sessions",
+	"inventory_movements",
+	"stock_thresholds",
+	"coin_thresholds",
+	"alerts",
+	"product_batches",
+	"price_rules",
+	"price_rule_items",
+	"vouchers",
+	"voucher_redemptions",
+	"categories",
+	"product_tags",
+	"product_images",
+	"product_allergens",
+	"coin_movements",
+	"cash_collections",
+	"cash_collection_coins",
+	"audit_log",
+	"webhook_subscriptions",
+	"webhook_deliveries",
+	"webhook_attempts",
+	"outbox",
+}
+
+// Ping checks that the database is reachable
+func (s *service) Ping(ctx context.Context) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+// CheckSchema checks that every table from the schema script exists
+func (s *service) CheckSchema(ctx context.Context) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var missing []string
+	for _, table := range schemaTables {
+		var name sql.NullString
+		err = s.db.QueryRowContext(ctx, "select to_regclass($1)::text", table).Scan(&name)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CheckSchema"))
+		}
+		if !name.Valid {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing tables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// inTransaction runs fn in a database transaction, committing when fn succeeds and rolling back otherwise
+func (s *service) inTransaction(ctx context.Context, fn func(tr *sql.Tx) error) (err error) {
+	tr, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, "inTransaction")
+	}
+	defer func() {
+		hooks := s.takeHooks(tr)
+		if p := recover(); p != nil {
+			_ = tr.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			if rbErr := tr.Rollback(); rbErr != nil {
+				log.Error(ctx, "transaction rollback failed", logger.Fields{"err": rbErr})
+			}
+			return
+		}
+		if err = tr.Commit(); err != nil {
+			return
+		}
+		for _, hook := range hooks {
+			hook()
+		}
+	}()
+	return fn(tr)
+}
+
+// onCommit runs fn once tr commits, and never when it rolls back. Without a transaction fn runs at once
+func (s *service) onCommit(tr *sql.Tx, fn func()) {
+	if tr == nil {
+		fn()
+		return
+	}
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.afterCommit[tr] = append(s.afterCommit[tr], fn)
+}
+
+// publish sends an event to the bus once tr commits
+func (s *service) publish(tr *sql.Tx, event bus.Event) {
+	s.onCommit(tr, func() {
+		s.events.Publish(event)
+	})
+}
+
+// takeHooks removes and returns the functions waiting for tr to commit
+func (s *service) takeHooks(tr *sql.Tx) []func() {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	hooks := s.afterCommit[tr]
+	delete(s.afterCommit, tr)
+	return hooks
+}
+
+// scanOne scans the first row into dest and closes rows, reporting whether a row was found
+func scanOne(rows *sql.Rows, dest ...interface{}) (found bool, err error) {
+	defer rows.Close()
+	if rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return false, err
+		}
+		found = true
 	}
+	return found, rows.Err()
 }
 
 // Query - query DB using transaction if provided
-func (s *service) Query(db *sqlx.DB, tr *sql.Tx, query string, args ...interface{}) (*sql.Rows, error) {
+func (s *service) Query(ctx context.Context, db *sqlx.DB, tr *sql.Tx, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	defer func(start time.Time) {
+		metrics.ObserveSince(metrics.DBQueryDuration.WithLabelValues("Query", metrics.Outcome(err)), start)
+	}(time.Now())
 	if tr == nil {
-		return s.QueryNoTr(db, query, args...)
+		return s.QueryNoTr(ctx, db, query, args...)
 	}
-	return s.QueryWithTr(tr, query, args...)
+	return s.QueryWithTr(ctx, tr, query, args...)
 }
 
 // QueryNoTr query db without transaction
-func (s *service) QueryNoTr(db *sqlx.DB, query string, args ...interface{}) (rows *sql.Rows, err error) {
-	rows, err = db.Query(query, args...)
+func (s *service) QueryNoTr(ctx context.Context, db *sqlx.DB, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	rows, err = db.QueryContext(ctx, query, args...)
 	if err != nil {
-		s.PrintQuery(query, args...)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "QueryNoTr"))
-		log.Println("QueryNoTr failed")
+		s.PrintQuery(ctx, query, args...)
+		err = fmt.Errorf("%w: %s", err, "QueryNoTr")
+		log.Error(ctx, "QueryNoTr failed", logger.Fields{"err": err, "query": query})
 	}
 	return
 }
 
 // QueryWithTr query db with transaction
-func (s *service) QueryWithTr(tr *sql.Tx, query string, args ...interface{}) (rows *sql.Rows, err error) {
-	rows, err = tr.Query(query, args...)
+func (s *service) QueryWithTr(ctx context.Context, tr *sql.Tx, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	rows, err = tr.QueryContext(ctx, query, args...)
 	if err != nil {
-		s.PrintQuery(query, args...)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "QueryWithTr"))
-		log.Println("QueryWithTr failed")
+		s.PrintQuery(ctx, query, args...)
+		err = fmt.Errorf("%w: %s", err, "QueryWithTr")
+		log.Error(ctx, "QueryWithTr failed", logger.Fields{"err": err, "query": query})
 	}
 	return
 }
 
 // RunQuery executes db queries
-func (s *service) RunQuery(db *sqlx.DB, tr *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+func (s *service) RunQuery(ctx context.Context, db *sqlx.DB, tr *sql.Tx, query string, args ...interface{}) (res sql.Result, err error) {
+	defer func(start time.Time) {
+		metrics.ObserveSince(metrics.DBQueryDuration.WithLabelValues("RunQuery", metrics.Outcome(err)), start)
+	}(time.Now())
 	if tr == nil {
-		return s.ExecuteQuery(db, query, args...)
+		return s.ExecuteQuery(ctx, db, query, args...)
 	}
-	return s.ExecuteTransaction(tr, query, args...)
+	return s.ExecuteTransaction(ctx, tr, query, args...)
 }
 
 // ExecuteQuery runs query without transaction
-func (s *service) ExecuteQuery(db *sqlx.DB, query string, args ...interface{}) (res sql.Result, err error) {
-	res, err = db.Exec(query, args...)
+func (s *service) ExecuteQuery(ctx context.Context, db *sqlx.DB, query string, args ...interface{}) (res sql.Result, err error) {
+	res, err = db.ExecContext(ctx, query, args...)
 	if err != nil {
-		s.PrintQuery(query, args...)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "ExecuteQuery"))
-		log.Println("ExecuteQuery failed")
+		s.PrintQuery(ctx, query, args...)
+		err = fmt.Errorf("%w: %s", err, "ExecuteQuery")
+		log.Error(ctx, "ExecuteQuery failed", logger.Fields{"err": err, "query": query})
 	}
 	return
 }
 
 // ExecuteTransaction runs db transaction
-func (s *service) ExecuteTransaction(tr *sql.Tx, query string, args ...interface{}) (res sql.Result, err error) {
-	res, err = tr.Exec(query, args...)
+func (s *service) ExecuteTransaction(ctx context.Context, tr *sql.Tx, query string, args ...interface{}) (res sql.Result, err error) {
+	res, err = tr.ExecContext(ctx, query, args...)
 	if err != nil {
-		s.PrintQuery(query, args...)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "ExecuteTransaction"))
-		log.Println("ExecuteTransaction failed")
+		s.PrintQuery(ctx, query, args...)
+		err = fmt.Errorf("%w: %s", err, "ExecuteTransaction")
+		log.Error(ctx, "ExecuteTransaction failed", logger.Fields{"err": err, "query": query})
 	}
 	return
 }
 
-// PrintQuery print query that has been executed
-func (s *service) PrintQuery(query string, args ...interface{}) {
-	str := ""
-	if len(args) > 0 {
-		for k, v := range args {
-			str += fmt.Sprintf("%d:%+v ", k+1, v)
-		}
+// PrintQuery logs a query that has been executed, with sensitive arguments redacted
+func (s *service) PrintQuery(ctx context.Context, query string, args ...interface{}) {
+	if !log.Enabled(logger.DebugLevel) {
+		return
 	}
-	fmt.Printf("%s\n", query)
-	if str != "" {
-		fmt.Printf("[%s]\n", str)
+	str := ""
+	for k, v := range logger.RedactArgs(args) {
+		str += fmt.Sprintf("%d:%+v ", k+1, v)
 	}
+	log.Debug(ctx, "query", logger.Fields{"query": query, "args": strings.TrimSpace(str)})
 }
 
 func (s *service) getPwdBytes(password string) []byte {
@@ -129,7 +438,7 @@ func (s *service) getPwdBytes(password string) []byte {
 	return []byte(password)
 }
 
-func (s *service) hashAndSalt(pwd []byte) string {
+func (s *service) hashAndSalt(ctx context.Context, pwd []byte) logger.Secret {
 	// Use GenerateFromPassword to hash & salt pwd.
 	// MinCost is just an integer constant provided by the bcrypt
 	// package along with DefaultCost & MaxCost.
@@ -137,20 +446,20 @@ func (s *service) hashAndSalt(pwd []byte) string {
 	// than the MinCost (4)
 	hash, err := bcrypt.GenerateFromPassword(pwd, bcrypt.MinCost)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(ctx, "unable to hash password", logger.Fields{"err": err})
 	}
 	// GenerateFromPassword returns a byte slice so we need to
-	// convert the bytes to a string and return it
-	return string(hash)
+	// convert the bytes to a string and return it, wrapped so that it is never logged
+	return logger.Secret(hash)
 }
 
-func (s *service) comparePasswords(hashedPwd string, plainPwd []byte) bool {
+func (s *service) comparePasswords(ctx context.Context, hashedPwd string, plainPwd []byte) bool {
 	// Since we'll be getting the hashed password from the DB it
 	// will be a string so we'll need to convert it to a byte slice
 	byteHash := []byte(hashedPwd)
 	err := bcrypt.CompareHashAndPassword(byteHash, plainPwd)
 	if err != nil {
-		log.Println(err)
+		log.Debug(ctx, "password comparison failed", logger.Fields{"err": err})
 		return false
 	}
 
@@ -170,10 +479,12 @@ func (s *service) generateUUID(val1, val2 string) (string, error) {
 }
 
 // CreateUser creates a new user
-func (s *service) CreateUser(userInput *User) (user *User, err error) {
+func (s *service) CreateUser(ctx context.Context, userInput *User) (user *User, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("CreateUser(exit): username:%+v err:%v", userInput.Username, err))
+		log.Outcome(ctx, "CreateUser(exit)", err, logger.Fields{"username": userInput.Username})
 	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	insert := "insert into users(uuid, username, password, deposit, role) select $1, $2, $3, $4, $5"
 
 	uid, err := s.generateUUID(userInput.Username, userInput.Role)
@@ -181,27 +492,30 @@ func (s *service) CreateUser(userInput *User) (user *User, err error) {
 		return
 	}
 
-	var res sql.Result
 	pwd := s.getPwdBytes(userInput.Password)
-	res, err = s.RunQuery(s.db, nil, insert, uid, userInput.Username, s.hashAndSalt(pwd), userInput.Deposit, userInput.Role)
-	if err != nil {
-		return
-	}
-	rowsAffected := int64(0)
-	rowsAffected, err = res.RowsAffected()
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		res, err := s.RunQuery(ctx, s.db, tr, insert, uid, userInput.Username, s.hashAndSalt(ctx, pwd), userInput.Deposit, userInput.Role)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected > 1 {
+			err = fmt.Errorf("user '%+v' insert affected %d rows", &userInput, rowsAffected)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateUser"))
+		} else if rowsAffected == 0 {
+			err = fmt.Errorf("create user '%+v' did not affect any rows", userInput)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateUser"))
+		}
+		created := &User{UUID: uid, Username: userInput.Username, Deposit: userInput.Deposit, Role: userInput.Role}
+		return s.recordEvent(ctx, tr, AggregateUser, uid, EventUserCreated, created)
+	})
 	if err != nil {
 		return
 	}
-	if rowsAffected > 1 {
-		err = fmt.Errorf("user '%+v' insert affected %d rows", &userInput, rowsAffected)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateUser"))
-		return
-	} else if rowsAffected == 0 {
-		err = fmt.Errorf("create user '%+v' did not affect any rows", userInput)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateUser"))
-		return
-	}
-	user, err = s.GetUser(uid)
+	user, err = s.GetUser(ctx, uid)
 	if err != nil {
 		return
 	}
@@ -209,11 +523,14 @@ func (s *service) CreateUser(userInput *User) (user *User, err error) {
 }
 
 // GetUser get user from db
-func (s *service) GetUser(uuid string) (user *User, err error) {
+func (s *service) GetUser(ctx context.Context, uuid string) (user *User, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("GetUser(exit): uuid:%+v err:%v", uuid, err))
+		log.Outcome(ctx, "GetUser(exit)", err, logger.Fields{"uuid": uuid})
 	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	rows, err := s.Query(
+		ctx,
 		s.db,
 		nil,
 		"select uuid, username, deposit, role from users where uuid = $1 limit 1",
@@ -255,11 +572,14 @@ func (s *service) GetUser(uuid string) (user *User, err error) {
 }
 
 // GetUserPasswordByUsername get user credentials from db
-func (s *service) GetUserPasswordByUsername(username string) (user *User, err error) {
+func (s *service) GetUserPasswordByUsername(ctx context.Context, username string) (user *User, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("GetUserPasswordByUsername(exit): uuid:%+v err:%v", username, err))
+		log.Outcome(ctx, "GetUserPasswordByUsername(exit)", err, logger.Fields{"username": username})
 	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	rows, err := s.Query(
+		ctx,
 		s.db,
 		nil,
 		"select uuid, username, password from users where username = $1 limit 1",
@@ -299,30 +619,45 @@ func (s *service) GetUserPasswordByUsername(username string) (user *User, err er
 	return
 }
 
-// UpdateUser update user details
-func (s *service) UpdateUser(userInput *User) (user *User, err error) {
+// UpdateUser update user details, a change of the deposit is recorded as a user.balance_reset event
+func (s *service) UpdateUser(ctx context.Context, userInput *User) (user *User, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("UpdateUser(exit): uuid:%+v err:%v", userInput.UUID, err))
+		log.Outcome(ctx, "UpdateUser(exit)", err, logger.Fields{"uuid": userInput.UUID})
 	}()
-	res, err := s.RunQuery(s.db, nil, "update users set deposit = $1 where uuid = $2", userInput.Deposit, userInput.UUID)
-	if err != nil {
-		return
-	}
-
-	rowsAffected, err := res.RowsAffected()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		rows, err := s.Query(ctx, s.db, tr, "select deposit from users where uuid = $1 for update", userInput.UUID)
+		if err != nil {
+			return err
+		}
+		var previous int
+		found, err := scanOne(rows, &previous)
+		if err != nil {
+			return err
+		}
+		if !found {
+			err = fmt.Errorf("update user '%+v' did not affect any rows", userInput.UUID)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateUser"))
+		}
+		if previous == userInput.Deposit {
+			return nil
+		}
+		if _, err := s.RunQuery(ctx, s.db, tr, "update users set deposit = $1 where uuid = $2", userInput.Deposit, userInput.UUID); err != nil {
+			return err
+		}
+		s.publish(tr, bus.Event{
+			Topic: bus.UserTopic(userInput.UUID),
+			Type:  bus.EventBalance,
+			Data:  &Balance{UserUUID: userInput.UUID, Balance: userInput.Deposit},
+		})
+		reset := &BalanceReset{UserUUID: userInput.UUID, PreviousBalance: previous, Balance: userInput.Deposit}
+		return s.recordEvent(ctx, tr, AggregateUser, userInput.UUID, EventUserBalanceReset, reset)
+	})
 	if err != nil {
 		return
 	}
-	if rowsAffected > 1 {
-		err = fmt.Errorf("user '%+v' insert affected %d rows", &user, rowsAffected)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateUser"))
-		return
-	} else if rowsAffected == 0 {
-		err = fmt.Errorf("update user '%+v' did not affect any rows", user)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateUser"))
-		return
-	}
-	user, err = s.GetUser(userInput.UUID)
+	user, err = s.GetUser(ctx, userInput.UUID)
 	if err != nil {
 		return
 	}
@@ -330,21 +665,23 @@ func (s *service) UpdateUser(userInput *User) (user *User, err error) {
 }
 
 // Login get user from db
-func (s *service) Login(username, password string) (user *User, err error) {
+func (s *service) Login(ctx context.Context, username, password string) (user *User, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("Login(exit): username:%+v  err:%v", username, err))
+		log.Outcome(ctx, "Login(exit)", err, logger.Fields{"username": username})
 	}()
-	user, err = s.GetUserPasswordByUsername(username)
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	user, err = s.GetUserPasswordByUsername(ctx, username)
 	if err != nil {
 		return
 	}
 	plainPwd := s.getPwdBytes(password)
-	pwdMatch := s.comparePasswords(user.Password, plainPwd)
+	pwdMatch := s.comparePasswords(ctx, user.Password, plainPwd)
 	if !pwdMatch {
 		return nil, errors.New("invalid username or password")
 	}
 
-	user, err = s.GetUser(user.UUID)
+	user, err = s.GetUser(ctx, user.UUID)
 	if err != nil {
 		return
 	}
@@ -352,60 +689,111 @@ func (s *service) Login(username, password string) (user *User, err error) {
 	return
 }
 
-// DeleteUser delete user details
-func (s *service) DeleteUser(uuid string) (err error) {
+// DeleteUser delete user details, recording a user.deleted event with the balance the user had left
+func (s *service) DeleteUser(ctx context.Context, uuid string) (err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("DeleteUser(exit): uuid:%+v err:%v", uuid, err))
+		log.Outcome(ctx, "DeleteUser(exit)", err, logger.Fields{"uuid": uuid})
 	}()
-	res, err := s.RunQuery(s.db, nil, "delete from users where uuid = $1", uuid)
-	if err != nil {
-		return
-	}
-
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return
-	}
-	if rowsAffected == 0 {
-		err = fmt.Errorf("delete user '%+v' did not affect any rows", uuid)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "DeleteUser"))
-		return
-	}
-	return
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.inTransaction(ctx, func(tr *sql.Tx) error {
+		rows, err := s.Query(ctx, s.db, tr, "delete from users where uuid = $1 returning uuid, username, deposit, role", uuid)
+		if err != nil {
+			return err
+		}
+		deleted := new(User)
+		found, err := scanOne(rows, &deleted.UUID, &deleted.Username, &deleted.Deposit, &deleted.Role)
+		if err != nil {
+			return err
+		}
+		if !found {
+			err = fmt.Errorf("delete user '%+v' did not affect any rows", uuid)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "DeleteUser"))
+		}
+		return s.recordEvent(ctx, tr, AggregateUser, uuid, EventUserDeleted, deleted)
+	})
 }
 
 // CreateProduct creates a new product
-func (s *service) CreateProduct(pInput *Product) (product *Product, err error) {
+func (s *service) CreateProduct(ctx context.Context, pInput *Product) (product *Product, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("CreateProduct(exit): productData:%+v err:%v", pInput, err))
+		log.Outcome(ctx, "CreateProduct(exit)", err, logger.Fields{"productData": pInput})
 	}()
-	insert := "insert into products(uuid, amount_available, cost, product_name, seller_id) select $1, $2, $3, $4, $5"
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	insert := "insert into products(uuid, amount_available, cost, product_name, seller_id, sku) select $1, $2, $3, $4, $5, $6"
 
 	uid, err := s.generateUUID(pInput.ProductName, pInput.SellerID)
 	if err != nil {
 		return
 	}
 
-	var res sql.Result
-	res, err = s.RunQuery(s.db, nil, insert, uid, pInput.AmountAvailable, pInput.Cost, pInput.ProductName, pInput.SellerID)
+	if pInput.AmountAvailable < 0 {
+		return nil, errors.New("amount available should not be negative")
+	}
+	tags, err := normalizeTags(pInput.Tags)
 	if err != nil {
 		return
 	}
-	rowsAffected := int64(0)
-	rowsAffected, err = res.RowsAffected()
-	if err != nil {
+	if err = validateNutrition(pInput.Nutrition); err != nil {
 		return
 	}
-	if rowsAffected > 1 {
-		err = fmt.Errorf("product '%+v' insert affected %d rows", &pInput, rowsAffected)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateProduct"))
+	if pInput.SKU != "" {
+		if err = validateSKU(pInput.SKU); err != nil {
+			return
+		}
+	}
+	allergens, err := normalizeAllergens(pInput.Allergens)
+	if err != nil {
 		return
-	} else if rowsAffected == 0 {
-		err = fmt.Errorf("create product '%+v' did not affect any rows", pInput)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateProduct"))
+	}
+
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		res, err := s.RunQuery(ctx, s.db, tr, insert, uid, 0, pInput.Cost, pInput.ProductName, pInput.SellerID, nullString(pInput.SKU))
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected > 1 {
+			err = fmt.Errorf("product '%+v' insert affected %d rows", &pInput, rowsAffected)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateProduct"))
+		} else if rowsAffected == 0 {
+			err = fmt.Errorf("create product '%+v' did not affect any rows", pInput)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateProduct"))
+		}
+		if err = s.classifyProduct(ctx, tr, uid, pInput.CategoryUUID, tags); err != nil {
+			return err
+		}
+		if err = s.declareProduct(ctx, tr, uid, pInput.Nutrition, allergens); err != nil {
+			return err
+		}
+		if err = s.refreshSearch(ctx, tr, "p.uuid = $1", uid); err != nil {
+			return err
+		}
+		// the initial stock is the first restock of the product
+		if pInput.AmountAvailable > 0 {
+			err = s.changeProductStock(ctx, tr, uid, pInput.AmountAvailable, MovementRestock, "initial stock", pInput.SellerID)
+			if err != nil {
+				return err
+			}
+		}
+		created := &ProductChange{
+			ProductUUID:     uid,
+			ProductName:     pInput.ProductName,
+			Cost:            pInput.Cost,
+			SellerID:        pInput.SellerID,
+			SKU:             pInput.SKU,
+			AmountAvailable: pInput.AmountAvailable,
+		}
+		return s.recordEvent(ctx, tr, AggregateProduct, uid, EventProductCreated, created)
+	})
+	if err != nil {
 		return
 	}
-	product, err = s.GetProduct(uid)
+	product, err = s.GetProduct(ctx, uid)
 	if err != nil {
 		return
 	}
@@ -413,20 +801,25 @@ func (s *service) CreateProduct(pInput *Product) (product *Product, err error) {
 }
 
 // GetProduct get product from db
-func (s *service) GetProduct(uuid string) (product *Product, err error) {
+func (s *service) GetProduct(ctx context.Context, uuid string) (product *Product, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("GetProduct(exit): uuid:%+v  err:%v", uuid, err))
+		log.Outcome(ctx, "GetProduct(exit)", err, logger.Fields{"uuid": uuid})
 	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	rows, err := s.Query(
+		ctx,
 		s.db,
 		nil,
-		"select uuid, amount_available, cost, product_name, seller_id from products where uuid = $1 limit 1",
+		`select uuid, amount_available, cost, product_name, seller_id, coalesce(category_uuid, ''), coalesce(nutrition, ''),
+		coalesce(sku, '') from products where uuid = $1 limit 1`,
 		uuid,
 	)
 	if err != nil {
 		return
 	}
 	product = new(Product)
+	var nutrition string
 	fetched := false
 	for rows.Next() {
 		err = rows.Scan(
@@ -435,6 +828,9 @@ func (s *service) GetProduct(uuid string) (product *Product, err error) {
 			&product.Cost,
 			&product.ProductName,
 			&product.SellerID,
+			&product.CategoryUUID,
+			&nutrition,
+			&product.SKU,
 		)
 		if err != nil {
 			return
@@ -456,34 +852,49 @@ func (s *service) GetProduct(uuid string) (product *Product, err error) {
 		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "GetProduct"))
 		return
 	}
+	if product.Nutrition, err = parseNutrition(nutrition); err != nil {
+		return
+	}
+	err = s.loadProductDetails(ctx, nil, []*Product{product})
 	return
 }
 
-// UpdateProduct update product details
-func (s *service) UpdateProduct(pInput *Product) (product *Product, err error) {
+// UpdateProduct update product details, the stock only changes through AdjustProductStock and sales
+func (s *service) UpdateProduct(ctx context.Context, pInput *Product) (product *Product, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("UpdateProduct(exit): uuid:%+v err:%v", pInput.UUID, err))
+		log.Outcome(ctx, "UpdateProduct(exit)", err, logger.Fields{"uuid": pInput.UUID})
 	}()
-	res, err := s.RunQuery(s.db, nil, "update products set amount_available = $1, cost = $2, product_name = $3 where uuid = $4",
-		pInput.AmountAvailable, pInput.Cost, pInput.ProductName, pInput.UUID)
-	if err != nil {
-		return
-	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		res, err := s.RunQuery(ctx, s.db, tr, "update products set cost = $1, product_name = $2 where uuid = $3",
+			pInput.Cost, pInput.ProductName, pInput.UUID)
+		if err != nil {
+			return err
+		}
 
-	rowsAffected, err := res.RowsAffected()
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected > 1 {
+			err = fmt.Errorf("product '%+v' insert affected %d rows", &product, rowsAffected)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateProduct"))
+		} else if rowsAffected == 0 {
+			err = fmt.Errorf("update product '%+v' did not affect any rows", pInput)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateProduct"))
+		}
+		// the product is searched under its new name
+		if err = s.refreshSearch(ctx, tr, "p.uuid = $1", pInput.UUID); err != nil {
+			return err
+		}
+		updated := &ProductChange{ProductUUID: pInput.UUID, ProductName: pInput.ProductName, Cost: pInput.Cost}
+		return s.recordEvent(ctx, tr, AggregateProduct, pInput.UUID, EventProductUpdated, updated)
+	})
 	if err != nil {
 		return
 	}
-	if rowsAffected > 1 {
-		err = fmt.Errorf("product '%+v' insert affected %d rows", &product, rowsAffected)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateProduct"))
-		return
-	} else if rowsAffected == 0 {
-		err = fmt.Errorf("update product '%+v' did not affect any rows", pInput)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateProduct"))
-		return
-	}
-	product, err = s.GetProduct(pInput.UUID)
+	product, err = s.GetProduct(ctx, pInput.UUID)
 	if err != nil {
 		return
 	}
@@ -491,48 +902,79 @@ func (s *service) UpdateProduct(pInput *Product) (product *Product, err error) {
 }
 
 // DeleteProduct delete product details
-func (s *service) DeleteProduct(uuid string) (err error) {
+func (s *service) DeleteProduct(ctx context.Context, uuid string) (err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("DeleteProductHandler(exit): uuid:%+v err:%v", uuid, err))
+		log.Outcome(ctx, "DeleteProductHandler(exit)", err, logger.Fields{"uuid": uuid})
 	}()
-	res, err := s.RunQuery(s.db, nil, "delete from products where uuid = $1", uuid)
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	// the image rows go with the product, their blobs are removed once it is deleted
+	images, err := s.GetProductImages(ctx, uuid)
 	if err != nil {
 		return
 	}
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		res, err := s.RunQuery(ctx, s.db, tr, "delete from products where uuid = $1", uuid)
+		if err != nil {
+			return err
+		}
 
-	rowsAffected, err := res.RowsAffected()
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			err = fmt.Errorf("delete product '%+v' did not affect any rows", uuid)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "DeleteProductHandler"))
+		}
+		return s.recordEvent(ctx, tr, AggregateProduct, uuid, EventProductDeleted, &ProductChange{ProductUUID: uuid})
+	})
 	if err != nil {
 		return
 	}
-	if rowsAffected == 0 {
-		err = fmt.Errorf("delete product '%+v' did not affect any rows", uuid)
-		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "DeleteProductHandler"))
-		return
+	for _, img := range images {
+		s.deleteBlobs(ctx, img.blobKey, img.thumbnailKey)
 	}
 	return
 }
 
 // Deposit amount of coins on users account
-func (s *service) Deposit(userUUID string, amount int) (user *User, err error) {
+func (s *service) Deposit(ctx context.Context, userUUID string, amount int) (user *User, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("Deposit(exit): userUUID:%+v amount:%+v err:%v", userUUID, amount, err))
+		log.Outcome(ctx, "Deposit(exit)", err, logger.Fields{"userUUID": userUUID, "amount": amount})
 	}()
-	acceptedDenominations := []int{5, 10, 20, 50, 100}
-	if ok := s.Find(acceptedDenominations, amount); !ok {
-		errString := fmt.Sprintf("[%+v] is not in the acceptable denominations: use one of the following %+v", amount, acceptedDenominations)
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if ok := s.Find(s.denominations, amount); !ok {
+		errString := fmt.Sprintf("[%+v] is not in the acceptable denominations: use one of the following %+v", amount, s.denominations)
 		return nil, errors.New(errString)
 	}
-	user, err = s.GetUser(userUUID)
+	// the balance is added to in place, concurrent deposits cannot overwrite each other
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		rows, err := s.Query(ctx, s.db, tr, "update users set deposit = deposit + $2 where uuid = $1 returning deposit", userUUID, amount)
+		if err != nil {
+			return err
+		}
+		var balance int
+		found, err := scanOne(rows, &balance)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("cannot find user with uuid '%s'", userUUID)
+		}
+		s.publish(tr, bus.Event{Topic: bus.UserTopic(userUUID), Type: bus.EventBalance, Data: &Balance{UserUUID: userUUID, Balance: balance}})
+		deposit := &DepositReceived{UserUUID: userUUID, Amount: amount, Balance: balance}
+		return s.recordEvent(ctx, tr, AggregateUser, userUUID, EventDepositReceived, deposit)
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	user.Deposit = user.Deposit + amount
-
-	user, err = s.UpdateUser(user)
+	user, err = s.GetUser(ctx, userUUID)
 	if err != nil {
 		return nil, err
 	}
+	metrics.Deposits.WithLabelValues(strconv.Itoa(amount)).Inc()
 	return user, nil
 }
 
@@ -546,74 +988,199 @@ func (s *service) Find(slice []int, val int) bool {
 	return false
 }
 
-// Buy buy products
-func (s *service) Buy(userUUID, productUUID string, numberOfProducts int) (buyRes *BuyResponse, err error) {
+// Buy buy products, voucherCode is the optional voucher paying for part of them
+func (s *service) Buy(ctx context.Context, userUUID, productUUID string, numberOfProducts int, voucherCode string) (buyRes *BuyResponse, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("Buy(exit): userUUID:%+v productUUID:%+v numberOfProducts:%+v err:%v", userUUID, productUUID, numberOfProducts, err))
+		log.Outcome(ctx, "Buy(exit)", err, logger.Fields{"userUUID": userUUID, "productUUID": productUUID, "numberOfProducts": numberOfProducts})
 	}()
-	product, err := s.GetProduct(productUUID)
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	basket, err := s.buyBasket(ctx, userUUID, []*BasketItem{{ProductUUID: productUUID, Quantity: numberOfProducts}}, voucherCode)
 	if err != nil {
 		return
 	}
+	buyRes = basket.Items[0]
+	buyRes.Change = basket.Change
+	return buyRes, nil
+}
 
-	if numberOfProducts > product.AmountAvailable {
-		errString := fmt.Sprintf("requested amount %+v is greater than available amout %+v", numberOfProducts, product.AmountAvailable)
-		return nil, errors.New(errString)
+// BuyBasket buys several products at once, paying for them with the user's deposit. The basket is priced
+// as a whole so that bundles apply across its products, voucherCode is the optional voucher paying for part of them
+func (s *service) BuyBasket(ctx context.Context, userUUID string, items []*BasketItem, voucherCode string) (basket *BasketResponse, err error) {
+	defer func() {
+		log.Outcome(ctx, "BuyBasket(exit)", err, logger.Fields{"userUUID": userUUID, "items": len(items), "voucher": voucherCode != ""})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.buyBasket(ctx, userUUID, items, voucherCode)
+}
+
+// buyBasket sells the items of a basket at the prices in force now, the change is returned to the user.
+// The voucher is redeemed in the transaction of the sale, so that it is only used up by a sale that commits
+func (s *service) buyBasket(ctx context.Context, userUUID string, items []*BasketItem, voucherCode string) (basket *BasketResponse, err error) {
+	if err = validateBasket(items); err != nil {
+		return
 	}
-	user, err := s.GetUser(userUUID)
+	lines, products, err := s.basketLines(ctx, items)
 	if err != nil {
-		return nil, err
-	}
-	amountToSpend := numberOfProducts * product.Cost
-	transaction := user.Deposit - amountToSpend
-	if transaction < 0 {
-		errString := fmt.Sprintf("insufficient funds to spend [%+v], available balance is [%+v]", amountToSpend, user.Deposit)
-		return nil, errors.New(errString)
+		metrics.FailedPurchases.WithLabelValues(metrics.ReasonProductNotFound).Inc()
+		return
 	}
 
-	user.Deposit = user.Deposit - amountToSpend
-	change := user.Deposit
-	remainingProducts := product.AmountAvailable - numberOfProducts
-	if remainingProducts < 0 {
-		remainingProducts = 0
+	for _, line := range lines {
+		expired, err := s.expiredStock(ctx, nil, line.ProductUUID, "")
+		if err != nil {
+			return nil, err
+		}
+		if available := products[line.ProductUUID].AmountAvailable - expired[""]; line.Quantity > available {
+			errString := fmt.Sprintf("requested amount %+v is greater than available amout %+v", line.Quantity, available)
+			metrics.FailedPurchases.WithLabelValues(metrics.ReasonInsufficientStock).Inc()
+			return nil, errors.New(errString)
+		}
+	}
+	if _, err = s.GetUser(ctx, userUUID); err != nil {
+		metrics.FailedPurchases.WithLabelValues(metrics.ReasonUserNotFound).Inc()
+		return nil, err
 	}
-	product.AmountAvailable = remainingProducts
-	product, err = s.UpdateProduct(product)
+	quote, err := s.quote(ctx, nil, lines)
 	if err != nil {
 		return
 	}
 
-	// set deposit to 0 since change is going to be returned to the user
-	user.Deposit = 0
-	_, err = s.UpdateUser(user)
+	var change int
+	failReason := metrics.ReasonUpdateFailed
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		var redemption *VoucherRedemption
+		if voucherCode != "" {
+			var err error
+			if redemption, err = s.redeemVoucher(ctx, tr, voucherCode, userUUID, quote, products); err != nil {
+				failReason = metrics.ReasonInvalidVoucher
+				return err
+			}
+		}
+
+		rows, err := s.Query(ctx, s.db, tr, "select deposit from users where uuid = $1 for update", userUUID)
+		if err != nil {
+			return err
+		}
+		var deposit int
+		if _, err = scanOne(rows, &deposit); err != nil {
+			return err
+		}
+		if deposit < quote.Amount {
+			failReason = metrics.ReasonInsufficientFunds
+			return fmt.Errorf("insufficient funds to spend [%+v], available balance is [%+v]", quote.Amount, deposit)
+		}
+		change = deposit - quote.Amount
+
+		basketUUID := uuid.NewV4().String()
+		// the products are locked in the order of their uuids, so that baskets sharing products cannot deadlock
+		lines := append([]*pricing.PricedLine(nil), quote.Lines...)
+		sort.Slice(lines, func(i, j int) bool { return lines[i].ProductUUID < lines[j].ProductUUID })
+		for i, priced := range lines {
+			product := products[priced.ProductUUID]
+			if err = s.changeProductStock(ctx, tr, product.UUID, -priced.Quantity, MovementSale, "", userUUID); err != nil {
+				return err
+			}
+			purchase := &Purchase{
+				UserUUID:    userUUID,
+				ProductUUID: product.UUID,
+				ProductName: product.ProductName,
+				SellerID:    product.SellerID,
+				Quantity:    priced.Quantity,
+				UnitCost:    priced.UnitPrice,
+				AmountSpent: priced.Amount,
+				Discount:    priced.Discount,
+				Promotions:  priced.Promotions,
+				BasketUUID:  basketUUID,
+			}
+			if redemption != nil {
+				purchase.VoucherRedemptionUUID = redemption.UUID
+			}
+			// the change is paid once for the whole basket
+			if i == len(lines)-1 {
+				purchase.Change = change
+			}
+			if err = s.recordPurchase(ctx, tr, purchase); err != nil {
+				return err
+			}
+		}
+
+		// set deposit to 0 since change is going to be returned to the user
+		_, err = s.RunQuery(ctx, s.db, tr, "update users set deposit = 0 where uuid = $1", userUUID)
+		if err != nil {
+			return err
+		}
+		s.publish(tr, bus.Event{Topic: bus.UserTopic(userUUID), Type: bus.EventBalance, Data: &Balance{UserUUID: userUUID}})
+		return nil
+	})
 	if err != nil {
+		metrics.FailedPurchases.WithLabelValues(failReason).Inc()
 		return
 	}
 
-	// TODO: handle change
-	changeSlice := make(map[string]string, 0)
-	acceptedDenominations := []int{5, 10, 20, 50, 100}
-	sort.Slice(acceptedDenominations, func(i, j int) bool {
-		return acceptedDenominations[i] > acceptedDenominations[j]
-	})
-	for _, denomination := range acceptedDenominations {
-		quotient, remainder := s.divisionAndModulus(int64(change), int64(denomination))
+	basket = &BasketResponse{
+		Items:       make([]*BuyResponse, 0, len(quote.Lines)),
+		AmountSpent: quote.Amount,
+		Discount:    quote.Discount,
+		Promotions:  quote.Promotions,
+	}
+	metrics.Purchases.Inc()
+	for _, priced := range quote.Lines {
+		metrics.UnitsSold.WithLabelValues(priced.ProductUUID).Add(float64(priced.Quantity))
+		basket.Items = append(basket.Items, &BuyResponse{
+			ProductUUID:       priced.ProductUUID,
+			AmountSpent:       priced.Amount,
+			ProductName:       products[priced.ProductUUID].ProductName,
+			ProductsPurchased: priced.Quantity,
+			UnitPrice:         priced.UnitPrice,
+			Discount:          priced.Discount,
+			Promotions:        priced.Promotions,
+		})
+	}
+	basket.Change, _, _ = s.makeChange(change, nil)
+	return basket, nil
+}
+
+// makeChange splits amount into coins, from the largest denomination to the smallest.
+// When available is not nil only the coins it holds are used. It returns the change description,
+// the number of coins paid out per denomination and the part of amount that could not be paid out
+func (s *service) makeChange(amount int, available map[int]int) (changeSlice map[string]string, payout map[int]int, remainder int) {
+	payout, remainder = s.planChange(amount, available)
+	return s.describeChange(payout, remainder), payout, remainder
+}
+
+// planChange splits amount into the fewest coins, limited to the coins available when available is not nil
+func (s *service) planChange(amount int, available map[int]int) (payout map[int]int, remainder int) {
+	payout = make(map[int]int)
+	change := amount
+	// denominations are sorted from the largest to the smallest
+	for _, denomination := range s.denominations {
+		quotient, rest := s.divisionAndModulus(int64(change), int64(denomination))
+		if available != nil && quotient > int64(available[denomination]) {
+			quotient = int64(available[denomination])
+			rest = int64(change) - quotient*int64(denomination)
+		}
 		if quotient > 0 {
-			str := fmt.Sprintf("denomination: %+v", denomination)
-			changeSlice[str] = fmt.Sprintf("number of coins: %+v", quotient)
+			payout[denomination] = int(quotient)
 		}
-		change = int(remainder)
-	}
-	if change != 0 {
-		changeSlice["no supported denomination for change: "] = fmt.Sprintf(" %+v", change)
+		change = int(rest)
 	}
+	return payout, change
+}
 
-	return &BuyResponse{
-		AmountSpent:       amountToSpend,
-		ProductName:       product.ProductName,
-		ProductsPurchased: numberOfProducts,
-		Change:            changeSlice,
-	}, nil
+// describeChange lists the coins paid out and what could not be paid
+func (s *service) describeChange(payout map[int]int, remainder int) (changeSlice map[string]string) {
+	changeSlice = make(map[string]string, 0)
+	for denomination, count := range payout {
+		str := fmt.Sprintf("denomination: %+v", denomination)
+		changeSlice[str] = fmt.Sprintf("number of coins: %+v", count)
+	}
+	if remainder != 0 {
+		changeSlice["no supported denomination for change: "] = fmt.Sprintf(" %+v", remainder)
+		metrics.ChangeShortfalls.Inc()
+	}
+	return changeSlice
 }
 
 func (s *service) divisionAndModulus(numerator, denominator int64) (quotient, remainder int64) {
@@ -623,18 +1190,20 @@ func (s *service) divisionAndModulus(numerator, denominator int64) (quotient, re
 }
 
 // Reset resets users deposit
-func (s *service) Reset(userUUID string) (user *User, err error) {
+func (s *service) Reset(ctx context.Context, userUUID string) (user *User, err error) {
 	defer func() {
-		log.Println(fmt.Sprintf("Reset(exit): userUUID:%+v  err:%v", userUUID, err))
+		log.Outcome(ctx, "Reset(exit)", err, logger.Fields{"userUUID": userUUID})
 	}()
-	user, err = s.GetUser(userUUID)
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	user, err = s.GetUser(ctx, userUUID)
 	if err != nil {
 		return
 	}
 
 	user.Deposit = 0
 
-	user, err = s.UpdateUser(user)
+	user, err = s.UpdateUser(ctx, user)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// blockingDriver is a database driver whose statements run until their context ends, like a
+// pg_sleep that never returns on its own
+type blockingDriver struct{}
+
+func (blockingDriver) Open(string) (driver.Conn, error) {
+	return blockingConn{}, nil
+}
+
+type blockingConn struct{}
+
+func (blockingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (blockingConn) Close() error {
+	return nil
+}
+
+func (blockingConn) Begin() (driver.Tx, error) {
+	return blockingTx{}, nil
+}
+
+func (blockingConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return blockingTx{}, nil
+}
+
+func (blockingConn) QueryContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingConn) ExecContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Result, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type blockingTx struct{}
+
+func (blockingTx) Commit() error {
+	return nil
+}
+
+func (blockingTx) Rollback() error {
+	return nil
+}
+
+func init() {
+	sql.Register("blocking", blockingDriver{})
+}
+
+// newBlockingService returns a service over the blocking driver
+func newBlockingService(t *testing.T, statementTimeout time.Duration) *service {
+	t.Helper()
+	conn, err := sql.Open("blocking", "")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return &service{
+		db:               sqlx.NewDb(conn, "postgres"),
+		statementTimeout: statementTimeout,
+		afterCommit:      make(map[*sql.Tx][]func()),
+	}
+}
+
+// cancelAfter returns a context cancelled after d, as a request is once its client goes away
+func cancelAfter(d time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(d, cancel)
+	return ctx
+}
+
+// assertAborted checks that err reports why ctx ended and that the call returned promptly
+func assertAborted(t *testing.T, err, want error, start time.Time) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the query returned after %s, it was not aborted", elapsed)
+	}
+}
+
+func TestCancelledRequestAbortsQuery(t *testing.T) {
+	s := newBlockingService(t, time.Minute)
+	start := time.Now()
+	_, err := s.Query(cancelAfter(50*time.Millisecond), s.db, nil, "select pg_sleep(60)")
+	assertAborted(t, err, context.Canceled, start)
+}
+
+func TestCancelledRequestAbortsStatementInTransaction(t *testing.T) {
+	s := newBlockingService(t, time.Minute)
+	start := time.Now()
+	ctx := cancelAfter(50 * time.Millisecond)
+	committed := false
+	err := s.inTransaction(ctx, func(tr *sql.Tx) error {
+		s.onCommit(tr, func() {
+			committed = true
+		})
+		_, err := s.RunQuery(ctx, s.db, tr, "update users set deposit = deposit + pg_sleep(60)")
+		return err
+	})
+	assertAborted(t, err, context.Canceled, start)
+	if committed {
+		t.Fatal("the aborted transaction ran its commit hooks")
+	}
+}
+
+func TestCancelledRequestAbortsServiceCall(t *testing.T) {
+	s := newBlockingService(t, time.Minute)
+	start := time.Now()
+	_, err := s.GetUser(cancelAfter(50*time.Millisecond), "00000000-0000-0000-0000-000000000000")
+	assertAborted(t, err, context.Canceled, start)
+}
+
+func TestStatementTimeoutAbortsQuery(t *testing.T) {
+	s := newBlockingService(t, 50*time.Millisecond)
+	start := time.Now()
+	_, err := s.GetUser(context.Background(), "00000000-0000-0000-0000-000000000000")
+	assertAborted(t, err, context.DeadlineExceeded, start)
+}
@@ -0,0 +1,317 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/code-sleuth/vending-machine/imaging"
+	"github.com/code-sleuth/vending-machine/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+// validateNutrition checks that the amounts of a nutrition declaration are consistent
+func validateNutrition(n *Nutrition) error {
+	if n == nil {
+		return nil
+	}
+	amounts := map[string]float64{
+		"serving_size": n.ServingSize, "energy_kcal": n.EnergyKcal, "fat": n.Fat, "saturated_fat": n.SaturatedFat,
+		"carbohydrates": n.Carbohydrates, "sugars": n.Sugars, "fibre": n.Fibre, "protein": n.Protein, "salt": n.Salt,
+	}
+	for name, amount := range amounts {
+		if amount < 0 {
+			return fmt.Errorf("%s should not be negative", name)
+		}
+	}
+	if n.SaturatedFat > n.Fat {
+		return errors.New("saturated_fat should not exceed fat")
+	}
+	if n.Sugars > n.Carbohydrates {
+		return errors.New("sugars should not exceed carbohydrates")
+	}
+	return nil
+}
+
+// nutritionJSON encodes a nutrition declaration for the nutrition column, nil when there is none
+func nutritionJSON(n *Nutrition) (interface{}, error) {
+	if n == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// parseNutrition decodes the nutrition column, empty when the product has no declaration
+func parseNutrition(value string) (*Nutrition, error) {
+	if value == "" {
+		return nil, nil
+	}
+	n := new(Nutrition)
+	if err := json.Unmarshal([]byte(value), n); err != nil {
+		return nil, fmt.Errorf("invalid nutrition '%s': %v", value, err)
+	}
+	return n, nil
+}
+
+// normalizeAllergens lowercases, deduplicates and sorts allergens, which must be among Allergens
+func normalizeAllergens(allergens []string) ([]string, error) {
+	seen := make(map[string]bool, len(allergens))
+	normalized := make([]string, 0, len(allergens))
+	for _, allergen := range allergens {
+		allergen = strings.ToLower(strings.TrimSpace(allergen))
+		known := false
+		for _, a := range Allergens {
+			if a == allergen {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown allergen '%s': use one of %s", allergen, strings.Join(Allergens, ", "))
+		}
+		if !seen[allergen] {
+			seen[allergen] = true
+			normalized = append(normalized, allergen)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// setProductAllergens replaces the allergens of a product with allergens, already normalized
+func (s *service) setProductAllergens(ctx context.Context, tr *sql.Tx, productUUID string, allergens []string) error {
+	if _, err := s.RunQuery(ctx, s.db, tr, "delete from product_allergens where product_uuid = $1", productUUID); err != nil {
+		return err
+	}
+	for _, allergen := range allergens {
+		if _, err := s.RunQuery(ctx, s.db, tr, "insert into product_allergens(product_uuid, allergen) values ($1, $2)", productUUID, allergen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// declareProduct sets the nutrition declaration and the normalized allergens of a product
+func (s *service) declareProduct(ctx context.Context, tr *sql.Tx, productUUID string, nutrition *Nutrition, allergens []string) error {
+	value, err := nutritionJSON(nutrition)
+	if err != nil {
+		return err
+	}
+	res, err := s.RunQuery(ctx, s.db, tr, "update products set nutrition = $1 where uuid = $2", value, productUUID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("cannot find product with uuid '%s'", productUUID)
+	}
+	return s.setProductAllergens(ctx, tr, productUUID, allergens)
+}
+
+// SetProductNutrition replaces the nutrition declaration and the allergens of a product
+func (s *service) SetProductNutrition(ctx context.Context, productUUID string, nutrition *Nutrition, allergens []string) (product *Product, err error) {
+	defer func() {
+		log.Outcome(ctx, "SetProductNutrition(exit)", err, logger.Fields{"productUUID": productUUID, "allergens": allergens})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = validateNutrition(nutrition); err != nil {
+		return
+	}
+	if allergens, err = normalizeAllergens(allergens); err != nil {
+		return
+	}
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		return s.declareProduct(ctx, tr, productUUID, nutrition, allergens)
+	})
+	if err != nil {
+		return
+	}
+	return s.GetProduct(ctx, productUUID)
+}
+
+// imageURLs sets the routes an image and its thumbnail are served at
+func imageURLs(img *ProductImage) {
+	img.URL = fmt.Sprintf("/api/products/%s/images/%s", img.ProductUUID, img.UUID)
+	img.ThumbnailURL = img.URL + "?size=thumbnail"
+}
+
+// scanProductImages reads the rows of product_images
+func scanProductImages(rows *sql.Rows) (images []*ProductImage, err error) {
+	defer rows.Close()
+	images = make([]*ProductImage, 0)
+	for rows.Next() {
+		img := new(ProductImage)
+		err = rows.Scan(&img.UUID, &img.ProductUUID, &img.blobKey, &img.thumbnailKey, &img.ContentType,
+			&img.Width, &img.Height, &img.Size, &img.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		imageURLs(img)
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+const productImageColumns = "uuid, product_uuid, blob_key, thumbnail_key, content_type, width, height, size, created_at"
+
+// loadProductImages reads the images of products, the oldest first
+func (s *service) loadProductImages(ctx context.Context, tr *sql.Tx, products []*Product) error {
+	byUUID, condition, args := productsIn(products, "product_uuid")
+	rows, err := s.Query(ctx, s.db, tr,
+		"select "+productImageColumns+" from product_images where "+condition+" order by created_at, uuid", args...)
+	if err != nil {
+		return err
+	}
+	images, err := scanProductImages(rows)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		p := byUUID[img.ProductUUID]
+		p.Images = append(p.Images, img)
+	}
+	return nil
+}
+
+// getProductImage reads an image of a product
+func (s *service) getProductImage(ctx context.Context, productUUID, imageUUID string) (*ProductImage, error) {
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+productImageColumns+" from product_images where uuid = $1 and product_uuid = $2", imageUUID, productUUID)
+	if err != nil {
+		return nil, err
+	}
+	images, err := scanProductImages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("cannot find image with uuid '%s' of product '%s'", imageUUID, productUUID)
+	}
+	return images[0], nil
+}
+
+// deleteBlobs removes blobs, failures are only logged as the rows referencing them are already gone
+func (s *service) deleteBlobs(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			log.Warn(ctx, "unable to delete blob", logger.Fields{"key": key, "err": err})
+		}
+	}
+}
+
+// AddProductImage stores an image of a product with its thumbnail
+func (s *service) AddProductImage(ctx context.Context, productUUID, actorUUID string, data []byte) (img *ProductImage, err error) {
+	defer func() {
+		log.Outcome(ctx, "AddProductImage(exit)", err, logger.Fields{"productUUID": productUUID, "size": len(data)})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	decoded, format, err := imaging.Decode(data)
+	if err != nil {
+		return
+	}
+	thumbnail, err := imaging.EncodeThumbnail(imaging.Thumbnail(decoded, s.thumbnailSize))
+	if err != nil {
+		return
+	}
+	bounds := decoded.Bounds()
+	img = &ProductImage{
+		UUID:        uuid.NewV4().String(),
+		ProductUUID: productUUID,
+		ContentType: imaging.ContentType(format),
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Size:        len(data),
+	}
+	img.blobKey = fmt.Sprintf("products/%s/%s%s", productUUID, img.UUID, imaging.Extension(format))
+	img.thumbnailKey = fmt.Sprintf("products/%s/%s_thumb%s", productUUID, img.UUID, imaging.Extension(imaging.FormatJPEG))
+
+	if err = s.blobs.Put(ctx, img.blobKey, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if err = s.blobs.Put(ctx, img.thumbnailKey, bytes.NewReader(thumbnail)); err != nil {
+		s.deleteBlobs(ctx, img.blobKey)
+		return nil, err
+	}
+	rows, err := s.Query(ctx, s.db, nil,
+		`insert into product_images(uuid, product_uuid, blob_key, thumbnail_key, content_type, width, height, size, created_by)
+		select $1, p.uuid, $3, $4, $5, $6, $7, $8, $9 from products p where p.uuid = $2 returning created_at`,
+		img.UUID, productUUID, img.blobKey, img.thumbnailKey, img.ContentType, img.Width, img.Height, img.Size, nullString(actorUUID))
+	if err == nil {
+		var found bool
+		if found, err = scanOne(rows, &img.CreatedAt); err == nil && !found {
+			err = fmt.Errorf("cannot find product with uuid '%s'", productUUID)
+		}
+	}
+	if err != nil {
+		s.deleteBlobs(ctx, img.blobKey, img.thumbnailKey)
+		return nil, err
+	}
+	imageURLs(img)
+	return img, nil
+}
+
+// GetProductImages lists the images of a product, the oldest first
+func (s *service) GetProductImages(ctx context.Context, productUUID string) (images []*ProductImage, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetProductImages(exit)", err, logger.Fields{"productUUID": productUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+productImageColumns+" from product_images where product_uuid = $1 order by created_at, uuid", productUUID)
+	if err != nil {
+		return
+	}
+	return scanProductImages(rows)
+}
+
+// OpenProductImage opens an image of a product, or its thumbnail, the caller closes it
+func (s *service) OpenProductImage(ctx context.Context, productUUID, imageUUID string, thumbnail bool) (content io.ReadCloser, img *ProductImage, err error) {
+	defer func() {
+		log.Outcome(ctx, "OpenProductImage(exit)", err, logger.Fields{"productUUID": productUUID, "imageUUID": imageUUID, "thumbnail": thumbnail})
+	}()
+	img, err = s.getProductImage(ctx, productUUID, imageUUID)
+	if err != nil {
+		return
+	}
+	key := img.blobKey
+	if thumbnail {
+		key = img.thumbnailKey
+		img.ContentType = imaging.ContentType(imaging.FormatJPEG)
+	}
+	content, err = s.blobs.Get(ctx, key)
+	return
+}
+
+// DeleteProductImage removes an image of a product and its thumbnail
+func (s *service) DeleteProductImage(ctx context.Context, productUUID, imageUUID string) (err error) {
+	defer func() {
+		log.Outcome(ctx, "DeleteProductImage(exit)", err, logger.Fields{"productUUID": productUUID, "imageUUID": imageUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	img, err := s.getProductImage(ctx, productUUID, imageUUID)
+	if err != nil {
+		return
+	}
+	if _, err = s.RunQuery(ctx, s.db, nil, "delete from product_images where uuid = $1", img.UUID); err != nil {
+		return
+	}
+	s.deleteBlobs(ctx, img.blobKey, img.thumbnailKey)
+	return
+}
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+// maxImportRows bounds the rows of a bulk import, larger catalogs are imported in several files
+const maxImportRows = 5000
+
+var skuRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,63}$`)
+
+// errImportRollback rolls back the transaction of an import that must not be written
+var errImportRollback = errors.New("import rolled back")
+
+// validateSKU checks the format of a seller's product reference
+func validateSKU(sku string) error {
+	if !skuRegex.MatchString(sku) {
+		return fmt.Errorf("invalid sku '%s': use up to 64 letters, digits, '.', '_', '/' or '-'", sku)
+	}
+	return nil
+}
+
+// importRow is a validated row of a bulk import
+type importRow struct {
+	*ProductImportRow
+	tags      []string
+	allergens []string
+	// productUUID is the product the row updates, empty when it creates one
+	productUUID string
+	stock       int
+}
+
+// validateImportRow checks a row of a bulk import, returning its normalized tags and allergens
+func validateImportRow(row *ProductImportRow) (tags, allergens []string, err error) {
+	if err = validateSKU(row.SKU); err != nil {
+		return
+	}
+	row.ProductName = strings.TrimSpace(row.ProductName)
+	if row.ProductName == "" {
+		return nil, nil, errors.New("product name should not be empty")
+	}
+	if row.Cost <= 0 {
+		return nil, nil, errors.New("cost should be positive")
+	}
+	if row.AmountAvailable != nil && *row.AmountAvailable < 0 {
+		return nil, nil, errors.New("amount available should not be negative")
+	}
+	if err = validateNutrition(row.Nutrition); err != nil {
+		return
+	}
+	if tags, err = normalizeTags(row.Tags); err != nil {
+		return
+	}
+	allergens, err = normalizeAllergens(row.Allergens)
+	return
+}
+
+// ImportProducts creates, and in upsert mode updates, the products of a seller from rows in a single
+// transaction. Rows failing validation are reported in the result and then nothing is written, as for
+// a dry run, which performs the whole import before rolling it back
+func (s *service) ImportProducts(ctx context.Context, sellerID, actorUUID, mode string, rows []*ProductImportRow, dryRun bool) (result *ImportResult, err error) {
+	defer func() {
+		log.Outcome(ctx, "ImportProducts(exit)", err, logger.Fields{"sellerID": sellerID, "mode": mode, "rows": len(rows), "dryRun": dryRun})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if mode == "" {
+		mode = ImportInsert
+	}
+	if mode != ImportInsert && mode != ImportUpsert {
+		return nil, fmt.Errorf("invalid import mode '%s': use %s or %s", mode, ImportInsert, ImportUpsert)
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no products to import")
+	}
+	if len(rows) > maxImportRows {
+		return nil, fmt.Errorf("import of %d products exceeds the limit of %d, split it in several files", len(rows), maxImportRows)
+	}
+
+	result = &ImportResult{
+		DryRun:   dryRun,
+		Mode:     mode,
+		Rows:     len(rows),
+		Products: make([]*ImportedProduct, 0, len(rows)),
+		Errors:   make([]*ImportError, 0),
+	}
+	reject := func(row *ProductImportRow, err error) {
+		result.Errors = append(result.Errors, &ImportError{Line: row.Line, SKU: row.SKU, Error: err.Error()})
+	}
+	valid := make([]*importRow, 0, len(rows))
+	lines := make(map[string]int, len(rows))
+	for _, row := range rows {
+		tags, allergens, err := validateImportRow(row)
+		if err != nil {
+			reject(row, err)
+			continue
+		}
+		if line, ok := lines[row.SKU]; ok {
+			reject(row, fmt.Errorf("duplicate sku '%s', already on line %d", row.SKU, line))
+			continue
+		}
+		lines[row.SKU] = row.Line
+		valid = append(valid, &importRow{ProductImportRow: row, tags: tags, allergens: allergens})
+	}
+
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if err := s.resolveImportRows(ctx, tr, sellerID, mode, valid, reject); err != nil {
+			return err
+		}
+		if len(result.Errors) > 0 {
+			return errImportRollback
+		}
+		for _, row := range valid {
+			imported, err := s.importProduct(ctx, tr, sellerID, actorUUID, row)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", row.Line, err)
+			}
+			if imported.Action == "created" {
+				result.Created++
+			} else {
+				result.Updated++
+			}
+			result.Products = append(result.Products, imported)
+		}
+		if err := s.refreshSearch(ctx, tr, "p.seller_id = $1", sellerID); err != nil {
+			return err
+		}
+		if dryRun {
+			return errImportRollback
+		}
+		return nil
+	})
+	if err == errImportRollback {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Errors) > 0 {
+		sort.SliceStable(result.Errors, func(i, j int) bool { return result.Errors[i].Line < result.Errors[j].Line })
+	}
+	return result, nil
+}
+
+// resolveImportRows finds the product each row updates, locking it, and rejects the rows conflicting with
+// existing products or naming a missing category
+func (s *service) resolveImportRows(ctx context.Context, tr *sql.Tx, sellerID, mode string, rows []*importRow, reject func(*ProductImportRow, error)) error {
+	categories := make(map[string]error)
+	// imported holds the line of the products created or given a sku by the import
+	imported := make(map[string]int)
+	for _, row := range rows {
+		if row.CategoryUUID != "" {
+			checked, ok := categories[row.CategoryUUID]
+			if !ok {
+				checked = s.checkCategory(ctx, tr, row.CategoryUUID)
+				categories[row.CategoryUUID] = checked
+			}
+			if checked != nil {
+				reject(row.ProductImportRow, checked)
+				continue
+			}
+		}
+
+		found, _, err := s.lockImportProduct(ctx, tr, "seller_id = $1 and sku = $2", row, sellerID, row.SKU)
+		if err != nil {
+			return err
+		}
+		if found {
+			if mode != ImportUpsert {
+				reject(row.ProductImportRow, fmt.Errorf("sku '%s' is already used by product '%s', import in %s mode to update it", row.SKU, row.productUUID, ImportUpsert))
+			}
+			continue
+		}
+
+		// a new product takes the uuid of its name, which an existing product without sku may already have
+		uid, err := s.generateUUID(row.ProductName, sellerID)
+		if err != nil {
+			return err
+		}
+		if line, ok := imported[uid]; ok {
+			reject(row.ProductImportRow, fmt.Errorf("product '%s' is already imported on line %d", row.ProductName, line))
+			continue
+		}
+		found, sku, err := s.lockImportProduct(ctx, tr, "uuid = $1", row, uid)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !found:
+			imported[uid] = row.Line
+		case sku != "":
+			row.productUUID = ""
+			reject(row.ProductImportRow, fmt.Errorf("product '%s' already exists with sku '%s'", row.ProductName, sku))
+		case mode != ImportUpsert:
+			row.productUUID = ""
+			reject(row.ProductImportRow, fmt.Errorf("product '%s' already exists without sku, import in %s mode to give it one", row.ProductName, ImportUpsert))
+		default:
+			imported[uid] = row.Line
+		}
+	}
+	return nil
+}
+
+// lockImportProduct locks the product matching condition, setting it and its stock on row when found,
+// and returns its sku
+func (s *service) lockImportProduct(ctx context.Context, tr *sql.Tx, condition string, row *importRow, args ...interface{}) (found bool, sku string, err error) {
+	rows, err := s.Query(ctx, s.db, tr, "select uuid, amount_available, coalesce(sku, '') from products where "+condition+" for update", args...)
+	if err != nil {
+		return
+	}
+	found, err = scanOne(rows, &row.productUUID, &row.stock, &sku)
+	return
+}
+
+// importProduct writes a resolved row of a bulk import
+func (s *service) importProduct(ctx context.Context, tr *sql.Tx, sellerID, actorUUID string, row *importRow) (*ImportedProduct, error) {
+	imported := &ImportedProduct{Line: row.Line, SKU: row.SKU, ProductUUID: row.productUUID, Action: "updated"}
+	if row.productUUID == "" {
+		uid, err := s.generateUUID(row.ProductName, sellerID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.RunQuery(ctx, s.db, tr,
+			"insert into products(uuid, amount_available, cost, product_name, seller_id, sku) values ($1, 0, $2, $3, $4, $5)",
+			uid, row.Cost, row.ProductName, sellerID, row.SKU)
+		if err != nil {
+			return nil, err
+		}
+		imported.ProductUUID, imported.Action = uid, "created"
+	} else {
+		_, err := s.RunQuery(ctx, s.db, tr, "update products set sku = $1, cost = $2, product_name = $3 where uuid = $4",
+			row.SKU, row.Cost, row.ProductName, row.productUUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.classifyProduct(ctx, tr, imported.ProductUUID, row.CategoryUUID, row.tags); err != nil {
+		return nil, err
+	}
+	// a known product keeps its nutrition declaration when the row has none
+	if row.Nutrition != nil || imported.Action == "created" {
+		if err := s.declareProduct(ctx, tr, imported.ProductUUID, row.Nutrition, row.allergens); err != nil {
+			return nil, err
+		}
+	} else if err := s.setProductAllergens(ctx, tr, imported.ProductUUID, row.allergens); err != nil {
+		return nil, err
+	}
+
+	if row.AmountAvailable == nil {
+		return imported, nil
+	}
+	switch change := *row.AmountAvailable - row.stock; {
+	case change == 0:
+	case imported.Action == "created":
+		// the imported stock is the first restock of the product
+		if err := s.changeProductStock(ctx, tr, imported.ProductUUID, change, MovementRestock, "initial stock", actorUUID); err != nil {
+			return nil, err
+		}
+	default:
+		if err := s.changeProductStock(ctx, tr, imported.ProductUUID, change, MovementCountCorrection, "bulk import", actorUUID); err != nil {
+			return nil, err
+		}
+	}
+	return imported, nil
+}
+
+// ExportProducts lists the products of a seller as import rows, by sku
+func (s *service) ExportProducts(ctx context.Context, sellerID string) (rows []*ProductImportRow, err error) {
+	defer func() {
+		log.Outcome(ctx, "ExportProducts(exit)", err, logger.Fields{"sellerID": sellerID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	result, err := s.Query(ctx, s.db, nil,
+		"select "+productColumns+" from products p where p.seller_id = $1 order by coalesce(p.sku, ''), p.product_name, p.uuid", sellerID)
+	if err != nil {
+		return
+	}
+	products, err := scanProducts(result, nil)
+	if err != nil {
+		return
+	}
+	if err = s.loadProductDetails(ctx, nil, products); err != nil {
+		return
+	}
+	rows = make([]*ProductImportRow, 0, len(products))
+	for i, p := range products {
+		amount := p.AmountAvailable
+		rows = append(rows, &ProductImportRow{
+			Line:            i + 1,
+			SKU:             p.SKU,
+			ProductName:     p.ProductName,
+			Cost:            p.Cost,
+			AmountAvailable: &amount,
+			CategoryUUID:    p.CategoryUUID,
+			Tags:            p.Tags,
+			Allergens:       p.Allergens,
+			Nutrition:       p.Nutrition,
+		})
+	}
+	return rows, nil
+}
@@ -0,0 +1,212 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/code-sleuth/vending-machine/bus"
+	"github.com/code-sleuth/vending-machine/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+// defaultHistoryLimit bounds the movements returned by a stock history query
+const defaultHistoryLimit = 100
+
+// validateAdjustment checks that the sign of a manual stock change matches its reason
+func validateAdjustment(adjustment *StockAdjustment) error {
+	switch adjustment.Reason {
+	case MovementRestock:
+		if adjustment.Change <= 0 {
+			return errors.New("a restock should add stock, use a positive change")
+		}
+	case MovementSpoilage, MovementTheft:
+		if adjustment.Change >= 0 {
+			return fmt.Errorf("%s should remove stock, use a negative change", adjustment.Reason)
+		}
+	case MovementCountCorrection:
+		if adjustment.Change == 0 {
+			return errors.New("a count correction should change the stock")
+		}
+	default:
+		return fmt.Errorf("invalid reason '%s': use one of %s, %s, %s, %s", adjustment.Reason,
+			MovementRestock, MovementSpoilage, MovementTheft, MovementCountCorrection)
+	}
+	if adjustment.Reason != MovementRestock && (adjustment.ExpiresAt != nil || adjustment.Lot != "") {
+		return errors.New("only a restock can receive a batch with an expiry date")
+	}
+	return validateBatch(adjustment.Lot, adjustment.ExpiresAt)
+}
+
+// recordMovement stores a change of stock
+func (s *service) recordMovement(ctx context.Context, tr *sql.Tx, m *InventoryMovement) (err error) {
+	m.UUID = uuid.NewV4().String()
+	insert := `insert into inventory_movements(uuid, product_uuid, machine_uuid, slot_code, change, balance, reason, note, actor_uuid)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		returning created_at`
+	rows, err := s.Query(ctx, s.db, tr, insert, m.UUID, m.ProductUUID, nullString(m.MachineUUID), nullString(m.SlotCode),
+		m.Change, m.Balance, m.Reason, nullString(m.Note), nullString(m.ActorUUID))
+	if err != nil {
+		return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "recordMovement"))
+	}
+	_, err = scanOne(rows, &m.CreatedAt)
+	return
+}
+
+// changeProductStock adds change, negative to remove stock, to the stock of a product and records why
+func (s *service) changeProductStock(ctx context.Context, tr *sql.Tx, productUUID string, change int, reason, note, actorUUID string) (err error) {
+	rows, err := s.Query(ctx, s.db, tr, "select amount_available from products where uuid = $1 for update", productUUID)
+	if err != nil {
+		return
+	}
+	var amount int
+	found, err := scanOne(rows, &amount)
+	if err != nil {
+		return
+	}
+	if !found {
+		return fmt.Errorf("cannot find product with uuid '%s'", productUUID)
+	}
+	if amount+change < 0 {
+		return fmt.Errorf("cannot remove %d units, only %d available", -change, amount)
+	}
+	if err = s.moveBatches(ctx, tr, productUUID, "", "", amount, change, reason); err != nil {
+		return
+	}
+	_, err = s.RunQuery(ctx, s.db, tr, "update products set amount_available = $1 where uuid = $2", amount+change, productUUID)
+	if err != nil {
+		return
+	}
+	err = s.recordMovement(ctx, tr, &InventoryMovement{
+		ProductUUID: productUUID,
+		Change:      change,
+		Balance:     amount + change,
+		Reason:      reason,
+		Note:        note,
+		ActorUUID:   actorUUID,
+	})
+	if err != nil {
+		return
+	}
+	s.publish(tr, bus.Event{
+		Topic: bus.ProductTopic(productUUID),
+		Type:  bus.EventStock,
+		Data:  &StockLevel{ProductUUID: productUUID, Stock: amount + change},
+	})
+	return s.checkStockLevel(ctx, tr, "", productUUID, amount, amount+change)
+}
+
+// moveSlotStock adds change, negative to remove units, to a slot holding productUUID and records why.
+// Added units are capped to the capacity of the slot, the number of units actually moved is returned
+// and nothing moves when the slot holds another product
+func (s *service) moveSlotStock(ctx context.Context, tr *sql.Tx, machineUUID, code, productUUID string, change int, reason, actorUUID string) (moved int, err error) {
+	slot, err := s.getSlot(ctx, tr, machineUUID, code, true)
+	if err != nil {
+		return 0, err
+	}
+	if slot.ProductUUID != productUUID {
+		return 0, nil
+	}
+	amount := slot.Amount + change
+	if amount > slot.Capacity {
+		amount = slot.Capacity
+	}
+	if amount < 0 {
+		return 0, fmt.Errorf("cannot take %d units out of slot '%s', it holds %d", -change, code, slot.Amount)
+	}
+	moved = amount - slot.Amount
+	if moved == 0 {
+		return 0, nil
+	}
+	if err = s.moveBatches(ctx, tr, productUUID, machineUUID, code, slot.Amount, moved, reason); err != nil {
+		return 0, err
+	}
+	_, err = s.RunQuery(ctx, s.db, tr, "update machine_slots set amount = $1 where machine_uuid = $2 and code = $3", amount, machineUUID, code)
+	if err != nil {
+		return 0, err
+	}
+	err = s.recordMovement(ctx, tr, &InventoryMovement{
+		ProductUUID: productUUID,
+		MachineUUID: machineUUID,
+		SlotCode:    code,
+		Change:      moved,
+		Balance:     amount,
+		Reason:      reason,
+		ActorUUID:   actorUUID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.publish(tr, bus.Event{
+		Topic: bus.ProductTopic(productUUID),
+		Type:  bus.EventStock,
+		Key:   machineUUID + "/" + code,
+		Data:  &StockLevel{ProductUUID: productUUID, MachineUUID: machineUUID, SlotCode: code, Stock: amount},
+	})
+	return moved, s.checkMachineStock(ctx, tr, machineUUID, productUUID, moved)
+}
+
+// AdjustProductStock changes the stock of a product for one of the manual reasons: restock, spoilage,
+// theft or count correction. A restock with an expiry date is received as a batch
+func (s *service) AdjustProductStock(ctx context.Context, productUUID, actorUUID string, adjustment *StockAdjustment) (product *Product, err error) {
+	defer func() {
+		log.Outcome(ctx, "AdjustProductStock(exit)", err, logger.Fields{"productUUID": productUUID, "actorUUID": actorUUID, "reason": adjustment.Reason, "change": adjustment.Change})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = validateAdjustment(adjustment); err != nil {
+		return
+	}
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		err := s.changeProductStock(ctx, tr, productUUID, adjustment.Change, adjustment.Reason, adjustment.Note, actorUUID)
+		if err != nil || adjustment.ExpiresAt == nil {
+			return err
+		}
+		return s.addBatch(ctx, tr, &Batch{
+			ProductUUID: productUUID,
+			Lot:         adjustment.Lot,
+			Quantity:    adjustment.Change,
+			ExpiresAt:   *adjustment.ExpiresAt,
+		}, actorUUID)
+	})
+	if err != nil {
+		return
+	}
+	return s.GetProduct(ctx, productUUID)
+}
+
+// GetStockHistory lists the latest stock movements of a product, optionally in one machine
+func (s *service) GetStockHistory(ctx context.Context, productUUID, machineUUID string, limit int) (movements []*InventoryMovement, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetStockHistory(exit)", err, logger.Fields{"productUUID": productUUID, "machineUUID": machineUUID, "limit": limit})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	rows, err := s.Query(ctx, s.db, nil,
+		`select uuid, product_uuid, coalesce(machine_uuid, ''), coalesce(slot_code, ''), change, balance, reason,
+		coalesce(note, ''), coalesce(actor_uuid, ''), created_at
+		from inventory_movements
+		where product_uuid = $1 and ($2 = '' or machine_uuid = $2)
+		order by created_at desc, uuid limit $3`,
+		productUUID, machineUUID, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	movements = make([]*InventoryMovement, 0)
+	for rows.Next() {
+		m := new(InventoryMovement)
+		err = rows.Scan(&m.UUID, &m.ProductUUID, &m.MachineUUID, &m.SlotCode, &m.Change, &m.Balance, &m.Reason,
+			&m.Note, &m.ActorUUID, &m.CreatedAt)
+		if err != nil {
+			return
+		}
+		movements = append(movements, m)
+	}
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,814 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/code-sleuth/vending-machine/bus"
+	"github.com/code-sleuth/vending-machine/device"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/metrics"
+	"github.com/code-sleuth/vending-machine/pricing"
+	uuid "github.com/satori/go.uuid"
+)
+
+var currencyRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// validateMachine checks the editable fields of a machine
+func validateMachine(m *Machine) error {
+	if strings.TrimSpace(m.Location) == "" {
+		return errors.New("machine location should not be empty")
+	}
+	switch m.Status {
+	case MachineActive, MachineInactive, MachineMaintenance:
+	default:
+		return fmt.Errorf("invalid machine status '%s': use one of %s, %s, %s", m.Status, MachineActive, MachineInactive, MachineMaintenance)
+	}
+	if !currencyRegex.MatchString(m.Currency) {
+		return fmt.Errorf("invalid currency '%s': use a three letter ISO 4217 code", m.Currency)
+	}
+	return nil
+}
+
+// CreateMachine registers a new machine
+func (s *service) CreateMachine(ctx context.Context, mInput *Machine) (machine *Machine, err error) {
+	defer func() {
+		log.Outcome(ctx, "CreateMachine(exit)", err, logger.Fields{"machineData": mInput})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if mInput.Status == "" {
+		mInput.Status = MachineActive
+	}
+	mInput.Currency = strings.ToUpper(mInput.Currency)
+	if err = validateMachine(mInput); err != nil {
+		return
+	}
+
+	uid := uuid.NewV4().String()
+	_, err = s.RunQuery(ctx, s.db, nil, "insert into machines(uuid, location, status, currency) select $1, $2, $3, $4",
+		uid, mInput.Location, mInput.Status, mInput.Currency)
+	if err != nil {
+		return
+	}
+	return s.GetMachine(ctx, uid)
+}
+
+// GetMachine get machine from db
+func (s *service) GetMachine(ctx context.Context, uuid string) (machine *Machine, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetMachine(exit)", err, logger.Fields{"uuid": uuid})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.getMachine(ctx, nil, uuid, false)
+}
+
+// getMachine reads a machine, locking its row for the rest of tr when forUpdate is set
+func (s *service) getMachine(ctx context.Context, tr *sql.Tx, uuid string, forUpdate bool) (machine *Machine, err error) {
+	query := "select uuid, location, status, currency from machines where uuid = $1 limit 1"
+	if forUpdate {
+		query += " for update"
+	}
+	rows, err := s.Query(ctx, s.db, tr, query, uuid)
+	if err != nil {
+		return
+	}
+	machine = new(Machine)
+	found, err := scanOne(rows, &machine.UUID, &machine.Location, &machine.Status, &machine.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		err = fmt.Errorf("cannot find machine with uuid '%s'", uuid)
+		return nil, errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "GetMachine"))
+	}
+	return machine, nil
+}
+
+// GetMachines lists all machines of the fleet
+func (s *service) GetMachines(ctx context.Context) (machines []*Machine, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetMachines(exit)", err, nil)
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil, "select uuid, location, status, currency from machines order by location, uuid")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	machines = make([]*Machine, 0)
+	for rows.Next() {
+		machine := new(Machine)
+		err = rows.Scan(&machine.UUID, &machine.Location, &machine.Status, &machine.Currency)
+		if err != nil {
+			return
+		}
+		machines = append(machines, machine)
+	}
+	err = rows.Err()
+	return
+}
+
+// UpdateMachine update machine details
+func (s *service) UpdateMachine(ctx context.Context, mInput *Machine) (machine *Machine, err error) {
+	defer func() {
+		log.Outcome(ctx, "UpdateMachine(exit)", err, logger.Fields{"uuid": mInput.UUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	mInput.Currency = strings.ToUpper(mInput.Currency)
+	if err = validateMachine(mInput); err != nil {
+		return
+	}
+	res, err := s.RunQuery(ctx, s.db, nil, "update machines set location = $1, status = $2, currency = $3 where uuid = $4",
+		mInput.Location, mInput.Status, mInput.Currency, mInput.UUID)
+	if err != nil {
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowsAffected == 0 {
+		err = fmt.Errorf("update machine '%+v' did not affect any rows", mInput.UUID)
+		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateMachine"))
+		return
+	}
+	s.publish(nil, bus.Event{
+		Topic: bus.MachineTopic(mInput.UUID),
+		Type:  bus.EventMachineStatus,
+		Data:  &MachineState{MachineUUID: mInput.UUID, Status: mInput.Status},
+	})
+	return s.GetMachine(ctx, mInput.UUID)
+}
+
+// DeleteMachine removes an emptied machine. A machine still holding credit, pending reservations, coins
+// or stock is refused: the credit has to be paid out, the reservations settled, the coin box collected
+// and the slots unloaded first. Its purchases, reservations and ledgers are kept without it
+func (s *service) DeleteMachine(ctx context.Context, uuid string) (err error) {
+	defer func() {
+		log.Outcome(ctx, "DeleteMachine(exit)", err, logger.Fields{"uuid": uuid})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.inTransaction(ctx, func(tr *sql.Tx) error {
+		// no credit, reservation or stock can be added to the machine once it is locked
+		if _, err := s.getMachine(ctx, tr, uuid, true); err != nil {
+			return err
+		}
+		if err := s.checkMachineEmpty(ctx, tr, uuid); err != nil {
+			return err
+		}
+		res, err := s.RunQuery(ctx, s.db, tr, "delete from machines where uuid = $1", uuid)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			err = fmt.Errorf("delete machine '%+v' did not affect any rows", uuid)
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "DeleteMachine"))
+		}
+		return nil
+	})
+}
+
+// checkMachineEmpty fails when a machine holds customer credit, pending reservations, coins or stock,
+// locking what it holds until tr ends
+func (s *service) checkMachineEmpty(ctx context.Context, tr *sql.Tx, machineUUID string) error {
+	rows, err := s.Query(ctx, s.db, tr,
+		`select
+			(select coalesce(sum(deposit), 0) from (select deposit from machine_credits where machine_uuid = $1 for update) c),
+			(select count(*) from (select uuid from reservations where machine_uuid = $1 and status = $2 for update) r),
+			(select coalesce(sum(count), 0) from (select count from machine_coins where machine_uuid = $1 for update) m),
+			(select coalesce(sum(amount), 0) from (select amount from machine_slots where machine_uuid = $1 for update) sl)`,
+		machineUUID, ReservationPending)
+	if err != nil {
+		return err
+	}
+	var credit, pending, coins, stock int
+	if _, err := scanOne(rows, &credit, &pending, &coins, &stock); err != nil {
+		return err
+	}
+	held := make([]string, 0, 4)
+	if credit > 0 {
+		held = append(held, fmt.Sprintf("%d of customer credit to pay out", credit))
+	}
+	if pending > 0 {
+		held = append(held, fmt.Sprintf("%d pending reservations to settle", pending))
+	}
+	if coins > 0 {
+		held = append(held, fmt.Sprintf("%d coins to collect", coins))
+	}
+	if stock > 0 {
+		held = append(held, fmt.Sprintf("%d units of stock to unload", stock))
+	}
+	if len(held) > 0 {
+		return fmt.Errorf("machine '%s' still holds %s", machineUUID, strings.Join(held, ", "))
+	}
+	return nil
+}
+
+// GetMachineProducts lists the products stocked in a machine with the units available across its slots
+func (s *service) GetMachineProducts(ctx context.Context, machineUUID string) (products []*MachineProduct, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetMachineProducts(exit)", err, logger.Fields{"machineUUID": machineUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.getMachine(ctx, nil, machineUUID, false); err != nil {
+		return
+	}
+	rows, err := s.Query(ctx, s.db, nil,
+		`select ms.machine_uuid, ms.product_uuid, p.product_name, p.cost, p.seller_id, sum(ms.amount)
+		from machine_slots ms join products p on p.uuid = ms.product_uuid
+		where ms.machine_uuid = $1
+		group by ms.machine_uuid, ms.product_uuid, p.product_name, p.cost, p.seller_id
+		order by p.product_name`,
+		machineUUID,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	products = make([]*MachineProduct, 0)
+	for rows.Next() {
+		product := new(MachineProduct)
+		err = rows.Scan(&product.MachineUUID, &product.ProductUUID, &product.ProductName, &product.Cost, &product.SellerID, &product.AmountAvailable)
+		if err != nil {
+			return
+		}
+		products = append(products, product)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetMachineCoins lists the coins held in a machine's coin box
+func (s *service) GetMachineCoins(ctx context.Context, machineUUID string) (coins []*CoinCount, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetMachineCoins(exit)", err, logger.Fields{"machineUUID": machineUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.getMachine(ctx, nil, machineUUID, false); err != nil {
+		return
+	}
+	available, err := s.getMachineCoins(ctx, nil, machineUUID, false)
+	if err != nil {
+		return
+	}
+	coins = make([]*CoinCount, 0, len(s.denominations))
+	for _, denomination := range s.denominations {
+		coins = append(coins, &CoinCount{Denomination: denomination, Count: available[denomination]})
+	}
+	return
+}
+
+// getMachineCoins reads the coin box of a machine as counts per denomination
+func (s *service) getMachineCoins(ctx context.Context, tr *sql.Tx, machineUUID string, forUpdate bool) (coins map[int]int, err error) {
+	query := "select denomination, count from machine_coins where machine_uuid = $1"
+	if forUpdate {
+		query += " for update"
+	}
+	rows, err := s.Query(ctx, s.db, tr, query, machineUUID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	coins = make(map[int]int)
+	for rows.Next() {
+		var denomination, count int
+		if err = rows.Scan(&denomination, &count); err != nil {
+			return
+		}
+		coins[denomination] = count
+	}
+	err = rows.Err()
+	return
+}
+
+// addMachineCoins adds (or with a negative count removes) coins of a denomination to a machine's coin box
+// and records why, collectionUUID is the cash collection emptying the box
+func (s *service) addMachineCoins(ctx context.Context, tr *sql.Tx, machineUUID string, denomination, count int, reason, collectionUUID string) (err error) {
+	upsert := `insert into machine_coins(machine_uuid, denomination, count) values ($1, $2, $3)
+		on conflict (machine_uuid, denomination) do update set count = machine_coins.count + excluded.count`
+	if _, err = s.RunQuery(ctx, s.db, tr, upsert, machineUUID, denomination, count); err != nil {
+		return
+	}
+	_, err = s.RunQuery(ctx, s.db, tr,
+		"insert into coin_movements(uuid, machine_uuid, denomination, change, reason, collection_uuid) values ($1, $2, $3, $4, $5, $6)",
+		uuid.NewV4().String(), machineUUID, denomination, count, reason, nullString(collectionUUID))
+	return
+}
+
+// GetMachineCredit returns the amount a user has deposited into a machine
+func (s *service) GetMachineCredit(ctx context.Context, machineUUID, userUUID string) (credit *MachineCredit, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetMachineCredit(exit)", err, logger.Fields{"machineUUID": machineUUID, "userUUID": userUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.getMachine(ctx, nil, machineUUID, false); err != nil {
+		return
+	}
+	return s.getMachineCredit(ctx, nil, machineUUID, userUUID, false)
+}
+
+// getMachineCredit reads a user's credit in a machine, a missing row is a zero credit
+func (s *service) getMachineCredit(ctx context.Context, tr *sql.Tx, machineUUID, userUUID string, forUpdate bool) (credit *MachineCredit, err error) {
+	query := "select deposit from machine_credits where machine_uuid = $1 and user_uuid = $2 limit 1"
+	if forUpdate {
+		query += " for update"
+	}
+	rows, err := s.Query(ctx, s.db, tr, query, machineUUID, userUUID)
+	if err != nil {
+		return
+	}
+	credit = &MachineCredit{MachineUUID: machineUUID, UserUUID: userUUID}
+	if _, err = scanOne(rows, &credit.Deposit); err != nil {
+		return nil, err
+	}
+	return credit, nil
+}
+
+// setMachineCredit stores a user's credit in a machine
+func (s *service) setMachineCredit(ctx context.Context, tr *sql.Tx, machineUUID, userUUID string, deposit int) (err error) {
+	upsert := `insert into machine_credits(machine_uuid, user_uuid, deposit) values ($1, $2, $3)
+		on conflict (machine_uuid, user_uuid) do update set deposit = excluded.deposit`
+	_, err = s.RunQuery(ctx, s.db, tr, upsert, machineUUID, userUUID, deposit)
+	if err != nil {
+		return
+	}
+	s.publish(tr, bus.Event{
+		Topic: bus.UserTopic(userUUID),
+		Type:  bus.EventBalance,
+		Key:   machineUUID,
+		Data:  &Balance{UserUUID: userUUID, MachineUUID: machineUUID, Balance: deposit},
+	})
+	return
+}
+
+// activeMachine locks a machine for the rest of tr and checks that it accepts coins and sales
+func (s *service) activeMachine(ctx context.Context, tr *sql.Tx, machineUUID string) (machine *Machine, err error) {
+	machine, err = s.getMachine(ctx, tr, machineUUID, true)
+	if err != nil {
+		return nil, err
+	}
+	if machine.Status != MachineActive {
+		return nil, fmt.Errorf("machine '%s' is %s", machineUUID, machine.Status)
+	}
+	return machine, nil
+}
+
+// MachineDeposit inserts a coin into a machine on behalf of a user
+func (s *service) MachineDeposit(ctx context.Context, machineUUID, userUUID string, amount int) (credit *MachineCredit, err error) {
+	defer func() {
+		log.Outcome(ctx, "MachineDeposit(exit)", err, logger.Fields{"machineUUID": machineUUID, "userUUID": userUUID, "amount": amount})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.GetUser(ctx, userUUID); err != nil {
+		return
+	}
+	devices, err := s.machineDevices(machineUUID)
+	if err != nil {
+		return
+	}
+	if devices != nil {
+		// a rollback cannot hand a coin back: the acceptor takes it before the transaction, and the
+		// changer returns it when crediting it fails
+		if _, err = s.activeMachine(ctx, nil, machineUUID); err != nil {
+			return
+		}
+		if err = s.checkDenomination(amount); err != nil {
+			return
+		}
+		if err = devices.Acceptor.Accept(ctx, amount); err != nil {
+			return
+		}
+	}
+
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.activeMachine(ctx, tr, machineUUID); err != nil {
+			return err
+		}
+		credit, err = s.depositCoin(ctx, tr, machineUUID, userUUID, amount)
+		return err
+	})
+	if err != nil {
+		if devices != nil {
+			s.returnCoin(ctx, machineUUID, userUUID, devices.Changer, amount, err)
+		}
+		return nil, err
+	}
+	metrics.Deposits.WithLabelValues(strconv.Itoa(amount)).Inc()
+	return credit, nil
+}
+
+// checkDenomination checks that amount is an accepted coin
+func (s *service) checkDenomination(amount int) error {
+	if ok := s.Find(s.denominations, amount); !ok {
+		errString := fmt.Sprintf("[%+v] is not in the acceptable denominations: use one of the following %+v", amount, s.denominations)
+		return errors.New(errString)
+	}
+	return nil
+}
+
+// returnCoin hands back a coin the acceptor took when crediting it failed, and raises an alert
+func (s *service) returnCoin(ctx context.Context, machineUUID, userUUID string, changer device.CoinChanger, amount int, cause error) {
+	ctx, cancel := s.detached(ctx)
+	defer cancel()
+	dispensed, err := changer.Dispense(ctx, amount, 1)
+	if err != nil || dispensed != 1 {
+		s.raiseDeviceMismatch(ctx, machineUUID, AlertCritical, amount,
+			fmt.Sprintf("a %d coin machine '%s' accepted from user '%s' was neither credited nor returned", amount, machineUUID, userUUID), cause)
+		return
+	}
+	s.raiseDeviceMismatch(ctx, machineUUID, AlertWarning, amount,
+		fmt.Sprintf("a %d coin machine '%s' accepted from user '%s' could not be credited and was returned", amount, machineUUID, userUUID), cause)
+}
+
+// depositCoin adds a coin to a machine's coin box and to the user's credit in it
+func (s *service) depositCoin(ctx context.Context, tr *sql.Tx, machineUUID, userUUID string, amount int) (credit *MachineCredit, err error) {
+	if err = s.checkDenomination(amount); err != nil {
+		return nil, err
+	}
+	current, err := s.getMachineCredit(ctx, tr, machineUUID, userUUID, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.setMachineCredit(ctx, tr, machineUUID, userUUID, current.Deposit+amount); err != nil {
+		return nil, err
+	}
+	if err = s.addMachineCoins(ctx, tr, machineUUID, amount, 1, CoinDeposit, ""); err != nil {
+		return nil, err
+	}
+	deposit := &DepositReceived{UserUUID: userUUID, MachineUUID: machineUUID, Amount: amount, Balance: current.Deposit + amount}
+	if err = s.recordEvent(ctx, tr, AggregateUser, userUUID, EventDepositReceived, deposit); err != nil {
+		return nil, err
+	}
+	return &MachineCredit{MachineUUID: machineUUID, UserUUID: userUUID, Deposit: current.Deposit + amount}, nil
+}
+
+// MachineBuy buys products from a machine with the credit the user deposited into it,
+// the units are taken from the slots holding the product, the fullest first
+func (s *service) MachineBuy(ctx context.Context, machineUUID, userUUID, productUUID string, numberOfProducts int) (buyRes *BuyResponse, err error) {
+	defer func() {
+		log.Outcome(ctx, "MachineBuy(exit)", err, logger.Fields{"machineUUID": machineUUID, "userUUID": userUUID, "productUUID": productUUID, "numberOfProducts": numberOfProducts})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.machineBuy(ctx, machineUUID, userUUID, productUUID, "", numberOfProducts)
+}
+
+// MachineBuySlot buys products from a given slot of a machine
+func (s *service) MachineBuySlot(ctx context.Context, machineUUID, userUUID, slotCode string, numberOfProducts int) (buyRes *BuyResponse, err error) {
+	defer func() {
+		log.Outcome(ctx, "MachineBuySlot(exit)", err, logger.Fields{"machineUUID": machineUUID, "userUUID": userUUID, "slotCode": slotCode, "numberOfProducts": numberOfProducts})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.machineBuy(ctx, machineUUID, userUUID, "", slotCode, numberOfProducts)
+}
+
+// machineBuy sells numberOfProducts units either of productUUID or from slotCode.
+// Change is paid out from the machine's coin box, what cannot be paid out stays as credit
+func (s *service) machineBuy(ctx context.Context, machineUUID, userUUID, productUUID, slotCode string, numberOfProducts int) (buyRes *BuyResponse, err error) {
+	if numberOfProducts <= 0 {
+		return nil, errors.New("number of products should be greater than zero")
+	}
+
+	devices, err := s.machineDevices(machineUUID)
+	if err != nil {
+		return nil, err
+	}
+	var failReason string
+	if devices != nil {
+		buyRes, failReason, err = s.vendSale(ctx, machineUUID, userUUID, productUUID, slotCode, numberOfProducts, devices)
+	} else {
+		err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+			if _, err := s.activeMachine(ctx, tr, machineUUID); err != nil {
+				return err
+			}
+			buyRes, failReason, err = s.sell(ctx, tr, machineUUID, userUUID, productUUID, slotCode, numberOfProducts)
+			return err
+		})
+	}
+	if err != nil {
+		if failReason == "" {
+			failReason = metrics.ReasonUpdateFailed
+		}
+		metrics.FailedPurchases.WithLabelValues(failReason).Inc()
+		return nil, err
+	}
+	observeSale(buyRes)
+	return buyRes, nil
+}
+
+// observeSale counts a completed sale
+func observeSale(buyRes *BuyResponse) {
+	metrics.Purchases.Inc()
+	metrics.UnitsSold.WithLabelValues(buyRes.ProductUUID).Add(float64(buyRes.ProductsPurchased))
+}
+
+// checkSale checks, without changing anything, that a user's credit in a machine covers numberOfProducts
+// units from the given slots at the price in force now, returning the failure reason when it does not
+func (s *service) checkSale(ctx context.Context, tr *sql.Tx, machineUUID, userUUID string, slots []*Slot, numberOfProducts int) (product *Product, vended map[string]int, credit *MachineCredit, priced *pricing.PricedLine, failReason string, err error) {
+	product, err = s.GetProduct(ctx, slots[0].ProductUUID)
+	if err != nil {
+		return nil, nil, nil, nil, metrics.ReasonProductNotFound, err
+	}
+	sellable, err := s.sellableSlots(ctx, tr, machineUUID, product.UUID, slots)
+	if err != nil {
+		return nil, nil, nil, nil, "", err
+	}
+	vended, err = planVend(sellable, numberOfProducts)
+	if err != nil {
+		return nil, nil, nil, nil, metrics.ReasonInsufficientStock, err
+	}
+	credit, err = s.getMachineCredit(ctx, tr, machineUUID, userUUID, true)
+	if err != nil {
+		return nil, nil, nil, nil, "", err
+	}
+	quote, err := s.quote(ctx, tr, []pricing.Line{{ProductUUID: product.UUID, Quantity: numberOfProducts, UnitPrice: product.Cost}})
+	if err != nil {
+		return nil, nil, nil, nil, "", err
+	}
+	priced = quote.Lines[0]
+	if credit.Deposit < priced.Amount {
+		err = fmt.Errorf("insufficient funds to spend [%+v], available balance is [%+v]", priced.Amount, credit.Deposit)
+		return nil, nil, nil, nil, metrics.ReasonInsufficientFunds, err
+	}
+	return product, vended, credit, priced, "", nil
+}
+
+// sell takes numberOfProducts units out of the machine's slots, pays the change out of the coin box,
+// keeping what cannot be paid out as credit, and records the purchase, for machines without devices
+func (s *service) sell(ctx context.Context, tr *sql.Tx, machineUUID, userUUID, productUUID, slotCode string, numberOfProducts int) (buyRes *BuyResponse, failReason string, err error) {
+	held, failReason, err := s.holdSale(ctx, tr, machineUUID, userUUID, productUUID, slotCode, numberOfProducts)
+	if err != nil {
+		return nil, failReason, err
+	}
+	buyRes, p, err := s.settleSale(ctx, tr, held)
+	if err != nil {
+		return nil, "", err
+	}
+	buyRes.Change, buyRes.RemainingCredit = s.payChange(ctx, nil, p)
+	return buyRes, "", nil
+}
+
+// vendSale sells through the devices of a machine, which a rollback cannot undo: the sale is held as a
+// pending reservation and committed, the products are vended outside any transaction, then the sale is
+// settled, or released when the vend failed, and its change paid out once settled
+func (s *service) vendSale(ctx context.Context, machineUUID, userUUID, productUUID, slotCode string, numberOfProducts int, devices *device.Devices) (buyRes *BuyResponse, failReason string, err error) {
+	var held *Reservation
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.activeMachine(ctx, tr, machineUUID); err != nil {
+			return err
+		}
+		var err error
+		if held, failReason, err = s.holdSale(ctx, tr, machineUUID, userUUID, productUUID, slotCode, numberOfProducts); err != nil {
+			return err
+		}
+		return s.saveReservation(ctx, tr, held)
+	})
+	if err != nil {
+		return nil, failReason, err
+	}
+
+	vendErr := s.vendHeld(ctx, devices.Dispenser, held)
+	// the products left the machine or did not, what follows is recorded even when the request is gone
+	ctx, cancel := s.detached(ctx)
+	defer cancel()
+	if vendErr != nil {
+		err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+			r, err := s.getReservation(ctx, tr, held.UUID, true)
+			if err != nil || r.Status != ReservationPending {
+				return err
+			}
+			if err := s.releaseSale(ctx, tr, r); err != nil {
+				return err
+			}
+			return s.resolveReservation(ctx, tr, r, ReservationRolledBack, "vend failed: "+vendErr.Error())
+		})
+		if err != nil {
+			// the sweeper releases the reservation once it expires
+			log.Error(ctx, "unable to release the sale of a failed vend", logger.Fields{"err": err, "reservation": held.UUID})
+		}
+		return nil, metrics.ReasonVendFailed, vendErr
+	}
+
+	var p *payout
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		r, err := s.getReservation(ctx, tr, held.UUID, true)
+		if err != nil {
+			return err
+		}
+		if r.Status != ReservationPending {
+			return fmt.Errorf("reservation '%s' was %s while its products were vended", r.UUID, r.Status)
+		}
+		if buyRes, p, err = s.settleSale(ctx, tr, r); err != nil {
+			return err
+		}
+		return s.resolveReservation(ctx, tr, r, ReservationCommitted, "")
+	})
+	if err != nil {
+		s.raiseDeviceMismatch(ctx, machineUUID, AlertCritical, held.Amount,
+			fmt.Sprintf("machine '%s' vended the products of reservation '%s' but the sale could not be settled", machineUUID, held.UUID), err)
+		return nil, "", err
+	}
+	buyRes.Change, buyRes.RemainingCredit = s.payChange(ctx, devices.Changer, p)
+	return buyRes, "", nil
+}
+
+// payout is the change a transaction took out of a machine's coin box for a user, paid by the coin
+// changer once the transaction committed
+type payout struct {
+	machineUUID string
+	userUUID    string
+	amount      int
+	// coins is the change planned out of available, the coins of the box, remainder what it left unpaid
+	coins     map[int]int
+	available map[int]int
+	remainder int
+}
+
+// payOut takes amount out of a machine's coin box for a user, leaving what cannot be paid out as their
+// credit, and returns the payout for payChange to pay once tr commits
+func (s *service) payOut(ctx context.Context, tr *sql.Tx, machineUUID, userUUID string, amount int) (p *payout, err error) {
+	coins, err := s.getMachineCoins(ctx, tr, machineUUID, true)
+	if err != nil {
+		return nil, err
+	}
+	p = &payout{machineUUID: machineUUID, userUUID: userUUID, amount: amount, available: coins}
+	p.coins, p.remainder = s.planChange(amount, coins)
+	for _, denomination := range s.denominations {
+		count := p.coins[denomination]
+		if count == 0 {
+			continue
+		}
+		if err = s.addMachineCoins(ctx, tr, machineUUID, denomination, -count, CoinChange, ""); err != nil {
+			return nil, err
+		}
+		if err = s.checkCoinLevel(ctx, tr, machineUUID, denomination, coins[denomination], coins[denomination]-count); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.setMachineCredit(ctx, tr, machineUUID, userUUID, p.remainder); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// payChange pays a committed payout out of changer and describes the change paid with the credit left.
+// Without a changer the payout is paid as planned. The coins the changer could not pay go back into the
+// coin box and their value back into the user's credit, the tubes it found empty raise alerts
+func (s *service) payChange(ctx context.Context, changer device.CoinChanger, p *payout) (changeSlice map[string]string, remainder int) {
+	if changer == nil || p.amount == p.remainder {
+		return s.describeChange(p.coins, p.remainder), p.remainder
+	}
+	paid, unpaid, emptyTubes := s.dispenseChange(ctx, changer, p.amount, p.available)
+	short := unpaid - p.remainder
+	differs := short != 0 || len(emptyTubes) > 0
+	for _, denomination := range s.denominations {
+		differs = differs || paid[denomination] != p.coins[denomination]
+	}
+	if !differs {
+		return s.describeChange(paid, p.remainder), p.remainder
+	}
+
+	ctx, cancel := s.detached(ctx)
+	defer cancel()
+	err := s.inTransaction(ctx, func(tr *sql.Tx) error {
+		for _, denomination := range s.denominations {
+			if diff := p.coins[denomination] - paid[denomination]; diff != 0 {
+				if err := s.addMachineCoins(ctx, tr, p.machineUUID, denomination, diff, CoinChange, ""); err != nil {
+					return err
+				}
+			}
+		}
+		for _, denomination := range emptyTubes {
+			if err := s.raiseEmptyTube(ctx, tr, p.machineUUID, denomination, p.available[denomination]-paid[denomination]); err != nil {
+				return err
+			}
+		}
+		if short == 0 {
+			return nil
+		}
+		credit, err := s.getMachineCredit(ctx, tr, p.machineUUID, p.userUUID, true)
+		if err != nil {
+			return err
+		}
+		return s.setMachineCredit(ctx, tr, p.machineUUID, p.userUUID, credit.Deposit+short)
+	})
+	if err != nil {
+		s.raiseDeviceMismatch(ctx, p.machineUUID, AlertCritical, short,
+			fmt.Sprintf("the coin changer of machine '%s' paid user '%s' %d of the %d change planned, the difference could not be recorded",
+				p.machineUUID, p.userUUID, p.amount-unpaid, p.amount-p.remainder), err)
+	}
+	return s.describeChange(paid, unpaid), unpaid
+}
+
+// dispenseChange pays amount out of a changer, falling back to smaller coins when a tube runs empty,
+// and returns the coins actually paid with what could not be paid and the tubes the changer reported empty
+func (s *service) dispenseChange(ctx context.Context, changer device.CoinChanger, amount int, available map[int]int) (paid map[int]int, remainder int, emptyTubes []int) {
+	paid = make(map[int]int)
+	left := make(map[int]int, len(available))
+	for denomination, count := range available {
+		left[denomination] = count
+	}
+	remainder = amount
+	for {
+		payout, _ := s.planChange(remainder, left)
+		if len(payout) == 0 {
+			return paid, remainder, emptyTubes
+		}
+		failed := false
+		for _, denomination := range s.denominations {
+			count := payout[denomination]
+			if count == 0 {
+				continue
+			}
+			dispensed, err := changer.Dispense(ctx, denomination, count)
+			if dispensed > 0 {
+				paid[denomination] += dispensed
+				remainder -= dispensed * denomination
+			}
+			if err != nil {
+				log.Warn(ctx, "coin changer failed", logger.Fields{"err": err, "denomination": denomination, "dispensed": dispensed})
+				if errors.Is(err, device.ErrTubeEmpty) {
+					emptyTubes = append(emptyTubes, denomination)
+				}
+				// stop paying out of this tube and plan the rest with the others
+				left[denomination] = 0
+				failed = true
+				break
+			}
+			left[denomination] -= dispensed
+		}
+		if !failed {
+			return paid, remainder, emptyTubes
+		}
+	}
+}
+
+// machineDevices returns the devices fitted to a machine, nil when machines run without hardware
+func (s *service) machineDevices(machineUUID string) (*device.Devices, error) {
+	if s.devices == nil {
+		return nil, nil
+	}
+	return s.devices.Devices(machineUUID)
+}
+
+// MachineReset returns a user's credit in a machine as coins from the coin box
+func (s *service) MachineReset(ctx context.Context, machineUUID, userUUID string) (credit *MachineCredit, err error) {
+	defer func() {
+		log.Outcome(ctx, "MachineReset(exit)", err, logger.Fields{"machineUUID": machineUUID, "userUUID": userUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	devices, err := s.machineDevices(machineUUID)
+	if err != nil {
+		return
+	}
+	var p *payout
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.getMachine(ctx, tr, machineUUID, true); err != nil {
+			return err
+		}
+		credit, p, err = s.returnCredit(ctx, tr, machineUUID, userUUID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var changer device.CoinChanger
+	if devices != nil {
+		changer = devices.Changer
+	}
+	credit.Change, credit.Deposit = s.payChange(ctx, changer, p)
+	return credit, nil
+}
+
+// returnCredit takes a user's whole credit in a machine out of its coin box, returning the payout for
+// payChange to pay once tr commits
+func (s *service) returnCredit(ctx context.Context, tr *sql.Tx, machineUUID, userUUID string) (credit *MachineCredit, p *payout, err error) {
+	current, err := s.getMachineCredit(ctx, tr, machineUUID, userUUID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p, err = s.payOut(ctx, tr, machineUUID, userUUID, current.Deposit); err != nil {
+		return nil, nil, err
+	}
+	return &MachineCredit{MachineUUID: machineUUID, UserUUID: userUUID, Deposit: p.remainder}, p, nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+// recordEvent writes an event about an aggregate to the outbox inside tr, so that it is published if and
+// only if the change it reports commits. The aggregate is locked until tr ends: a later event of the
+// aggregate can only be recorded, and numbered, once this one is committed
+func (s *service) recordEvent(ctx context.Context, tr *sql.Tx, aggregateType, aggregateID, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = s.RunQuery(ctx, s.db, tr, "select pg_advisory_xact_lock(hashtext($1))", aggregateType+":"+aggregateID)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "recordEvent"))
+	}
+	_, err = s.RunQuery(ctx, s.db, tr,
+		"insert into outbox(uuid, aggregate_type, aggregate_id, event_type, payload) values ($1, $2, $3, $4, $5)",
+		uuid.NewV4().String(), aggregateType, aggregateID, eventType, string(payload))
+	if err != nil {
+		return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "recordEvent"))
+	}
+	return nil
+}
+
+// ClaimOutboxEvents takes up to limit unpublished events due, counting the attempt and leasing them for
+// lease. Only the oldest unpublished event of each aggregate is claimed, the next one waits until it is
+// published: the events of an aggregate are published one at a time, in order
+func (s *service) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) (events []*OutboxEvent, err error) {
+	defer func() {
+		log.Outcome(ctx, "ClaimOutboxEvents(exit)", err, logger.Fields{"limit": limit, "claimed": len(events)})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		`update outbox o set attempts = o.attempts + 1, next_attempt_at = now() + make_interval(secs => $2)
+		where o.id in (
+			select q.id from outbox q
+			where q.published_at is null and q.next_attempt_at <= now() and not exists (
+				select 1 from outbox e where e.published_at is null and e.aggregate_type = q.aggregate_type
+				and e.aggregate_id = q.aggregate_id and e.id < q.id)
+			order by q.id limit $1 for update skip locked)
+		returning o.id, o.uuid, o.event_type, o.aggregate_type, o.aggregate_id, o.created_at, o.payload, o.attempts`,
+		limit, lease.Seconds())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	events = make([]*OutboxEvent, 0)
+	for rows.Next() {
+		e := new(OutboxEvent)
+		var payload string
+		err = rows.Scan(&e.Sequence, &e.UUID, &e.Type, &e.AggregateType, &e.AggregateID, &e.CreatedAt, &payload, &e.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = json.RawMessage(payload)
+		events = append(events, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// update returning follows no order, the relay publishes in sequence
+	sort.Slice(events, func(i, j int) bool { return events[i].Sequence < events[j].Sequence })
+	return events, nil
+}
+
+// CompleteOutboxEvent records the outcome of publishing a claimed event: published when publishErr is
+// nil, due again at retryAt otherwise
+func (s *service) CompleteOutboxEvent(ctx context.Context, event *OutboxEvent, publishErr error, retryAt time.Time) (err error) {
+	defer func() {
+		log.Outcome(ctx, "CompleteOutboxEvent(exit)", err, logger.Fields{"eventUUID": event.UUID, "attempt": event.Attempts, "published": publishErr == nil})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	// an event claimed again once its lease ended belongs to the later attempt
+	if publishErr == nil {
+		_, err = s.RunQuery(ctx, s.db, nil,
+			"update outbox set published_at = now(), last_error = null where id = $1 and attempts = $2 and published_at is null",
+			event.Sequence, event.Attempts)
+		return
+	}
+	_, err = s.RunQuery(ctx, s.db, nil,
+		"update outbox set next_attempt_at = $3, last_error = $4 where id = $1 and attempts = $2 and published_at is null",
+		event.Sequence, event.Attempts, retryAt, publishErr.Error())
+	return
+}
+
+// PruneOutbox removes the events published before before and returns how many were removed
+func (s *service) PruneOutbox(ctx context.Context, before time.Time) (pruned int64, err error) {
+	defer func() {
+		log.Outcome(ctx, "PruneOutbox(exit)", err, logger.Fields{"before": before, "pruned": pruned})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	res, err := s.RunQuery(ctx, s.db, nil, "delete from outbox where published_at < $1", before)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,363 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/pricing"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+)
+
+const priceRuleColumns = `uuid, kind, name, seller_id, coalesce(product_uuid, ''), price, percent_off, quantity, starts_at, ends_at,
+	coalesce(daily_start, ''), coalesce(daily_end, ''), active, created_at`
+
+// scanPriceRules reads rules selected with priceRuleColumns, without their bundle items
+func scanPriceRules(rows *sql.Rows) (rules []*pricing.Rule, err error) {
+	defer rows.Close()
+	rules = make([]*pricing.Rule, 0)
+	for rows.Next() {
+		r := new(pricing.Rule)
+		var startsAt, endsAt sql.NullTime
+		err = rows.Scan(&r.UUID, &r.Kind, &r.Name, &r.SellerID, &r.ProductUUID, &r.Price, &r.PercentOff, &r.Quantity,
+			&startsAt, &endsAt, &r.DailyStart, &r.DailyEnd, &r.Active, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if startsAt.Valid {
+			r.StartsAt = &startsAt.Time
+		}
+		if endsAt.Valid {
+			r.EndsAt = &endsAt.Time
+		}
+		rules = append(rules, r)
+	}
+	err = rows.Err()
+	return
+}
+
+// loadRuleItems reads the products of the bundles among rules
+func (s *service) loadRuleItems(ctx context.Context, tr *sql.Tx, rules []*pricing.Rule) error {
+	bundles := make(map[string]*pricing.Rule)
+	ids := make([]string, 0)
+	for _, r := range rules {
+		if r.Kind == pricing.KindBundle {
+			r.Items = make(map[string]int)
+			bundles[r.UUID] = r
+			ids = append(ids, r.UUID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := s.Query(ctx, s.db, tr, "select rule_uuid, product_uuid, quantity from price_rule_items where rule_uuid = any($1)", pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ruleUUID, productUUID string
+		var quantity int
+		if err = rows.Scan(&ruleUUID, &productUUID, &quantity); err != nil {
+			return err
+		}
+		bundles[ruleUUID].Items[productUUID] = quantity
+	}
+	return rows.Err()
+}
+
+// rulesFor reads the active rules pricing any of productUUIDs that have not ended
+func (s *service) rulesFor(ctx context.Context, tr *sql.Tx, productUUIDs []string) ([]*pricing.Rule, error) {
+	rows, err := s.Query(ctx, s.db, tr,
+		"select "+priceRuleColumns+` from price_rules
+		where active and (ends_at is null or ends_at > now())
+		and (product_uuid = any($1) or uuid in (select rule_uuid from price_rule_items where product_uuid = any($1)))`,
+		pq.Array(productUUIDs))
+	if err != nil {
+		return nil, err
+	}
+	rules, err := scanPriceRules(rows)
+	if err != nil {
+		return nil, err
+	}
+	return rules, s.loadRuleItems(ctx, tr, rules)
+}
+
+// quote prices lines with the rules in force now
+func (s *service) quote(ctx context.Context, tr *sql.Tx, lines []pricing.Line) (*pricing.Quote, error) {
+	products := make([]string, 0, len(lines))
+	for _, line := range lines {
+		products = append(products, line.ProductUUID)
+	}
+	rules, err := s.rulesFor(ctx, tr, products)
+	if err != nil {
+		return nil, err
+	}
+	return s.pricing.Quote(lines, rules, time.Now()), nil
+}
+
+// promotionsJSON stores the promotions applied to a sale, NULL when there are none
+func promotionsJSON(promotions []*pricing.Applied) (sql.NullString, error) {
+	if len(promotions) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(promotions)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// parsePromotions reads promotions stored by promotionsJSON
+func parsePromotions(value string) ([]*pricing.Applied, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var promotions []*pricing.Applied
+	err := json.Unmarshal([]byte(value), &promotions)
+	return promotions, err
+}
+
+// ruleSeller returns the seller of the products a rule prices, they must all belong to the same seller
+func (s *service) ruleSeller(ctx context.Context, tr *sql.Tx, rule *pricing.Rule) (sellerID string, err error) {
+	products := rule.Products()
+	rows, err := s.Query(ctx, s.db, tr, "select uuid, seller_id from products where uuid = any($1)", pq.Array(products))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	sellers := make(map[string]string, len(products))
+	for rows.Next() {
+		var productUUID, seller string
+		if err = rows.Scan(&productUUID, &seller); err != nil {
+			return "", err
+		}
+		sellers[productUUID] = seller
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+	for _, productUUID := range products {
+		seller, ok := sellers[productUUID]
+		if !ok {
+			return "", fmt.Errorf("cannot find product with uuid '%s'", productUUID)
+		}
+		if sellerID != "" && seller != sellerID {
+			return "", errors.New("the products of a price rule must belong to the same seller")
+		}
+		sellerID = seller
+	}
+	return sellerID, nil
+}
+
+// saveRuleItems replaces the products of a bundle
+func (s *service) saveRuleItems(ctx context.Context, tr *sql.Tx, rule *pricing.Rule) error {
+	if _, err := s.RunQuery(ctx, s.db, tr, "delete from price_rule_items where rule_uuid = $1", rule.UUID); err != nil {
+		return err
+	}
+	for _, productUUID := range rule.Products() {
+		if rule.Kind != pricing.KindBundle {
+			break
+		}
+		_, err := s.RunQuery(ctx, s.db, tr, "insert into price_rule_items(rule_uuid, product_uuid, quantity) values ($1, $2, $3)",
+			rule.UUID, productUUID, rule.Items[productUUID])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreatePriceRule stores a price change or a promotion, owned by the seller of the products it prices
+func (s *service) CreatePriceRule(ctx context.Context, rule *pricing.Rule) (created *pricing.Rule, err error) {
+	defer func() {
+		log.Outcome(ctx, "CreatePriceRule(exit)", err, logger.Fields{"kind": rule.Kind, "productUUID": rule.ProductUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = rule.Validate(); err != nil {
+		return
+	}
+	rule.UUID = uuid.NewV4().String()
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		sellerID, err := s.ruleSeller(ctx, tr, rule)
+		if err != nil {
+			return err
+		}
+		insert := `insert into price_rules(uuid, kind, name, seller_id, product_uuid, price, percent_off, quantity, starts_at, ends_at,
+			daily_start, daily_end, active)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+		_, err = s.RunQuery(ctx, s.db, tr, insert, rule.UUID, rule.Kind, rule.Name, sellerID, nullString(rule.ProductUUID),
+			rule.Price, rule.PercentOff, rule.Quantity, rule.StartsAt, rule.EndsAt, nullString(rule.DailyStart),
+			nullString(rule.DailyEnd), rule.Active)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreatePriceRule"))
+		}
+		return s.saveRuleItems(ctx, tr, rule)
+	})
+	if err != nil {
+		return
+	}
+	return s.GetPriceRule(ctx, rule.UUID)
+}
+
+// GetPriceRule returns a price rule with the products of a bundle
+func (s *service) GetPriceRule(ctx context.Context, ruleUUID string) (rule *pricing.Rule, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetPriceRule(exit)", err, logger.Fields{"ruleUUID": ruleUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil, "select "+priceRuleColumns+" from price_rules where uuid = $1", ruleUUID)
+	if err != nil {
+		return
+	}
+	rules, err := scanPriceRules(rows)
+	if err != nil {
+		return
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("cannot find price rule with uuid '%s'", ruleUUID)
+	}
+	if err = s.loadRuleItems(ctx, nil, rules); err != nil {
+		return
+	}
+	return rules[0], nil
+}
+
+// GetPriceRules lists the price rules of a product, including the bundles it is part of, or of a seller
+func (s *service) GetPriceRules(ctx context.Context, productUUID, sellerID string) (rules []*pricing.Rule, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetPriceRules(exit)", err, logger.Fields{"productUUID": productUUID, "sellerID": sellerID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+priceRuleColumns+` from price_rules
+		where ($1 = '' or product_uuid = $1 or uuid in (select rule_uuid from price_rule_items where product_uuid = $1))
+		and ($2 = '' or seller_id = $2)
+		order by created_at desc, uuid limit 500`,
+		productUUID, sellerID)
+	if err != nil {
+		return
+	}
+	if rules, err = scanPriceRules(rows); err != nil {
+		return
+	}
+	return rules, s.loadRuleItems(ctx, nil, rules)
+}
+
+// UpdatePriceRule replaces a price rule, it keeps its kind
+func (s *service) UpdatePriceRule(ctx context.Context, rule *pricing.Rule) (updated *pricing.Rule, err error) {
+	defer func() {
+		log.Outcome(ctx, "UpdatePriceRule(exit)", err, logger.Fields{"ruleUUID": rule.UUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = rule.Validate(); err != nil {
+		return
+	}
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		sellerID, err := s.ruleSeller(ctx, tr, rule)
+		if err != nil {
+			return err
+		}
+		update := `update price_rules set name = $2, seller_id = $3, product_uuid = $4, price = $5, percent_off = $6, quantity = $7,
+			starts_at = $8, ends_at = $9, daily_start = $10, daily_end = $11, active = $12
+			where uuid = $1 and kind = $13`
+		res, err := s.RunQuery(ctx, s.db, tr, update, rule.UUID, rule.Name, sellerID, nullString(rule.ProductUUID), rule.Price,
+			rule.PercentOff, rule.Quantity, rule.StartsAt, rule.EndsAt, nullString(rule.DailyStart), nullString(rule.DailyEnd),
+			rule.Active, rule.Kind)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdatePriceRule"))
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return fmt.Errorf("cannot find %s price rule with uuid '%s'", rule.Kind, rule.UUID)
+		}
+		return s.saveRuleItems(ctx, tr, rule)
+	})
+	if err != nil {
+		return
+	}
+	return s.GetPriceRule(ctx, rule.UUID)
+}
+
+// DeletePriceRule removes a price rule, the sales it priced keep their recorded promotions
+func (s *service) DeletePriceRule(ctx context.Context, ruleUUID string) (err error) {
+	defer func() {
+		log.Outcome(ctx, "DeletePriceRule(exit)", err, logger.Fields{"ruleUUID": ruleUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	res, err := s.RunQuery(ctx, s.db, nil, "delete from price_rules where uuid = $1", ruleUUID)
+	if err != nil {
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowsAffected == 0 {
+		err = fmt.Errorf("cannot find price rule with uuid '%s'", ruleUUID)
+	}
+	return
+}
+
+// validateBasket checks that a basket holds a positive quantity of each of its products
+func validateBasket(items []*BasketItem) error {
+	if len(items) == 0 {
+		return errors.New("the basket is empty")
+	}
+	for _, item := range items {
+		if item == nil || item.Quantity <= 0 {
+			return errors.New("number of products should be greater than zero")
+		}
+	}
+	return nil
+}
+
+// basketLines merges the items of a basket into lines priced at the catalog price of their products
+func (s *service) basketLines(ctx context.Context, items []*BasketItem) (lines []pricing.Line, products map[string]*Product, err error) {
+	if err = validateBasket(items); err != nil {
+		return
+	}
+	products = make(map[string]*Product, len(items))
+	index := make(map[string]int, len(items))
+	for _, item := range items {
+		if i, ok := index[item.ProductUUID]; ok {
+			lines[i].Quantity += item.Quantity
+			continue
+		}
+		product, err := s.GetProduct(ctx, item.ProductUUID)
+		if err != nil {
+			return nil, nil, err
+		}
+		products[product.UUID] = product
+		index[product.UUID] = len(lines)
+		lines = append(lines, pricing.Line{ProductUUID: product.UUID, Quantity: item.Quantity, UnitPrice: product.Cost})
+	}
+	return lines, products, nil
+}
+
+// QuotePrices prices a basket with the rules in force now, without buying it
+func (s *service) QuotePrices(ctx context.Context, items []*BasketItem) (quote *pricing.Quote, err error) {
+	defer func() {
+		log.Outcome(ctx, "QuotePrices(exit)", err, logger.Fields{"items": len(items)})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	lines, _, err := s.basketLines(ctx, items)
+	if err != nil {
+		return
+	}
+	return s.quote(ctx, nil, lines)
+}
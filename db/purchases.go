@@ -0,0 +1,41 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// recordPurchase stores a completed sale, inside tr when it is provided
+func (s *service) recordPurchase(ctx context.Context, tr *sql.Tx, p *Purchase) (err error) {
+	if p.UUID == "" {
+		p.UUID = uuid.NewV4().String()
+	}
+	promotions, err := promotionsJSON(p.Promotions)
+	if err != nil {
+		return
+	}
+	insert := `insert into purchases(uuid, machine_uuid, user_uuid, product_uuid, product_name, seller_id, quantity, unit_cost, amount_spent, change,
+		discount, promotions, voucher_redemption_uuid, basket_uuid)
+		select $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12::jsonb, $13, $14`
+	_, err = s.RunQuery(ctx, s.db, tr, insert, p.UUID, nullString(p.MachineUUID), p.UserUUID, p.ProductUUID,
+		p.ProductName, p.SellerID, p.Quantity, p.UnitCost, p.AmountSpent, p.Change, p.Discount, promotions,
+		nullString(p.VoucherRedemptionUUID), nullString(p.BasketUUID))
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "recordPurchase"))
+		return
+	}
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = time.Now().UTC()
+	}
+	return s.recordEvent(ctx, tr, AggregateUser, p.UserUUID, EventPurchaseCompleted, p)
+}
+
+// nullString stores empty strings as NULL
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
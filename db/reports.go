@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+const (
+	// defaultReportPeriod is the period of a report ending now, when it has no start
+	defaultReportPeriod = 30 * 24 * time.Hour
+	// maxReportRows bounds the groups of a report
+	maxReportRows = 10000
+)
+
+// salesGroups are the key and the label of the groups of purchases p by product, seller and machine,
+// the key being the first column of the query
+var salesGroups = map[string]struct{ key, label string }{
+	SalesByProduct: {"p.product_uuid", "max(p.product_name)"},
+	SalesBySeller:  {"p.seller_id", "coalesce((select u.username from users u where u.uuid = p.seller_id), '')"},
+	SalesByMachine: {"p.machine_uuid", "coalesce((select m.location from machines m where m.uuid = p.machine_uuid), '')"},
+}
+
+// salesFigures are the aggregates of purchases p, in the order of the fields of SalesFigures
+const salesFigures = `coalesce(sum(p.amount_spent), 0), coalesce(sum(p.discount), 0), coalesce(sum(p.quantity), 0),
+	count(distinct coalesce(p.basket_uuid, p.uuid))`
+
+// roundFigure rounds an average to cents of a unit
+func roundFigure(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// averageBasket sets the basket averages of figures
+func (f *SalesFigures) averageBasket() {
+	if f.Transactions == 0 {
+		return
+	}
+	f.AverageBasketValue = roundFigure(float64(f.Revenue) / float64(f.Transactions))
+	f.AverageBasketUnits = roundFigure(float64(f.Units) / float64(f.Transactions))
+}
+
+// reportPeriod completes the period of filter, the last defaultReportPeriod when it has none
+func (s *service) reportPeriod(filter *SalesFilter) error {
+	if filter.To.IsZero() {
+		filter.To = time.Now()
+	}
+	if filter.From.IsZero() {
+		filter.From = filter.To.Add(-defaultReportPeriod)
+	}
+	if !filter.From.Before(filter.To) {
+		return errors.New("report start should be before its end")
+	}
+	if filter.Location == nil {
+		filter.Location = s.location
+	}
+	if filter.Limit <= 0 || filter.Limit > maxReportRows {
+		filter.Limit = maxReportRows
+	}
+	return nil
+}
+
+// salesConditions returns the conditions on purchases p selected by filter and their arguments
+func salesConditions(filter *SalesFilter) (conditions []string, args []interface{}) {
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	conditions = []string{"p.created_at >= " + arg(filter.From), "p.created_at < " + arg(filter.To)}
+	if filter.SellerID != "" {
+		conditions = append(conditions, "p.seller_id = "+arg(filter.SellerID))
+	}
+	if filter.MachineUUID != "" {
+		conditions = append(conditions, "p.machine_uuid = "+arg(filter.MachineUUID))
+	}
+	if filter.ProductUUID != "" {
+		conditions = append(conditions, "p.product_uuid = "+arg(filter.ProductUUID))
+	}
+	return conditions, args
+}
+
+// GetSalesReport aggregates the revenue, units and transactions of the purchases selected by filter,
+// grouped by product, seller, machine or time bucket
+func (s *service) GetSalesReport(ctx context.Context, filter *SalesFilter) (report *SalesReport, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetSalesReport(exit)", err, logger.Fields{"filter": filter})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = s.reportPeriod(filter); err != nil {
+		return
+	}
+	if filter.GroupBy == "" {
+		filter.GroupBy = SalesByDay
+	}
+	if filter.RankBy != "" && filter.RankBy != RankByRevenue && filter.RankBy != RankByUnits {
+		return nil, fmt.Errorf("invalid ranking '%s': use %s or %s", filter.RankBy, RankByRevenue, RankByUnits)
+	}
+	conditions, args := salesConditions(filter)
+	where := " from purchases p where " + strings.Join(conditions, " and ")
+
+	report = &SalesReport{GroupBy: filter.GroupBy, From: filter.From, To: filter.To, Totals: new(SalesFigures), Rows: make([]*SalesRow, 0)}
+	rows, err := s.Query(ctx, s.db, nil, "select "+salesFigures+where, args...)
+	if err != nil {
+		return
+	}
+	totals := report.Totals
+	if _, err = scanOne(rows, &totals.Revenue, &totals.Discount, &totals.Units, &totals.Transactions); err != nil {
+		return
+	}
+	totals.averageBasket()
+
+	var key, label, order string
+	bucket := false
+	switch filter.GroupBy {
+	case SalesByHour, SalesByDay, SalesByWeek:
+		// buckets start in the local time of the report, the zone is an argument like the others
+		args = append(args, filter.Location.String())
+		key, label, order = fmt.Sprintf("date_trunc('%s', p.created_at at time zone $%d::text)", filter.GroupBy, len(args)), "''", "1"
+		bucket = true
+	default:
+		group, ok := salesGroups[filter.GroupBy]
+		if !ok {
+			return nil, fmt.Errorf("invalid grouping '%s': use %s, %s, %s, %s, %s or %s", filter.GroupBy,
+				SalesByProduct, SalesBySeller, SalesByMachine, SalesByHour, SalesByDay, SalesByWeek)
+		}
+		key, label, order = group.key, group.label, "3 desc, 1"
+	}
+	if !bucket && filter.RankBy == RankByUnits {
+		order = "5 desc, 1"
+	}
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf("select %s, %s, %s%s group by 1 order by %s limit $%d", key, label, salesFigures, where, order, len(args))
+	if rows, err = s.Query(ctx, s.db, nil, query, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := new(SalesRow)
+		var groupKey sql.NullString
+		var start time.Time
+		dest := []interface{}{&groupKey, &row.Label, &row.Revenue, &row.Discount, &row.Units, &row.Transactions}
+		if bucket {
+			dest[0] = &start
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return
+		}
+		row.Key = groupKey.String
+		if bucket {
+			// the bucket start is read as the wall clock of the report's zone
+			start = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), 0, 0, 0, filter.Location)
+			row.Key = start.Format(time.RFC3339)
+		}
+		row.averageBasket()
+		report.Rows = append(report.Rows, row)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetStockTurnover reports how often the stock of the products selected by filter sold over its period,
+// the product stock or, with a machine, the stock of its slots
+func (s *service) GetStockTurnover(ctx context.Context, filter *SalesFilter) (report *TurnoverReport, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetStockTurnover(exit)", err, logger.Fields{"filter": filter})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = s.reportPeriod(filter); err != nil {
+		return
+	}
+
+	// the stock at a time is the current stock less the movements since
+	args := []interface{}{filter.From, filter.To}
+	stock, movements, sales := "p.amount_available", "m.machine_uuid is null", ""
+	conditions := make([]string, 0)
+	if filter.MachineUUID != "" {
+		args = append(args, filter.MachineUUID)
+		machine := fmt.Sprintf("$%d", len(args))
+		stock = "coalesce((select sum(ms.amount) from machine_slots ms where ms.machine_uuid = " + machine + " and ms.product_uuid = p.uuid), 0)"
+		movements = "m.machine_uuid = " + machine
+		sales = " and s.machine_uuid = " + machine
+		conditions = append(conditions, "exists (select 1 from inventory_movements m where m.product_uuid = p.uuid and "+movements+")")
+	}
+	if filter.SellerID != "" {
+		args = append(args, filter.SellerID)
+		conditions = append(conditions, fmt.Sprintf("p.seller_id = $%d", len(args)))
+	}
+	if filter.ProductUUID != "" {
+		args = append(args, filter.ProductUUID)
+		conditions = append(conditions, fmt.Sprintf("p.uuid = $%d", len(args)))
+	}
+	query := `select p.uuid, p.product_name, p.seller_id, ` + stock + `,
+		coalesce((select sum(m.change) from inventory_movements m where m.product_uuid = p.uuid and ` + movements + ` and m.created_at >= $1), 0),
+		coalesce((select sum(m.change) from inventory_movements m where m.product_uuid = p.uuid and ` + movements + ` and m.created_at >= $2), 0),
+		coalesce((select sum(s.quantity) from purchases s where s.product_uuid = p.uuid and s.created_at >= $1 and s.created_at < $2` + sales + `), 0)
+		from products p`
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	rows, err := s.Query(ctx, s.db, nil, query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	days := filter.To.Sub(filter.From).Hours() / 24
+	report = &TurnoverReport{From: filter.From, To: filter.To, Products: make([]*StockTurnover, 0)}
+	for rows.Next() {
+		t := new(StockTurnover)
+		var current, sinceFrom, sinceTo int
+		if err = rows.Scan(&t.ProductUUID, &t.ProductName, &t.SellerID, &current, &sinceFrom, &sinceTo, &t.UnitsSold); err != nil {
+			return
+		}
+		t.OpeningStock, t.ClosingStock = current-sinceFrom, current-sinceTo
+		t.AverageStock = float64(t.OpeningStock+t.ClosingStock) / 2
+		if t.AverageStock > 0 {
+			t.Turnover = roundFigure(float64(t.UnitsSold) / t.AverageStock)
+		}
+		if t.UnitsSold > 0 {
+			daysOfStock := roundFigure(float64(t.ClosingStock) / (float64(t.UnitsSold) / days))
+			t.DaysOfStock = &daysOfStock
+		}
+		report.Products = append(report.Products, t)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	sort.SliceStable(report.Products, func(i, j int) bool {
+		a, b := report.Products[i], report.Products[j]
+		if a.Turnover != b.Turnover {
+			return a.Turnover > b.Turnover
+		}
+		if a.UnitsSold != b.UnitsSold {
+			return a.UnitsSold > b.UnitsSold
+		}
+		return a.ProductName < b.ProductName
+	})
+	if len(report.Products) > filter.Limit {
+		report.Products = report.Products[:filter.Limit]
+	}
+	return
+}
@@ -0,0 +1,469 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/device"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/metrics"
+	uuid "github.com/satori/go.uuid"
+)
+
+// maxSweepBatch bounds the reservations expired by a single sweep
+const maxSweepBatch = 100
+
+// holdSale takes numberOfProducts units out of the machine's slots and their cost out of the user's credit,
+// returning what was held so that the sale can be settled or released
+func (s *service) holdSale(ctx context.Context, tr *sql.Tx, machineUUID, userUUID, productUUID, slotCode string, numberOfProducts int) (held *Reservation, failReason string, err error) {
+	if numberOfProducts <= 0 {
+		return nil, "", errors.New("number of products should be greater than zero")
+	}
+	slots, err := s.slotsToVend(ctx, tr, machineUUID, productUUID, slotCode)
+	if err != nil {
+		return nil, metrics.ReasonProductNotFound, err
+	}
+	product, vended, credit, priced, failReason, err := s.checkSale(ctx, tr, machineUUID, userUUID, slots, numberOfProducts)
+	if err != nil {
+		return nil, failReason, err
+	}
+
+	for code, count := range vended {
+		if _, err = s.moveSlotStock(ctx, tr, machineUUID, code, product.UUID, -count, MovementSale, userUUID); err != nil {
+			return nil, metrics.ReasonUpdateFailed, err
+		}
+	}
+	if err = s.setMachineCredit(ctx, tr, machineUUID, userUUID, credit.Deposit-priced.Amount); err != nil {
+		return nil, metrics.ReasonUpdateFailed, err
+	}
+
+	return &Reservation{
+		MachineUUID: machineUUID,
+		UserUUID:    userUUID,
+		ProductUUID: product.UUID,
+		ProductName: product.ProductName,
+		SellerID:    product.SellerID,
+		Quantity:    numberOfProducts,
+		UnitCost:    priced.UnitPrice,
+		Amount:      priced.Amount,
+		Discount:    priced.Discount,
+		Promotions:  priced.Promotions,
+		Slots:       vended,
+		Status:      ReservationPending,
+	}, "", nil
+}
+
+// vendHeld releases the held units from their slots with dispenser, outside any transaction: the sale
+// is committed as a pending reservation before and settled or released after
+func (s *service) vendHeld(ctx context.Context, dispenser device.Dispenser, held *Reservation) error {
+	codes := make([]string, 0, len(held.Slots))
+	for code := range held.Slots {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if err := dispenser.Vend(ctx, code, held.Slots[code]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settleSale completes a held sale: the rest of the user's credit is taken out of the coin box as change
+// and the purchase is recorded. The change is paid by payChange with the payout returned once tr commits
+func (s *service) settleSale(ctx context.Context, tr *sql.Tx, held *Reservation) (buyRes *BuyResponse, p *payout, err error) {
+	credit, err := s.getMachineCredit(ctx, tr, held.MachineUUID, held.UserUUID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p, err = s.payOut(ctx, tr, held.MachineUUID, held.UserUUID, credit.Deposit); err != nil {
+		return nil, nil, err
+	}
+	remainder := p.remainder
+
+	err = s.recordPurchase(ctx, tr, &Purchase{
+		MachineUUID: held.MachineUUID,
+		UserUUID:    held.UserUUID,
+		ProductUUID: held.ProductUUID,
+		ProductName: held.ProductName,
+		SellerID:    held.SellerID,
+		Quantity:    held.Quantity,
+		UnitCost:    held.UnitCost,
+		AmountSpent: held.Amount,
+		Change:      credit.Deposit - remainder,
+		Discount:    held.Discount,
+		Promotions:  held.Promotions,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &BuyResponse{
+		MachineUUID:       held.MachineUUID,
+		ProductUUID:       held.ProductUUID,
+		AmountSpent:       held.Amount,
+		ProductName:       held.ProductName,
+		ProductsPurchased: held.Quantity,
+		RemainingCredit:   remainder,
+		Slots:             held.Slots,
+		UnitPrice:         held.UnitCost,
+		Discount:          held.Discount,
+		Promotions:        held.Promotions,
+	}, p, nil
+}
+
+// releaseSale puts held units back into their slots and the held funds back into the user's credit.
+// Units whose slot has since been given another product or refilled to capacity cannot go back and are written off
+func (s *service) releaseSale(ctx context.Context, tr *sql.Tx, held *Reservation) (err error) {
+	for code, count := range held.Slots {
+		moved, err := s.moveSlotStock(ctx, tr, held.MachineUUID, code, held.ProductUUID, count, MovementSaleReversal, held.UserUUID)
+		if err != nil {
+			return err
+		}
+		if moved < count {
+			log.Warn(ctx, "held units could not go back into their slot", logger.Fields{"reservation": held.UUID, "code": code, "count": count, "moved": moved})
+		}
+	}
+	credit, err := s.getMachineCredit(ctx, tr, held.MachineUUID, held.UserUUID, true)
+	if err != nil {
+		return err
+	}
+	return s.setMachineCredit(ctx, tr, held.MachineUUID, held.UserUUID, credit.Deposit+held.Amount)
+}
+
+// saveReservation stores a held sale that has to be confirmed within the reservation timeout
+func (s *service) saveReservation(ctx context.Context, tr *sql.Tx, held *Reservation) (err error) {
+	held.UUID = uuid.NewV4().String()
+	promotions, err := promotionsJSON(held.Promotions)
+	if err != nil {
+		return
+	}
+	insert := `insert into reservations(uuid, machine_uuid, user_uuid, product_uuid, product_name, seller_id, quantity, unit_cost, amount,
+		discount, promotions, status, expires_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11::jsonb, $12, now() + $13 * interval '1 millisecond')
+		returning created_at, expires_at`
+	rows, err := s.Query(ctx, s.db, tr, insert, held.UUID, held.MachineUUID, held.UserUUID, held.ProductUUID, held.ProductName,
+		held.SellerID, held.Quantity, held.UnitCost, held.Amount, held.Discount, promotions, held.Status, s.reservationTimeout.Milliseconds())
+	if err != nil {
+		return
+	}
+	if _, err = scanOne(rows, &held.CreatedAt, &held.ExpiresAt); err != nil {
+		return
+	}
+	for code, count := range held.Slots {
+		_, err = s.RunQuery(ctx, s.db, tr, "insert into reservation_slots(reservation_uuid, code, amount) values ($1, $2, $3)",
+			held.UUID, code, count)
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+const reservationColumns = `uuid, coalesce(machine_uuid, ''), user_uuid, coalesce(product_uuid, ''), product_name, seller_id, quantity, unit_cost, amount,
+	discount, coalesce(promotions::text, ''), status, coalesce(reason, ''), expires_at, created_at, resolved_at, status = 'pending' and expires_at <= now()`
+
+// scanReservations reads reservations selected with reservationColumns
+func scanReservations(rows *sql.Rows) (reservations []*Reservation, err error) {
+	defer rows.Close()
+	reservations = make([]*Reservation, 0)
+	for rows.Next() {
+		r := new(Reservation)
+		var resolvedAt sql.NullTime
+		var promotions string
+		err = rows.Scan(&r.UUID, &r.MachineUUID, &r.UserUUID, &r.ProductUUID, &r.ProductName, &r.SellerID, &r.Quantity, &r.UnitCost,
+			&r.Amount, &r.Discount, &promotions, &r.Status, &r.Reason, &r.ExpiresAt, &r.CreatedAt, &resolvedAt, &r.expired)
+		if err != nil {
+			return nil, err
+		}
+		if r.Promotions, err = parsePromotions(promotions); err != nil {
+			return nil, err
+		}
+		if resolvedAt.Valid {
+			r.ResolvedAt = &resolvedAt.Time
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
+
+// getReservation reads a reservation with its slots, locking it for the rest of tr when forUpdate is set
+func (s *service) getReservation(ctx context.Context, tr *sql.Tx, reservationUUID string, forUpdate bool) (r *Reservation, err error) {
+	query := "select " + reservationColumns + " from reservations where uuid = $1"
+	if forUpdate {
+		query += " for update"
+	}
+	rows, err := s.Query(ctx, s.db, tr, query, reservationUUID)
+	if err != nil {
+		return
+	}
+	reservations, err := scanReservations(rows)
+	if err != nil {
+		return
+	}
+	if len(reservations) == 0 {
+		err = fmt.Errorf("cannot find reservation with uuid '%s'", reservationUUID)
+		return nil, errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "getReservation"))
+	}
+	r = reservations[0]
+
+	rows, err = s.Query(ctx, s.db, tr, "select code, amount from reservation_slots where reservation_uuid = $1", reservationUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r.Slots = make(map[string]int)
+	for rows.Next() {
+		var code string
+		var count int
+		if err = rows.Scan(&code, &count); err != nil {
+			return nil, err
+		}
+		r.Slots[code] = count
+	}
+	return r, rows.Err()
+}
+
+// resolveReservation records how a reservation ended
+func (s *service) resolveReservation(ctx context.Context, tr *sql.Tx, r *Reservation, status, reason string) (err error) {
+	rows, err := s.Query(ctx, s.db, tr,
+		"update reservations set status = $1, reason = $2, resolved_at = now() where uuid = $3 returning resolved_at",
+		status, nullString(reason), r.UUID)
+	if err != nil {
+		return
+	}
+	r.Status, r.Reason, r.expired = status, reason, false
+	r.ResolvedAt = new(time.Time)
+	_, err = scanOne(rows, r.ResolvedAt)
+	return
+}
+
+// ReserveMachineProduct holds numberOfProducts units of a product and their cost until the machine
+// confirms whether it dispensed them, the reservation is released if no confirmation arrives in time
+func (s *service) ReserveMachineProduct(ctx context.Context, machineUUID, userUUID, productUUID string, numberOfProducts int) (reservation *Reservation, err error) {
+	defer func() {
+		log.Outcome(ctx, "ReserveMachineProduct(exit)", err, logger.Fields{"machineUUID": machineUUID, "userUUID": userUUID, "productUUID": productUUID, "numberOfProducts": numberOfProducts})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.GetUser(ctx, userUUID); err != nil {
+		return
+	}
+
+	var failReason string
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.activeMachine(ctx, tr, machineUUID); err != nil {
+			return err
+		}
+		held, reason, err := s.holdSale(ctx, tr, machineUUID, userUUID, productUUID, "", numberOfProducts)
+		if err != nil {
+			failReason = reason
+			return err
+		}
+		if err := s.saveReservation(ctx, tr, held); err != nil {
+			return err
+		}
+		reservation = held
+		return nil
+	})
+	if err != nil {
+		if failReason == "" {
+			failReason = metrics.ReasonUpdateFailed
+		}
+		metrics.FailedPurchases.WithLabelValues(failReason).Inc()
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// GetReservation returns a reservation
+func (s *service) GetReservation(ctx context.Context, reservationUUID string) (reservation *Reservation, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetReservation(exit)", err, logger.Fields{"reservationUUID": reservationUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.getReservation(ctx, nil, reservationUUID, false)
+}
+
+// GetReservations lists the latest reservations, optionally of one machine and in one status
+func (s *service) GetReservations(ctx context.Context, machineUUID, status string) (reservations []*Reservation, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetReservations(exit)", err, logger.Fields{"machineUUID": machineUUID, "status": status})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+reservationColumns+` from reservations
+		where ($1 = '' or machine_uuid = $1) and ($2 = '' or status = $2)
+		order by created_at desc limit 500`,
+		machineUUID, status)
+	if err != nil {
+		return
+	}
+	return scanReservations(rows)
+}
+
+// ConfirmReservation settles a reservation when the machine dispensed the products and releases it
+// when it did not. A reservation past its deadline is released whatever the outcome
+func (s *service) ConfirmReservation(ctx context.Context, reservationUUID string, success bool, reason string) (reservation *Reservation, err error) {
+	defer func() {
+		log.Outcome(ctx, "ConfirmReservation(exit)", err, logger.Fields{"reservationUUID": reservationUUID, "success": success, "reason": reason})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	current, err := s.getReservation(ctx, nil, reservationUUID, false)
+	if err != nil {
+		return
+	}
+	devices, err := s.machineDevices(current.MachineUUID)
+	if err != nil {
+		return
+	}
+
+	var p *payout
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.getMachine(ctx, tr, current.MachineUUID, true); err != nil {
+			return err
+		}
+		r, err := s.getReservation(ctx, tr, reservationUUID, true)
+		if err != nil {
+			return err
+		}
+		if r.Status != ReservationPending {
+			return fmt.Errorf("reservation '%s' is already %s", reservationUUID, r.Status)
+		}
+		rows, err := s.Query(ctx, s.db, tr, "select machine_uuid from machine_sessions where reservation_uuid = $1", reservationUUID)
+		if err != nil {
+			return err
+		}
+		var sessionMachine string
+		if found, err := scanOne(rows, &sessionMachine); err != nil {
+			return err
+		} else if found {
+			return fmt.Errorf("reservation '%s' belongs to the vend cycle of machine '%s', report the vend to its session", reservationUUID, sessionMachine)
+		}
+
+		switch {
+		case r.expired:
+			if err := s.releaseSale(ctx, tr, r); err != nil {
+				return err
+			}
+			if err := s.resolveReservation(ctx, tr, r, ReservationExpired, "confirmation arrived after the deadline"); err != nil {
+				return err
+			}
+		case success:
+			if r.Sale, p, err = s.settleSale(ctx, tr, r); err != nil {
+				return err
+			}
+			if err := s.resolveReservation(ctx, tr, r, ReservationCommitted, reason); err != nil {
+				return err
+			}
+		default:
+			if err := s.releaseSale(ctx, tr, r); err != nil {
+				return err
+			}
+			if err := s.resolveReservation(ctx, tr, r, ReservationRolledBack, reason); err != nil {
+				return err
+			}
+		}
+		reservation = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reservation.Sale != nil {
+		// the change is paid once the sale committed, a rollback cannot take coins back
+		var changer device.CoinChanger
+		if devices != nil {
+			changer = devices.Changer
+		}
+		reservation.Sale.Change, reservation.Sale.RemainingCredit = s.payChange(ctx, changer, p)
+		observeSale(reservation.Sale)
+	} else {
+		metrics.FailedPurchases.WithLabelValues(metrics.ReasonVendFailed).Inc()
+	}
+	if reservation.Status == ReservationExpired {
+		return reservation, fmt.Errorf("reservation '%s' expired at %s, stock and credit were restored", reservationUUID, reservation.ExpiresAt.Format(time.RFC3339))
+	}
+	return reservation, nil
+}
+
+// SweepReservations releases the pending reservations past their deadline and puts the machines
+// that were waiting on them into a fault, returning how many were released
+func (s *service) SweepReservations(ctx context.Context) (expired int, err error) {
+	defer func() {
+		log.Outcome(ctx, "SweepReservations(exit)", err, logger.Fields{"expired": expired})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		"select uuid, machine_uuid from reservations where status = $1 and expires_at <= now() order by expires_at limit $2",
+		ReservationPending, maxSweepBatch)
+	if err != nil {
+		return
+	}
+	type pending struct{ uuid, machineUUID string }
+	var due []pending
+	for rows.Next() {
+		var p pending
+		if err = rows.Scan(&p.uuid, &p.machineUUID); err != nil {
+			rows.Close()
+			return
+		}
+		due = append(due, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, p := range due {
+		released := false
+		err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+			if _, err := s.getMachine(ctx, tr, p.machineUUID, true); err != nil {
+				return err
+			}
+			r, err := s.getReservation(ctx, tr, p.uuid, true)
+			if err != nil {
+				return err
+			}
+			// confirmed since it was listed
+			if !r.expired {
+				return nil
+			}
+			if err := s.releaseSale(ctx, tr, r); err != nil {
+				return err
+			}
+			if err := s.resolveReservation(ctx, tr, r, ReservationExpired, "no confirmation from the machine"); err != nil {
+				return err
+			}
+			// the machine waiting on the reservation goes into a fault, its streams are told so
+			session, err := s.getSession(ctx, tr, p.machineUUID, true)
+			if err != nil {
+				return err
+			}
+			if session.ReservationUUID == r.UUID {
+				session.State, session.Fault, session.ReservationUUID = StateFault, FaultTimeout, ""
+				if err := s.saveSession(ctx, tr, session); err != nil {
+					return err
+				}
+			}
+			released = true
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		if released {
+			expired++
+			metrics.FailedPurchases.WithLabelValues(metrics.ReasonVendFailed).Inc()
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,396 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/code-sleuth/vending-machine/bus"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/metrics"
+)
+
+// Vend cycle states
+const (
+	StateIdle             = "idle"
+	StateCoinsInserted    = "coins_inserted"
+	StateSelecting        = "selecting"
+	StateVending          = "vending"
+	StateDispensingChange = "dispensing_change"
+	StateFault            = "fault"
+)
+
+// Vend cycle events reported by the machine firmware
+const (
+	EventInsertCoin      = "insert_coin"
+	EventSelect          = "select"
+	EventCancel          = "cancel"
+	EventVend            = "vend"
+	EventVended          = "vended"
+	EventFault           = "fault"
+	EventCoinReturn      = "coin_return"
+	EventChangeDispensed = "change_dispensed"
+)
+
+// Faults a machine can report while serving a customer
+const (
+	FaultJam       = "jam"
+	FaultEmptySlot = "empty_slot"
+	FaultCoinJam   = "coin_jam"
+	// FaultTimeout is set when the machine never reported the outcome of a vend
+	FaultTimeout = "timeout"
+)
+
+// sessionTransitions maps an event and the current state to the next state,
+// an event missing for a state is an invalid transition
+var sessionTransitions = map[string]map[string]string{
+	EventInsertCoin: {
+		StateIdle:          StateCoinsInserted,
+		StateCoinsInserted: StateCoinsInserted,
+	},
+	EventSelect: {
+		StateCoinsInserted: StateSelecting,
+		StateSelecting:     StateSelecting,
+	},
+	EventCancel: {
+		StateSelecting: StateCoinsInserted,
+	},
+	EventVend: {
+		StateSelecting: StateVending,
+	},
+	EventVended: {
+		StateVending: StateDispensingChange,
+	},
+	EventFault: {
+		StateCoinsInserted:    StateFault,
+		StateSelecting:        StateFault,
+		StateVending:          StateFault,
+		StateDispensingChange: StateFault,
+	},
+	EventCoinReturn: {
+		StateCoinsInserted: StateDispensingChange,
+		StateSelecting:     StateDispensingChange,
+		StateFault:         StateDispensingChange,
+	},
+	EventChangeDispensed: {
+		StateDispensingChange: StateIdle,
+	},
+}
+
+// nextState returns the state event leads to from state
+func nextState(state, event string) (string, error) {
+	from, ok := sessionTransitions[event]
+	if !ok {
+		return "", fmt.Errorf("unknown event '%s'", event)
+	}
+	to, ok := from[state]
+	if !ok {
+		return "", fmt.Errorf("invalid transition: cannot %s while the machine is %s", strings.Replace(event, "_", " ", -1), strings.Replace(state, "_", " ", -1))
+	}
+	return to, nil
+}
+
+// getSession reads the vend cycle of a machine, a machine without a stored session is idle
+func (s *service) getSession(ctx context.Context, tr *sql.Tx, machineUUID string, forUpdate bool) (session *MachineSession, err error) {
+	query := `select state, coalesce(user_uuid, ''), coalesce(slot_code, ''), quantity, coalesce(fault, ''), coalesce(reservation_uuid, ''), updated_at
+		from machine_sessions where machine_uuid = $1`
+	if forUpdate {
+		query += " for update"
+	}
+	rows, err := s.Query(ctx, s.db, tr, query, machineUUID)
+	if err != nil {
+		return
+	}
+	session = &MachineSession{MachineUUID: machineUUID, State: StateIdle}
+	_, err = scanOne(rows, &session.State, &session.UserUUID, &session.SlotCode, &session.Quantity, &session.Fault, &session.ReservationUUID, &session.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// saveSession stores the vend cycle of a machine, an idle session serves nobody
+func (s *service) saveSession(ctx context.Context, tr *sql.Tx, session *MachineSession) (err error) {
+	if session.State == StateIdle {
+		session.UserUUID, session.SlotCode, session.Quantity, session.Fault, session.ReservationUUID = "", "", 0, "", ""
+	}
+	upsert := `insert into machine_sessions(machine_uuid, state, user_uuid, slot_code, quantity, fault, reservation_uuid, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, now())
+		on conflict (machine_uuid) do update set state = excluded.state, user_uuid = excluded.user_uuid,
+		slot_code = excluded.slot_code, quantity = excluded.quantity, fault = excluded.fault,
+		reservation_uuid = excluded.reservation_uuid, updated_at = excluded.updated_at
+		returning updated_at`
+	rows, err := s.Query(ctx, s.db, tr, upsert, session.MachineUUID, session.State, nullString(session.UserUUID),
+		nullString(session.SlotCode), session.Quantity, nullString(session.Fault), nullString(session.ReservationUUID))
+	if err != nil {
+		return
+	}
+	if _, err = scanOne(rows, &session.UpdatedAt); err != nil {
+		return
+	}
+	updatedAt := session.UpdatedAt
+	s.publish(tr, bus.Event{
+		Topic: bus.MachineTopic(session.MachineUUID),
+		Type:  bus.EventMachineSession,
+		Data:  &MachineState{MachineUUID: session.MachineUUID, State: session.State, Fault: session.Fault, UpdatedAt: &updatedAt},
+	})
+	return
+}
+
+// sessionCredit fills in the credit of the customer a session is serving
+func (s *service) sessionCredit(ctx context.Context, tr *sql.Tx, session *MachineSession) (err error) {
+	session.Credit = 0
+	if session.UserUUID == "" {
+		return nil
+	}
+	credit, err := s.getMachineCredit(ctx, tr, session.MachineUUID, session.UserUUID, false)
+	if err != nil {
+		return err
+	}
+	session.Credit = credit.Deposit
+	return nil
+}
+
+// GetMachineSession returns the current state of a machine's vend cycle
+func (s *service) GetMachineSession(ctx context.Context, machineUUID string) (session *MachineSession, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetMachineSession(exit)", err, logger.Fields{"machineUUID": machineUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.getMachine(ctx, nil, machineUUID, false); err != nil {
+		return
+	}
+	session, err = s.getSession(ctx, nil, machineUUID, false)
+	if err != nil {
+		return
+	}
+	if err = s.sessionCredit(ctx, nil, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// SessionEvent applies an event reported by a machine on behalf of a customer to its vend cycle.
+// A machine serves one customer from the first coin until it is idle again, and events that are
+// not valid in the current state are rejected without changing anything. The firmware reporting
+// the events drives the hardware itself, so no device is called
+func (s *service) SessionEvent(ctx context.Context, machineUUID, userUUID string, event *SessionEvent) (session *MachineSession, err error) {
+	defer func() {
+		log.Outcome(ctx, "SessionEvent(exit)", err, logger.Fields{"machineUUID": machineUUID, "userUUID": userUUID, "event": event.Event})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.GetUser(ctx, userUUID); err != nil {
+		return
+	}
+
+	var failReason string
+	var vendFailed bool
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.activeMachine(ctx, tr, machineUUID); err != nil {
+			return err
+		}
+		current, err := s.getSession(ctx, tr, machineUUID, true)
+		if err != nil {
+			return err
+		}
+		if current.State != StateIdle && current.UserUUID != userUUID {
+			return fmt.Errorf("machine '%s' is serving another customer", machineUUID)
+		}
+		next, err := nextState(current.State, event.Event)
+		if err != nil {
+			return err
+		}
+		current.UserUUID = userUUID
+
+		switch event.Event {
+		case EventInsertCoin:
+			if _, err := s.depositCoin(ctx, tr, machineUUID, userUUID, event.Amount); err != nil {
+				return err
+			}
+		case EventSelect:
+			code, err := NormalizeSlotCode(event.SlotCode)
+			if err != nil {
+				return err
+			}
+			quantity := event.Quantity
+			if quantity == 0 {
+				quantity = 1
+			}
+			if quantity < 0 {
+				return errors.New("quantity should be greater than zero")
+			}
+			if failReason, err = s.checkSelection(ctx, tr, machineUUID, userUUID, code, quantity); err != nil {
+				return err
+			}
+			current.SlotCode, current.Quantity = code, quantity
+		case EventCancel:
+			current.SlotCode, current.Quantity = "", 0
+		case EventVend:
+			// hold the stock and the funds until the machine reports how the vend went
+			held, reason, err := s.holdSale(ctx, tr, machineUUID, userUUID, "", current.SlotCode, current.Quantity)
+			if err != nil {
+				failReason = reason
+				return err
+			}
+			if err := s.saveReservation(ctx, tr, held); err != nil {
+				return err
+			}
+			current.ReservationUUID = held.UUID
+		case EventVended:
+			held, err := s.sessionReservation(ctx, tr, current)
+			if err != nil {
+				return err
+			}
+			var p *payout
+			if current.Sale, p, err = s.settleSale(ctx, tr, held); err != nil {
+				return err
+			}
+			// the firmware pays the change out, the machine reports it with change_dispensed
+			current.Sale.Change, current.Sale.RemainingCredit = s.payChange(ctx, nil, p)
+			if err := s.resolveReservation(ctx, tr, held, ReservationCommitted, ""); err != nil {
+				return err
+			}
+			current.ReservationUUID = ""
+		case EventFault:
+			if current.ReservationUUID != "" {
+				if err := s.releaseSessionReservation(ctx, tr, current, "fault: "+event.Fault); err != nil {
+					return err
+				}
+				vendFailed = true
+			}
+			switch event.Fault {
+			case FaultJam, FaultCoinJam:
+			case FaultEmptySlot:
+				// the slot sensor is the truth, the recorded amount was wrong
+				if current.SlotCode != "" {
+					slot, err := s.getSlot(ctx, tr, machineUUID, current.SlotCode, true)
+					if err != nil {
+						return err
+					}
+					if slot.ProductUUID != "" {
+						if _, err := s.moveSlotStock(ctx, tr, machineUUID, slot.Code, slot.ProductUUID, -slot.Amount, MovementCountCorrection, userUUID); err != nil {
+							return err
+						}
+					}
+				}
+			default:
+				return fmt.Errorf("invalid fault '%s': use one of %s, %s, %s", event.Fault, FaultJam, FaultEmptySlot, FaultCoinJam)
+			}
+			current.Fault = event.Fault
+		case EventCoinReturn:
+			_, p, err := s.returnCredit(ctx, tr, machineUUID, userUUID)
+			if err != nil {
+				return err
+			}
+			current.Change, _ = s.payChange(ctx, nil, p)
+			current.SlotCode, current.Quantity, current.Fault = "", 0, ""
+		}
+
+		current.State = next
+		if err := s.sessionCredit(ctx, tr, current); err != nil {
+			return err
+		}
+		if err := s.saveSession(ctx, tr, current); err != nil {
+			return err
+		}
+		session = current
+		return nil
+	})
+	if err != nil {
+		// a selection or a vend refused for the stock or the funds is a failed purchase, as is a vend
+		// or its completion that could not be recorded
+		if failReason == "" && (event.Event == EventVend || event.Event == EventVended) {
+			failReason = metrics.ReasonUpdateFailed
+		}
+		if failReason != "" {
+			metrics.FailedPurchases.WithLabelValues(failReason).Inc()
+		}
+		return nil, err
+	}
+	if vendFailed {
+		metrics.FailedPurchases.WithLabelValues(metrics.ReasonVendFailed).Inc()
+	}
+	if session.Sale != nil {
+		observeSale(session.Sale)
+	}
+	return session, nil
+}
+
+// sessionReservation locks the pending reservation a session is vending
+func (s *service) sessionReservation(ctx context.Context, tr *sql.Tx, session *MachineSession) (held *Reservation, err error) {
+	if session.ReservationUUID == "" {
+		return nil, fmt.Errorf("machine '%s' has no reservation to vend", session.MachineUUID)
+	}
+	held, err = s.getReservation(ctx, tr, session.ReservationUUID, true)
+	if err != nil {
+		return nil, err
+	}
+	if held.Status != ReservationPending {
+		return nil, fmt.Errorf("reservation '%s' is already %s", held.UUID, held.Status)
+	}
+	return held, nil
+}
+
+// releaseSessionReservation gives back the stock and funds held by the reservation of a session
+func (s *service) releaseSessionReservation(ctx context.Context, tr *sql.Tx, session *MachineSession, reason string) (err error) {
+	held, err := s.sessionReservation(ctx, tr, session)
+	if err != nil {
+		return err
+	}
+	if err = s.releaseSale(ctx, tr, held); err != nil {
+		return err
+	}
+	if err = s.resolveReservation(ctx, tr, held, ReservationRolledBack, reason); err != nil {
+		return err
+	}
+	session.ReservationUUID = ""
+	return nil
+}
+
+// checkSelection checks that a slot holds enough units for the selection and that the customer's credit covers it
+func (s *service) checkSelection(ctx context.Context, tr *sql.Tx, machineUUID, userUUID, slotCode string, quantity int) (failReason string, err error) {
+	slots, err := s.slotsToVend(ctx, tr, machineUUID, "", slotCode)
+	if err != nil {
+		return metrics.ReasonProductNotFound, err
+	}
+	_, _, _, _, failReason, err = s.checkSale(ctx, tr, machineUUID, userUUID, slots, quantity)
+	return failReason, err
+}
+
+// ClearMachineSession returns a machine to idle whatever state it is in, used by maintenance to clear faults.
+// Credit left by the customer stays in the machine
+func (s *service) ClearMachineSession(ctx context.Context, machineUUID string) (session *MachineSession, err error) {
+	defer func() {
+		log.Outcome(ctx, "ClearMachineSession(exit)", err, logger.Fields{"machineUUID": machineUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		if _, err := s.getMachine(ctx, tr, machineUUID, true); err != nil {
+			return err
+		}
+		current, err := s.getSession(ctx, tr, machineUUID, true)
+		if err != nil {
+			return err
+		}
+		if current.ReservationUUID != "" {
+			if err := s.releaseSessionReservation(ctx, tr, current, "cleared by maintenance"); err != nil {
+				return err
+			}
+		}
+		current.State = StateIdle
+		if err := s.saveSession(ctx, tr, current); err != nil {
+			return err
+		}
+		session = current
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
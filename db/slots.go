@@ -0,0 +1,290 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+// slotCodeRegex matches slot codes such as A1 or C12: a row letter followed by a column number
+var slotCodeRegex = regexp.MustCompile(`^[A-Z][0-9]{1,2}$`)
+
+// NormalizeSlotCode upper cases a slot code and checks its format
+func NormalizeSlotCode(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !slotCodeRegex.MatchString(code) {
+		return "", fmt.Errorf("invalid slot code '%s': use a row letter followed by a number, e.g. A1", code)
+	}
+	return code, nil
+}
+
+// fillLevel returns amount as a fraction of capacity
+func fillLevel(amount, capacity int) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return float64(amount) / float64(capacity)
+}
+
+const slotColumns = `ms.machine_uuid, ms.code, ms.capacity, coalesce(ms.product_uuid, ''), coalesce(p.product_name, ''), ms.amount
+	from machine_slots ms left join products p on p.uuid = ms.product_uuid`
+
+// scanSlots reads slots selected with slotColumns
+func scanSlots(rows *sql.Rows) (slots []*Slot, err error) {
+	defer rows.Close()
+	slots = make([]*Slot, 0)
+	for rows.Next() {
+		slot := new(Slot)
+		err = rows.Scan(&slot.MachineUUID, &slot.Code, &slot.Capacity, &slot.ProductUUID, &slot.ProductName, &slot.Amount)
+		if err != nil {
+			return nil, err
+		}
+		slot.FillLevel = fillLevel(slot.Amount, slot.Capacity)
+		slots = append(slots, slot)
+	}
+	return slots, rows.Err()
+}
+
+// getSlot reads a slot, locking it for the rest of tr when forUpdate is set
+func (s *service) getSlot(ctx context.Context, tr *sql.Tx, machineUUID, code string, forUpdate bool) (slot *Slot, err error) {
+	query := "select " + slotColumns + " where ms.machine_uuid = $1 and ms.code = $2"
+	if forUpdate {
+		query += " for update of ms"
+	}
+	rows, err := s.Query(ctx, s.db, tr, query, machineUUID, code)
+	if err != nil {
+		return
+	}
+	slots, err := scanSlots(rows)
+	if err != nil {
+		return
+	}
+	if len(slots) == 0 {
+		err = fmt.Errorf("cannot find slot '%s' in machine '%s'", code, machineUUID)
+		return nil, errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "getSlot"))
+	}
+	return slots[0], nil
+}
+
+// GetPlanogram returns the slot layout of a machine with the fill level of every slot
+func (s *service) GetPlanogram(ctx context.Context, machineUUID string) (planogram *Planogram, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetPlanogram(exit)", err, logger.Fields{"machineUUID": machineUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if _, err = s.getMachine(ctx, nil, machineUUID, false); err != nil {
+		return
+	}
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+slotColumns+" where ms.machine_uuid = $1 order by substr(ms.code, 1, 1), length(ms.code), ms.code",
+		machineUUID)
+	if err != nil {
+		return
+	}
+	slots, err := scanSlots(rows)
+	if err != nil {
+		return
+	}
+	planogram = &Planogram{MachineUUID: machineUUID, Slots: slots}
+	for _, slot := range slots {
+		planogram.Capacity += slot.Capacity
+		planogram.Amount += slot.Amount
+	}
+	planogram.FillLevel = fillLevel(planogram.Amount, planogram.Capacity)
+	return planogram, nil
+}
+
+// SaveSlot creates a slot or changes its capacity
+func (s *service) SaveSlot(ctx context.Context, slotInput *Slot) (slot *Slot, err error) {
+	defer func() {
+		log.Outcome(ctx, "SaveSlot(exit)", err, logger.Fields{"machineUUID": slotInput.MachineUUID, "code": slotInput.Code, "capacity": slotInput.Capacity})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	code, err := NormalizeSlotCode(slotInput.Code)
+	if err != nil {
+		return
+	}
+	if slotInput.Capacity <= 0 {
+		return nil, errors.New("slot capacity should be greater than zero")
+	}
+	if _, err = s.getMachine(ctx, nil, slotInput.MachineUUID, false); err != nil {
+		return
+	}
+
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		existing, err := s.getSlot(ctx, tr, slotInput.MachineUUID, code, true)
+		if err == nil && existing.Amount > slotInput.Capacity {
+			return fmt.Errorf("slot '%s' holds %d units, more than the requested capacity %d", code, existing.Amount, slotInput.Capacity)
+		}
+		upsert := `insert into machine_slots(machine_uuid, code, capacity) values ($1, $2, $3)
+			on conflict (machine_uuid, code) do update set capacity = excluded.capacity`
+		_, err = s.RunQuery(ctx, s.db, tr, upsert, slotInput.MachineUUID, code, slotInput.Capacity)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	return s.getSlot(ctx, nil, slotInput.MachineUUID, code, false)
+}
+
+// DeleteSlot removes an empty slot from a machine's layout
+func (s *service) DeleteSlot(ctx context.Context, machineUUID, code string) (err error) {
+	defer func() {
+		log.Outcome(ctx, "DeleteSlot(exit)", err, logger.Fields{"machineUUID": machineUUID, "code": code})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if code, err = NormalizeSlotCode(code); err != nil {
+		return
+	}
+	res, err := s.RunQuery(ctx, s.db, nil, "delete from machine_slots where machine_uuid = $1 and code = $2 and amount = 0", machineUUID, code)
+	if err != nil {
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowsAffected == 0 {
+		err = fmt.Errorf("delete slot '%+v' did not affect any rows, make sure the slot exists and is empty", code)
+		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "DeleteSlot"))
+		return
+	}
+	return
+}
+
+// FillSlot assigns a product to a slot and sets the number of units it holds, recording the difference
+// as a restock or a count correction. A slot must be emptied before another product is assigned to it.
+// Units added with a batch are tracked with its lot and expiry date
+func (s *service) FillSlot(ctx context.Context, machineUUID, code, productUUID, actorUUID string, amount int, batch *Batch) (slot *Slot, err error) {
+	defer func() {
+		log.Outcome(ctx, "FillSlot(exit)", err, logger.Fields{"machineUUID": machineUUID, "code": code, "productUUID": productUUID, "actorUUID": actorUUID, "amount": amount})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if code, err = NormalizeSlotCode(code); err != nil {
+		return
+	}
+	if amount < 0 {
+		return nil, errors.New("amount should not be negative")
+	}
+	if productUUID == "" && amount > 0 {
+		return nil, errors.New("a product is required to fill a slot")
+	}
+	if batch != nil {
+		if err = validateBatch(batch.Lot, &batch.ExpiresAt); err != nil {
+			return
+		}
+	}
+
+	err = s.inTransaction(ctx, func(tr *sql.Tx) error {
+		current, err := s.getSlot(ctx, tr, machineUUID, code, true)
+		if err != nil {
+			return err
+		}
+		if amount > current.Capacity {
+			return fmt.Errorf("amount %d exceeds the capacity %d of slot '%s'", amount, current.Capacity, code)
+		}
+		if current.ProductUUID != "" && current.ProductUUID != productUUID && current.Amount > 0 {
+			return fmt.Errorf("slot '%s' still holds %d units of another product, empty it first", code, current.Amount)
+		}
+		// assign the product first, the units are moved and recorded under it
+		_, err = s.RunQuery(ctx, s.db, tr, "update machine_slots set product_uuid = $1 where machine_uuid = $2 and code = $3",
+			nullString(productUUID), machineUUID, code)
+		if err != nil || productUUID == "" {
+			return err
+		}
+		previous := current.Amount
+		if current.ProductUUID != productUUID {
+			previous = 0
+		}
+		reason := MovementRestock
+		if amount < previous {
+			reason = MovementCountCorrection
+		}
+		moved, err := s.moveSlotStock(ctx, tr, machineUUID, code, productUUID, amount-previous, reason, actorUUID)
+		if err != nil || batch == nil || moved <= 0 {
+			return err
+		}
+		return s.addBatch(ctx, tr, &Batch{
+			ProductUUID: productUUID,
+			MachineUUID: machineUUID,
+			SlotCode:    code,
+			Lot:         batch.Lot,
+			Quantity:    moved,
+			ExpiresAt:   batch.ExpiresAt,
+		}, actorUUID)
+	})
+	if err != nil {
+		return
+	}
+	return s.getSlot(ctx, nil, machineUUID, code, false)
+}
+
+// slotsToVend locks the slots a sale can take units from: the given slot, or every slot holding the product
+// ordered from the fullest to the emptiest
+func (s *service) slotsToVend(ctx context.Context, tr *sql.Tx, machineUUID, productUUID, slotCode string) (slots []*Slot, err error) {
+	if slotCode != "" {
+		code, err := NormalizeSlotCode(slotCode)
+		if err != nil {
+			return nil, err
+		}
+		slot, err := s.getSlot(ctx, tr, machineUUID, code, true)
+		if err != nil {
+			return nil, err
+		}
+		if slot.ProductUUID == "" {
+			return nil, fmt.Errorf("slot '%s' has no product assigned", code)
+		}
+		return []*Slot{slot}, nil
+	}
+
+	rows, err := s.Query(ctx, s.db, tr,
+		"select "+slotColumns+" where ms.machine_uuid = $1 and ms.product_uuid = $2 order by ms.amount desc, ms.code for update of ms",
+		machineUUID, productUUID)
+	if err != nil {
+		return nil, err
+	}
+	slots, err = scanSlots(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("product '%s' is not stocked in machine '%s'", productUUID, machineUUID)
+	}
+	return slots, nil
+}
+
+// planVend splits numberOfProducts over slots in order, returning the units to take per slot code
+func planVend(slots []*Slot, numberOfProducts int) (map[string]int, error) {
+	available := 0
+	for _, slot := range slots {
+		available += slot.Amount
+	}
+	if numberOfProducts > available {
+		return nil, fmt.Errorf("requested amount %+v is greater than available amout %+v", numberOfProducts, available)
+	}
+	vended := make(map[string]int)
+	remaining := numberOfProducts
+	for _, slot := range slots {
+		if remaining == 0 {
+			break
+		}
+		take := slot.Amount
+		if take > remaining {
+			take = remaining
+		}
+		if take > 0 {
+			vended[slot.Code] = take
+			remaining -= take
+		}
+	}
+	return vended, nil
+}
@@ -33,3 +33,436 @@ BEGIN
 
 END $$;
 
+
+CREATE TABLE IF NOT EXISTS "machines" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "location" VARCHAR(255) NOT NULL,
+    "status" VARCHAR(20) NOT NULL DEFAULT 'active',
+    "currency" VARCHAR(3) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "machine_slots" (
+    "machine_uuid" VARCHAR(50) NOT NULL REFERENCES "machines" ("uuid") ON DELETE CASCADE,
+    "code" VARCHAR(10) NOT NULL,
+    "capacity" INTEGER NOT NULL CHECK ("capacity" > 0),
+    "product_uuid" VARCHAR(50) REFERENCES "products" ("uuid") ON DELETE SET NULL,
+    "amount" INTEGER NOT NULL DEFAULT 0 CHECK ("amount" >= 0 AND "amount" <= "capacity"),
+    PRIMARY KEY ("machine_uuid", "code")
+);
+
+CREATE INDEX IF NOT EXISTS "machine_slots_product_uuid_idx" ON "machine_slots" ("machine_uuid", "product_uuid");
+
+CREATE TABLE IF NOT EXISTS "machine_credits" (
+    "machine_uuid" VARCHAR(50) NOT NULL REFERENCES "machines" ("uuid") ON DELETE CASCADE,
+    "user_uuid" VARCHAR(50) NOT NULL REFERENCES "users" ("uuid") ON DELETE CASCADE,
+    "deposit" INTEGER NOT NULL CHECK ("deposit" >= 0),
+    PRIMARY KEY ("machine_uuid", "user_uuid")
+);
+
+CREATE TABLE IF NOT EXISTS "machine_coins" (
+    "machine_uuid" VARCHAR(50) NOT NULL REFERENCES "machines" ("uuid") ON DELETE CASCADE,
+    "denomination" INTEGER NOT NULL,
+    "count" INTEGER NOT NULL CHECK ("count" >= 0),
+    PRIMARY KEY ("machine_uuid", "denomination")
+);
+
+CREATE TABLE IF NOT EXISTS "purchases" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "machine_uuid" VARCHAR(50) REFERENCES "machines" ("uuid") ON DELETE SET NULL,
+    "user_uuid" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "product_uuid" VARCHAR(50) REFERENCES "products" ("uuid") ON DELETE SET NULL,
+    "product_name" VARCHAR(255) NOT NULL,
+    "seller_id" VARCHAR(50) NOT NULL,
+    "quantity" INTEGER NOT NULL,
+    "unit_cost" INTEGER NOT NULL,
+    "amount_spent" INTEGER NOT NULL,
+    "change" INTEGER NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS "purchases_created_at_idx" ON "purchases" ("created_at");
+CREATE INDEX IF NOT EXISTS "purchases_machine_uuid_idx" ON "purchases" ("machine_uuid");
+
+CREATE TABLE IF NOT EXISTS "reservations" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "machine_uuid" VARCHAR(50) REFERENCES "machines" ("uuid") ON DELETE SET NULL,
+    "user_uuid" VARCHAR(50) NOT NULL REFERENCES "users" ("uuid") ON DELETE CASCADE,
+    "product_uuid" VARCHAR(50) REFERENCES "products" ("uuid") ON DELETE SET NULL,
+    "product_name" VARCHAR(255) NOT NULL,
+    "seller_id" VARCHAR(50) NOT NULL,
+    "quantity" INTEGER NOT NULL,
+    "unit_cost" INTEGER NOT NULL,
+    "amount" INTEGER NOT NULL,
+    "status" VARCHAR(20) NOT NULL DEFAULT 'pending',
+    "reason" VARCHAR(255),
+    "expires_at" TIMESTAMPTZ NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "resolved_at" TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS "reservations_pending_expires_at_idx" ON "reservations" ("expires_at") WHERE "status" = 'pending';
+CREATE INDEX IF NOT EXISTS "reservations_machine_uuid_idx" ON "reservations" ("machine_uuid", "created_at");
+
+-- the reservations of a deleted machine are kept as history, a machine with pending ones cannot be deleted
+ALTER TABLE "reservations" ALTER COLUMN "machine_uuid" DROP NOT NULL;
+ALTER TABLE "reservations" DROP CONSTRAINT IF EXISTS "reservations_machine_uuid_fkey";
+ALTER TABLE "reservations" ADD CONSTRAINT "reservations_machine_uuid_fkey"
+    FOREIGN KEY ("machine_uuid") REFERENCES "machines" ("uuid") ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS "reservation_slots" (
+    "reservation_uuid" VARCHAR(50) NOT NULL REFERENCES "reservations" ("uuid") ON DELETE CASCADE,
+    "code" VARCHAR(10) NOT NULL,
+    "amount" INTEGER NOT NULL CHECK ("amount" > 0),
+    PRIMARY KEY ("reservation_uuid", "code")
+);
+
+CREATE TABLE IF NOT EXISTS "machine_sessions" (
+    "machine_uuid" VARCHAR(50) PRIMARY KEY REFERENCES "machines" ("uuid") ON DELETE CASCADE,
+    "state" VARCHAR(30) NOT NULL DEFAULT 'idle',
+    "user_uuid" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "slot_code" VARCHAR(10),
+    "quantity" INTEGER NOT NULL DEFAULT 0,
+    "fault" VARCHAR(30),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE "machine_sessions" ADD COLUMN IF NOT EXISTS "reservation_uuid" VARCHAR(50) REFERENCES "reservations" ("uuid") ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS "machine_sessions_reservation_uuid_idx" ON "machine_sessions" ("reservation_uuid");
+
+CREATE TABLE IF NOT EXISTS "inventory_movements" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "product_uuid" VARCHAR(50) NOT NULL REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "machine_uuid" VARCHAR(50) REFERENCES "machines" ("uuid") ON DELETE SET NULL,
+    "slot_code" VARCHAR(10),
+    "change" INTEGER NOT NULL,
+    "balance" INTEGER NOT NULL,
+    "reason" VARCHAR(30) NOT NULL,
+    "note" VARCHAR(255),
+    "actor_uuid" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS "inventory_movements_product_uuid_idx" ON "inventory_movements" ("product_uuid", "created_at");
+
+CREATE TABLE IF NOT EXISTS "stock_thresholds" (
+    "product_uuid" VARCHAR(50) PRIMARY KEY REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "threshold" INTEGER NOT NULL CHECK ("threshold" >= 0)
+);
+
+CREATE TABLE IF NOT EXISTS "coin_thresholds" (
+    "denomination" INTEGER PRIMARY KEY,
+    "threshold" INTEGER NOT NULL CHECK ("threshold" >= 0)
+);
+
+CREATE TABLE IF NOT EXISTS "alerts" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "kind" VARCHAR(30) NOT NULL,
+    "level" VARCHAR(20) NOT NULL,
+    "dedup_key" VARCHAR(150) NOT NULL,
+    "machine_uuid" VARCHAR(50) REFERENCES "machines" ("uuid") ON DELETE CASCADE,
+    "product_uuid" VARCHAR(50) REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "denomination" INTEGER,
+    "value" INTEGER NOT NULL,
+    "threshold" INTEGER NOT NULL,
+    "message" VARCHAR(255) NOT NULL,
+    "status" VARCHAR(20) NOT NULL DEFAULT 'open',
+    "occurrences" INTEGER NOT NULL DEFAULT 1,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "last_seen_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "acknowledged_at" TIMESTAMPTZ,
+    "acknowledged_by" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "resolved_at" TIMESTAMPTZ,
+    "resolved_by" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL
+);
+
+-- a condition raises a single alert until that alert is resolved
+CREATE UNIQUE INDEX IF NOT EXISTS "alerts_unresolved_dedup_key_idx" ON "alerts" ("dedup_key") WHERE "status" <> 'resolved';
+CREATE INDEX IF NOT EXISTS "alerts_status_idx" ON "alerts" ("status", "last_seen_at");
+
+CREATE TABLE IF NOT EXISTS "product_batches" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "product_uuid" VARCHAR(50) NOT NULL REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "machine_uuid" VARCHAR(50) REFERENCES "machines" ("uuid") ON DELETE CASCADE,
+    "slot_code" VARCHAR(10),
+    "lot" VARCHAR(100),
+    "quantity" INTEGER NOT NULL CHECK ("quantity" > 0),
+    "remaining" INTEGER NOT NULL CHECK ("remaining" >= 0 AND "remaining" <= "quantity"),
+    "expires_at" TIMESTAMPTZ NOT NULL,
+    "received_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "actor_uuid" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS "product_batches_stock_idx" ON "product_batches" ("product_uuid", "machine_uuid", "slot_code", "received_at");
+CREATE INDEX IF NOT EXISTS "product_batches_expires_at_idx" ON "product_batches" ("expires_at") WHERE "remaining" > 0;
+
+CREATE TABLE IF NOT EXISTS "price_rules" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "kind" VARCHAR(30) NOT NULL,
+    "name" VARCHAR(255) NOT NULL,
+    "seller_id" VARCHAR(50) NOT NULL REFERENCES "users" ("uuid") ON DELETE CASCADE,
+    "product_uuid" VARCHAR(50) REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "price" INTEGER NOT NULL DEFAULT 0,
+    "percent_off" INTEGER NOT NULL DEFAULT 0,
+    "quantity" INTEGER NOT NULL DEFAULT 0,
+    "starts_at" TIMESTAMPTZ,
+    "ends_at" TIMESTAMPTZ,
+    "daily_start" VARCHAR(5),
+    "daily_end" VARCHAR(5),
+    "active" BOOLEAN NOT NULL DEFAULT TRUE,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS "price_rules_product_uuid_idx" ON "price_rules" ("product_uuid");
+CREATE INDEX IF NOT EXISTS "price_rules_seller_id_idx" ON "price_rules" ("seller_id");
+
+CREATE TABLE IF NOT EXISTS "price_rule_items" (
+    "rule_uuid" VARCHAR(50) NOT NULL REFERENCES "price_rules" ("uuid") ON DELETE CASCADE,
+    "product_uuid" VARCHAR(50) NOT NULL REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "quantity" INTEGER NOT NULL CHECK ("quantity" > 0),
+    PRIMARY KEY ("rule_uuid", "product_uuid")
+);
+
+CREATE INDEX IF NOT EXISTS "price_rule_items_product_uuid_idx" ON "price_rule_items" ("product_uuid");
+
+-- the promotions applied to a sale, as a json array of {rule_id, kind, name, discount}
+ALTER TABLE "purchases" ADD COLUMN IF NOT EXISTS "discount" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "purchases" ADD COLUMN IF NOT EXISTS "promotions" JSONB;
+ALTER TABLE "reservations" ADD COLUMN IF NOT EXISTS "discount" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "reservations" ADD COLUMN IF NOT EXISTS "promotions" JSONB;
+
+CREATE TABLE IF NOT EXISTS "vouchers" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "code" VARCHAR(32) NOT NULL UNIQUE,
+    "kind" VARCHAR(10) NOT NULL,
+    "value" INTEGER NOT NULL CHECK ("value" > 0),
+    "max_uses" INTEGER NOT NULL DEFAULT 1,
+    "per_user_limit" INTEGER NOT NULL DEFAULT 0,
+    "uses" INTEGER NOT NULL DEFAULT 0,
+    "product_uuid" VARCHAR(50) REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "seller_id" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE CASCADE,
+    "starts_at" TIMESTAMPTZ,
+    "expires_at" TIMESTAMPTZ,
+    "active" BOOLEAN NOT NULL DEFAULT TRUE,
+    "created_by" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS "voucher_redemptions" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "voucher_uuid" VARCHAR(50) NOT NULL REFERENCES "vouchers" ("uuid") ON DELETE CASCADE,
+    "user_uuid" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "discount" INTEGER NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS "voucher_redemptions_voucher_user_idx" ON "voucher_redemptions" ("voucher_uuid", "user_uuid");
+
+ALTER TABLE "purchases" ADD COLUMN IF NOT EXISTS "voucher_redemption_uuid" VARCHAR(50) REFERENCES "voucher_redemptions" ("uuid") ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS "categories" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "name" VARCHAR(100) NOT NULL,
+    "parent_uuid" VARCHAR(50) REFERENCES "categories" ("uuid") ON DELETE RESTRICT,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "categories_parent_name_idx" ON "categories" (coalesce("parent_uuid", ''), lower("name"));
+
+ALTER TABLE "products" ADD COLUMN IF NOT EXISTS "category_uuid" VARCHAR(50) REFERENCES "categories" ("uuid") ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS "products_category_uuid_idx" ON "products" ("category_uuid");
+
+CREATE TABLE IF NOT EXISTS "product_tags" (
+    "product_uuid" VARCHAR(50) NOT NULL REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "tag" VARCHAR(50) NOT NULL,
+    PRIMARY KEY ("product_uuid", "tag")
+);
+
+CREATE INDEX IF NOT EXISTS "product_tags_tag_idx" ON "product_tags" ("tag");
+
+-- the text searched by the product search, weighted name, then tags, then category path
+ALTER TABLE "products" ADD COLUMN IF NOT EXISTS "search_vector" TSVECTOR;
+CREATE INDEX IF NOT EXISTS "products_search_vector_idx" ON "products" USING GIN ("search_vector");
+UPDATE "products" SET "search_vector" = setweight(to_tsvector('english', "product_name"), 'A') WHERE "search_vector" IS NULL;
+
+CREATE TABLE IF NOT EXISTS "product_images" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "product_uuid" VARCHAR(50) NOT NULL REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "blob_key" VARCHAR(255) NOT NULL,
+    "thumbnail_key" VARCHAR(255) NOT NULL,
+    "content_type" VARCHAR(50) NOT NULL,
+    "width" INTEGER NOT NULL,
+    "height" INTEGER NOT NULL,
+    "size" INTEGER NOT NULL,
+    "created_by" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS "product_images_product_uuid_idx" ON "product_images" ("product_uuid", "created_at");
+
+-- the nutrition declaration of a product, as a json object
+ALTER TABLE "products" ADD COLUMN IF NOT EXISTS "nutrition" TEXT;
+
+CREATE TABLE IF NOT EXISTS "product_allergens" (
+    "product_uuid" VARCHAR(50) NOT NULL REFERENCES "products" ("uuid") ON DELETE CASCADE,
+    "allergen" VARCHAR(30) NOT NULL,
+    PRIMARY KEY ("product_uuid", "allergen")
+);
+
+CREATE INDEX IF NOT EXISTS "product_allergens_allergen_idx" ON "product_allergens" ("allergen");
+
+-- the seller's own reference of a product, bulk imports upsert on it
+ALTER TABLE "products" ADD COLUMN IF NOT EXISTS "sku" VARCHAR(64);
+CREATE UNIQUE INDEX IF NOT EXISTS "products_seller_sku_idx" ON "products" ("seller_id", "sku");
+
+-- the purchases recorded by one sale share a basket, the reports count them as one transaction
+ALTER TABLE "purchases" ADD COLUMN IF NOT EXISTS "basket_uuid" VARCHAR(50);
+CREATE INDEX IF NOT EXISTS "purchases_seller_id_idx" ON "purchases" ("seller_id", "created_at");
+CREATE INDEX IF NOT EXISTS "purchases_product_uuid_idx" ON "purchases" ("product_uuid", "created_at");
+
+-- the coins entering and leaving the coin boxes, machine_coins holds their running total
+CREATE TABLE IF NOT EXISTS "coin_movements" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "machine_uuid" VARCHAR(50) REFERENCES "machines" ("uuid") ON DELETE SET NULL,
+    "denomination" INTEGER NOT NULL,
+    "change" INTEGER NOT NULL,
+    "reason" VARCHAR(20) NOT NULL,
+    "collection_uuid" VARCHAR(50),
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS "coin_movements_machine_uuid_idx" ON "coin_movements" ("machine_uuid", "created_at");
+
+CREATE TABLE IF NOT EXISTS "cash_collections" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "machine_uuid" VARCHAR(50) REFERENCES "machines" ("uuid") ON DELETE SET NULL,
+    "expected_total" INTEGER NOT NULL,
+    "counted_total" INTEGER NOT NULL,
+    "left_total" INTEGER NOT NULL,
+    "status" VARCHAR(20) NOT NULL,
+    "note" VARCHAR(255),
+    "collected_by" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS "cash_collections_machine_uuid_idx" ON "cash_collections" ("machine_uuid", "created_at");
+
+CREATE TABLE IF NOT EXISTS "cash_collection_coins" (
+    "collection_uuid" VARCHAR(50) NOT NULL REFERENCES "cash_collections" ("uuid") ON DELETE CASCADE,
+    "denomination" INTEGER NOT NULL,
+    "opening" INTEGER NOT NULL,
+    "deposited" INTEGER NOT NULL,
+    "paid_out" INTEGER NOT NULL,
+    "expected" INTEGER NOT NULL,
+    "counted" INTEGER NOT NULL CHECK ("counted" >= 0),
+    "left_in_box" INTEGER NOT NULL CHECK ("left_in_box" >= 0 AND "left_in_box" <= "counted"),
+    PRIMARY KEY ("collection_uuid", "denomination")
+);
+
+-- the coin box ledger and the collections are kept when a machine is deleted, a machine with coins
+-- left cannot be deleted
+ALTER TABLE "coin_movements" ALTER COLUMN "machine_uuid" DROP NOT NULL;
+ALTER TABLE "coin_movements" DROP CONSTRAINT IF EXISTS "coin_movements_machine_uuid_fkey";
+ALTER TABLE "coin_movements" ADD CONSTRAINT "coin_movements_machine_uuid_fkey"
+    FOREIGN KEY ("machine_uuid") REFERENCES "machines" ("uuid") ON DELETE SET NULL;
+ALTER TABLE "cash_collections" ALTER COLUMN "machine_uuid" DROP NOT NULL;
+ALTER TABLE "cash_collections" DROP CONSTRAINT IF EXISTS "cash_collections_machine_uuid_fkey";
+ALTER TABLE "cash_collections" ADD CONSTRAINT "cash_collections_machine_uuid_fkey"
+    FOREIGN KEY ("machine_uuid") REFERENCES "machines" ("uuid") ON DELETE SET NULL;
+
+-- the mutating requests, each entry hashes the one before it so that editing or removing an entry breaks
+-- the chain
+CREATE TABLE IF NOT EXISTS "audit_log" (
+    "id" BIGSERIAL PRIMARY KEY,
+    "actor" VARCHAR(255) NOT NULL DEFAULT '',
+    "action" VARCHAR(255) NOT NULL,
+    "target" TEXT NOT NULL,
+    "request_id" VARCHAR(128) NOT NULL DEFAULT '',
+    "status" INTEGER NOT NULL,
+    "before_state" TEXT,
+    "after_state" TEXT,
+    "created_at" TIMESTAMPTZ NOT NULL,
+    "prev_hash" CHAR(64) NOT NULL,
+    "hash" CHAR(64) NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS "audit_log_actor_idx" ON "audit_log" ("actor", "id");
+CREATE INDEX IF NOT EXISTS "audit_log_action_idx" ON "audit_log" ("action", "id");
+CREATE INDEX IF NOT EXISTS "audit_log_request_id_idx" ON "audit_log" ("request_id");
+
+CREATE OR REPLACE FUNCTION "audit_log_append_only"() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS "audit_log_no_change" ON "audit_log";
+CREATE TRIGGER "audit_log_no_change" BEFORE UPDATE OR DELETE ON "audit_log"
+    FOR EACH ROW EXECUTE PROCEDURE "audit_log_append_only"();
+
+DROP TRIGGER IF EXISTS "audit_log_no_truncate" ON "audit_log";
+CREATE TRIGGER "audit_log_no_truncate" BEFORE TRUNCATE ON "audit_log"
+    FOR EACH STATEMENT EXECUTE PROCEDURE "audit_log_append_only"();
+
+CREATE TABLE IF NOT EXISTS "webhook_subscriptions" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "url" TEXT NOT NULL,
+    "events" TEXT[] NOT NULL,
+    "secret" VARCHAR(128) NOT NULL,
+    "description" VARCHAR(255),
+    "active" BOOLEAN NOT NULL DEFAULT TRUE,
+    "created_by" VARCHAR(50) REFERENCES "users" ("uuid") ON DELETE SET NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- an event sent to a subscription, the payload is the exact body signed and posted on every attempt
+CREATE TABLE IF NOT EXISTS "webhook_deliveries" (
+    "uuid" VARCHAR(50) PRIMARY KEY,
+    "subscription_uuid" VARCHAR(50) NOT NULL REFERENCES "webhook_subscriptions" ("uuid") ON DELETE CASCADE,
+    "event_uuid" VARCHAR(50) NOT NULL,
+    "event_type" VARCHAR(50) NOT NULL,
+    "payload" TEXT NOT NULL,
+    "status" VARCHAR(20) NOT NULL DEFAULT 'pending',
+    "attempts" INTEGER NOT NULL DEFAULT 0,
+    "next_attempt_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "last_status_code" INTEGER,
+    "last_error" TEXT,
+    "replay_of" VARCHAR(50),
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "delivered_at" TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS "webhook_deliveries_due_idx" ON "webhook_deliveries" ("next_attempt_at") WHERE "status" = 'pending';
+CREATE INDEX IF NOT EXISTS "webhook_deliveries_subscription_idx" ON "webhook_deliveries" ("subscription_uuid", "created_at");
+
+CREATE TABLE IF NOT EXISTS "webhook_attempts" (
+    "delivery_uuid" VARCHAR(50) NOT NULL REFERENCES "webhook_deliveries" ("uuid") ON DELETE CASCADE,
+    "attempt" INTEGER NOT NULL,
+    "status_code" INTEGER,
+    "error" TEXT,
+    "duration_ms" INTEGER NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY ("delivery_uuid", "attempt")
+);
+
+-- events recorded in the transaction of the change they report, published by the relay in the order of
+-- "id" among the events of their aggregate
+CREATE TABLE IF NOT EXISTS "outbox" (
+    "id" BIGSERIAL PRIMARY KEY,
+    "uuid" VARCHAR(50) NOT NULL UNIQUE,
+    "aggregate_type" VARCHAR(50) NOT NULL,
+    "aggregate_id" VARCHAR(50) NOT NULL,
+    "event_type" VARCHAR(50) NOT NULL,
+    "payload" TEXT NOT NULL,
+    "attempts" INTEGER NOT NULL DEFAULT 0,
+    "next_attempt_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "last_error" TEXT,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    "published_at" TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS "outbox_pending_idx" ON "outbox" ("aggregate_type", "aggregate_id", "id") WHERE "published_at" IS NULL;
+CREATE INDEX IF NOT EXISTS "outbox_published_idx" ON "outbox" ("published_at") WHERE "published_at" IS NOT NULL;
+
+-- an event published again by the relay is only delivered once to each subscription
+CREATE UNIQUE INDEX IF NOT EXISTS "webhook_deliveries_event_idx" ON "webhook_deliveries" ("subscription_uuid", "event_uuid") WHERE "replay_of" IS NULL;
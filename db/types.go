@@ -1,5 +1,12 @@
 package db
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/pricing"
+)
+
 // User struct
 type User struct {
 	UUID     string `json:"uuid"`
@@ -11,11 +18,52 @@ type User struct {
 
 // Product struct
 type Product struct {
-	UUID            string `json:"uuid"`
-	AmountAvailable int    `json:"amount_available"`
-	Cost            int    `json:"cost"`
-	ProductName     string `json:"product_name"`
-	SellerID        string `json:"seller_id"`
+	UUID            string          `json:"uuid"`
+	AmountAvailable int             `json:"amount_available"`
+	Cost            int             `json:"cost"`
+	ProductName     string          `json:"product_name"`
+	SellerID        string          `json:"seller_id"`
+	SKU             string          `json:"sku,omitempty"`
+	CategoryUUID    string          `json:"category_id,omitempty"`
+	Tags            []string        `json:"tags,omitempty"`
+	Nutrition       *Nutrition      `json:"nutrition,omitempty"`
+	Allergens       []string        `json:"allergens,omitempty"`
+	Images          []*ProductImage `json:"images,omitempty"`
+}
+
+// Nutrition is the nutrition declaration of a product, per 100 g or 100 ml. The amounts are in grams
+// and the serving size in grams or millilitres
+type Nutrition struct {
+	ServingSize   float64 `json:"serving_size,omitempty"`
+	EnergyKcal    float64 `json:"energy_kcal"`
+	Fat           float64 `json:"fat"`
+	SaturatedFat  float64 `json:"saturated_fat"`
+	Carbohydrates float64 `json:"carbohydrates"`
+	Sugars        float64 `json:"sugars"`
+	Fibre         float64 `json:"fibre,omitempty"`
+	Protein       float64 `json:"protein"`
+	Salt          float64 `json:"salt"`
+}
+
+// Allergens are the allergens a product may declare
+var Allergens = []string{
+	"celery", "crustaceans", "eggs", "fish", "gluten", "lupin", "milk",
+	"molluscs", "mustard", "nuts", "peanuts", "sesame", "soya", "sulphites",
+}
+
+// ProductImage is an image of a product and its thumbnail, served at URL and ThumbnailURL
+type ProductImage struct {
+	UUID         string    `json:"uuid"`
+	ProductUUID  string    `json:"product_id"`
+	ContentType  string    `json:"content_type"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Size         int       `json:"size"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	CreatedAt    time.Time `json:"created_at"`
+	blobKey      string
+	thumbnailKey string
 }
 
 // ChangePassword struct
@@ -27,8 +75,756 @@ type ChangePassword struct {
 
 // BuyResponse response to when a user makes a purchase
 type BuyResponse struct {
-	AmountSpent       int               `json:"amount_spent"`
-	ProductName       string            `json:"product_name"`
-	ProductsPurchased int               `json:"products_purchased"`
-	Change            map[string]string `json:"change"`
+	MachineUUID       string             `json:"machine_id,omitempty"`
+	ProductUUID       string             `json:"product_id,omitempty"`
+	AmountSpent       int                `json:"amount_spent"`
+	ProductName       string             `json:"product_name"`
+	ProductsPurchased int                `json:"products_purchased"`
+	Change            map[string]string  `json:"change"`
+	RemainingCredit   int                `json:"remaining_credit,omitempty"`
+	Slots             map[string]int     `json:"slots,omitempty"`
+	UnitPrice         int                `json:"unit_price,omitempty"`
+	Discount          int                `json:"discount,omitempty"`
+	Promotions        []*pricing.Applied `json:"promotions,omitempty"`
+}
+
+// BasketItem is a quantity of a product to buy
+type BasketItem struct {
+	ProductUUID string `json:"product_id"`
+	Quantity    int    `json:"quantity"`
+}
+
+// BasketResponse response to when a user buys several products at once, bundles apply across them
+type BasketResponse struct {
+	Items       []*BuyResponse     `json:"items"`
+	AmountSpent int                `json:"amount_spent"`
+	Discount    int                `json:"discount,omitempty"`
+	Promotions  []*pricing.Applied `json:"promotions,omitempty"`
+	Change      map[string]string  `json:"change"`
+}
+
+// Machine statuses
+const (
+	MachineActive      = "active"
+	MachineInactive    = "inactive"
+	MachineMaintenance = "maintenance"
+)
+
+// Machine struct
+type Machine struct {
+	UUID     string `json:"uuid"`
+	Location string `json:"location"`
+	Status   string `json:"status"`
+	Currency string `json:"currency"`
+}
+
+// MachineProduct is the stock of a product inside a machine, summed over its slots
+type MachineProduct struct {
+	MachineUUID     string `json:"machine_id"`
+	ProductUUID     string `json:"product_id"`
+	ProductName     string `json:"product_name"`
+	Cost            int    `json:"cost"`
+	SellerID        string `json:"seller_id"`
+	AmountAvailable int    `json:"amount_available"`
+}
+
+// Slot is a numbered coil of a machine, holding up to Capacity units of one product
+type Slot struct {
+	MachineUUID string  `json:"machine_id"`
+	Code        string  `json:"code"`
+	Capacity    int     `json:"capacity"`
+	ProductUUID string  `json:"product_id,omitempty"`
+	ProductName string  `json:"product_name,omitempty"`
+	Amount      int     `json:"amount"`
+	FillLevel   float64 `json:"fill_level"`
+}
+
+// Planogram is the slot layout of a machine with its fill levels
+type Planogram struct {
+	MachineUUID string  `json:"machine_id"`
+	Capacity    int     `json:"capacity"`
+	Amount      int     `json:"amount"`
+	FillLevel   float64 `json:"fill_level"`
+	Slots       []*Slot `json:"slots"`
+}
+
+// MachineCredit is the amount a user has deposited into a machine
+type MachineCredit struct {
+	MachineUUID string            `json:"machine_id"`
+	UserUUID    string            `json:"user_id"`
+	Deposit     int               `json:"deposit"`
+	Change      map[string]string `json:"change,omitempty"`
+}
+
+// CoinCount is the number of coins of a denomination held in a machine's coin box
+type CoinCount struct {
+	Denomination int `json:"denomination"`
+	Count        int `json:"count"`
+}
+
+// Purchase is a recorded sale
+type Purchase struct {
+	UUID        string    `json:"uuid"`
+	MachineUUID string    `json:"machine_id,omitempty"`
+	UserUUID    string    `json:"user_id"`
+	ProductUUID string    `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	SellerID    string    `json:"seller_id"`
+	Quantity    int       `json:"quantity"`
+	UnitCost    int       `json:"unit_cost"`
+	AmountSpent int       `json:"amount_spent"`
+	Change      int       `json:"change"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Discount is what the Promotions took off Quantity units at UnitCost
+	Discount   int                `json:"discount,omitempty"`
+	Promotions []*pricing.Applied `json:"promotions,omitempty"`
+	// VoucherRedemptionUUID is the use of the voucher that paid for part of the sale
+	VoucherRedemptionUUID string `json:"voucher_redemption_id,omitempty"`
+	// BasketUUID groups the purchases of a sale of several products
+	BasketUUID string `json:"basket_id,omitempty"`
+}
+
+// Reservation statuses
+const (
+	ReservationPending    = "pending"
+	ReservationCommitted  = "committed"
+	ReservationRolledBack = "rolled_back"
+	ReservationExpired    = "expired"
+)
+
+// Reservation is stock and credit held for a sale until the machine confirms it dispensed the products
+type Reservation struct {
+	UUID        string             `json:"uuid"`
+	MachineUUID string             `json:"machine_id"`
+	UserUUID    string             `json:"user_id"`
+	ProductUUID string             `json:"product_id"`
+	ProductName string             `json:"product_name"`
+	SellerID    string             `json:"seller_id"`
+	Quantity    int                `json:"quantity"`
+	UnitCost    int                `json:"unit_cost"`
+	Amount      int                `json:"amount"`
+	Discount    int                `json:"discount,omitempty"`
+	Promotions  []*pricing.Applied `json:"promotions,omitempty"`
+	Slots       map[string]int     `json:"slots"`
+	Status      string             `json:"status"`
+	Reason      string             `json:"reason,omitempty"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	CreatedAt   time.Time          `json:"created_at"`
+	ResolvedAt  *time.Time         `json:"resolved_at,omitempty"`
+	Sale        *BuyResponse       `json:"sale,omitempty"`
+	// expired is set for a pending reservation past its deadline
+	expired bool
+}
+
+// MachineSession is the state of a machine's vend cycle and the customer it is serving
+type MachineSession struct {
+	MachineUUID     string            `json:"machine_id"`
+	State           string            `json:"state"`
+	UserUUID        string            `json:"user_id,omitempty"`
+	SlotCode        string            `json:"slot_code,omitempty"`
+	Quantity        int               `json:"quantity,omitempty"`
+	Fault           string            `json:"fault,omitempty"`
+	ReservationUUID string            `json:"reservation_id,omitempty"`
+	Credit          int               `json:"credit"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+	Sale            *BuyResponse      `json:"sale,omitempty"`
+	Change          map[string]string `json:"change,omitempty"`
+}
+
+// SessionEvent is an event reported by a machine's firmware to drive its vend cycle
+type SessionEvent struct {
+	Event    string `json:"event"`
+	Amount   int    `json:"amount,omitempty"`
+	SlotCode string `json:"slot_code,omitempty"`
+	Quantity int    `json:"quantity,omitempty"`
+	Fault    string `json:"fault,omitempty"`
+}
+
+// Inventory movement reasons
+const (
+	MovementRestock         = "restock"
+	MovementSpoilage        = "spoilage"
+	MovementTheft           = "theft"
+	MovementCountCorrection = "count_correction"
+	MovementSale            = "sale"
+	MovementSaleReversal    = "sale_reversal"
+)
+
+// InventoryMovement is a recorded change of stock, of a product or of a machine slot when MachineUUID is set
+type InventoryMovement struct {
+	UUID        string    `json:"uuid"`
+	ProductUUID string    `json:"product_id"`
+	MachineUUID string    `json:"machine_id,omitempty"`
+	SlotCode    string    `json:"slot_code,omitempty"`
+	Change      int       `json:"change"`
+	Balance     int       `json:"balance"`
+	Reason      string    `json:"reason"`
+	Note        string    `json:"note,omitempty"`
+	ActorUUID   string    `json:"actor_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// StockAdjustment is a manual change of a product's stock, a restock with an expiry date is tracked as a batch
+type StockAdjustment struct {
+	Reason    string     `json:"reason"`
+	Change    int        `json:"change"`
+	Note      string     `json:"note"`
+	Lot       string     `json:"lot,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Alert kinds
+const (
+	AlertLowStock      = "low_stock"
+	AlertOutOfStock    = "out_of_stock"
+	AlertCoinTubeLow   = "coin_tube_low"
+	AlertCoinTubeEmpty = "coin_tube_empty"
+	// AlertCashDiscrepancy is raised when the coins collected from a machine differ from those expected,
+	// its value is the counted amount and its threshold the expected one
+	AlertCashDiscrepancy = "cash_discrepancy"
+	// AlertDeviceMismatch is raised when a device acted but what it did could not be recorded, the machine
+	// has to be reconciled by hand; its value is the amount in question
+	AlertDeviceMismatch = "device_mismatch"
+	// AlertAuditFailure is raised when a change was made but its audit entry could not be written, the
+	// change has to be checked and recorded by hand; its value is the status the change was answered with
+	AlertAuditFailure = "audit_failure"
+)
+
+// Alert levels
+const (
+	AlertWarning  = "warning"
+	AlertCritical = "critical"
+)
+
+// Alert statuses
+const (
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// Alert is raised when the stock of a product or the coins of a tube fall to their threshold,
+// a condition raised again before its alert is resolved only counts one more occurrence
+type Alert struct {
+	UUID           string     `json:"uuid"`
+	Kind           string     `json:"kind"`
+	Level          string     `json:"level"`
+	MachineUUID    string     `json:"machine_id,omitempty"`
+	ProductUUID    string     `json:"product_id,omitempty"`
+	Denomination   int        `json:"denomination,omitempty"`
+	Value          int        `json:"value"`
+	Threshold      int        `json:"threshold"`
+	Message        string     `json:"message"`
+	Status         string     `json:"status"`
+	Occurrences    int        `json:"occurrences"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastSeenAt     time.Time  `json:"last_seen_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy     string     `json:"resolved_by,omitempty"`
+}
+
+// StockThreshold is the stock of a product at which a low stock alert is raised
+type StockThreshold struct {
+	ProductUUID string `json:"product_id"`
+	Threshold   int    `json:"threshold"`
+	// Default is set when the product uses the configured threshold
+	Default bool `json:"default"`
+}
+
+// CoinThreshold is the number of coins of a denomination at which a coin tube alert is raised
+type CoinThreshold struct {
+	Denomination int  `json:"denomination"`
+	Threshold    int  `json:"threshold"`
+	Default      bool `json:"default"`
+}
+
+// Batch is a delivery of units of a product sharing an expiry date, in the catalog stock or in a machine
+// slot when MachineUUID is set. Units are sold from the oldest batch first and never once expired
+type Batch struct {
+	UUID        string    `json:"uuid"`
+	ProductUUID string    `json:"product_id"`
+	ProductName string    `json:"product_name,omitempty"`
+	SellerID    string    `json:"seller_id,omitempty"`
+	MachineUUID string    `json:"machine_id,omitempty"`
+	SlotCode    string    `json:"slot_code,omitempty"`
+	Lot         string    `json:"lot,omitempty"`
+	Quantity    int       `json:"quantity"`
+	Remaining   int       `json:"remaining"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	ReceivedAt  time.Time `json:"received_at"`
+	Expired     bool      `json:"expired"`
+}
+
+// ExpiryReport lists the batches of a seller expired or expiring within Days days
+type ExpiryReport struct {
+	SellerID      string   `json:"seller_id"`
+	Days          int      `json:"days"`
+	ExpiredUnits  int      `json:"expired_units"`
+	ExpiringUnits int      `json:"expiring_units"`
+	Batches       []*Batch `json:"batches"`
+}
+
+// Voucher kinds
+const (
+	VoucherPercent = "percent"
+	VoucherFixed   = "fixed"
+)
+
+// Voucher is a promo code taking Value percent, or a fixed Value, off the products it applies to:
+// those of ProductUUID or of SellerID when either is set. It can be redeemed MaxUses times in total,
+// any number of times when MaxUses is 0, and PerUserLimit times by each user when that is set
+type Voucher struct {
+	UUID         string     `json:"uuid"`
+	Code         string     `json:"code"`
+	Kind         string     `json:"kind"`
+	Value        int        `json:"value"`
+	MaxUses      int        `json:"max_uses"`
+	PerUserLimit int        `json:"per_user_limit,omitempty"`
+	Uses         int        `json:"uses"`
+	ProductUUID  string     `json:"product_id,omitempty"`
+	SellerID     string     `json:"seller_id,omitempty"`
+	StartsAt     *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Active       bool       `json:"active"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// VoucherRedemption is a use of a voucher by a user
+type VoucherRedemption struct {
+	UUID        string    `json:"uuid"`
+	VoucherUUID string    `json:"voucher_id"`
+	UserUUID    string    `json:"user_id"`
+	Discount    int       `json:"discount"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Category groups products, a category nests under its parent. Path holds the names of the
+// categories from the root down to this one
+type Category struct {
+	UUID       string      `json:"uuid"`
+	Name       string      `json:"name"`
+	ParentUUID string      `json:"parent_id,omitempty"`
+	Path       []string    `json:"path"`
+	Children   []*Category `json:"children,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// ProductFilter selects products of the catalog: those of CategoryUUID or of its subcategories,
+// carrying all of Tags and sold by SellerID, each when set. Query is the text of a search
+type ProductFilter struct {
+	CategoryUUID string
+	Tags         []string
+	SellerID     string
+	Query        string
+	Limit        int
+	// ExcludeAllergens leaves out the products declaring any of them
+	ExcludeAllergens []string
+}
+
+// SearchResult is a product matching a search, the most relevant have the highest rank
+type SearchResult struct {
+	*Product
+	Rank float64 `json:"rank"`
+}
+
+// Product import modes
+const (
+	// ImportInsert only creates products, a row whose sku is already used is an error
+	ImportInsert = "insert"
+	// ImportUpsert creates the products of new skus and updates those of known skus
+	ImportUpsert = "upsert"
+)
+
+// ProductImportRow is a product of a bulk import or export, identified by its seller's SKU.
+// An upsert leaves the stock of a known product alone when AmountAvailable is nil, and its
+// nutrition declaration when Nutrition is nil
+type ProductImportRow struct {
+	Line            int        `json:"-"`
+	SKU             string     `json:"sku"`
+	ProductName     string     `json:"product_name"`
+	Cost            int        `json:"cost"`
+	AmountAvailable *int       `json:"amount_available,omitempty"`
+	CategoryUUID    string     `json:"category_id,omitempty"`
+	Tags            []string   `json:"tags,omitempty"`
+	Allergens       []string   `json:"allergens,omitempty"`
+	Nutrition       *Nutrition `json:"nutrition,omitempty"`
+}
+
+// ImportError is the reason a row of a bulk import was rejected, Line is the row's line in the imported file
+type ImportError struct {
+	Line  int    `json:"line"`
+	SKU   string `json:"sku,omitempty"`
+	Error string `json:"error"`
+}
+
+// ImportedProduct is the outcome of a row of a bulk import
+type ImportedProduct struct {
+	Line        int    `json:"line"`
+	SKU         string `json:"sku"`
+	ProductUUID string `json:"product_id"`
+	// Action is created or updated
+	Action string `json:"action"`
+}
+
+// ImportResult reports a bulk import. Nothing is written when it is a dry run or when any row has an error
+type ImportResult struct {
+	DryRun   bool               `json:"dry_run"`
+	Mode     string             `json:"mode"`
+	Rows     int                `json:"rows"`
+	Created  int                `json:"created"`
+	Updated  int                `json:"updated"`
+	Products []*ImportedProduct `json:"products"`
+	Errors   []*ImportError     `json:"errors"`
+}
+
+// Sales report groupings, by a dimension of the purchases or by the period they were made in
+const (
+	SalesByProduct = "product"
+	SalesBySeller  = "seller"
+	SalesByMachine = "machine"
+	SalesByHour    = "hour"
+	SalesByDay     = "day"
+	SalesByWeek    = "week"
+)
+
+// Sales report rankings
+const (
+	RankByRevenue = "revenue"
+	RankByUnits   = "units"
+)
+
+// SalesFilter selects the purchases of a report, made in [From, To) and of SellerID, MachineUUID
+// and ProductUUID when set. The hour, day and week buckets start at midnight in Location
+type SalesFilter struct {
+	From        time.Time
+	To          time.Time
+	SellerID    string
+	MachineUUID string
+	ProductUUID string
+	GroupBy     string
+	// RankBy orders the groups by revenue or units, highest first, time buckets are always in order
+	RankBy   string
+	Limit    int
+	Location *time.Location
+}
+
+// SalesFigures are the totals of a set of purchases. A transaction is a sale, of one or several
+// products, and the basket averages are per transaction
+type SalesFigures struct {
+	Revenue            int     `json:"revenue"`
+	Discount           int     `json:"discount"`
+	Units              int     `json:"units"`
+	Transactions       int     `json:"transactions"`
+	AverageBasketValue float64 `json:"average_basket_value"`
+	AverageBasketUnits float64 `json:"average_basket_units"`
+}
+
+// SalesRow is a group of a sales report. Key is the product, seller or machine uuid, empty for sales
+// outside machines, or the start of the time bucket, and Label names it
+type SalesRow struct {
+	Key   string `json:"key"`
+	Label string `json:"label,omitempty"`
+	SalesFigures
+}
+
+// SalesReport are the sales of a period grouped by GroupBy
+type SalesReport struct {
+	GroupBy string        `json:"group_by"`
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Totals  *SalesFigures `json:"totals"`
+	Rows    []*SalesRow   `json:"rows"`
+}
+
+// StockTurnover is how often the stock of a product sold over a period. Turnover is the units sold
+// over the average of the opening and closing stock, DaysOfStock how long the closing stock lasts at
+// the period's sales rate, nil when nothing sold
+type StockTurnover struct {
+	ProductUUID  string   `json:"product_id"`
+	ProductName  string   `json:"product_name"`
+	SellerID     string   `json:"seller_id"`
+	UnitsSold    int      `json:"units_sold"`
+	OpeningStock int      `json:"opening_stock"`
+	ClosingStock int      `json:"closing_stock"`
+	AverageStock float64  `json:"average_stock"`
+	Turnover     float64  `json:"turnover"`
+	DaysOfStock  *float64 `json:"days_of_stock"`
+}
+
+// TurnoverReport is the stock turnover of products over a period, fastest first
+type TurnoverReport struct {
+	From     time.Time        `json:"from"`
+	To       time.Time        `json:"to"`
+	Products []*StockTurnover `json:"products"`
+}
+
+// Coin movement reasons
+const (
+	CoinDeposit    = "deposit"
+	CoinChange     = "change"
+	CoinCollection = "collection"
+)
+
+// Cash collection statuses
+const (
+	CollectionBalanced    = "balanced"
+	CollectionDiscrepancy = "discrepancy"
+)
+
+// CashCollectionInput is what an operator counted when emptying a coin box, and the coins put back
+// in it as float for the change
+type CashCollectionInput struct {
+	Counted []*CoinCount `json:"counted"`
+	Left    []*CoinCount `json:"left"`
+	Note    string       `json:"note"`
+}
+
+// CashBoxCoins are the coins of a denomination in a coin box since its last collection: Opening were
+// left in it then, Deposited came in and PaidOut went out as change, leaving Expected. A collection
+// adds what was Counted and the coins Left in the box
+type CashBoxCoins struct {
+	Denomination int `json:"denomination"`
+	Opening      int `json:"opening"`
+	Deposited    int `json:"deposited"`
+	PaidOut      int `json:"paid_out"`
+	Expected     int `json:"expected"`
+	Counted      int `json:"counted"`
+	Difference   int `json:"difference"`
+	Left         int `json:"left"`
+}
+
+// CashBox is what a machine's coin box should hold, since its last collection at Since
+type CashBox struct {
+	MachineUUID   string          `json:"machine_id"`
+	Since         *time.Time      `json:"since,omitempty"`
+	Coins         []*CashBoxCoins `json:"coins"`
+	ExpectedTotal int             `json:"expected_total"`
+}
+
+// CashCollection is a recorded emptying of a coin box. The totals are amounts, the coins of each
+// denomination times its value, and Difference is the counted total less the expected one
+type CashCollection struct {
+	UUID          string          `json:"uuid"`
+	MachineUUID   string          `json:"machine_id"`
+	Coins         []*CashBoxCoins `json:"coins"`
+	ExpectedTotal int             `json:"expected_total"`
+	CountedTotal  int             `json:"counted_total"`
+	LeftTotal     int             `json:"left_total"`
+	Difference    int             `json:"difference"`
+	Status        string          `json:"status"`
+	Note          string          `json:"note,omitempty"`
+	CollectedBy   string          `json:"collected_by,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// AuditEntry records a mutating request: the Actor, the username of its session, performed the Action,
+// the method and route, on Target, its path. Before and After are json snapshots of the state changed
+// and Hash chains the entry to the one before it
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	RequestID string          `json:"request_id"`
+	Status    int             `json:"status"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+}
+
+// AuditFilter selects audit entries, the newest first. Target matches the entries on a path and the
+// paths below it, BeforeID pages through older entries
+type AuditFilter struct {
+	Actor     string    `json:"actor,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	From      time.Time `json:"from,omitempty"`
+	To        time.Time `json:"to,omitempty"`
+	BeforeID  int64     `json:"before_id,omitempty"`
+	Limit     int       `json:"limit,omitempty"`
+}
+
+// AuditVerification is the outcome of checking the hash chain of the audit log, BrokenAt being the
+// first entry whose hash or link does not match
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Entries  int    `json:"entries"`
+	LastHash string `json:"last_hash,omitempty"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Event types recorded in the outbox
+const (
+	EventPurchaseCompleted = "purchase.completed"
+	EventProductOutOfStock = "product.out_of_stock"
+	EventDepositReceived   = "deposit.received"
+	EventUserCreated       = "user.created"
+	EventUserBalanceReset  = "user.balance_reset"
+	EventUserDeleted       = "user.deleted"
+	EventProductCreated    = "product.created"
+	EventProductUpdated    = "product.updated"
+	EventProductDeleted    = "product.deleted"
+)
+
+// Aggregates of the outbox events, the events of an aggregate are published in the order they were recorded
+const (
+	AggregateUser    = "user"
+	AggregateProduct = "product"
+)
+
+// OutboxEvent is an event recorded in the transaction of the change it reports, waiting to be published
+// to the sinks. Sequence orders the events of an aggregate
+type OutboxEvent struct {
+	Sequence      int64           `json:"sequence"`
+	UUID          string          `json:"id"`
+	Type          string          `json:"type"`
+	AggregateType string          `json:"aggregate_type"`
+	AggregateID   string          `json:"aggregate_id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Data          json.RawMessage `json:"data"`
+	// Attempts counts the claims of the event, the current one included
+	Attempts int `json:"-"`
+}
+
+// ProductChange is the data of the product.created, product.updated and product.deleted events, only
+// the product id is set for a deleted product
+type ProductChange struct {
+	ProductUUID     string `json:"product_id"`
+	ProductName     string `json:"product_name,omitempty"`
+	Cost            int    `json:"cost,omitempty"`
+	SellerID        string `json:"seller_id,omitempty"`
+	SKU             string `json:"sku,omitempty"`
+	AmountAvailable int    `json:"amount_available,omitempty"`
+}
+
+// StockOut is the data of a product.out_of_stock event, MachineUUID is set when a machine ran out
+type StockOut struct {
+	ProductUUID string `json:"product_id"`
+	ProductName string `json:"product_name"`
+	MachineUUID string `json:"machine_id,omitempty"`
+	Stock       int    `json:"stock"`
+}
+
+// DepositReceived is the data of a deposit.received event, Balance is the credit of the user after it,
+// in the machine when MachineUUID is set
+type DepositReceived struct {
+	UserUUID    string `json:"user_id"`
+	MachineUUID string `json:"machine_id,omitempty"`
+	Amount      int    `json:"amount"`
+	Balance     int    `json:"balance"`
+}
+
+// BalanceReset is the data of a user.balance_reset event: the balance of a user was set to Balance
+// from PreviousBalance rather than changed by a deposit or a purchase
+type BalanceReset struct {
+	UserUUID        string `json:"user_id"`
+	PreviousBalance int    `json:"previous_balance"`
+	Balance         int    `json:"balance"`
+}
+
+// WebhookEvents are the event types a webhook can subscribe to
+var WebhookEvents = []string{EventPurchaseCompleted, EventProductOutOfStock, EventDepositReceived, EventUserCreated,
+	EventUserBalanceReset, EventUserDeleted, EventProductCreated, EventProductUpdated, EventProductDeleted}
+
+// StockLevel is the data of a stock event: the stock of a product in the catalog, or in a slot of a
+// machine when MachineUUID is set
+type StockLevel struct {
+	ProductUUID string `json:"product_id"`
+	MachineUUID string `json:"machine_id,omitempty"`
+	SlotCode    string `json:"slot_code,omitempty"`
+	Stock       int    `json:"stock"`
+}
+
+// Balance is the data of a balance event: the deposit of a user, or their credit in a machine when
+// MachineUUID is set
+type Balance struct {
+	UserUUID    string `json:"user_id"`
+	MachineUUID string `json:"machine_id,omitempty"`
+	Balance     int    `json:"balance"`
+}
+
+// MachineState is the data of the machine events: its status, or the state of its vend cycle without
+// the customer it serves
+type MachineState struct {
+	MachineUUID string     `json:"machine_id"`
+	Status      string     `json:"status,omitempty"`
+	State       string     `json:"state,omitempty"`
+	Fault       string     `json:"fault,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookSubscription posts the events of its types to URL, signed with Secret. The secret is only
+// returned when it is set
+type WebhookSubscription struct {
+	UUID        string    `json:"uuid"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Secret      string    `json:"secret,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Active      *bool     `json:"active,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// WebhookEvent is the body posted to the subscriptions of its type
+type WebhookEvent struct {
+	UUID      string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is an event sent to a subscription, Payload being the body posted
+type WebhookDelivery struct {
+	UUID             string            `json:"uuid"`
+	SubscriptionUUID string            `json:"webhook_id"`
+	EventUUID        string            `json:"event_id"`
+	EventType        string            `json:"event_type"`
+	Payload          json.RawMessage   `json:"payload"`
+	Status           string            `json:"status"`
+	Attempts         int               `json:"attempts"`
+	NextAttemptAt    *time.Time        `json:"next_attempt_at,omitempty"`
+	LastStatusCode   int               `json:"last_status_code,omitempty"`
+	LastError        string            `json:"last_error,omitempty"`
+	ReplayOf         string            `json:"replay_of,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+	DeliveredAt      *time.Time        `json:"delivered_at,omitempty"`
+	AttemptLog       []*WebhookAttempt `json:"attempt_log,omitempty"`
+	// URL and Secret are where and how a claimed delivery is sent
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookAttempt is an attempt to send a delivery, StatusCode is 0 when no response was received
+type WebhookAttempt struct {
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int       `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookOutcome is the result of an attempt to send a claimed delivery, a failed delivery is sent
+// again at RetryAt or given up when it is nil
+type WebhookOutcome struct {
+	StatusCode int
+	Error      string
+	Duration   time.Duration
+	Delivered  bool
+	RetryAt    *time.Time
 }
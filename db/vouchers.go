@@ -0,0 +1,371 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/pricing"
+	uuid "github.com/satori/go.uuid"
+)
+
+var voucherCodeRegex = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// normalizeVoucherCode makes codes case insensitive
+func normalizeVoucherCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// validateVoucher checks the editable fields of a voucher
+func validateVoucher(v *Voucher) error {
+	v.Code = normalizeVoucherCode(v.Code)
+	if !voucherCodeRegex.MatchString(v.Code) {
+		return fmt.Errorf("invalid voucher code '%s': use 3 to 32 letters, digits, '-' or '_'", v.Code)
+	}
+	switch v.Kind {
+	case VoucherPercent:
+		if v.Value <= 0 || v.Value > 100 {
+			return errors.New("a percent voucher needs a value between 1 and 100")
+		}
+	case VoucherFixed:
+		if v.Value <= 0 {
+			return errors.New("a fixed voucher needs a positive value")
+		}
+	default:
+		return fmt.Errorf("invalid voucher kind '%s': use one of %s, %s", v.Kind, VoucherPercent, VoucherFixed)
+	}
+	if v.MaxUses < 0 || v.PerUserLimit < 0 {
+		return errors.New("max_uses and per_user_limit should not be negative")
+	}
+	if v.StartsAt != nil && v.ExpiresAt != nil && !v.ExpiresAt.After(*v.StartsAt) {
+		return errors.New("expires_at must be after starts_at")
+	}
+	return nil
+}
+
+const voucherColumns = `uuid, code, kind, value, max_uses, per_user_limit, uses, coalesce(product_uuid, ''), coalesce(seller_id, ''),
+	starts_at, expires_at, active, coalesce(created_by, ''), created_at`
+
+// scanVouchers reads vouchers selected with voucherColumns
+func scanVouchers(rows *sql.Rows) (vouchers []*Voucher, err error) {
+	defer rows.Close()
+	vouchers = make([]*Voucher, 0)
+	for rows.Next() {
+		v := new(Voucher)
+		var startsAt, expiresAt sql.NullTime
+		err = rows.Scan(&v.UUID, &v.Code, &v.Kind, &v.Value, &v.MaxUses, &v.PerUserLimit, &v.Uses, &v.ProductUUID, &v.SellerID,
+			&startsAt, &expiresAt, &v.Active, &v.CreatedBy, &v.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if startsAt.Valid {
+			v.StartsAt = &startsAt.Time
+		}
+		if expiresAt.Valid {
+			v.ExpiresAt = &expiresAt.Time
+		}
+		vouchers = append(vouchers, v)
+	}
+	return vouchers, rows.Err()
+}
+
+// checkVoucherScope checks that the product a voucher is restricted to belongs to the seller it is restricted to
+func (s *service) checkVoucherScope(ctx context.Context, v *Voucher) error {
+	if v.ProductUUID == "" {
+		return nil
+	}
+	product, err := s.GetProduct(ctx, v.ProductUUID)
+	if err != nil {
+		return err
+	}
+	if v.SellerID != "" && product.SellerID != v.SellerID {
+		return fmt.Errorf("product '%s' is not sold by seller '%s'", v.ProductUUID, v.SellerID)
+	}
+	return nil
+}
+
+// CreateVoucher stores a new voucher
+func (s *service) CreateVoucher(ctx context.Context, vInput *Voucher, actorUUID string) (voucher *Voucher, err error) {
+	defer func() {
+		log.Outcome(ctx, "CreateVoucher(exit)", err, logger.Fields{"code": vInput.Code, "actorUUID": actorUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = validateVoucher(vInput); err != nil {
+		return
+	}
+	if err = s.checkVoucherScope(ctx, vInput); err != nil {
+		return
+	}
+	rows, err := s.Query(ctx, s.db, nil, "select 1 from vouchers where code = $1", vInput.Code)
+	if err != nil {
+		return
+	}
+	var one int
+	exists, err := scanOne(rows, &one)
+	if err != nil {
+		return
+	}
+	if exists {
+		return nil, fmt.Errorf("voucher code '%s' already exists", vInput.Code)
+	}
+
+	vInput.UUID = uuid.NewV4().String()
+	insert := `insert into vouchers(uuid, code, kind, value, max_uses, per_user_limit, product_uuid, seller_id, starts_at, expires_at, active, created_by)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+	_, err = s.RunQuery(ctx, s.db, nil, insert, vInput.UUID, vInput.Code, vInput.Kind, vInput.Value, vInput.MaxUses, vInput.PerUserLimit,
+		nullString(vInput.ProductUUID), nullString(vInput.SellerID), vInput.StartsAt, vInput.ExpiresAt, vInput.Active, nullString(actorUUID))
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateVoucher"))
+		return
+	}
+	return s.GetVoucher(ctx, vInput.UUID)
+}
+
+// GetVoucher returns a voucher
+func (s *service) GetVoucher(ctx context.Context, voucherUUID string) (voucher *Voucher, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetVoucher(exit)", err, logger.Fields{"voucherUUID": voucherUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil, "select "+voucherColumns+" from vouchers where uuid = $1", voucherUUID)
+	if err != nil {
+		return
+	}
+	vouchers, err := scanVouchers(rows)
+	if err != nil {
+		return
+	}
+	if len(vouchers) == 0 {
+		return nil, fmt.Errorf("cannot find voucher with uuid '%s'", voucherUUID)
+	}
+	return vouchers[0], nil
+}
+
+// GetVouchers lists the vouchers, the newest first
+func (s *service) GetVouchers(ctx context.Context) (vouchers []*Voucher, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetVouchers(exit)", err, nil)
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil, "select "+voucherColumns+" from vouchers order by created_at desc, uuid limit 500")
+	if err != nil {
+		return
+	}
+	return scanVouchers(rows)
+}
+
+// UpdateVoucher replaces the editable fields of a voucher, its uses are kept
+func (s *service) UpdateVoucher(ctx context.Context, vInput *Voucher) (voucher *Voucher, err error) {
+	defer func() {
+		log.Outcome(ctx, "UpdateVoucher(exit)", err, logger.Fields{"voucherUUID": vInput.UUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = validateVoucher(vInput); err != nil {
+		return
+	}
+	if err = s.checkVoucherScope(ctx, vInput); err != nil {
+		return
+	}
+	rows, err := s.Query(ctx, s.db, nil, "select 1 from vouchers where code = $1 and uuid <> $2", vInput.Code, vInput.UUID)
+	if err != nil {
+		return
+	}
+	var one int
+	exists, err := scanOne(rows, &one)
+	if err != nil {
+		return
+	}
+	if exists {
+		return nil, fmt.Errorf("voucher code '%s' already exists", vInput.Code)
+	}
+
+	update := `update vouchers set code = $2, kind = $3, value = $4, max_uses = $5, per_user_limit = $6, product_uuid = $7, seller_id = $8,
+		starts_at = $9, expires_at = $10, active = $11
+		where uuid = $1`
+	res, err := s.RunQuery(ctx, s.db, nil, update, vInput.UUID, vInput.Code, vInput.Kind, vInput.Value, vInput.MaxUses, vInput.PerUserLimit,
+		nullString(vInput.ProductUUID), nullString(vInput.SellerID), vInput.StartsAt, vInput.ExpiresAt, vInput.Active)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateVoucher"))
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("cannot find voucher with uuid '%s'", vInput.UUID)
+	}
+	return s.GetVoucher(ctx, vInput.UUID)
+}
+
+// DeleteVoucher removes a voucher that was never redeemed, a redeemed voucher can only be deactivated
+func (s *service) DeleteVoucher(ctx context.Context, voucherUUID string) (err error) {
+	defer func() {
+		log.Outcome(ctx, "DeleteVoucher(exit)", err, logger.Fields{"voucherUUID": voucherUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	res, err := s.RunQuery(ctx, s.db, nil, "delete from vouchers where uuid = $1 and uses = 0", voucherUUID)
+	if err != nil {
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
+	if _, err = s.GetVoucher(ctx, voucherUUID); err != nil {
+		return
+	}
+	return errors.New("voucher has been redeemed, deactivate it instead")
+}
+
+// GetVoucherRedemptions lists the uses of a voucher, the newest first
+func (s *service) GetVoucherRedemptions(ctx context.Context, voucherUUID string) (redemptions []*VoucherRedemption, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetVoucherRedemptions(exit)", err, logger.Fields{"voucherUUID": voucherUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		`select uuid, voucher_uuid, coalesce(user_uuid, ''), discount, created_at from voucher_redemptions
+		where voucher_uuid = $1 order by created_at desc, uuid limit 500`,
+		voucherUUID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	redemptions = make([]*VoucherRedemption, 0)
+	for rows.Next() {
+		r := new(VoucherRedemption)
+		if err = rows.Scan(&r.UUID, &r.VoucherUUID, &r.UserUUID, &r.Discount, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	err = rows.Err()
+	return
+}
+
+// applyVoucher takes the discount of a voucher off the lines of quote it applies to, shared in proportion
+// to what they cost, and returns it
+func applyVoucher(v *Voucher, quote *pricing.Quote, products map[string]*Product) (discount int, err error) {
+	var eligible []*pricing.PricedLine
+	amount := 0
+	for _, line := range quote.Lines {
+		if v.ProductUUID != "" && line.ProductUUID != v.ProductUUID {
+			continue
+		}
+		if v.SellerID != "" && products[line.ProductUUID].SellerID != v.SellerID {
+			continue
+		}
+		eligible = append(eligible, line)
+		amount += line.Amount
+	}
+	if len(eligible) == 0 {
+		return 0, fmt.Errorf("voucher '%s' does not apply to these products", v.Code)
+	}
+
+	discount = v.Value
+	if v.Kind == VoucherPercent {
+		discount = (amount*v.Value + 50) / 100
+	}
+	if discount > amount {
+		discount = amount
+	}
+	shared := 0
+	for i, line := range eligible {
+		share := 0
+		if amount > 0 {
+			share = discount * line.Amount / amount
+		}
+		if i == len(eligible)-1 {
+			share = discount - shared
+		}
+		shared += share
+		if share == 0 {
+			continue
+		}
+		line.Amount -= share
+		line.Discount += share
+		line.Promotions = append(line.Promotions, &pricing.Applied{RuleUUID: v.UUID, Kind: pricing.KindVoucher, Name: v.Code, Discount: share})
+	}
+	if discount > 0 {
+		quote.Amount -= discount
+		quote.Discount += discount
+		quote.Promotions = append(quote.Promotions, &pricing.Applied{RuleUUID: v.UUID, Kind: pricing.KindVoucher, Name: v.Code, Discount: discount})
+	}
+	return discount, nil
+}
+
+// redeemVoucher checks that a user may use the voucher of code now, takes its discount off quote and
+// records the use inside tr, so that it only counts when the sale commits
+func (s *service) redeemVoucher(ctx context.Context, tr *sql.Tx, code, userUUID string, quote *pricing.Quote, products map[string]*Product) (redemption *VoucherRedemption, err error) {
+	code = normalizeVoucherCode(code)
+	rows, err := s.Query(ctx, s.db, tr, "select "+voucherColumns+" from vouchers where code = $1 for update", code)
+	if err != nil {
+		return
+	}
+	vouchers, err := scanVouchers(rows)
+	if err != nil {
+		return
+	}
+	if len(vouchers) == 0 {
+		return nil, fmt.Errorf("invalid voucher code '%s'", code)
+	}
+	v := vouchers[0]
+	now := time.Now()
+	switch {
+	case !v.Active:
+		return nil, fmt.Errorf("voucher '%s' is not active", code)
+	case v.StartsAt != nil && now.Before(*v.StartsAt):
+		return nil, fmt.Errorf("voucher '%s' is not valid before %s", code, v.StartsAt.Format(time.RFC3339))
+	case v.ExpiresAt != nil && !now.Before(*v.ExpiresAt):
+		return nil, fmt.Errorf("voucher '%s' has expired", code)
+	case v.MaxUses > 0 && v.Uses >= v.MaxUses:
+		return nil, fmt.Errorf("voucher '%s' has been used up", code)
+	}
+	if v.PerUserLimit > 0 {
+		rows, err := s.Query(ctx, s.db, tr, "select count(*) from voucher_redemptions where voucher_uuid = $1 and user_uuid = $2", v.UUID, userUUID)
+		if err != nil {
+			return nil, err
+		}
+		var used int
+		if _, err = scanOne(rows, &used); err != nil {
+			return nil, err
+		}
+		if used >= v.PerUserLimit {
+			return nil, fmt.Errorf("voucher '%s' can only be used %d times per user", code, v.PerUserLimit)
+		}
+	}
+
+	discount, err := applyVoucher(v, quote, products)
+	if err != nil {
+		return
+	}
+	if _, err = s.RunQuery(ctx, s.db, tr, "update vouchers set uses = uses + 1 where uuid = $1", v.UUID); err != nil {
+		return
+	}
+	redemption = &VoucherRedemption{UUID: uuid.NewV4().String(), VoucherUUID: v.UUID, UserUUID: userUUID, Discount: discount}
+	rows, err = s.Query(ctx, s.db, tr,
+		"insert into voucher_redemptions(uuid, voucher_uuid, user_uuid, discount) values ($1, $2, $3, $4) returning created_at",
+		redemption.UUID, v.UUID, userUUID, discount)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "redeemVoucher"))
+	}
+	if _, err = scanOne(rows, &redemption.CreatedAt); err != nil {
+		return nil, err
+	}
+	return redemption, nil
+}
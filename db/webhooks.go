@@ -0,0 +1,454 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// minWebhookSecret is the shortest secret a subscription may be given
+	minWebhookSecret = 16
+	// defaultDeliveryLimit is the length of a page of deliveries without limit
+	defaultDeliveryLimit = 100
+)
+
+// newWebhookSecret generates the signing secret of a subscription created without one
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// validateWebhook checks a subscription, removing the event types listed twice
+func validateWebhook(w *WebhookSubscription) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url '%s': use an absolute http or https url", w.URL)
+	}
+	if len(w.Events) == 0 {
+		return fmt.Errorf("subscribe to at least one event: %v", WebhookEvents)
+	}
+	events := make([]string, 0, len(w.Events))
+	seen := make(map[string]bool, len(w.Events))
+	for _, event := range w.Events {
+		known := false
+		for _, e := range WebhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return fmt.Errorf("invalid event '%s': use one of %v", event, WebhookEvents)
+		}
+		if !seen[event] {
+			events = append(events, event)
+		}
+		seen[event] = true
+	}
+	w.Events = events
+	if w.Secret != "" && len(w.Secret) < minWebhookSecret {
+		return fmt.Errorf("secret should have at least %d characters", minWebhookSecret)
+	}
+	if len(w.Description) > 255 {
+		return errors.New("description should not exceed 255 characters")
+	}
+	return nil
+}
+
+// QueueWebhookEvent queues an event of the outbox for the active webhooks subscribed to its type. The
+// relay may publish an event more than once, each subscription is only queued one delivery of it
+func (s *service) QueueWebhookEvent(ctx context.Context, event *OutboxEvent) (err error) {
+	defer func() {
+		log.Outcome(ctx, "QueueWebhookEvent(exit)", err, logger.Fields{"eventUUID": event.UUID, "event": event.Type})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	payload, err := json.Marshal(&WebhookEvent{UUID: event.UUID, Type: event.Type, CreatedAt: event.CreatedAt, Data: event.Data})
+	if err != nil {
+		return
+	}
+	return s.inTransaction(ctx, func(tr *sql.Tx) error {
+		rows, err := s.Query(ctx, s.db, tr, "select uuid from webhook_subscriptions where active and $1 = any(events)", event.Type)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		subscriptions := make([]string, 0)
+		for rows.Next() {
+			var subscription string
+			if err = rows.Scan(&subscription); err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, subscription := range subscriptions {
+			_, err = s.RunQuery(ctx, s.db, tr,
+				`insert into webhook_deliveries(uuid, subscription_uuid, event_uuid, event_type, payload) values ($1, $2, $3, $4, $5)
+				on conflict (subscription_uuid, event_uuid) where replay_of is null do nothing`,
+				uuid.NewV4().String(), subscription, event.UUID, event.Type, string(payload))
+			if err != nil {
+				return errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "QueueWebhookEvent"))
+			}
+		}
+		return nil
+	})
+}
+
+const webhookColumns = "uuid, url, events, description, active, created_by, created_at, updated_at"
+
+// scanWebhooks reads the rows of webhook_subscriptions, without their secret
+func scanWebhooks(rows *sql.Rows) (webhooks []*WebhookSubscription, err error) {
+	defer rows.Close()
+	webhooks = make([]*WebhookSubscription, 0)
+	for rows.Next() {
+		w := &WebhookSubscription{Active: new(bool)}
+		var description, createdBy sql.NullString
+		err = rows.Scan(&w.UUID, &w.URL, pq.Array(&w.Events), &description, w.Active, &createdBy, &w.CreatedAt, &w.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		w.Description, w.CreatedBy = description.String, createdBy.String
+		webhooks = append(webhooks, w)
+	}
+	err = rows.Err()
+	return
+}
+
+// CreateWebhook subscribes a url to event types, generating its secret when it has none. The secret is
+// only returned here and when it is changed
+func (s *service) CreateWebhook(ctx context.Context, input *WebhookSubscription, actorUUID string) (webhook *WebhookSubscription, err error) {
+	defer func() {
+		log.Outcome(ctx, "CreateWebhook(exit)", err, logger.Fields{"events": input.Events, "actorUUID": actorUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = validateWebhook(input); err != nil {
+		return
+	}
+	secret := input.Secret
+	if secret == "" {
+		if secret, err = newWebhookSecret(); err != nil {
+			return
+		}
+	}
+	active := input.Active == nil || *input.Active
+
+	uid := uuid.NewV4().String()
+	_, err = s.RunQuery(ctx, s.db, nil,
+		`insert into webhook_subscriptions(uuid, url, events, secret, description, active, created_by)
+		values ($1, $2, $3, $4, $5, $6, $7)`,
+		uid, input.URL, pq.Array(input.Events), secret, nullString(input.Description), active, nullString(actorUUID))
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "CreateWebhook"))
+		return
+	}
+	if webhook, err = s.GetWebhook(ctx, uid); err != nil {
+		return
+	}
+	webhook.Secret = secret
+	return webhook, nil
+}
+
+// GetWebhook returns a webhook subscription
+func (s *service) GetWebhook(ctx context.Context, webhookUUID string) (webhook *WebhookSubscription, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetWebhook(exit)", err, logger.Fields{"webhookUUID": webhookUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil, "select "+webhookColumns+" from webhook_subscriptions where uuid = $1", webhookUUID)
+	if err != nil {
+		return
+	}
+	webhooks, err := scanWebhooks(rows)
+	if err != nil {
+		return
+	}
+	if len(webhooks) == 0 {
+		return nil, fmt.Errorf("cannot find webhook with uuid '%s'", webhookUUID)
+	}
+	return webhooks[0], nil
+}
+
+// GetWebhooks lists the webhook subscriptions, the newest first
+func (s *service) GetWebhooks(ctx context.Context) (webhooks []*WebhookSubscription, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetWebhooks(exit)", err, nil)
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil, "select "+webhookColumns+" from webhook_subscriptions order by created_at desc, uuid")
+	if err != nil {
+		return
+	}
+	return scanWebhooks(rows)
+}
+
+// UpdateWebhook replaces the url, events and description of a subscription, its secret and active flag
+// are only changed when given
+func (s *service) UpdateWebhook(ctx context.Context, input *WebhookSubscription) (webhook *WebhookSubscription, err error) {
+	defer func() {
+		log.Outcome(ctx, "UpdateWebhook(exit)", err, logger.Fields{"webhookUUID": input.UUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err = validateWebhook(input); err != nil {
+		return
+	}
+	res, err := s.RunQuery(ctx, s.db, nil,
+		`update webhook_subscriptions set url = $2, events = $3, description = $4, secret = coalesce($5, secret),
+		active = coalesce($6, active), updated_at = now()
+		where uuid = $1`,
+		input.UUID, input.URL, pq.Array(input.Events), nullString(input.Description), nullString(input.Secret), input.Active)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%+v: %+v", err.Error(), "UpdateWebhook"))
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("cannot find webhook with uuid '%s'", input.UUID)
+	}
+	if webhook, err = s.GetWebhook(ctx, input.UUID); err != nil {
+		return
+	}
+	webhook.Secret = input.Secret
+	return webhook, nil
+}
+
+// DeleteWebhook removes a subscription with its deliveries
+func (s *service) DeleteWebhook(ctx context.Context, webhookUUID string) (err error) {
+	defer func() {
+		log.Outcome(ctx, "DeleteWebhook(exit)", err, logger.Fields{"webhookUUID": webhookUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	res, err := s.RunQuery(ctx, s.db, nil, "delete from webhook_subscriptions where uuid = $1", webhookUUID)
+	if err != nil {
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("cannot find webhook with uuid '%s'", webhookUUID)
+	}
+	return nil
+}
+
+const deliveryColumns = `d.uuid, d.subscription_uuid, d.event_uuid, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at,
+	coalesce(d.last_status_code, 0), coalesce(d.last_error, ''), coalesce(d.replay_of, ''), d.created_at, d.delivered_at`
+
+// scanDelivery reads a row of deliveryColumns followed by extra
+func scanDelivery(rows *sql.Rows, extra ...interface{}) (*WebhookDelivery, error) {
+	d := new(WebhookDelivery)
+	var payload string
+	var next time.Time
+	dest := append([]interface{}{&d.UUID, &d.SubscriptionUUID, &d.EventUUID, &d.EventType, &payload, &d.Status, &d.Attempts, &next,
+		&d.LastStatusCode, &d.LastError, &d.ReplayOf, &d.CreatedAt, &d.DeliveredAt}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	if d.Status == DeliveryPending {
+		d.NextAttemptAt = &next
+	}
+	return d, nil
+}
+
+// GetWebhookDeliveries lists the latest deliveries of a subscription, optionally only those with a status
+func (s *service) GetWebhookDeliveries(ctx context.Context, webhookUUID, status string, limit int) (deliveries []*WebhookDelivery, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetWebhookDeliveries(exit)", err, logger.Fields{"webhookUUID": webhookUUID, "status": status, "limit": limit})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	switch status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryFailed:
+	default:
+		return nil, fmt.Errorf("invalid status '%s': use %s, %s or %s", status, DeliveryPending, DeliveryDelivered, DeliveryFailed)
+	}
+	if limit <= 0 || limit > defaultDeliveryLimit {
+		limit = defaultDeliveryLimit
+	}
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+deliveryColumns+` from webhook_deliveries d
+		where d.subscription_uuid = $1 and ($2 = '' or d.status = $2)
+		order by d.created_at desc, d.uuid limit $3`,
+		webhookUUID, status, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	deliveries = make([]*WebhookDelivery, 0)
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetWebhookDelivery returns a delivery of a subscription with the log of its attempts
+func (s *service) GetWebhookDelivery(ctx context.Context, webhookUUID, deliveryUUID string) (delivery *WebhookDelivery, err error) {
+	defer func() {
+		log.Outcome(ctx, "GetWebhookDelivery(exit)", err, logger.Fields{"webhookUUID": webhookUUID, "deliveryUUID": deliveryUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.getWebhookDelivery(ctx, webhookUUID, deliveryUUID)
+}
+
+func (s *service) getWebhookDelivery(ctx context.Context, webhookUUID, deliveryUUID string) (*WebhookDelivery, error) {
+	rows, err := s.Query(ctx, s.db, nil,
+		"select "+deliveryColumns+" from webhook_deliveries d where d.uuid = $1 and d.subscription_uuid = $2", deliveryUUID, webhookUUID)
+	if err != nil {
+		return nil, err
+	}
+	var delivery *WebhookDelivery
+	for rows.Next() {
+		if delivery, err = scanDelivery(rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if delivery == nil {
+		return nil, fmt.Errorf("cannot find delivery with uuid '%s'", deliveryUUID)
+	}
+
+	if rows, err = s.Query(ctx, s.db, nil,
+		`select attempt, coalesce(status_code, 0), coalesce(error, ''), duration_ms, created_at
+		from webhook_attempts where delivery_uuid = $1 order by attempt`, deliveryUUID); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	delivery.AttemptLog = make([]*WebhookAttempt, 0, delivery.Attempts)
+	for rows.Next() {
+		a := new(WebhookAttempt)
+		if err = rows.Scan(&a.Attempt, &a.StatusCode, &a.Error, &a.DurationMS, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		delivery.AttemptLog = append(delivery.AttemptLog, a)
+	}
+	return delivery, rows.Err()
+}
+
+// ReplayWebhookDelivery sends the event of a delivery again, as a new delivery of the same payload
+func (s *service) ReplayWebhookDelivery(ctx context.Context, webhookUUID, deliveryUUID string) (delivery *WebhookDelivery, err error) {
+	defer func() {
+		log.Outcome(ctx, "ReplayWebhookDelivery(exit)", err, logger.Fields{"webhookUUID": webhookUUID, "deliveryUUID": deliveryUUID})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	uid := uuid.NewV4().String()
+	res, err := s.RunQuery(ctx, s.db, nil,
+		`insert into webhook_deliveries(uuid, subscription_uuid, event_uuid, event_type, payload, replay_of)
+		select $1, subscription_uuid, event_uuid, event_type, payload, uuid from webhook_deliveries
+		where uuid = $2 and subscription_uuid = $3`,
+		uid, deliveryUUID, webhookUUID)
+	if err != nil {
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("cannot find delivery with uuid '%s'", deliveryUUID)
+	}
+	return s.getWebhookDelivery(ctx, webhookUUID, uid)
+}
+
+// ClaimWebhookDeliveries takes up to limit deliveries due to the active subscriptions, counting the
+// attempt and leasing them for lease: a delivery whose sender stops before completing it is due again
+// once the lease ends
+func (s *service) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) (deliveries []*WebhookDelivery, err error) {
+	defer func() {
+		log.Outcome(ctx, "ClaimWebhookDeliveries(exit)", err, logger.Fields{"limit": limit, "claimed": len(deliveries)})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.Query(ctx, s.db, nil,
+		`update webhook_deliveries d set attempts = d.attempts + 1, next_attempt_at = now() + make_interval(secs => $2)
+		from webhook_subscriptions w
+		where w.uuid = d.subscription_uuid and d.uuid in (
+			select q.uuid from webhook_deliveries q join webhook_subscriptions qw on qw.uuid = q.subscription_uuid
+			where q.status = $3 and q.next_attempt_at <= now() and qw.active
+			order by q.next_attempt_at limit $1 for update of q skip locked)
+		returning `+deliveryColumns+", w.url, w.secret",
+		limit, lease.Seconds(), DeliveryPending)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	deliveries = make([]*WebhookDelivery, 0)
+	for rows.Next() {
+		var d *WebhookDelivery
+		var u, secret string
+		if d, err = scanDelivery(rows, &u, &secret); err != nil {
+			return nil, err
+		}
+		d.URL, d.Secret = u, secret
+		deliveries = append(deliveries, d)
+	}
+	err = rows.Err()
+	return
+}
+
+// CompleteWebhookDelivery logs an attempt of a claimed delivery and records its outcome: delivered,
+// due again at the retry time or given up
+func (s *service) CompleteWebhookDelivery(ctx context.Context, delivery *WebhookDelivery, outcome *WebhookOutcome) (err error) {
+	defer func() {
+		log.Outcome(ctx, "CompleteWebhookDelivery(exit)", err, logger.Fields{"deliveryUUID": delivery.UUID, "attempt": delivery.Attempts, "delivered": outcome.Delivered})
+	}()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	status, next := DeliveryFailed, time.Now()
+	switch {
+	case outcome.Delivered:
+		status = DeliveryDelivered
+	case outcome.RetryAt != nil:
+		status, next = DeliveryPending, *outcome.RetryAt
+	}
+	statusCode := sql.NullInt64{Int64: int64(outcome.StatusCode), Valid: outcome.StatusCode != 0}
+	return s.inTransaction(ctx, func(tr *sql.Tx) error {
+		_, err := s.RunQuery(ctx, s.db, tr,
+			`insert into webhook_attempts(delivery_uuid, attempt, status_code, error, duration_ms) values ($1, $2, $3, $4, $5)
+			on conflict (delivery_uuid, attempt) do nothing`,
+			delivery.UUID, delivery.Attempts, statusCode, nullString(outcome.Error), outcome.Duration.Milliseconds())
+		if err != nil {
+			return err
+		}
+		// a delivery claimed again once its lease ended belongs to the later attempt
+		_, err = s.RunQuery(ctx, s.db, tr,
+			`update webhook_deliveries set status = $3, next_attempt_at = $4, last_status_code = $5, last_error = $6,
+			delivered_at = case when $7 then now() end
+			where uuid = $1 and attempts = $2 and status = $8`,
+			delivery.UUID, delivery.Attempts, status, next, statusCode, nullString(outcome.Error), outcome.Delivered, DeliveryPending)
+		return err
+	})
+}
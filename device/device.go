@@ -0,0 +1,69 @@
+// Package device abstracts the hardware of a vending machine: the coin acceptor validating inserted
+// coins, the coin changer paying change out of its tubes and the spiral dispensers releasing products
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+var log = logger.New("device")
+
+// Device errors, drivers wrap them so that callers can tell faults apart with errors.Is
+var (
+	ErrCoinRejected = errors.New("coin rejected")
+	ErrTubeEmpty    = errors.New("coin tube empty")
+	ErrJam          = errors.New("dispenser jammed")
+	ErrEmptySlot    = errors.New("slot empty")
+	ErrTimeout      = errors.New("device did not answer in time")
+)
+
+// CoinAcceptor validates the coins inserted into a machine
+type CoinAcceptor interface {
+	// Accept returns ErrCoinRejected when the coin went to the return cup
+	Accept(ctx context.Context, denomination int) error
+}
+
+// CoinChanger pays coins out of a machine's tubes
+type CoinChanger interface {
+	// Dispense pays up to count coins of a denomination and returns how many were paid,
+	// with ErrTubeEmpty when the tube ran out first
+	Dispense(ctx context.Context, denomination, count int) (dispensed int, err error)
+}
+
+// Dispenser releases products from the slots of a machine
+type Dispenser interface {
+	// Vend releases count units from a slot, returning ErrJam or ErrEmptySlot when it could not
+	Vend(ctx context.Context, slotCode string, count int) error
+}
+
+// Devices are the devices fitted to one machine
+type Devices struct {
+	Acceptor  CoinAcceptor
+	Changer   CoinChanger
+	Dispenser Dispenser
+}
+
+// Provider returns the devices of a machine
+type Provider interface {
+	Devices(machineUUID string) (*Devices, error)
+	Close() error
+}
+
+// New creates the provider for the configured driver, nil when machines run without devices
+func New(cfg *config.DevicesConfig) (Provider, error) {
+	switch cfg.Driver {
+	case config.DeviceDriverNone, "":
+		return nil, nil
+	case config.DeviceDriverSimulator:
+		return NewSimulator(cfg.Simulator), nil
+	case config.DeviceDriverSerial:
+		return NewSerialProvider(cfg.SerialPorts, cfg.Timeout)
+	default:
+		return nil, fmt.Errorf("unknown device driver '%s'", cfg.Driver)
+	}
+}
@@ -0,0 +1,181 @@
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The serial protocol is modelled on MDB: every message is a frame addressed to a peripheral,
+//
+//	STX | address | sequence | command | length | data... | checksum
+//
+// where checksum is the sum of address, sequence, command, length and data modulo 256. Peripherals
+// answer every command with a frame from the same address and with the same sequence number whose
+// command is ACK or NAK, a NAK carries the status explaining the failure as its first data byte. The
+// sequence number tells the answer to a command from a late answer to an earlier one that timed out
+const (
+	frameStart   byte = 0x02
+	maxFrameData      = 32
+)
+
+// Peripheral addresses
+const (
+	AddrChanger   byte = 0x08
+	AddrAcceptor  byte = 0x30
+	AddrDispenser byte = 0x40
+)
+
+// Commands
+const (
+	CmdReset    byte = 0x00
+	CmdAccept   byte = 0x0C
+	CmdDispense byte = 0x0D
+	CmdVend     byte = 0x13
+)
+
+// Responses
+const (
+	RespACK byte = 0x00
+	RespNAK byte = 0xFF
+)
+
+// Statuses carried by NAK responses
+const (
+	StatusUnknown        byte = 0x00
+	StatusCoinRejected   byte = 0x01
+	StatusTubeEmpty      byte = 0x02
+	StatusJam            byte = 0x03
+	StatusEmptySlot      byte = 0x04
+	StatusBadRequest     byte = 0x05
+	StatusUnknownCommand byte = 0x06
+)
+
+// ErrChecksum is returned for frames whose checksum does not match their content
+var ErrChecksum = errors.New("frame checksum mismatch")
+
+// Frame is a message on the serial line
+type Frame struct {
+	Address byte
+	// Seq numbers the commands sent to the peripherals, an answer carries the number of its command
+	Seq     byte
+	Command byte
+	Data    []byte
+}
+
+// checksum sums the bytes of a frame between the start byte and the checksum
+func (f Frame) checksum() byte {
+	sum := f.Address + f.Seq + f.Command + byte(len(f.Data))
+	for _, b := range f.Data {
+		sum += b
+	}
+	return sum
+}
+
+// MarshalBinary encodes the frame as it is sent on the line
+func (f Frame) MarshalBinary() ([]byte, error) {
+	if len(f.Data) > maxFrameData {
+		return nil, fmt.Errorf("frame data of %d bytes exceeds the maximum of %d", len(f.Data), maxFrameData)
+	}
+	b := make([]byte, 0, len(f.Data)+6)
+	b = append(b, frameStart, f.Address, f.Seq, f.Command, byte(len(f.Data)))
+	b = append(b, f.Data...)
+	return append(b, f.checksum()), nil
+}
+
+// Codec reads and writes frames on a serial line
+type Codec struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// NewCodec creates a codec over rw
+func NewCodec(rw io.ReadWriter) *Codec {
+	return &Codec{r: bufio.NewReader(rw), w: rw}
+}
+
+// WriteFrame sends a frame
+func (c *Codec) WriteFrame(f Frame) error {
+	b, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(b)
+	return err
+}
+
+// ReadFrame reads the next frame, skipping line noise before its start byte.
+// A frame with a bad checksum is consumed and reported with ErrChecksum
+func (c *Codec) ReadFrame() (Frame, error) {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return Frame{}, err
+		}
+		if b == frameStart {
+			break
+		}
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return Frame{}, err
+	}
+	if int(header[3]) > maxFrameData {
+		return Frame{}, fmt.Errorf("frame length %d exceeds the maximum of %d", header[3], maxFrameData)
+	}
+	body := make([]byte, int(header[3])+1)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{Address: header[0], Seq: header[1], Command: header[2], Data: body[:len(body)-1]}
+	if f.checksum() != body[len(body)-1] {
+		return f, ErrChecksum
+	}
+	return f, nil
+}
+
+// statusError maps a NAK status to a device error
+func statusError(status byte) error {
+	switch status {
+	case StatusCoinRejected:
+		return ErrCoinRejected
+	case StatusTubeEmpty:
+		return ErrTubeEmpty
+	case StatusJam:
+		return ErrJam
+	case StatusEmptySlot:
+		return ErrEmptySlot
+	default:
+		return fmt.Errorf("device refused the command with status 0x%02x", status)
+	}
+}
+
+// errorStatus maps a device error to the status of a NAK
+func errorStatus(err error) byte {
+	switch {
+	case errors.Is(err, ErrCoinRejected):
+		return StatusCoinRejected
+	case errors.Is(err, ErrTubeEmpty):
+		return StatusTubeEmpty
+	case errors.Is(err, ErrJam):
+		return StatusJam
+	case errors.Is(err, ErrEmptySlot):
+		return StatusEmptySlot
+	default:
+		return StatusUnknown
+	}
+}
+
+// encodeAmount encodes a coin value or count as two bytes, most significant first
+func encodeAmount(v int) ([]byte, error) {
+	if v < 0 || v > 0xFFFF {
+		return nil, fmt.Errorf("value %d does not fit in two bytes", v)
+	}
+	return []byte{byte(v >> 8), byte(v)}, nil
+}
+
+// decodeAmount decodes two bytes written by encodeAmount
+func decodeAmount(b []byte) int {
+	return int(b[0])<<8 | int(b[1])
+}
@@ -0,0 +1,118 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// readBack writes frames through a codec and returns the codec reading them back
+func readBack(t *testing.T, frames ...Frame) *Codec {
+	t.Helper()
+	var line bytes.Buffer
+	codec := NewCodec(&line)
+	for _, f := range frames {
+		if err := codec.WriteFrame(f); err != nil {
+			t.Fatalf("write %+v: %v", f, err)
+		}
+	}
+	return codec
+}
+
+func sameFrame(a, b Frame) bool {
+	return a.Address == b.Address && a.Seq == b.Seq && a.Command == b.Command && bytes.Equal(a.Data, b.Data)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Address: AddrAcceptor, Seq: 1, Command: CmdAccept, Data: []byte{0x00, 0x32}},
+		{Address: AddrChanger, Seq: 2, Command: RespACK},
+		{Address: AddrDispenser, Seq: 255, Command: CmdVend, Data: append([]byte{0x00, 0x01}, "A1"...)},
+		{Address: AddrChanger, Seq: 0, Command: RespNAK, Data: []byte{StatusTubeEmpty, 0x00, 0x02}},
+		{Address: AddrDispenser, Seq: 7, Command: CmdVend, Data: bytes.Repeat([]byte{0xFF}, maxFrameData)},
+	}
+	codec := readBack(t, frames...)
+	for _, want := range frames {
+		got, err := codec.ReadFrame()
+		if err != nil {
+			t.Fatalf("read %+v: %v", want, err)
+		}
+		if !sameFrame(got, want) {
+			t.Fatalf("read %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestFrameEncoding(t *testing.T) {
+	b, err := Frame{Address: AddrAcceptor, Seq: 3, Command: CmdAccept, Data: []byte{0x00, 0x0A}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{frameStart, AddrAcceptor, 3, CmdAccept, 2, 0x00, 0x0A, AddrAcceptor + 3 + CmdAccept + 2 + 0x0A}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("encoded % x, want % x", b, want)
+	}
+}
+
+func TestReadFrameSkipsLineNoise(t *testing.T) {
+	want := Frame{Address: AddrChanger, Seq: 9, Command: RespACK, Data: []byte{0x00, 0x04}}
+	b, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewCodec(bytes.NewBuffer(append([]byte{0x00, 0xFF, 0x13}, b...)))
+	got, err := codec.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameFrame(got, want) {
+		t.Fatalf("read %+v, want %+v", got, want)
+	}
+}
+
+func TestReadFrameChecksumMismatch(t *testing.T) {
+	corrupted, err := Frame{Address: AddrAcceptor, Seq: 1, Command: RespACK, Data: []byte{0x01}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted[5] ^= 0x40
+	next := Frame{Address: AddrAcceptor, Seq: 2, Command: RespACK}
+	b, err := next.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codec := NewCodec(bytes.NewBuffer(append(corrupted, b...)))
+	if _, err := codec.ReadFrame(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("err = %v, want %v", err, ErrChecksum)
+	}
+	// the corrupted frame is consumed, the line stays in sync
+	got, err := codec.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameFrame(got, next) {
+		t.Fatalf("read %+v, want %+v", got, next)
+	}
+}
+
+func TestFrameDataLimit(t *testing.T) {
+	if _, err := (Frame{Address: AddrDispenser, Data: make([]byte, maxFrameData+1)}).MarshalBinary(); err == nil {
+		t.Fatal("a frame with too much data was encoded")
+	}
+	codec := NewCodec(bytes.NewBuffer([]byte{frameStart, AddrDispenser, 1, CmdVend, maxFrameData + 1}))
+	if _, err := codec.ReadFrame(); err == nil {
+		t.Fatal("a frame announcing too much data was read")
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	for _, status := range []byte{StatusCoinRejected, StatusTubeEmpty, StatusJam, StatusEmptySlot} {
+		if got := errorStatus(statusError(status)); got != status {
+			t.Fatalf("status 0x%02x maps back to 0x%02x", status, got)
+		}
+	}
+	if got := errorStatus(errors.New("power failure")); got != StatusUnknown {
+		t.Fatalf("an unknown error maps to status 0x%02x", got)
+	}
+}
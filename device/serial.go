@@ -0,0 +1,225 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+// Serial drives the devices of one machine attached to a serial line
+type Serial struct {
+	mu      sync.Mutex
+	port    io.ReadWriteCloser
+	codec   *Codec
+	timeout time.Duration
+	// seq is the sequence number of the last command sent
+	seq byte
+}
+
+// NewSerial creates the driver for the devices answering on port
+func NewSerial(port io.ReadWriteCloser, timeout time.Duration) *Serial {
+	return &Serial{port: port, codec: NewCodec(port), timeout: timeout}
+}
+
+// Close closes the serial line
+func (s *Serial) Close() error {
+	return s.port.Close()
+}
+
+// request sends a command and waits for its answer, a NAK is returned as the error for its status.
+// Frames that do not carry the address and the sequence number of the command are discarded
+func (s *Serial) request(ctx context.Context, f Frame) (Frame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	f.Seq = s.seq
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if port, ok := s.port.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if err := port.SetReadDeadline(deadline); err != nil {
+			return Frame{}, err
+		}
+	}
+
+	if err := s.codec.WriteFrame(f); err != nil {
+		return Frame{}, err
+	}
+	for {
+		res, err := s.codec.ReadFrame()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return Frame{}, ErrTimeout
+		}
+		if err != nil {
+			return Frame{}, err
+		}
+		if res.Address != f.Address || res.Seq != f.Seq {
+			// the late answer to an earlier command that timed out, sent to this device or another
+			log.Warn(ctx, "discarding stale frame", logger.Fields{"address": res.Address, "seq": res.Seq, "expected": f.Seq})
+			continue
+		}
+		if res.Command == RespNAK {
+			if len(res.Data) == 0 {
+				return res, statusError(StatusUnknown)
+			}
+			return res, statusError(res.Data[0])
+		}
+		if res.Command != RespACK {
+			return res, fmt.Errorf("unexpected response 0x%02x from device 0x%02x", res.Command, res.Address)
+		}
+		return res, nil
+	}
+}
+
+// Accept asks the coin acceptor to validate a coin
+func (s *Serial) Accept(ctx context.Context, denomination int) error {
+	data, err := encodeAmount(denomination)
+	if err != nil {
+		return err
+	}
+	if _, err = s.request(ctx, Frame{Address: AddrAcceptor, Command: CmdAccept, Data: data}); err != nil {
+		return fmt.Errorf("%d: %w", denomination, err)
+	}
+	return nil
+}
+
+// Dispense asks the coin changer to pay coins out of a tube
+func (s *Serial) Dispense(ctx context.Context, denomination, count int) (int, error) {
+	value, err := encodeAmount(denomination)
+	if err != nil {
+		return 0, err
+	}
+	n, err := encodeAmount(count)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.request(ctx, Frame{Address: AddrChanger, Command: CmdDispense, Data: append(value, n...)})
+	dispensed := 0
+	switch {
+	case err == nil && len(res.Data) >= 2:
+		dispensed = decodeAmount(res.Data)
+	case errors.Is(err, ErrTubeEmpty) && len(res.Data) >= 3:
+		dispensed = decodeAmount(res.Data[1:])
+	}
+	if err != nil {
+		return dispensed, fmt.Errorf("%d: %w", denomination, err)
+	}
+	return dispensed, nil
+}
+
+// Vend asks the dispenser to release units from a slot
+func (s *Serial) Vend(ctx context.Context, slotCode string, count int) error {
+	data, err := encodeAmount(count)
+	if err != nil {
+		return err
+	}
+	if _, err = s.request(ctx, Frame{Address: AddrDispenser, Command: CmdVend, Data: append(data, slotCode...)}); err != nil {
+		return fmt.Errorf("%s: %w", slotCode, err)
+	}
+	return nil
+}
+
+// SerialProvider drives machines attached to serial lines
+type SerialProvider struct {
+	machines map[string]*Serial
+}
+
+// NewSerialProvider opens the serial line of every machine in ports, keyed by machine uuid
+func NewSerialProvider(ports map[string]string, timeout time.Duration) (*SerialProvider, error) {
+	p := &SerialProvider{machines: make(map[string]*Serial, len(ports))}
+	for machineUUID, path := range ports {
+		port, err := OpenSerial(path)
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("unable to open serial port %s of machine '%s': %v", path, machineUUID, err)
+		}
+		p.machines[machineUUID] = NewSerial(port, timeout)
+	}
+	return p, nil
+}
+
+// Devices returns the serial driver of a machine
+func (p *SerialProvider) Devices(machineUUID string) (*Devices, error) {
+	serial, ok := p.machines[machineUUID]
+	if !ok {
+		return nil, fmt.Errorf("no serial port configured for machine '%s'", machineUUID)
+	}
+	return &Devices{Acceptor: serial, Changer: serial, Dispenser: serial}, nil
+}
+
+// Close closes every serial line
+func (p *SerialProvider) Close() error {
+	var firstErr error
+	for _, serial := range p.machines {
+		if err := serial.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Serve answers the commands read from rw with devices, emulating the peripherals of a machine
+// on the other end of a serial line. It returns when rw is closed or ctx is done
+func Serve(ctx context.Context, rw io.ReadWriter, devices *Devices) error {
+	codec := NewCodec(rw)
+	for ctx.Err() == nil {
+		req, err := codec.ReadFrame()
+		if errors.Is(err, ErrChecksum) {
+			log.Warn(ctx, "discarding corrupted frame", logger.Fields{"address": req.Address})
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := codec.WriteFrame(answer(ctx, req, devices)); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// answer runs a command on devices and builds its response
+func answer(ctx context.Context, req Frame, devices *Devices) Frame {
+	nak := func(status byte, data ...byte) Frame {
+		return Frame{Address: req.Address, Seq: req.Seq, Command: RespNAK, Data: append([]byte{status}, data...)}
+	}
+	ack := Frame{Address: req.Address, Seq: req.Seq, Command: RespACK}
+
+	switch {
+	case req.Command == CmdReset:
+		return ack
+	case req.Address == AddrAcceptor && req.Command == CmdAccept && len(req.Data) == 2:
+		if err := devices.Acceptor.Accept(ctx, decodeAmount(req.Data)); err != nil {
+			return nak(errorStatus(err))
+		}
+		return ack
+	case req.Address == AddrChanger && req.Command == CmdDispense && len(req.Data) == 4:
+		dispensed, err := devices.Changer.Dispense(ctx, decodeAmount(req.Data), decodeAmount(req.Data[2:]))
+		n, _ := encodeAmount(dispensed)
+		if err != nil {
+			return nak(errorStatus(err), n...)
+		}
+		ack.Data = n
+		return ack
+	case req.Address == AddrDispenser && req.Command == CmdVend && len(req.Data) > 2:
+		if err := devices.Dispenser.Vend(ctx, string(req.Data[2:]), decodeAmount(req.Data)); err != nil {
+			return nak(errorStatus(err))
+		}
+		return ack
+	case req.Command == CmdAccept || req.Command == CmdDispense || req.Command == CmdVend:
+		return nak(StatusBadRequest)
+	default:
+		return nak(StatusUnknownCommand)
+	}
+}
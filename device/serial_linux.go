@@ -0,0 +1,77 @@
+package device
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// cbaud masks the speed bits of the control flags, missing from package syscall
+const cbaud = 0x100f
+
+// OpenSerial opens a serial line in raw mode at 9600 baud, 8N1, as MDB uses
+func OpenSerial(path string) (*os.File, error) {
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := makeRaw(fd, syscall.B9600); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	// a non blocking descriptor lets the runtime poller honour read deadlines
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// OpenPTY opens a pseudo-terminal pair in raw mode. Serving the emulated peripherals on the
+// master end while the server opens the slave path exercises the serial driver without hardware
+func OpenPTY() (master *os.File, slavePath string, err error) {
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	unlock := 0
+	if err := ioctl(fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		_ = syscall.Close(fd)
+		return nil, "", err
+	}
+	var n uint32
+	if err := ioctl(fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		_ = syscall.Close(fd)
+		return nil, "", err
+	}
+	if err := makeRaw(fd, 0); err != nil {
+		_ = syscall.Close(fd)
+		return nil, "", err
+	}
+	return os.NewFile(uintptr(fd), "/dev/ptmx"), fmt.Sprintf("/dev/pts/%d", n), nil
+}
+
+// makeRaw disables line editing, echo and character translation, setting the speed when it is not zero
+func makeRaw(fd int, speed uint32) error {
+	var t syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+	if speed != 0 {
+		t.Cflag &^= cbaud
+		t.Cflag |= speed
+		t.Ispeed, t.Ospeed = speed, speed
+	}
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
+
+func ioctl(fd int, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package device
+
+import (
+	"errors"
+	"os"
+)
+
+var errSerialUnsupported = errors.New("serial devices are only supported on linux")
+
+// OpenSerial is only supported on linux
+func OpenSerial(path string) (*os.File, error) {
+	return nil, errSerialUnsupported
+}
+
+// OpenPTY is only supported on linux
+func OpenPTY() (master *os.File, slavePath string, err error) {
+	return nil, "", errSerialUnsupported
+}
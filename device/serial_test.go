@@ -0,0 +1,142 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/config"
+)
+
+// openLine opens a pseudo-terminal: the peripherals answer on the master end, the driver uses the slave
+func openLine(t *testing.T) (master, slave *os.File) {
+	t.Helper()
+	master, slavePath, err := OpenPTY()
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %v", err)
+	}
+	slave, err = OpenSerial(slavePath)
+	if err != nil {
+		_ = master.Close()
+		t.Fatalf("open %s: %v", slavePath, err)
+	}
+	t.Cleanup(func() {
+		_ = slave.Close()
+		_ = master.Close()
+	})
+	return master, slave
+}
+
+// serveSimulator emulates the peripherals of a machine on master until the test ends
+func serveSimulator(t *testing.T, master *os.File, cfg config.SimulatorConfig) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	sim := NewSimulator(cfg)
+	devices, _ := sim.Devices("")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = Serve(ctx, master, devices)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		_ = master.Close()
+		<-done
+	})
+}
+
+func TestSerialOverPTY(t *testing.T) {
+	master, slave := openLine(t)
+	serveSimulator(t, master, config.SimulatorConfig{
+		RejectedCoins: []int{5},
+		EmptyTubes:    []int{50},
+		JammedSlots:   []string{"A1"},
+		EmptySlots:    []string{"B2"},
+	})
+	serial := NewSerial(slave, 2*time.Second)
+	ctx := context.Background()
+
+	if err := serial.Accept(ctx, 10); err != nil {
+		t.Fatalf("accept 10: %v", err)
+	}
+	if err := serial.Accept(ctx, 5); !errors.Is(err, ErrCoinRejected) {
+		t.Fatalf("accept 5: err = %v, want %v", err, ErrCoinRejected)
+	}
+	if dispensed, err := serial.Dispense(ctx, 20, 3); err != nil || dispensed != 3 {
+		t.Fatalf("dispense 3x20: %d, %v", dispensed, err)
+	}
+	if dispensed, err := serial.Dispense(ctx, 50, 2); !errors.Is(err, ErrTubeEmpty) || dispensed != 0 {
+		t.Fatalf("dispense 2x50: %d, err = %v, want %v", dispensed, err, ErrTubeEmpty)
+	}
+	if err := serial.Vend(ctx, "A2", 1); err != nil {
+		t.Fatalf("vend A2: %v", err)
+	}
+	if err := serial.Vend(ctx, "A1", 1); !errors.Is(err, ErrJam) {
+		t.Fatalf("vend A1: err = %v, want %v", err, ErrJam)
+	}
+	if err := serial.Vend(ctx, "B2", 1); !errors.Is(err, ErrEmptySlot) {
+		t.Fatalf("vend B2: err = %v, want %v", err, ErrEmptySlot)
+	}
+}
+
+func TestSerialNAKWithUnknownStatus(t *testing.T) {
+	master, slave := openLine(t)
+	go func() {
+		codec := NewCodec(master)
+		req, err := codec.ReadFrame()
+		if err != nil {
+			return
+		}
+		_ = codec.WriteFrame(Frame{Address: req.Address, Seq: req.Seq, Command: RespNAK, Data: []byte{0x7E}})
+	}()
+
+	err := NewSerial(slave, 2*time.Second).Accept(context.Background(), 10)
+	if err == nil || !strings.Contains(err.Error(), "status 0x7e") {
+		t.Fatalf("err = %v, want a refusal with status 0x7e", err)
+	}
+}
+
+func TestSerialTimeout(t *testing.T) {
+	_, slave := openLine(t)
+	start := time.Now()
+	err := NewSerial(slave, 100*time.Millisecond).Accept(context.Background(), 10)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("err = %v, want %v", err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timed out after %s", elapsed)
+	}
+}
+
+func TestSerialDiscardsLateAnswer(t *testing.T) {
+	master, slave := openLine(t)
+	// a changer too slow for the first command: it answers it only once the second one arrived
+	go func() {
+		codec := NewCodec(master)
+		first, err := codec.ReadFrame()
+		if err != nil {
+			return
+		}
+		second, err := codec.ReadFrame()
+		if err != nil {
+			return
+		}
+		_ = codec.WriteFrame(Frame{Address: first.Address, Seq: first.Seq, Command: RespACK, Data: []byte{0x00, 0x09}})
+		_ = codec.WriteFrame(Frame{Address: second.Address, Seq: second.Seq, Command: RespACK, Data: []byte{0x00, 0x02}})
+	}()
+
+	serial := NewSerial(slave, 200*time.Millisecond)
+	if _, err := serial.Dispense(context.Background(), 10, 9); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("first dispense: err = %v, want %v", err, ErrTimeout)
+	}
+	dispensed, err := serial.Dispense(context.Background(), 20, 2)
+	if err != nil {
+		t.Fatalf("second dispense: %v", err)
+	}
+	if dispensed != 2 {
+		t.Fatalf("second dispense paid %d coins, the late answer to the first was taken for it", dispensed)
+	}
+}
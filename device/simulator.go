@@ -0,0 +1,108 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+// Simulator emulates the devices of every machine, injecting the faults it is configured with:
+// rejected coins, empty change tubes, jammed and empty slots
+type Simulator struct {
+	mu     sync.Mutex
+	rand   *rand.Rand
+	config config.SimulatorConfig
+}
+
+// NewSimulator creates a simulator, a zero seed seeds it from the clock
+func NewSimulator(cfg config.SimulatorConfig) *Simulator {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Simulator{rand: rand.New(rand.NewSource(seed)), config: cfg}
+}
+
+// Devices returns the simulator for every device of a machine
+func (s *Simulator) Devices(machineUUID string) (*Devices, error) {
+	return &Devices{Acceptor: s, Changer: s, Dispenser: s}, nil
+}
+
+// Close releases nothing, the simulator holds no resources
+func (s *Simulator) Close() error {
+	return nil
+}
+
+// chance reports whether an event happening with probability rate happens
+func (s *Simulator) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < rate
+}
+
+// Accept rejects the configured coins and a random share of the others
+func (s *Simulator) Accept(ctx context.Context, denomination int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if containsInt(s.config.RejectedCoins, denomination) || s.chance(s.config.RejectRate) {
+		log.Info(ctx, "simulated coin rejected", logger.Fields{"denomination": denomination})
+		return fmt.Errorf("%d: %w", denomination, ErrCoinRejected)
+	}
+	return nil
+}
+
+// Dispense pays nothing out of the configured empty tubes
+func (s *Simulator) Dispense(ctx context.Context, denomination, count int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if count > 0 && containsInt(s.config.EmptyTubes, denomination) {
+		log.Info(ctx, "simulated coin tube empty", logger.Fields{"denomination": denomination})
+		return 0, fmt.Errorf("%d: %w", denomination, ErrTubeEmpty)
+	}
+	return count, nil
+}
+
+// Vend fails on the configured jammed and empty slots and jams at random on the others
+func (s *Simulator) Vend(ctx context.Context, slotCode string, count int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if containsString(s.config.EmptySlots, slotCode) {
+		log.Info(ctx, "simulated slot empty", logger.Fields{"slotCode": slotCode})
+		return fmt.Errorf("%s: %w", slotCode, ErrEmptySlot)
+	}
+	if containsString(s.config.JammedSlots, slotCode) || s.chance(s.config.JamRate) {
+		log.Info(ctx, "simulated dispenser jam", logger.Fields{"slotCode": slotCode})
+		return fmt.Errorf("%s: %w", slotCode, ErrJam)
+	}
+	return nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -10,7 +10,9 @@ require (
 	github.com/jinzhu/gorm v1.9.16
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/lib/pq v1.10.2
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rs/cors v1.7.0
 	github.com/satori/go.uuid v1.2.0
 	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// threshold is the body of the threshold routes
+type threshold struct {
+	Threshold *int `json:"threshold"`
+}
+
+// adminUser returns the user of the session when they are an admin
+func (s *service) adminUser(w http.ResponseWriter, r *http.Request) (*db.User, bool) {
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !s.isAdmin(user.Username) {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights, admin access required")
+		return nil, false
+	}
+	return user, true
+}
+
+// decodeThreshold reads the threshold of the request body
+func decodeThreshold(w http.ResponseWriter, r *http.Request) (int, bool) {
+	var body threshold
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return 0, false
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	if body.Threshold == nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: threshold is required")
+		return 0, false
+	}
+	return *body.Threshold, true
+}
+
+// GetAlerts handler lists alerts for admins, filtered by the status and kind query parameters
+func (s *service) GetAlerts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	alerts, err := s.db.GetAlerts(r.Context(), query.Get("status"), query.Get("kind"))
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, alerts)
+}
+
+// AcknowledgeAlert handler marks an open alert as seen
+func (s *service) AcknowledgeAlert(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	alert, err := s.db.AcknowledgeAlert(r.Context(), params["alertId"], user.UUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, alert)
+}
+
+// ResolveAlert handler closes an alert
+func (s *service) ResolveAlert(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	alert, err := s.db.ResolveAlert(r.Context(), params["alertId"], user.UUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, alert)
+}
+
+// GetStockThreshold handler returns the low stock threshold of a product
+func (s *service) GetStockThreshold(w http.ResponseWriter, r *http.Request) {
+	product, _, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := s.db.GetStockThreshold(r.Context(), product.UUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, t)
+}
+
+// SetStockThreshold handler sets the low stock threshold of a product
+func (s *service) SetStockThreshold(w http.ResponseWriter, r *http.Request) {
+	product, _, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+	value, ok := decodeThreshold(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := s.db.SetStockThreshold(r.Context(), product.UUID, value)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusAccepted, t)
+}
+
+// DeleteStockThreshold handler makes a product use the configured low stock threshold
+func (s *service) DeleteStockThreshold(w http.ResponseWriter, r *http.Request) {
+	product, _, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := s.db.DeleteStockThreshold(r.Context(), product.UUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, t)
+}
+
+// GetCoinThresholds handler lists the coin tube threshold of every denomination for admins
+func (s *service) GetCoinThresholds(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	thresholds, err := s.db.GetCoinThresholds(r.Context())
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, thresholds)
+}
+
+// SetCoinThreshold handler sets the coin tube threshold of a denomination
+func (s *service) SetCoinThreshold(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+	denomination, err := helpers.ConvertStringToInt(params["denomination"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: denomination must be a number")
+		return
+	}
+	value, ok := decodeThreshold(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := s.db.SetCoinThreshold(r.Context(), denomination, value)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusAccepted, t)
+}
+
+// DeleteCoinThreshold handler makes a denomination use the configured coin tube threshold
+func (s *service) DeleteCoinThreshold(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+	denomination, err := helpers.ConvertStringToInt(params["denomination"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: denomination must be a number")
+		return
+	}
+
+	t, err := s.db.DeleteCoinThreshold(r.Context(), denomination)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, t)
+}
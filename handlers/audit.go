@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// maxAuditSnapshot bounds the response kept as the state after an action
+const maxAuditSnapshot = 64 << 10
+
+// auditExempt are the routes of mutating methods that change nothing, by path template
+var auditExempt = map[string]bool{
+	"/api/price-quote": true,
+}
+
+// auditRedacted are the fields of the snapshots never written to the audit log
+var auditRedacted = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"session_token": true,
+	"secret":        true,
+}
+
+type auditContextKey struct{}
+
+// auditRecord collects what the handler of an audited request knows of its action
+type auditRecord struct {
+	actor  string
+	before json.RawMessage
+}
+
+// recordOf returns the audit record of the request, nil when it is not audited
+func recordOf(r *http.Request) *auditRecord {
+	record, _ := r.Context().Value(auditContextKey{}).(*auditRecord)
+	return record
+}
+
+// auditActor names the user performing the action of the request
+func auditActor(r *http.Request, username string) {
+	if record := recordOf(r); record != nil {
+		record.actor = username
+	}
+}
+
+// auditBefore keeps the state an audited request is about to change
+func auditBefore(r *http.Request, state interface{}) {
+	record := recordOf(r)
+	if record == nil {
+		return
+	}
+	snapshot, err := json.Marshal(state)
+	if err != nil {
+		log.Warn(r.Context(), "unable to snapshot audited state", logger.Fields{"err": err})
+		return
+	}
+	record.before = redactSnapshot(snapshot)
+}
+
+// redactSnapshot removes the secrets of a json snapshot, returning nil for anything but json
+func redactSnapshot(snapshot []byte) json.RawMessage {
+	decoder := json.NewDecoder(bytes.NewReader(snapshot))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// redactValue replaces the redacted fields of the objects in value
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if auditRedacted[strings.ToLower(key)] {
+				v[key] = "[redacted]"
+				continue
+			}
+			v[key] = redactValue(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
+
+// auditRecorder captures the status and the beginning of the response of an audited request
+type auditRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	a.status = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(p []byte) (int, error) {
+	if room := maxAuditSnapshot - a.body.Len(); room >= len(p) {
+		a.body.Write(p)
+	} else {
+		a.truncated = true
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (a *auditRecorder) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// after is the json response as the state after the action
+func (a *auditRecorder) after() json.RawMessage {
+	if a.truncated || !strings.HasPrefix(a.Header().Get("Content-Type"), "application/json") {
+		return nil
+	}
+	return redactSnapshot(a.body.Bytes())
+}
+
+// Audit middleware records the mutating requests that succeed in the audit log: the user of the session,
+// the method and route, the path, the state the handler reported before the change and its json
+// response as the state after it. The change is committed and answered before its entry is written: an
+// entry that cannot be written raises an audit failure alert rather than failing the request, whose
+// client could otherwise retry a purchase or a deposit that went through
+func (s *service) Audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		template := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if t, err := route.GetPathTemplate(); err == nil {
+				template = t
+			}
+		}
+		if auditExempt[template] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		record := new(auditRecord)
+		recorder := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+		if recorder.status >= http.StatusBadRequest {
+			return
+		}
+
+		requestID := logger.RequestID(r.Context())
+		// the change is made whether or not the client is still there, the entry is written regardless
+		ctx := logger.WithRequestID(context.Background(), requestID)
+		_, err := s.db.RecordAudit(ctx, &db.AuditEntry{
+			Actor:     record.actor,
+			Action:    r.Method + " " + template,
+			Target:    r.URL.Path,
+			RequestID: requestID,
+			Status:    recorder.status,
+			Before:    record.before,
+			After:     recorder.after(),
+		})
+		if err != nil {
+			log.Error(ctx, "unable to record audit entry", logger.Fields{"err": err, "method": r.Method, "path": r.URL.Path})
+		}
+	})
+}
+
+// GetAuditLog handler lists audit entries for admins, the newest first, filtered by the actor, action,
+// target, request_id, from and to query parameters and paged with before_id and limit
+func (s *service) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := &db.AuditFilter{
+		Actor:     query.Get("actor"),
+		Action:    query.Get("action"),
+		Target:    query.Get("target"),
+		RequestID: query.Get("request_id"),
+	}
+	for name, bound := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := parseReportTime(value, s.location)
+		if err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid %s '%s': use a RFC 3339 time or a 2006-01-02 date", name, value))
+			return
+		}
+		*bound = t
+	}
+	if value := query.Get("before_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid before_id: "+err.Error())
+			return
+		}
+		filter.BeforeID = id
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if filter.Limit, err = helpers.ConvertStringToInt(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return
+		}
+	}
+
+	entries, err := s.db.GetAuditLog(r.Context(), filter)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, entries)
+}
+
+// VerifyAuditLog handler checks the hash chain of the audit log
+func (s *service) VerifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	verification, err := s.db.VerifyAuditLog(r.Context())
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, verification)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/gorilla/mux"
+)
+
+// auditDB records the audit entries written, failing with err when it is set
+type auditDB struct {
+	db.Service
+	entries []*db.AuditEntry
+	err     error
+}
+
+func (a *auditDB) RecordAudit(_ context.Context, entry *db.AuditEntry) (*db.AuditEntry, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	a.entries = append(a.entries, entry)
+	return entry, nil
+}
+
+// serveAudited sends a request to a product update audited by s
+func serveAudited(s *service, status int) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.Use(s.Audit)
+	router.HandleFunc("/api/products/{productId}", func(w http.ResponseWriter, r *http.Request) {
+		auditActor(r, "admin")
+		auditBefore(r, map[string]interface{}{"name": "cola", "secret": "s3cr3t"})
+		w.Header().Set("Location", "/api/products/p1")
+		helpers.JSONResponse(w, status, map[string]string{"name": "lemonade"})
+	}).Methods("PUT")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/api/products/p1", strings.NewReader(`{"name":"lemonade"}`)))
+	return w
+}
+
+func TestAuditRecordsChange(t *testing.T) {
+	audit := new(auditDB)
+	w := serveAudited(&service{db: audit}, http.StatusOK)
+
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"name":"lemonade"}` {
+		t.Fatalf("answered %d %s, want the response of the handler", w.Code, w.Body)
+	}
+	if len(audit.entries) != 1 {
+		t.Fatalf("%d entries recorded, want 1", len(audit.entries))
+	}
+	entry := audit.entries[0]
+	if entry.Actor != "admin" || entry.Action != "PUT /api/products/{productId}" || entry.Target != "/api/products/p1" ||
+		entry.Status != http.StatusOK {
+		t.Fatalf("recorded %+v", entry)
+	}
+	if string(entry.Before) != `{"name":"cola","secret":"[redacted]"}` || string(entry.After) != `{"name":"lemonade"}` {
+		t.Fatalf("recorded before %s and after %s", entry.Before, entry.After)
+	}
+}
+
+func TestAuditAnswersChangeWhoseEntryFails(t *testing.T) {
+	audit := &auditDB{err: errors.New("connection refused")}
+	w := serveAudited(&service{db: audit}, http.StatusOK)
+
+	// the change is committed: its client is told so, the alert reports the missing entry
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"name":"lemonade"}` {
+		t.Fatalf("answered %d %s, want the response of the handler", w.Code, w.Body)
+	}
+}
+
+func TestAuditSkipsFailedRequests(t *testing.T) {
+	audit := new(auditDB)
+	w := serveAudited(&service{db: audit}, http.StatusBadRequest)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "lemonade") {
+		t.Fatalf("answered %d %s, want the response of the handler", w.Code, w.Body)
+	}
+	if len(audit.entries) != 0 {
+		t.Fatalf("%d entries recorded for a failed request", len(audit.entries))
+	}
+}
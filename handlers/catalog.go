@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// classification is the body of the product classification route
+type classification struct {
+	CategoryUUID string   `json:"category_id"`
+	Tags         []string `json:"tags"`
+}
+
+// productFilter reads the catalog filter of the category, tag, exclude_allergen, seller_id, q and limit
+// query parameters
+func productFilter(w http.ResponseWriter, r *http.Request) (*db.ProductFilter, bool) {
+	query := r.URL.Query()
+	filter := &db.ProductFilter{
+		CategoryUUID:     query.Get("category"),
+		Tags:             query["tag"],
+		ExcludeAllergens: query["exclude_allergen"],
+		SellerID:         query.Get("seller_id"),
+		Query:            query.Get("q"),
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if filter.Limit, err = helpers.ConvertStringToInt(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return nil, false
+		}
+	}
+	return filter, true
+}
+
+// decodeCategory reads the category of the request body
+func decodeCategory(w http.ResponseWriter, r *http.Request) (*db.Category, bool) {
+	var category db.Category
+
+	if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return nil, false
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+	return &category, true
+}
+
+// GetProducts handler lists the catalog, filtered by category (with its subcategories), tag and seller
+func (s *service) GetProducts(w http.ResponseWriter, r *http.Request) {
+	filter, ok := productFilter(w, r)
+	if !ok {
+		return
+	}
+
+	products, err := s.db.GetProducts(r.Context(), filter)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, products)
+}
+
+// SearchProducts handler returns the products matching the q query parameter, the most relevant first
+func (s *service) SearchProducts(w http.ResponseWriter, r *http.Request) {
+	filter, ok := productFilter(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := s.db.SearchProducts(r.Context(), filter)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, results)
+}
+
+// SetProductClassification handler replaces the category and the tags of a product
+func (s *service) SetProductClassification(w http.ResponseWriter, r *http.Request) {
+	product, _, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	var body classification
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	p, err := s.db.SetProductClassification(r.Context(), product.UUID, body.CategoryUUID, body.Tags)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, p)
+}
+
+// GetCategories handler returns the category tree
+func (s *service) GetCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := s.db.GetCategories(r.Context())
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, categories)
+}
+
+// GetCategory handler
+func (s *service) GetCategory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	category, err := s.db.GetCategory(r.Context(), params["categoryId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, category)
+}
+
+// CreateCategory handler
+func (s *service) CreateCategory(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+	category, ok := decodeCategory(w, r)
+	if !ok {
+		return
+	}
+
+	c, err := s.db.CreateCategory(r.Context(), category)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, c)
+}
+
+// UpdateCategory handler renames a category or moves it under another parent
+func (s *service) UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+	category, ok := decodeCategory(w, r)
+	if !ok {
+		return
+	}
+	category.UUID = params["categoryId"]
+
+	if before, err := s.db.GetCategory(r.Context(), category.UUID); err == nil {
+		auditBefore(r, before)
+	}
+
+	c, err := s.db.UpdateCategory(r.Context(), category)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, c)
+}
+
+// DeleteCategory handler removes a category without subcategories
+func (s *service) DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	if category, err := s.db.GetCategory(r.Context(), params["categoryId"]); err == nil {
+		auditBefore(r, category)
+	}
+
+	if err := s.db.DeleteCategory(r.Context(), params["categoryId"]); err != nil {
+		helpers.ErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	d := fmt.Sprintf("category with id: %+v deleted", params["categoryId"])
+
+	helpers.JSONResponse(w, http.StatusAccepted, map[string]string{"success": d})
+}
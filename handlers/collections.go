@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// GetCashBox handler returns the coins the box of a machine should hold since its last collection
+func (s *service) GetCashBox(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	box, err := s.db.GetCashBox(r.Context(), params["machineId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, box)
+}
+
+// CollectCash handler records the coins counted when emptying the box of a machine and those left in it
+func (s *service) CollectCash(w http.ResponseWriter, r *http.Request) {
+	var input db.CashCollectionInput
+	params := mux.Vars(r)
+
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	collection, err := s.db.CollectCash(r.Context(), params["machineId"], user.UUID, &input)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, collection)
+}
+
+// GetCashCollections handler lists the latest cash collections of a machine, filtered by the status
+// and limit query parameters
+func (s *service) GetCashCollections(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = helpers.ConvertStringToInt(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return
+		}
+	}
+
+	collections, err := s.db.GetCashCollections(r.Context(), params["machineId"], query.Get("status"), limit)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, collections)
+}
+
+// GetCashCollection handler returns a cash collection of a machine with its coins
+func (s *service) GetCashCollection(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	collection, err := s.db.GetCashCollection(r.Context(), params["machineId"], params["collectionId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, collection)
+}
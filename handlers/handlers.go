@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
+	"github.com/code-sleuth/vending-machine/bus"
+	"github.com/code-sleuth/vending-machine/config"
 	"github.com/code-sleuth/vending-machine/db"
 	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/metrics"
 	"github.com/gomodule/redigo/redis"
 	"github.com/gorilla/mux"
 	uuid "github.com/satori/go.uuid"
@@ -28,15 +32,137 @@ type Service interface {
 	GetProduct(w http.ResponseWriter, r *http.Request)
 	UpdateProduct(w http.ResponseWriter, r *http.Request)
 	DeleteProductHandler(w http.ResponseWriter, r *http.Request)
+	RestockProduct(w http.ResponseWriter, r *http.Request)
+	AdjustProductStock(w http.ResponseWriter, r *http.Request)
+	GetStockHistory(w http.ResponseWriter, r *http.Request)
+	GetBatches(w http.ResponseWriter, r *http.Request)
+	GetExpiringBatches(w http.ResponseWriter, r *http.Request)
+
+	Healthz(w http.ResponseWriter, r *http.Request)
+	Readyz(w http.ResponseWriter, r *http.Request)
+	Status(w http.ResponseWriter, r *http.Request)
+
+	CreateMachine(w http.ResponseWriter, r *http.Request)
+	GetMachines(w http.ResponseWriter, r *http.Request)
+	GetMachine(w http.ResponseWriter, r *http.Request)
+	UpdateMachine(w http.ResponseWriter, r *http.Request)
+	DeleteMachine(w http.ResponseWriter, r *http.Request)
+	GetMachineProducts(w http.ResponseWriter, r *http.Request)
+	GetPlanogram(w http.ResponseWriter, r *http.Request)
+	SaveSlot(w http.ResponseWriter, r *http.Request)
+	DeleteSlot(w http.ResponseWriter, r *http.Request)
+	FillSlot(w http.ResponseWriter, r *http.Request)
+	GetMachineCoins(w http.ResponseWriter, r *http.Request)
+	GetMachineCredit(w http.ResponseWriter, r *http.Request)
+	MachineDepositAmount(w http.ResponseWriter, r *http.Request)
+	MachineBuy(w http.ResponseWriter, r *http.Request)
+	MachineBuySlot(w http.ResponseWriter, r *http.Request)
+	MachineReset(w http.ResponseWriter, r *http.Request)
+	GetMachineSession(w http.ResponseWriter, r *http.Request)
+	MachineSessionEvent(w http.ResponseWriter, r *http.Request)
+	ClearMachineSession(w http.ResponseWriter, r *http.Request)
+	MachineReserve(w http.ResponseWriter, r *http.Request)
+	GetReservation(w http.ResponseWriter, r *http.Request)
+	ConfirmReservation(w http.ResponseWriter, r *http.Request)
+	GetReservations(w http.ResponseWriter, r *http.Request)
+
+	GetAlerts(w http.ResponseWriter, r *http.Request)
+	AcknowledgeAlert(w http.ResponseWriter, r *http.Request)
+	ResolveAlert(w http.ResponseWriter, r *http.Request)
+	GetStockThreshold(w http.ResponseWriter, r *http.Request)
+	SetStockThreshold(w http.ResponseWriter, r *http.Request)
+	DeleteStockThreshold(w http.ResponseWriter, r *http.Request)
+	GetCoinThresholds(w http.ResponseWriter, r *http.Request)
+	SetCoinThreshold(w http.ResponseWriter, r *http.Request)
+	DeleteCoinThreshold(w http.ResponseWriter, r *http.Request)
+
+	CreatePriceRule(w http.ResponseWriter, r *http.Request)
+	GetPriceRules(w http.ResponseWriter, r *http.Request)
+	GetPriceRule(w http.ResponseWriter, r *http.Request)
+	UpdatePriceRule(w http.ResponseWriter, r *http.Request)
+	DeletePriceRule(w http.ResponseWriter, r *http.Request)
+	QuotePrices(w http.ResponseWriter, r *http.Request)
+	BuyBasket(w http.ResponseWriter, r *http.Request)
+
+	CreateVoucher(w http.ResponseWriter, r *http.Request)
+	GetVouchers(w http.ResponseWriter, r *http.Request)
+	GetVoucher(w http.ResponseWriter, r *http.Request)
+	UpdateVoucher(w http.ResponseWriter, r *http.Request)
+	DeleteVoucher(w http.ResponseWriter, r *http.Request)
+	GetVoucherRedemptions(w http.ResponseWriter, r *http.Request)
+
+	GetProducts(w http.ResponseWriter, r *http.Request)
+	SearchProducts(w http.ResponseWriter, r *http.Request)
+	SetProductClassification(w http.ResponseWriter, r *http.Request)
+	GetCategories(w http.ResponseWriter, r *http.Request)
+	GetCategory(w http.ResponseWriter, r *http.Request)
+	CreateCategory(w http.ResponseWriter, r *http.Request)
+	UpdateCategory(w http.ResponseWriter, r *http.Request)
+	DeleteCategory(w http.ResponseWriter, r *http.Request)
+
+	SetProductNutrition(w http.ResponseWriter, r *http.Request)
+	UploadProductImage(w http.ResponseWriter, r *http.Request)
+	GetProductImages(w http.ResponseWriter, r *http.Request)
+	GetProductImage(w http.ResponseWriter, r *http.Request)
+	DeleteProductImage(w http.ResponseWriter, r *http.Request)
+
+	ImportProducts(w http.ResponseWriter, r *http.Request)
+	ExportProducts(w http.ResponseWriter, r *http.Request)
+
+	GetSalesReport(w http.ResponseWriter, r *http.Request)
+	GetTopSellers(w http.ResponseWriter, r *http.Request)
+	GetStockTurnover(w http.ResponseWriter, r *http.Request)
+
+	GetCashBox(w http.ResponseWriter, r *http.Request)
+	CollectCash(w http.ResponseWriter, r *http.Request)
+	GetCashCollections(w http.ResponseWriter, r *http.Request)
+	GetCashCollection(w http.ResponseWriter, r *http.Request)
+
+	Audit(next http.Handler) http.Handler
+	GetAuditLog(w http.ResponseWriter, r *http.Request)
+	VerifyAuditLog(w http.ResponseWriter, r *http.Request)
+
+	CreateWebhook(w http.ResponseWriter, r *http.Request)
+	GetWebhooks(w http.ResponseWriter, r *http.Request)
+	GetWebhook(w http.ResponseWriter, r *http.Request)
+	UpdateWebhook(w http.ResponseWriter, r *http.Request)
+	DeleteWebhook(w http.ResponseWriter, r *http.Request)
+	GetWebhookDeliveries(w http.ResponseWriter, r *http.Request)
+	GetWebhookDelivery(w http.ResponseWriter, r *http.Request)
+	ReplayWebhookDelivery(w http.ResponseWriter, r *http.Request)
+
+	StreamEvents(w http.ResponseWriter, r *http.Request)
+	StreamWebSocket(w http.ResponseWriter, r *http.Request)
 }
 
+var log = logger.New("handlers")
+
 type service struct {
-	db db.Service
+	db             db.Service
+	sessionTTL     time.Duration
+	adminUsernames []string
+	startedAt      time.Time
+	// maxUploadSize bounds the size of an uploaded product image, in bytes
+	maxUploadSize int64
+	// location is the local time of the machines, the zone of the reports
+	location *time.Location
+	// events is the bus the streams subscribe to
+	events         *bus.Bus
+	streams        *config.StreamsConfig
+	allowedOrigins []string
 }
 
-func New(db db.Service) Service {
+func New(db db.Service, cfg *config.Config, events *bus.Bus) Service {
 	return &service{
-		db: db,
+		db:             db,
+		sessionTTL:     cfg.Auth.SessionTTL,
+		adminUsernames: cfg.Auth.AdminUsernames,
+		startedAt:      time.Now(),
+		maxUploadSize:  int64(cfg.Images.MaxUploadSize),
+		location:       cfg.Pricing.Location(),
+		events:         events,
+		streams:        cfg.Streams,
+		allowedOrigins: cfg.CORS.AllowedOrigins,
 	}
 }
 
@@ -51,7 +177,7 @@ func (s *service) CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			log.Println(err)
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
 		}
 	}()
 
@@ -65,11 +191,12 @@ func (s *service) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := s.db.CreateUser(&user)
+	u, err := s.db.CreateUser(r.Context(), &user)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "unable to create user "+err.Error())
 		return
 	}
+	auditActor(r, u.Username)
 	helpers.JSONResponse(w, http.StatusCreated, u)
 }
 
@@ -83,7 +210,7 @@ func (s *service) GetUser(w http.ResponseWriter, r *http.Request) {
 
 	params := mux.Vars(r)
 
-	user, err := s.db.GetUser(params["id"])
+	user, err := s.db.GetUser(r.Context(), params["id"])
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
 		return
@@ -113,7 +240,7 @@ func (s *service) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			log.Println(err)
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
 		}
 	}()
 
@@ -123,14 +250,15 @@ func (s *service) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userUUID := params["id"]
-	usr, err := s.db.GetUser(userUUID)
+	usr, err := s.db.GetUser(r.Context(), userUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
 		return
 	}
+	auditBefore(r, usr)
 	usr.Deposit = user.Deposit
 
-	u, err := s.db.UpdateUser(usr)
+	u, err := s.db.UpdateUser(r.Context(), usr)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -150,7 +278,7 @@ func (s *service) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userUUID := params["id"]
 
-	user, err := s.db.GetUser(userUUID)
+	user, err := s.db.GetUser(r.Context(), userUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
 		return
@@ -161,7 +289,8 @@ func (s *service) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.db.DeleteUser(userUUID)
+	auditBefore(r, user)
+	err = s.db.DeleteUser(r.Context(), userUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -187,7 +316,7 @@ func (s *service) DepositAmount(w http.ResponseWriter, r *http.Request) {
 	}
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			log.Println(err)
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
 		}
 	}()
 
@@ -202,7 +331,11 @@ func (s *service) DepositAmount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := s.db.Deposit(params["id"], amount)
+	if before, err := s.db.GetUser(r.Context(), params["id"]); err == nil {
+		auditBefore(r, before)
+	}
+
+	u, err := s.db.Deposit(r.Context(), params["id"], amount)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -221,7 +354,7 @@ func (s *service) Buy(w http.ResponseWriter, r *http.Request) {
 	userUUID := params["id"]
 	productUUID := params["productId"]
 
-	user, err := s.db.GetUser(userUUID)
+	user, err := s.db.GetUser(r.Context(), userUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
 		return
@@ -243,7 +376,13 @@ func (s *service) Buy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := s.db.Buy(userUUID, productUUID, amountOfProducts)
+	voucher, ok := decodeVoucher(w, r)
+	if !ok {
+		return
+	}
+
+	auditBefore(r, user)
+	u, err := s.db.Buy(r.Context(), userUUID, productUUID, amountOfProducts, voucher)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -261,7 +400,7 @@ func (s *service) Reset(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userUUID := params["id"]
-	user, err := s.db.GetUser(userUUID)
+	user, err := s.db.GetUser(r.Context(), userUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
 		return
@@ -277,7 +416,8 @@ func (s *service) Reset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := s.db.Reset(userUUID)
+	auditBefore(r, user)
+	u, err := s.db.Reset(r.Context(), userUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -299,21 +439,22 @@ func (s *service) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			log.Println(err)
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
 		}
 	}()
 
-	u, err := s.db.Login(user.Username, user.Password)
+	u, err := s.db.Login(r.Context(), user.Username, user.Password)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusUnauthorized, err.Error())
 		return
 	}
+	auditActor(r, user.Username)
 
 	// Create a new random session token
 	sessionToken := uuid.NewV4().String()
 	// Set the token in the cache, along with the user whom it represents
-	// The token has an expiry time of 7200 seconds (120 minutes or 2 hours)
-	_, err = cache.Do("SETEX", sessionToken, "7200", user.Username)
+	// The token expires after the configured session ttl
+	_, err = cacheDo("SETEX", sessionToken, int64(s.sessionTTL/time.Second), user.Username)
 	if err != nil {
 		// If there is an error in setting the cache, return an internal server error
 		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
@@ -321,11 +462,11 @@ func (s *service) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Finally, we set the client cookie for "session_token" as the session token we just generated
-	// we also set an expiry time of 120 minutes, the same as the cache
+	// we also set the same expiry time as the cache
 	http.SetCookie(w, &http.Cookie{
 		Name:    "session_token",
 		Value:   sessionToken,
-		Expires: time.Now().Add(120 * time.Minute),
+		Expires: time.Now().Add(s.sessionTTL),
 		Path:    "/",
 	})
 
@@ -344,18 +485,44 @@ func (s *service) Login(w http.ResponseWriter, r *http.Request) {
 	helpers.JSONResponse(w, http.StatusOK, successMap)
 }
 
-// Store the redis connection as a package level variable
-var cache redis.Conn
+// Store the redis connection pool as a package level variable
+var cache *redis.Pool
 
 // InitCache function
-func InitCache() {
-	// Initialize the redis connection to a redis instance running on your local machine
-	conn, err := redis.DialURL(helpers.GetEnv("REDIS_URL", "redis://localhost"))
-	if err != nil {
-		log.Fatalf("failed to start redis server: %+v", err)
+func InitCache(redisURL string) {
+	// Initialize the redis connection pool to the configured redis instance
+	pool := &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(redisURL)
+		},
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		log.Fatal(context.Background(), "failed to start redis server", logger.Fields{"err": err})
+	}
+	// Assign the pool to the package level `cache` variable
+	cache = pool
+}
+
+// cacheDo runs a redis command on a pooled connection and records its latency
+func cacheDo(command string, args ...interface{}) (reply interface{}, err error) {
+	defer func(start time.Time) {
+		metrics.ObserveSince(metrics.RedisDuration.WithLabelValues(command, metrics.Outcome(err)), start)
+	}(time.Now())
+	conn := cache.Get()
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+// CloseCache function releases the redis connection pool
+func CloseCache() error {
+	if cache == nil {
+		return nil
 	}
-	// Assign the connection to the package level `cache` variable
-	cache = conn
+	return cache.Close()
 }
 
 // CheckIfUserSessionIsActive handler
@@ -375,7 +542,7 @@ func (s *service) CheckIfUserSessionIsActive(w http.ResponseWriter, r *http.Requ
 	sessionToken := c.Value
 
 	// We then get the username of the user from our cache, where we set the session token
-	username, err := cache.Do("GET", sessionToken)
+	username, err := cacheDo("GET", sessionToken)
 	if err != nil {
 		// If there is an error fetching from cache, return an internal server error status
 		helpers.ErrorResponse(w, http.StatusInternalServerError, "Internal Server Error, please login")
@@ -388,9 +555,23 @@ func (s *service) CheckIfUserSessionIsActive(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Return true if user has active session
+	auditActor(r, fmt.Sprintf("%s", username))
 	return fmt.Sprintf("%s", username), true
 }
 
+// CheckIfUserIsAdmin handler
+func (s *service) CheckIfUserIsAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, ok := s.CheckIfUserSessionIsActive(w, r)
+	if !ok {
+		return "", false
+	}
+	if s.isAdmin(username) {
+		return username, true
+	}
+	helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights, admin access required")
+	return "", false
+}
+
 // CreateProduct handler
 func (s *service) CreateProduct(w http.ResponseWriter, r *http.Request) {
 	var product db.Product
@@ -402,7 +583,7 @@ func (s *service) CreateProduct(w http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			log.Println(err)
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
 		}
 	}()
 
@@ -416,7 +597,7 @@ func (s *service) CreateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p, err := s.db.CreateProduct(&product)
+	p, err := s.db.CreateProduct(r.Context(), &product)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "unable to create product "+err.Error())
 		return
@@ -424,24 +605,11 @@ func (s *service) CreateProduct(w http.ResponseWriter, r *http.Request) {
 	helpers.JSONResponse(w, http.StatusCreated, p)
 }
 
-// GetProducts handler
-//func (s *service) GetProducts(w http.ResponseWriter, r *http.Request) {
-//	var p db.Product
-//
-//	productsList, err := s.db.GetProducts()
-//	if err != nil {
-//		helpers.ErrorResponse(w, http.StatusNoContent, "could not get products from database | "+err.Error())
-//		return
-//	}
-//
-//	helpers.JSONResponse(w, http.StatusOK, productsList)
-//}
-
 // GetProduct by id handler
 func (s *service) GetProduct(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	uid := params["id"]
-	product, err := s.db.GetProduct(uid)
+	product, err := s.db.GetProduct(r.Context(), uid)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
 		return
@@ -467,17 +635,17 @@ func (s *service) UpdateProduct(w http.ResponseWriter, r *http.Request) {
 	}
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			log.Println(err)
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
 		}
 	}()
 
-	p, err := s.db.GetProduct(sellerUUID)
+	p, err := s.db.GetProduct(r.Context(), sellerUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
 		return
 	}
 
-	user, err := s.db.GetUser(product.SellerID)
+	user, err := s.db.GetUser(r.Context(), product.SellerID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
 		return
@@ -493,11 +661,12 @@ func (s *service) UpdateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	auditBefore(r, p)
+	// stock changes go through the restock and adjust stock endpoints
 	p.ProductName = product.ProductName
 	p.Cost = product.Cost
-	p.AmountAvailable = product.AmountAvailable
 
-	u, err := s.db.UpdateProduct(p)
+	u, err := s.db.UpdateProduct(r.Context(), p)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -517,7 +686,7 @@ func (s *service) DeleteProductHandler(w http.ResponseWriter, r *http.Request) {
 	productUUID := params["id"]
 	userUUID := params["userId"]
 
-	user, err := s.db.GetUser(userUUID)
+	user, err := s.db.GetUser(r.Context(), userUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: [DeleteProductHandler] "+err.Error())
 		return
@@ -533,7 +702,11 @@ func (s *service) DeleteProductHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.db.DeleteProduct(productUUID)
+	if product, err := s.db.GetProduct(r.Context(), productUUID); err == nil {
+		auditBefore(r, product)
+	}
+
+	err = s.db.DeleteProduct(r.Context(), productUUID)
 	if err != nil {
 		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
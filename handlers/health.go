@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/helpers"
+)
+
+// Version is the build version, set at build time with
+// -ldflags "-X github.com/code-sleuth/vending-machine/handlers.Version=<version>"
+var Version = "dev"
+
+// componentStatus describes the state of a dependency of the service
+type componentStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// checkComponent runs check and reports its outcome and how long it took
+func checkComponent(check func() error) componentStatus {
+	start := time.Now()
+	err := check()
+	status := componentStatus{
+		Status:    "up",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Status = "down"
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// checkComponents checks the database, redis and the database schema
+func (s *service) checkComponents(ctx context.Context) (map[string]componentStatus, bool) {
+	components := map[string]componentStatus{
+		"database":   checkComponent(func() error { return s.db.Ping(ctx) }),
+		"redis":      checkComponent(pingCache),
+		"migrations": checkComponent(func() error { return s.db.CheckSchema(ctx) }),
+	}
+	ready := true
+	for _, component := range components {
+		if component.Status != "up" {
+			ready = false
+		}
+	}
+	return components, ready
+}
+
+func pingCache() error {
+	_, err := cacheDo("PING")
+	return err
+}
+
+// Healthz handler reports that the process is alive
+func (s *service) Healthz(w http.ResponseWriter, r *http.Request) {
+	helpers.JSONResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz handler reports whether the service can serve requests
+func (s *service) Readyz(w http.ResponseWriter, r *http.Request) {
+	components, ready := s.checkComponents(r.Context())
+	statuses := make(map[string]string, len(components))
+	for name, component := range components {
+		statuses[name] = component.Status
+	}
+	if !ready {
+		helpers.JSONResponse(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "components": statuses})
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, map[string]interface{}{"status": "ready", "components": statuses})
+}
+
+// Status handler returns the detailed state of the service for admins
+func (s *service) Status(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	components, ready := s.checkComponents(r.Context())
+	status := "ok"
+	if !ready {
+		status = "degraded"
+	}
+	helpers.JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"status":         status,
+		"version":        Version,
+		"started_at":     s.startedAt.UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(s.startedAt).Seconds()),
+		"components":     components,
+	})
+}
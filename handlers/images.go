@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/imaging"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// declaration is the body of the product nutrition route
+type declaration struct {
+	Nutrition *db.Nutrition `json:"nutrition"`
+	Allergens []string      `json:"allergens"`
+}
+
+// SetProductNutrition handler replaces the nutrition declaration and the allergens of a product
+func (s *service) SetProductNutrition(w http.ResponseWriter, r *http.Request) {
+	product, _, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	var body declaration
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	p, err := s.db.SetProductNutrition(r.Context(), product.UUID, body.Nutrition, body.Allergens)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, p)
+}
+
+// UploadProductImage handler stores the image multipart form file of a product and its thumbnail
+func (s *service) UploadProductImage(w http.ResponseWriter, r *http.Request) {
+	product, user, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	// leave room for the multipart headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize+1<<10)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close uploaded image", logger.Fields{"err": err})
+		}
+	}()
+	data, err := ioutil.ReadAll(io.LimitReader(file, s.maxUploadSize+1))
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	if int64(len(data)) > s.maxUploadSize {
+		helpers.ErrorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("image should not exceed %d bytes", s.maxUploadSize))
+		return
+	}
+
+	img, err := s.db.AddProductImage(r.Context(), product.UUID, user.UUID, data)
+	if err == imaging.ErrUnsupported {
+		helpers.ErrorResponse(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, img)
+}
+
+// GetProductImages handler lists the images of a product
+func (s *service) GetProductImages(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	images, err := s.db.GetProductImages(r.Context(), params["id"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, images)
+}
+
+// GetProductImage handler serves an image of a product, or its thumbnail with the size=thumbnail query parameter
+func (s *service) GetProductImage(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	thumbnail := r.URL.Query().Get("size") == "thumbnail"
+	content, img, err := s.db.OpenProductImage(r.Context(), params["id"], params["imageId"], thumbnail)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	defer func() {
+		if err := content.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close product image", logger.Fields{"err": err})
+		}
+	}()
+
+	w.Header().Set("Content-Type", img.ContentType)
+	if !thumbnail {
+		w.Header().Set("Content-Length", strconv.Itoa(img.Size))
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, content); err != nil {
+		log.Warn(r.Context(), "unable to write product image", logger.Fields{"err": err})
+	}
+}
+
+// DeleteProductImage handler removes an image of a product and its thumbnail
+func (s *service) DeleteProductImage(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	product, _, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteProductImage(r.Context(), product.UUID, params["imageId"]); err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	d := fmt.Sprintf("image with id: %+v deleted", params["imageId"])
+
+	helpers.JSONResponse(w, http.StatusAccepted, map[string]string{"success": d})
+}
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// maxImportSize bounds the size of a bulk import file, in bytes
+const maxImportSize = 10 << 20
+
+// Bulk import and export formats
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// listSeparator separates the tags and the allergens of a csv cell
+const listSeparator = "|"
+
+// csvColumns are the columns of a product csv, a file may leave out any but sku, product_name and cost
+var csvColumns = []string{"sku", "product_name", "cost", "amount_available", "category_id", "tags", "allergens"}
+
+// nutritionColumns are the csv columns of the nutrition declaration, a row declares it when any is set
+var nutritionColumns = []struct {
+	name   string
+	amount func(n *db.Nutrition) *float64
+}{
+	{"serving_size", func(n *db.Nutrition) *float64 { return &n.ServingSize }},
+	{"energy_kcal", func(n *db.Nutrition) *float64 { return &n.EnergyKcal }},
+	{"fat", func(n *db.Nutrition) *float64 { return &n.Fat }},
+	{"saturated_fat", func(n *db.Nutrition) *float64 { return &n.SaturatedFat }},
+	{"carbohydrates", func(n *db.Nutrition) *float64 { return &n.Carbohydrates }},
+	{"sugars", func(n *db.Nutrition) *float64 { return &n.Sugars }},
+	{"fibre", func(n *db.Nutrition) *float64 { return &n.Fibre }},
+	{"protein", func(n *db.Nutrition) *float64 { return &n.Protein }},
+	{"salt", func(n *db.Nutrition) *float64 { return &n.Salt }},
+}
+
+// transferFormat reads the format of a bulk import or export from the format query parameter, then
+// from the content type of the request
+func transferFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/x-ndjson", "application/jsonl":
+			format = formatNDJSON
+		default:
+			format = formatCSV
+		}
+	}
+	if format != formatCSV && format != formatNDJSON {
+		return "", fmt.Errorf("invalid format '%s': use %s or %s", format, formatCSV, formatNDJSON)
+	}
+	return format, nil
+}
+
+// splitList reads the tags or the allergens of a csv cell
+func splitList(cell string) []string {
+	if strings.TrimSpace(cell) == "" {
+		return nil
+	}
+	return strings.Split(cell, listSeparator)
+}
+
+// parseCSVRow reads a product of a csv record, columns holds the index of each column
+func parseCSVRow(line int, record []string, columns map[string]int) (*db.ProductImportRow, error) {
+	cell := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	row := &db.ProductImportRow{
+		Line:         line,
+		SKU:          cell("sku"),
+		ProductName:  cell("product_name"),
+		CategoryUUID: cell("category_id"),
+		Tags:         splitList(cell("tags")),
+		Allergens:    splitList(cell("allergens")),
+	}
+	var err error
+	if row.Cost, err = strconv.Atoi(cell("cost")); err != nil {
+		return row, fmt.Errorf("invalid cost '%s'", cell("cost"))
+	}
+	if value := cell("amount_available"); value != "" {
+		amount, err := strconv.Atoi(value)
+		if err != nil {
+			return row, fmt.Errorf("invalid amount_available '%s'", value)
+		}
+		row.AmountAvailable = &amount
+	}
+	for _, column := range nutritionColumns {
+		value := cell(column.name)
+		if value == "" {
+			continue
+		}
+		if row.Nutrition == nil {
+			row.Nutrition = new(db.Nutrition)
+		}
+		if *column.amount(row.Nutrition), err = strconv.ParseFloat(value, 64); err != nil {
+			return row, fmt.Errorf("invalid %s '%s'", column.name, value)
+		}
+	}
+	return row, nil
+}
+
+// parseCSV reads the products of a csv file with a header, returning the errors of the rows it cannot read
+func parseCSV(r io.Reader) (rows []*db.ProductImportRow, rowErrors []*db.ImportError, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("empty csv file")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	known := make(map[string]bool)
+	for _, name := range csvColumns {
+		known[name] = true
+	}
+	for _, column := range nutritionColumns {
+		known[column.name] = true
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !known[name] {
+			return nil, nil, fmt.Errorf("unknown csv column '%s'", name)
+		}
+		columns[name] = i
+	}
+	for _, name := range csvColumns[:3] {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("missing csv column '%s'", name)
+		}
+	}
+
+	// the header is line 1
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, nil, err
+			}
+			rowErrors = append(rowErrors, &db.ImportError{Line: line, Error: err.Error()})
+			continue
+		}
+		row, err := parseCSVRow(line, record, columns)
+		if err != nil {
+			rowErrors = append(rowErrors, &db.ImportError{Line: line, SKU: row.SKU, Error: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, nil
+}
+
+// parseNDJSON reads the products of a file holding a json object per line, skipping blank lines
+func parseNDJSON(r io.Reader) (rows []*db.ProductImportRow, rowErrors []*db.ImportError, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxImportSize)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		row := new(db.ProductImportRow)
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(row); err != nil {
+			rowErrors = append(rowErrors, &db.ImportError{Line: line, SKU: row.SKU, Error: "invalid json: " + err.Error()})
+			continue
+		}
+		row.Line = line
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, scanner.Err()
+}
+
+// writeCSV writes products as a csv file with a header, listing every column
+func writeCSV(w io.Writer, rows []*db.ProductImportRow) error {
+	writer := csv.NewWriter(w)
+	header := append([]string{}, csvColumns...)
+	for _, column := range nutritionColumns {
+		header = append(header, column.name)
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		amount := ""
+		if row.AmountAvailable != nil {
+			amount = strconv.Itoa(*row.AmountAvailable)
+		}
+		record := []string{
+			row.SKU, row.ProductName, strconv.Itoa(row.Cost), amount, row.CategoryUUID,
+			strings.Join(row.Tags, listSeparator), strings.Join(row.Allergens, listSeparator),
+		}
+		for _, column := range nutritionColumns {
+			value := ""
+			if row.Nutrition != nil {
+				value = strconv.FormatFloat(*column.amount(row.Nutrition), 'f', -1, 64)
+			}
+			record = append(record, value)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeNDJSON writes products as a json object per line
+func writeNDJSON(w io.Writer, rows []*db.ProductImportRow) error {
+	encoder := json.NewEncoder(w)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// catalogSeller returns the seller of the {id} route parameter when the user of the session is that
+// seller or an admin
+func (s *service) catalogSeller(w http.ResponseWriter, r *http.Request) (seller, user *db.User, ok bool) {
+	params := mux.Vars(r)
+
+	if user, ok = s.currentUser(w, r); !ok {
+		return nil, nil, false
+	}
+	if user.UUID != params["id"] && !s.isAdmin(user.Username) {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights, make sure user is the seller")
+		return nil, nil, false
+	}
+	seller, err := s.db.GetUser(r.Context(), params["id"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return nil, nil, false
+	}
+	if seller.Role != "seller" {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "products can only be imported for a seller")
+		return nil, nil, false
+	}
+	return seller, user, true
+}
+
+// ImportProducts handler creates, or with mode=upsert also updates by sku, the products of a seller
+// from a csv or ndjson body. With dry_run=true it only reports what the import would do. Rows
+// failing validation are all reported and then nothing is imported
+func (s *service) ImportProducts(w http.ResponseWriter, r *http.Request) {
+	seller, user, ok := s.catalogSeller(w, r)
+	if !ok {
+		return
+	}
+	format, err := transferFormat(r)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = db.ImportInsert
+	}
+	dryRun := false
+	if value := query.Get("dry_run"); value != "" {
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid dry_run: "+err.Error())
+			return
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+	var rows []*db.ProductImportRow
+	var rowErrors []*db.ImportError
+	if format == formatNDJSON {
+		rows, rowErrors, err = parseNDJSON(body)
+	} else {
+		rows, rowErrors, err = parseCSV(body)
+	}
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+
+	// rows that cannot be read fail the import, the others are still checked
+	result := &db.ImportResult{DryRun: dryRun, Mode: mode, Products: []*db.ImportedProduct{}}
+	if len(rows) > 0 || len(rowErrors) == 0 {
+		result, err = s.db.ImportProducts(r.Context(), seller.UUID, user.UUID, mode, rows, dryRun || len(rowErrors) > 0)
+		if err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		result.DryRun = dryRun
+	}
+	if len(rowErrors) > 0 {
+		result.Rows += len(rowErrors)
+		result.Created, result.Updated, result.Products = 0, 0, []*db.ImportedProduct{}
+		result.Errors = append(result.Errors, rowErrors...)
+		sort.SliceStable(result.Errors, func(i, j int) bool { return result.Errors[i].Line < result.Errors[j].Line })
+	}
+	if len(result.Errors) > 0 {
+		helpers.JSONResponse(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, result)
+}
+
+// ExportProducts handler writes the products of a seller as a csv or, with format=ndjson, a json object
+// per line, in the format the import reads
+func (s *service) ExportProducts(w http.ResponseWriter, r *http.Request) {
+	seller, _, ok := s.catalogSeller(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatCSV
+	}
+	if format != formatCSV && format != formatNDJSON {
+		helpers.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid format '%s': use %s or %s", format, formatCSV, formatNDJSON))
+		return
+	}
+
+	rows, err := s.db.ExportProducts(r.Context(), seller.UUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	contentType, write := "text/csv; charset=utf-8", writeCSV
+	if format == formatNDJSON {
+		contentType, write = "application/x-ndjson", writeNDJSON
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"products-%s.%s\"", seller.UUID, format))
+	w.WriteHeader(http.StatusOK)
+	if err := write(w, rows); err != nil {
+		log.Warn(r.Context(), "unable to write product export", logger.Fields{"err": err})
+	}
+}
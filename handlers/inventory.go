@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// restock is a delivery of units of a product, tracked as a batch when it has an expiry date
+type restock struct {
+	Amount    int        `json:"amount"`
+	Note      string     `json:"note"`
+	Lot       string     `json:"lot"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// productManager returns the product in the {id} route parameter and the user of the session
+// when the user is its seller or an admin
+func (s *service) productManager(w http.ResponseWriter, r *http.Request) (*db.Product, *db.User, bool) {
+	params := mux.Vars(r)
+
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	product, err := s.db.GetProduct(r.Context(), params["id"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return nil, nil, false
+	}
+	if product.SellerID != user.UUID && !s.isAdmin(user.Username) {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to manage stock, make sure user is the seller of the product")
+		return nil, nil, false
+	}
+	auditBefore(r, product)
+	return product, user, true
+}
+
+// adjustStock applies a stock adjustment and writes the updated product
+func (s *service) adjustStock(w http.ResponseWriter, r *http.Request, product *db.Product, user *db.User, adjustment *db.StockAdjustment) {
+	p, err := s.db.AdjustProductStock(r.Context(), product.UUID, user.UUID, adjustment)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusAccepted, p)
+}
+
+// RestockProduct handler adds a delivery to the stock of a product
+func (s *service) RestockProduct(w http.ResponseWriter, r *http.Request) {
+	var delivery restock
+
+	product, user, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&delivery); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	s.adjustStock(w, r, product, user, &db.StockAdjustment{
+		Reason:    db.MovementRestock,
+		Change:    delivery.Amount,
+		Note:      delivery.Note,
+		Lot:       delivery.Lot,
+		ExpiresAt: delivery.ExpiresAt,
+	})
+}
+
+// AdjustProductStock handler changes the stock of a product with a reason code
+func (s *service) AdjustProductStock(w http.ResponseWriter, r *http.Request) {
+	var adjustment db.StockAdjustment
+
+	product, user, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&adjustment); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	s.adjustStock(w, r, product, user, &adjustment)
+}
+
+// GetStockHistory handler lists the stock movements of a product, filtered by the machine_id
+// query parameter and bounded by limit
+func (s *service) GetStockHistory(w http.ResponseWriter, r *http.Request) {
+	product, _, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = helpers.ConvertStringToInt(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return
+		}
+	}
+
+	movements, err := s.db.GetStockHistory(r.Context(), product.UUID, query.Get("machine_id"), limit)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, movements)
+}
+
+// GetBatches handler lists the batches of a product with units left, in the catalog stock or in the
+// machine of the machine_id query parameter
+func (s *service) GetBatches(w http.ResponseWriter, r *http.Request) {
+	product, _, ok := s.productManager(w, r)
+	if !ok {
+		return
+	}
+
+	batches, err := s.db.GetBatches(r.Context(), product.UUID, r.URL.Query().Get("machine_id"))
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, batches)
+}
+
+// GetExpiringBatches handler reports the batches of a seller expiring within the days query parameter,
+// allowed for the seller and for admins
+func (s *service) GetExpiringBatches(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.UUID != params["id"] && !s.isAdmin(user.Username) {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights, make sure user is the seller")
+		return
+	}
+
+	days := 0
+	if value := r.URL.Query().Get("days"); value != "" {
+		var err error
+		if days, err = helpers.ConvertStringToInt(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid days: "+err.Error())
+			return
+		}
+	}
+
+	report, err := s.db.GetExpiringBatches(r.Context(), params["id"], days)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, report)
+}
@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// currentUser returns the user of the active session
+func (s *service) currentUser(w http.ResponseWriter, r *http.Request) (*db.User, bool) {
+	username, ok := s.CheckIfUserSessionIsActive(w, r)
+	if !ok {
+		return nil, false
+	}
+	credentials, err := s.db.GetUserPasswordByUsername(r.Context(), username)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusUnauthorized, "Not Authorized, please login")
+		return nil, false
+	}
+	user, err := s.db.GetUser(r.Context(), credentials.UUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusUnauthorized, "Not Authorized, please login")
+		return nil, false
+	}
+	return user, true
+}
+
+// isAdmin reports whether username is configured as an admin
+func (s *service) isAdmin(username string) bool {
+	for _, admin := range s.adminUsernames {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMachineBuyer checks that the session belongs to the buyer in the {id} route parameter
+func (s *service) checkMachineBuyer(w http.ResponseWriter, r *http.Request, action string) (*db.User, bool) {
+	params := mux.Vars(r)
+
+	username, ok := s.CheckIfUserSessionIsActive(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	user, err := s.db.GetUser(r.Context(), params["id"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return nil, false
+	}
+
+	if username != user.Username {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to "+action)
+		return nil, false
+	}
+
+	if user.Role != "buyer" {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to "+action+", make sure user is a buyer")
+		return nil, false
+	}
+	return user, true
+}
+
+// checkMachineOrAdmin checks that the request comes from the machine in the {machineId} route parameter,
+// authenticated with its machine key, or from an admin
+func (s *service) checkMachineOrAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if machineUUID, ok := helpers.AuthenticatedMachine(r); ok {
+		actor := "machine:" + machineUUID
+		auditActor(r, actor)
+		return actor, true
+	}
+	return s.CheckIfUserIsAdmin(w, r)
+}
+
+// decodeMachine reads a machine from the request body
+func decodeMachine(w http.ResponseWriter, r *http.Request) (*db.Machine, bool) {
+	var machine db.Machine
+	if err := json.NewDecoder(r.Body).Decode(&machine); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return nil, false
+	}
+	if err := r.Body.Close(); err != nil {
+		log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+	}
+	return &machine, true
+}
+
+// CreateMachine handler
+func (s *service) CreateMachine(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	machine, ok := decodeMachine(w, r)
+	if !ok {
+		return
+	}
+
+	m, err := s.db.CreateMachine(r.Context(), machine)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "unable to create machine "+err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, m)
+}
+
+// GetMachines handler
+func (s *service) GetMachines(w http.ResponseWriter, r *http.Request) {
+	machines, err := s.db.GetMachines(r.Context())
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, machines)
+}
+
+// GetMachine handler
+func (s *service) GetMachine(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	machine, err := s.db.GetMachine(r.Context(), params["machineId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, machine)
+}
+
+// UpdateMachine handler
+func (s *service) UpdateMachine(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	machine, ok := decodeMachine(w, r)
+	if !ok {
+		return
+	}
+	machine.UUID = params["machineId"]
+
+	if before, err := s.db.GetMachine(r.Context(), machine.UUID); err == nil {
+		auditBefore(r, before)
+	}
+
+	m, err := s.db.UpdateMachine(r.Context(), machine)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusAccepted, m)
+}
+
+// DeleteMachine handler
+func (s *service) DeleteMachine(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	machine, err := s.db.GetMachine(r.Context(), params["machineId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	auditBefore(r, machine)
+
+	// a machine still holding credit, reservations, coins or stock is refused
+	if err := s.db.DeleteMachine(r.Context(), params["machineId"]); err != nil {
+		helpers.ErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	d := fmt.Sprintf("machine with id: %+v deleted", params["machineId"])
+
+	helpers.JSONResponse(w, http.StatusAccepted, map[string]string{"success": d})
+}
+
+// GetMachineProducts handler
+func (s *service) GetMachineProducts(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	products, err := s.db.GetMachineProducts(r.Context(), params["machineId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, products)
+}
+
+// GetPlanogram handler
+func (s *service) GetPlanogram(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	planogram, err := s.db.GetPlanogram(r.Context(), params["machineId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, planogram)
+}
+
+// SaveSlot handler creates a slot in a machine's layout or changes its capacity
+func (s *service) SaveSlot(w http.ResponseWriter, r *http.Request) {
+	var slot db.Slot
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&slot); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+	slot.MachineUUID = params["machineId"]
+	slot.Code = params["slotCode"]
+
+	sl, err := s.db.SaveSlot(r.Context(), &slot)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusAccepted, sl)
+}
+
+// DeleteSlot handler
+func (s *service) DeleteSlot(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	if err := s.db.DeleteSlot(r.Context(), params["machineId"], params["slotCode"]); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d := fmt.Sprintf("slot %+v deleted", params["slotCode"])
+
+	helpers.JSONResponse(w, http.StatusAccepted, map[string]string{"success": d})
+}
+
+// slotFill is the product and the number of units a slot should hold, the units added are tracked as
+// a batch when an expiry date is given
+type slotFill struct {
+	ProductUUID string     `json:"product_id"`
+	Amount      int        `json:"amount"`
+	Lot         string     `json:"lot"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+// FillSlot handler assigns a product to a slot and sets how many units it holds,
+// allowed for the seller of the product and for admins. Only admins can clear a slot
+func (s *service) FillSlot(w http.ResponseWriter, r *http.Request) {
+	var slot slotFill
+	params := mux.Vars(r)
+
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&slot); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	admin := s.isAdmin(user.Username)
+	if slot.ProductUUID == "" {
+		if !admin {
+			helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to clear slot, admin access required")
+			return
+		}
+	} else {
+		product, err := s.db.GetProduct(r.Context(), slot.ProductUUID)
+		if err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+			return
+		}
+		if product.SellerID != user.UUID && !admin {
+			helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to stock product, make sure user is the seller of the product")
+			return
+		}
+	}
+
+	var batch *db.Batch
+	if slot.ExpiresAt != nil {
+		batch = &db.Batch{Lot: slot.Lot, ExpiresAt: *slot.ExpiresAt}
+	} else if slot.Lot != "" {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: a lot needs an expiry date (expires_at) to be tracked")
+		return
+	}
+
+	sl, err := s.db.FillSlot(r.Context(), params["machineId"], params["slotCode"], slot.ProductUUID, user.UUID, slot.Amount, batch)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusAccepted, sl)
+}
+
+// GetMachineCoins handler
+func (s *service) GetMachineCoins(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	coins, err := s.db.GetMachineCoins(r.Context(), params["machineId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, coins)
+}
+
+// GetMachineCredit handler
+func (s *service) GetMachineCredit(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.checkMachineBuyer(w, r, "get credit"); !ok {
+		return
+	}
+
+	credit, err := s.db.GetMachineCredit(r.Context(), params["machineId"], params["id"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, credit)
+}
+
+// MachineDepositAmount handler
+func (s *service) MachineDepositAmount(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.checkMachineBuyer(w, r, "deposit"); !ok {
+		return
+	}
+
+	amount, err := helpers.ConvertStringToInt(params["amount"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, "invalid character in route for amount:"+err.Error())
+		return
+	}
+
+	if before, err := s.db.GetMachineCredit(r.Context(), params["machineId"], params["id"]); err == nil {
+		auditBefore(r, before)
+	}
+
+	credit, err := s.db.MachineDeposit(r.Context(), params["machineId"], params["id"], amount)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, credit)
+}
+
+// MachineBuy handler
+func (s *service) MachineBuy(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.checkMachineBuyer(w, r, "make purchase"); !ok {
+		return
+	}
+
+	amountOfProducts, err := helpers.ConvertStringToInt(params["amountOfProducts"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, "invalid character in route for amount:"+err.Error())
+		return
+	}
+
+	res, err := s.db.MachineBuy(r.Context(), params["machineId"], params["id"], params["productId"], amountOfProducts)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, res)
+}
+
+// MachineBuySlot handler
+func (s *service) MachineBuySlot(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.checkMachineBuyer(w, r, "make purchase"); !ok {
+		return
+	}
+
+	amountOfProducts, err := helpers.ConvertStringToInt(params["amountOfProducts"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, "invalid character in route for amount:"+err.Error())
+		return
+	}
+
+	res, err := s.db.MachineBuySlot(r.Context(), params["machineId"], params["id"], params["slotCode"], amountOfProducts)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, res)
+}
+
+// MachineReset handler
+func (s *service) MachineReset(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.checkMachineBuyer(w, r, "reset deposit"); !ok {
+		return
+	}
+
+	if before, err := s.db.GetMachineCredit(r.Context(), params["machineId"], params["id"]); err == nil {
+		auditBefore(r, before)
+	}
+
+	credit, err := s.db.MachineReset(r.Context(), params["machineId"], params["id"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusAccepted, credit)
+}
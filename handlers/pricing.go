@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/pricing"
+	"github.com/gorilla/mux"
+)
+
+// basket is the body of the basket routes
+type basket struct {
+	Items   []*db.BasketItem `json:"items"`
+	Voucher string           `json:"voucher"`
+}
+
+// decodeBasket reads the basket of the request body
+func decodeBasket(w http.ResponseWriter, r *http.Request) (*basket, bool) {
+	var body basket
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return nil, false
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+	return &body, true
+}
+
+// decodePriceRule reads the price rule of the request body
+func decodePriceRule(w http.ResponseWriter, r *http.Request) (*pricing.Rule, bool) {
+	var rule pricing.Rule
+
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return nil, false
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+	return &rule, true
+}
+
+// checkRuleProducts checks that user sells every product a rule prices, admins may price any product
+func (s *service) checkRuleProducts(w http.ResponseWriter, r *http.Request, user *db.User, rule *pricing.Rule) bool {
+	if s.isAdmin(user.Username) {
+		return true
+	}
+	for _, productUUID := range rule.Products() {
+		product, err := s.db.GetProduct(r.Context(), productUUID)
+		if err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+		if product.SellerID != user.UUID {
+			helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to price product, make sure user is the seller of the product")
+			return false
+		}
+	}
+	return true
+}
+
+// priceRuleManager returns the price rule of the {ruleId} route parameter and the user of the session
+// when they are its seller or an admin
+func (s *service) priceRuleManager(w http.ResponseWriter, r *http.Request) (*pricing.Rule, *db.User, bool) {
+	params := mux.Vars(r)
+
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	rule, err := s.db.GetPriceRule(r.Context(), params["ruleId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return nil, nil, false
+	}
+	if rule.SellerID != user.UUID && !s.isAdmin(user.Username) {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to manage price rule, make sure user is the seller of its products")
+		return nil, nil, false
+	}
+	auditBefore(r, rule)
+	return rule, user, true
+}
+
+// CreatePriceRule handler stores a price change or a promotion on products of the seller
+func (s *service) CreatePriceRule(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return
+	}
+	rule, ok := decodePriceRule(w, r)
+	if !ok {
+		return
+	}
+	if err := rule.Validate(); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.checkRuleProducts(w, r, user, rule) {
+		return
+	}
+
+	created, err := s.db.CreatePriceRule(r.Context(), rule)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, created)
+}
+
+// GetPriceRules handler lists price rules, filtered by the product_id and seller_id query parameters.
+// Sellers only see their own rules
+func (s *service) GetPriceRules(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	sellerID := query.Get("seller_id")
+	if !s.isAdmin(user.Username) {
+		sellerID = user.UUID
+	}
+	rules, err := s.db.GetPriceRules(r.Context(), query.Get("product_id"), sellerID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, rules)
+}
+
+// GetPriceRule handler
+func (s *service) GetPriceRule(w http.ResponseWriter, r *http.Request) {
+	rule, _, ok := s.priceRuleManager(w, r)
+	if !ok {
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, rule)
+}
+
+// UpdatePriceRule handler replaces a price rule, its kind cannot change
+func (s *service) UpdatePriceRule(w http.ResponseWriter, r *http.Request) {
+	rule, user, ok := s.priceRuleManager(w, r)
+	if !ok {
+		return
+	}
+	update, ok := decodePriceRule(w, r)
+	if !ok {
+		return
+	}
+	update.UUID = rule.UUID
+	if update.Kind == "" {
+		update.Kind = rule.Kind
+	}
+	if err := update.Validate(); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.checkRuleProducts(w, r, user, update) {
+		return
+	}
+
+	updated, err := s.db.UpdatePriceRule(r.Context(), update)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, updated)
+}
+
+// DeletePriceRule handler
+func (s *service) DeletePriceRule(w http.ResponseWriter, r *http.Request) {
+	rule, _, ok := s.priceRuleManager(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeletePriceRule(r.Context(), rule.UUID); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d := fmt.Sprintf("price rule with id: %+v deleted", rule.UUID)
+
+	helpers.JSONResponse(w, http.StatusAccepted, map[string]string{"success": d})
+}
+
+// QuotePrices handler prices a basket with the promotions in force, without buying it
+func (s *service) QuotePrices(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserSessionIsActive(w, r); !ok {
+		return
+	}
+	body, ok := decodeBasket(w, r)
+	if !ok {
+		return
+	}
+
+	quote, err := s.db.QuotePrices(r.Context(), body.Items)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, quote)
+}
+
+// BuyBasket handler buys several products at once with the buyer's deposit
+func (s *service) BuyBasket(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	username, ok := s.CheckIfUserSessionIsActive(w, r)
+	if !ok {
+		return
+	}
+	userUUID := params["id"]
+
+	user, err := s.db.GetUser(r.Context(), userUUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+
+	if username != user.Username {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to make purchase")
+		return
+	}
+
+	if user.Role != "buyer" {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to make purchase, make sure user is a buyer")
+		return
+	}
+
+	body, ok := decodeBasket(w, r)
+	if !ok {
+		return
+	}
+
+	bought, err := s.db.BuyBasket(r.Context(), userUUID, body.Items, body.Voucher)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, bought)
+}
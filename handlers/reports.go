@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+// defaultTopSellers is the length of the top sellers without limit
+const defaultTopSellers = 10
+
+// parseReportTime reads a report bound, a RFC 3339 time or a date starting at midnight in location
+func parseReportTime(value string, location *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, location)
+}
+
+// reportFilter reads the report filter of the from, to, tz, seller_id, machine_id, product_id, group_by,
+// rank_by and limit query parameters, tz defaulting to the local time of the machines. Reports are for
+// sellers, who only see their own sales, and admins
+func (s *service) reportFilter(w http.ResponseWriter, r *http.Request) (*db.SalesFilter, bool) {
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	admin := s.isAdmin(user.Username)
+	if user.Role != "seller" && !admin {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to read reports, make sure user is a seller")
+		return nil, false
+	}
+
+	query := r.URL.Query()
+	filter := &db.SalesFilter{
+		SellerID:    query.Get("seller_id"),
+		MachineUUID: query.Get("machine_id"),
+		ProductUUID: query.Get("product_id"),
+		GroupBy:     query.Get("group_by"),
+		RankBy:      query.Get("rank_by"),
+	}
+	if !admin {
+		filter.SellerID = user.UUID
+	}
+	filter.Location = s.location
+	if value := query.Get("tz"); value != "" {
+		var err error
+		if filter.Location, err = time.LoadLocation(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid tz: "+err.Error())
+			return nil, false
+		}
+	}
+	for name, bound := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := parseReportTime(value, filter.Location)
+		if err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid %s '%s': use a RFC 3339 time or a 2006-01-02 date", name, value))
+			return nil, false
+		}
+		*bound = t
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if filter.Limit, err = helpers.ConvertStringToInt(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return nil, false
+		}
+	}
+	return filter, true
+}
+
+// wantsCSV reports whether the format query parameter asks for a csv download
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == formatCSV
+}
+
+// csvResponse writes records as a csv attachment named filename
+func csvResponse(w http.ResponseWriter, r *http.Request, filename string, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(w)
+	if err := writer.WriteAll(records); err != nil {
+		log.Warn(r.Context(), "unable to write csv report", logger.Fields{"err": err, "filename": filename})
+	}
+}
+
+// formatFigure writes an average of a csv report
+func formatFigure(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// salesRecords are the rows of a sales report as csv records, with a header
+func salesRecords(report *db.SalesReport) [][]string {
+	records := [][]string{{report.GroupBy, "label", "revenue", "discount", "units", "transactions", "average_basket_value", "average_basket_units"}}
+	for _, row := range report.Rows {
+		records = append(records, []string{
+			row.Key, row.Label, strconv.Itoa(row.Revenue), strconv.Itoa(row.Discount), strconv.Itoa(row.Units),
+			strconv.Itoa(row.Transactions), formatFigure(row.AverageBasketValue), formatFigure(row.AverageBasketUnits),
+		})
+	}
+	return records
+}
+
+// salesReport writes a sales report as json or, with format=csv, as a csv download
+func (s *service) salesReport(w http.ResponseWriter, r *http.Request, filter *db.SalesFilter, name string) {
+	report, err := s.db.GetSalesReport(r.Context(), filter)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if wantsCSV(r) {
+		csvResponse(w, r, fmt.Sprintf("%s-%s.csv", name, report.GroupBy), salesRecords(report))
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, report)
+}
+
+// GetSalesReport handler returns the revenue, units and transactions grouped by product, seller, machine
+// or hour, day and week bucket, with the group_by query parameter
+func (s *service) GetSalesReport(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.reportFilter(w, r)
+	if !ok {
+		return
+	}
+	s.salesReport(w, r, filter, "sales")
+}
+
+// GetTopSellers handler ranks the best selling products, or sellers and machines with the group_by query
+// parameter, by revenue or with rank_by=units by units
+func (s *service) GetTopSellers(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.reportFilter(w, r)
+	if !ok {
+		return
+	}
+	switch filter.GroupBy {
+	case "":
+		filter.GroupBy = db.SalesByProduct
+	case db.SalesByHour, db.SalesByDay, db.SalesByWeek:
+		helpers.ErrorResponse(w, http.StatusBadRequest, "top sellers group by product, seller or machine")
+		return
+	}
+	if filter.RankBy == "" {
+		filter.RankBy = db.RankByRevenue
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultTopSellers
+	}
+	s.salesReport(w, r, filter, "top-sellers")
+}
+
+// GetStockTurnover handler returns how often the stock of each product sold over the period, as json or
+// with format=csv as a csv download
+func (s *service) GetStockTurnover(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.reportFilter(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := s.db.GetStockTurnover(r.Context(), filter)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !wantsCSV(r) {
+		helpers.JSONResponse(w, http.StatusOK, report)
+		return
+	}
+	records := [][]string{{"product_id", "product_name", "seller_id", "units_sold", "opening_stock", "closing_stock", "average_stock", "turnover", "days_of_stock"}}
+	for _, t := range report.Products {
+		days := ""
+		if t.DaysOfStock != nil {
+			days = formatFigure(*t.DaysOfStock)
+		}
+		records = append(records, []string{
+			t.ProductUUID, t.ProductName, t.SellerID, strconv.Itoa(t.UnitsSold), strconv.Itoa(t.OpeningStock),
+			strconv.Itoa(t.ClosingStock), formatFigure(t.AverageStock), formatFigure(t.Turnover), days,
+		})
+	}
+	csvResponse(w, r, "stock-turnover.csv", records)
+}
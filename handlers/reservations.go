@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// confirmation is the outcome of a vend reported by a machine
+type confirmation struct {
+	Success bool   `json:"success"`
+	Reason  string `json:"reason"`
+}
+
+// machineReservation returns the reservation in the route
+func (s *service) machineReservation(w http.ResponseWriter, r *http.Request) (*db.Reservation, bool) {
+	params := mux.Vars(r)
+
+	reservation, err := s.db.GetReservation(r.Context(), params["reservationId"])
+	if err != nil || reservation.MachineUUID != params["machineId"] {
+		helpers.ErrorResponse(w, http.StatusNotFound, "reservation not found")
+		return nil, false
+	}
+	return reservation, true
+}
+
+// MachineReserve handler holds products and their cost until the machine confirms the vend
+func (s *service) MachineReserve(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.checkMachineBuyer(w, r, "make purchase"); !ok {
+		return
+	}
+
+	amountOfProducts, err := helpers.ConvertStringToInt(params["amountOfProducts"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, "invalid character in route for amount:"+err.Error())
+		return
+	}
+
+	reservation, err := s.db.ReserveMachineProduct(r.Context(), params["machineId"], params["id"], params["productId"], amountOfProducts)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, reservation)
+}
+
+// GetReservation handler shows a reservation to its buyer, to its machine and to admins
+func (s *service) GetReservation(w http.ResponseWriter, r *http.Request) {
+	var user *db.User
+	if _, machine := helpers.AuthenticatedMachine(r); !machine {
+		var ok bool
+		if user, ok = s.currentUser(w, r); !ok {
+			return
+		}
+	}
+	reservation, ok := s.machineReservation(w, r)
+	if !ok {
+		return
+	}
+	if user != nil && reservation.UserUUID != user.UUID && !s.isAdmin(user.Username) {
+		helpers.ErrorResponse(w, http.StatusForbidden, "insufficient rights to access reservation")
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, reservation)
+}
+
+// ConfirmReservation handler settles or releases a reservation with the outcome of the vend. Only the
+// machine, authenticated with its machine key, and admins report it: a buyer reporting a failed vend
+// would get both the products and their credit
+func (s *service) ConfirmReservation(w http.ResponseWriter, r *http.Request) {
+	var c confirmation
+
+	if _, ok := s.checkMachineOrAdmin(w, r); !ok {
+		return
+	}
+	reservation, ok := s.machineReservation(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	res, err := s.db.ConfirmReservation(r.Context(), reservation.UUID, c.Success, c.Reason)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, res)
+}
+
+// GetReservations handler lists reservations for admins, filtered by the machine_id and status query parameters
+func (s *service) GetReservations(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	reservations, err := s.db.GetReservations(r.Context(), query.Get("machine_id"), query.Get("status"))
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, reservations)
+}
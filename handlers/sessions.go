@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// buyerSessionEvents are the events a buyer may report for themselves, the others are reported by the
+// machine firmware or an admin: a buyer reporting a fault or an empty slot would release their own hold
+// or wipe out the stock of a slot
+var buyerSessionEvents = map[string]bool{
+	db.EventSelect:     true,
+	db.EventCancel:     true,
+	db.EventCoinReturn: true,
+}
+
+// GetMachineSession handler
+func (s *service) GetMachineSession(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := helpers.AuthenticatedMachine(r); !ok {
+		if _, ok := s.CheckIfUserSessionIsActive(w, r); !ok {
+			return
+		}
+	}
+
+	session, err := s.db.GetMachineSession(r.Context(), params["machineId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, session)
+}
+
+// MachineSessionEvent handler drives a machine's vend cycle with an event reported for the buyer it serves.
+// The machine firmware, authenticated with its machine key, and admins report any event, the buyer only
+// selects, cancels and presses coin return
+func (s *service) MachineSessionEvent(w http.ResponseWriter, r *http.Request) {
+	var event db.SessionEvent
+	params := mux.Vars(r)
+
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+
+	if _, machine := helpers.AuthenticatedMachine(r); machine || !buyerSessionEvents[event.Event] {
+		if _, ok := s.checkMachineOrAdmin(w, r); !ok {
+			return
+		}
+	} else if _, ok := s.checkMachineBuyer(w, r, "use machine"); !ok {
+		return
+	}
+
+	session, err := s.db.SessionEvent(r.Context(), params["machineId"], params["id"], &event)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, session)
+}
+
+// ClearMachineSession handler
+func (s *service) ClearMachineSession(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	session, err := s.db.ClearMachineSession(r.Context(), params["machineId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, session)
+}
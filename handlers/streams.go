@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/code-sleuth/vending-machine/bus"
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/metrics"
+	"github.com/code-sleuth/vending-machine/stream"
+)
+
+// streamRequest is what a stream follows
+type streamRequest struct {
+	products []string
+	machines []string
+	// user is set when the stream follows the balance of the user of the session
+	user *db.User
+}
+
+// topics of the bus the stream subscribes to
+func (req *streamRequest) topics() []string {
+	topics := make([]string, 0, len(req.products)+len(req.machines)+1)
+	for _, productUUID := range req.products {
+		topics = append(topics, bus.ProductTopic(productUUID))
+	}
+	for _, machineUUID := range req.machines {
+		topics = append(topics, bus.MachineTopic(machineUUID))
+	}
+	if req.user != nil {
+		topics = append(topics, bus.UserTopic(req.user.UUID))
+	}
+	return topics
+}
+
+// streamRequestOf reads what a stream follows of the product, machine and balance query parameters. The
+// stock of products and the state of machines are public like the product and machine routes, following
+// the balance needs a session
+func (s *service) streamRequestOf(w http.ResponseWriter, r *http.Request) (*streamRequest, bool) {
+	query := r.URL.Query()
+	req := &streamRequest{products: query["product"], machines: query["machine"]}
+	if len(req.products)+len(req.machines) > s.streams.MaxTopics {
+		helpers.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("a stream follows at most %d products and machines", s.streams.MaxTopics))
+		return nil, false
+	}
+	if query.Get("balance") == "true" {
+		user, ok := s.currentUser(w, r)
+		if !ok {
+			return nil, false
+		}
+		req.user = user
+	}
+	if len(req.products)+len(req.machines) == 0 && req.user == nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "nothing to stream: use the product, machine or balance query parameters")
+		return nil, false
+	}
+	return req, true
+}
+
+// streamSnapshot returns the current state of what a stream follows, sent before its changes
+func (s *service) streamSnapshot(ctx context.Context, req *streamRequest) ([]bus.Event, error) {
+	snapshot := make([]bus.Event, 0, len(req.products)+2*len(req.machines)+1)
+	for _, productUUID := range req.products {
+		product, err := s.db.GetProduct(ctx, productUUID)
+		if err != nil {
+			return nil, err
+		}
+		snapshot = append(snapshot, bus.Event{
+			Topic: bus.ProductTopic(productUUID),
+			Type:  bus.EventStock,
+			Data:  &db.StockLevel{ProductUUID: productUUID, Stock: product.AmountAvailable},
+		})
+	}
+	for _, machineUUID := range req.machines {
+		machine, err := s.db.GetMachine(ctx, machineUUID)
+		if err != nil {
+			return nil, err
+		}
+		session, err := s.db.GetMachineSession(ctx, machineUUID)
+		if err != nil {
+			return nil, err
+		}
+		updatedAt := session.UpdatedAt
+		snapshot = append(snapshot, bus.Event{
+			Topic: bus.MachineTopic(machineUUID),
+			Type:  bus.EventMachineStatus,
+			Data:  &db.MachineState{MachineUUID: machineUUID, Status: machine.Status},
+		}, bus.Event{
+			Topic: bus.MachineTopic(machineUUID),
+			Type:  bus.EventMachineSession,
+			Data:  &db.MachineState{MachineUUID: machineUUID, State: session.State, Fault: session.Fault, UpdatedAt: &updatedAt},
+		})
+	}
+	if req.user != nil {
+		snapshot = append(snapshot, bus.Event{
+			Topic: bus.UserTopic(req.user.UUID),
+			Type:  bus.EventBalance,
+			Data:  &db.Balance{UserUUID: req.user.UUID, Balance: req.user.Deposit},
+		})
+	}
+	return snapshot, nil
+}
+
+// allowedOrigin reports whether a websocket may be opened from a page of the origin of the request: the
+// host itself or an origin allowed by cors. Browsers send the session cookie along whatever the origin
+func (s *service) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamEvents handler streams the stock of the products, the state of the machines and the balance of the
+// user it follows as server-sent events, starting with their current state
+func (s *service) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	s.serveStream(w, r, stream.TransportSSE)
+}
+
+// StreamWebSocket handler streams the same events as StreamEvents over a websocket
+func (s *service) StreamWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !s.allowedOrigin(r) {
+		helpers.ErrorResponse(w, http.StatusForbidden, "origin not allowed")
+		return
+	}
+	s.serveStream(w, r, stream.TransportWebSocket)
+}
+
+// serveStream subscribes to what the request follows, sends its current state then its changes until
+// the client goes away, falls too far behind or the server stops
+func (s *service) serveStream(w http.ResponseWriter, r *http.Request, transport string) {
+	ctx := r.Context()
+	req, ok := s.streamRequestOf(w, r)
+	if !ok {
+		return
+	}
+	// subscribed before reading the current state, so that no change falls in between
+	sub := s.events.Subscribe(req.topics()...)
+	defer sub.Close()
+	snapshot, err := s.streamSnapshot(ctx, req)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var conn stream.Conn
+	if transport == stream.TransportWebSocket {
+		conn, err = stream.Upgrade(w, r, s.streams.WriteTimeout)
+	} else {
+		conn, err = stream.ServeSSE(w, s.streams.WriteTimeout)
+	}
+	if err != nil {
+		log.Warn(ctx, "unable to open stream", logger.Fields{"err": err, "transport": transport})
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	metrics.StreamSubscribers.WithLabelValues(transport).Inc()
+	defer metrics.StreamSubscribers.WithLabelValues(transport).Dec()
+
+	for i := range snapshot {
+		if err = stream.SendEvent(conn, &snapshot[i]); err != nil {
+			log.Info(ctx, "stream closed", logger.Fields{"err": err, "transport": transport})
+			return
+		}
+	}
+	dropped, err := stream.Pump(conn, sub, s.streams.Heartbeat)
+	if dropped > 0 {
+		metrics.StreamEventsDropped.WithLabelValues(transport).Add(float64(dropped))
+	}
+	if err != nil {
+		log.Info(ctx, "stream closed", logger.Fields{"err": err, "transport": transport, "dropped": dropped})
+	}
+}
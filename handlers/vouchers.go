@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// purchaseOptions is the optional body of the buy route
+type purchaseOptions struct {
+	Voucher string `json:"voucher"`
+}
+
+// decodeVoucher reads the voucher code of the request body, which may be empty
+func decodeVoucher(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body purchaseOptions
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return "", false
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+	return body.Voucher, true
+}
+
+// decodeVoucherBody reads the voucher of the request body
+func decodeVoucherBody(w http.ResponseWriter, r *http.Request) (*db.Voucher, bool) {
+	var voucher db.Voucher
+
+	if err := json.NewDecoder(r.Body).Decode(&voucher); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return nil, false
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+	return &voucher, true
+}
+
+// CreateVoucher handler stores a new voucher
+func (s *service) CreateVoucher(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+	voucher, ok := decodeVoucherBody(w, r)
+	if !ok {
+		return
+	}
+
+	v, err := s.db.CreateVoucher(r.Context(), voucher, user.UUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, v)
+}
+
+// GetVouchers handler
+func (s *service) GetVouchers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	vouchers, err := s.db.GetVouchers(r.Context())
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, vouchers)
+}
+
+// GetVoucher handler
+func (s *service) GetVoucher(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	v, err := s.db.GetVoucher(r.Context(), params["voucherId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, v)
+}
+
+// UpdateVoucher handler replaces the editable fields of a voucher
+func (s *service) UpdateVoucher(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+	voucher, ok := decodeVoucherBody(w, r)
+	if !ok {
+		return
+	}
+	voucher.UUID = params["voucherId"]
+
+	if before, err := s.db.GetVoucher(r.Context(), voucher.UUID); err == nil {
+		auditBefore(r, before)
+	}
+
+	v, err := s.db.UpdateVoucher(r.Context(), voucher)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, v)
+}
+
+// DeleteVoucher handler removes a voucher that was never redeemed
+func (s *service) DeleteVoucher(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	if voucher, err := s.db.GetVoucher(r.Context(), params["voucherId"]); err == nil {
+		auditBefore(r, voucher)
+	}
+
+	if err := s.db.DeleteVoucher(r.Context(), params["voucherId"]); err != nil {
+		helpers.ErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	d := fmt.Sprintf("voucher with id: %+v deleted", params["voucherId"])
+
+	helpers.JSONResponse(w, http.StatusAccepted, map[string]string{"success": d})
+}
+
+// GetVoucherRedemptions handler lists the uses of a voucher
+func (s *service) GetVoucherRedemptions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	redemptions, err := s.db.GetVoucherRedemptions(r.Context(), params["voucherId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, redemptions)
+}
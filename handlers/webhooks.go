@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+)
+
+// decodeWebhookBody reads the webhook subscription of the request body
+func decodeWebhookBody(w http.ResponseWriter, r *http.Request) (*db.WebhookSubscription, bool) {
+	var webhook db.WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return nil, false
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Warn(r.Context(), "unable to close request body", logger.Fields{"err": err})
+		}
+	}()
+	return &webhook, true
+}
+
+// CreateWebhook handler subscribes a url to events, returning the secret signing its deliveries
+func (s *service) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+	input, ok := decodeWebhookBody(w, r)
+	if !ok {
+		return
+	}
+
+	webhook, err := s.db.CreateWebhook(r.Context(), input, user.UUID)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, webhook)
+}
+
+// GetWebhooks handler lists the webhook subscriptions
+func (s *service) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	webhooks, err := s.db.GetWebhooks(r.Context())
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, webhooks)
+}
+
+// GetWebhook handler
+func (s *service) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	webhook, err := s.db.GetWebhook(r.Context(), params["webhookId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, webhook)
+}
+
+// UpdateWebhook handler replaces the url, events and description of a subscription, rotating its secret
+// or pausing it when given
+func (s *service) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+	input, ok := decodeWebhookBody(w, r)
+	if !ok {
+		return
+	}
+	input.UUID = params["webhookId"]
+
+	if before, err := s.db.GetWebhook(r.Context(), input.UUID); err == nil {
+		auditBefore(r, before)
+	}
+
+	webhook, err := s.db.UpdateWebhook(r.Context(), input)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, webhook)
+}
+
+// DeleteWebhook handler removes a subscription with its delivery log
+func (s *service) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	if webhook, err := s.db.GetWebhook(r.Context(), params["webhookId"]); err == nil {
+		auditBefore(r, webhook)
+	}
+
+	if err := s.db.DeleteWebhook(r.Context(), params["webhookId"]); err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	d := fmt.Sprintf("webhook with id: %+v deleted", params["webhookId"])
+
+	helpers.JSONResponse(w, http.StatusAccepted, map[string]string{"success": d})
+}
+
+// GetWebhookDeliveries handler lists the latest deliveries of a subscription, filtered by the status and
+// limit query parameters
+func (s *service) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = helpers.ConvertStringToInt(value); err != nil {
+			helpers.ErrorResponse(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return
+		}
+	}
+
+	deliveries, err := s.db.GetWebhookDeliveries(r.Context(), params["webhookId"], query.Get("status"), limit)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, deliveries)
+}
+
+// GetWebhookDelivery handler returns a delivery of a subscription with its attempts
+func (s *service) GetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	delivery, err := s.db.GetWebhookDelivery(r.Context(), params["webhookId"], params["deliveryId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusOK, delivery)
+}
+
+// ReplayWebhookDelivery handler sends the event of a delivery again as a new delivery
+func (s *service) ReplayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	if _, ok := s.CheckIfUserIsAdmin(w, r); !ok {
+		return
+	}
+
+	delivery, err := s.db.ReplayWebhookDelivery(r.Context(), params["webhookId"], params["deliveryId"])
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	helpers.JSONResponse(w, http.StatusCreated, delivery)
+}
@@ -1,17 +1,22 @@
 package helpers
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/code-sleuth/vending-machine/logger"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 )
 
+var log = logger.New("helpers")
+
 // ErrorResponse function
 func ErrorResponse(w http.ResponseWriter, statusCode int, message string) {
 	JSONResponse(w, statusCode, map[string]string{"error": message})
@@ -23,7 +28,7 @@ func JSONResponse(w http.ResponseWriter, statusCode int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	if _, err := w.Write(resp); err != nil {
-		log.Println(err)
+		log.Warn(context.Background(), "unable to write response", logger.Fields{"err": err})
 	}
 }
 
@@ -47,6 +52,19 @@ func ConvertStringToInt(param string) (int, error) {
 	return uid, nil
 }
 
+// Backoff returns the wait after attempts failed attempts: base, doubled after each further attempt,
+// up to max
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	wait := base
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
 // GetEnv function
 func GetEnv(key string, defaultVal string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -64,7 +82,7 @@ func GenerateJWT(uuid string, username string) (string, error) {
 	claims["authorized"] = true
 	claims["uuid"] = uuid
 	claims["username"] = username
-	claims["exp"] = time.Now().Add(time.Minute * 120).Unix()
+	claims["exp"] = time.Now().Add(tokenTTL).Unix()
 
 	tokenString, err := token.SignedString(signingKey)
 	if err != nil {
@@ -77,6 +95,14 @@ func GenerateJWT(uuid string, username string) (string, error) {
 
 var signingKey = []byte(GetEnv("JWT_SECRET", ""))
 
+var tokenTTL = time.Minute * 120
+
+// ConfigureJWT function sets the key used to sign tokens and how long they stay valid
+func ConfigureJWT(secret string, ttl time.Duration) {
+	signingKey = []byte(secret)
+	tokenTTL = ttl
+}
+
 // IsAuthorized function
 func IsAuthorized(endpoint func(http.ResponseWriter, *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -105,3 +131,37 @@ func IsAuthorized(endpoint func(http.ResponseWriter, *http.Request)) func(w http
 		}
 	}
 }
+
+// machineKeys maps machine uuids to the key their firmware authenticates with
+var machineKeys map[string]string
+
+// ConfigureMachineKeys function sets the keys machines authenticate with, by machine uuid
+func ConfigureMachineKeys(keys map[string]string) {
+	machineKeys = keys
+}
+
+type machineContextKey struct{}
+
+// IsMachineOrAuthorized function lets the machine of the {machineId} route parameter through when the
+// Machine-Key header holds its key, and users with a valid token as IsAuthorized does otherwise
+func IsMachineOrAuthorized(endpoint func(http.ResponseWriter, *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header["Machine-Key"] == nil {
+			IsAuthorized(endpoint)(w, r)
+			return
+		}
+		machineUUID := mux.Vars(r)["machineId"]
+		key, ok := machineKeys[machineUUID]
+		if !ok || key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(r.Header.Get("Machine-Key"))) != 1 {
+			ErrorResponse(w, http.StatusForbidden, "invalid machine key")
+			return
+		}
+		endpoint(w, r.WithContext(context.WithValue(r.Context(), machineContextKey{}, machineUUID)))
+	}
+}
+
+// AuthenticatedMachine function returns the machine IsMachineOrAuthorized authenticated the request as
+func AuthenticatedMachine(r *http.Request) (string, bool) {
+	machineUUID, ok := r.Context().Value(machineContextKey{}).(string)
+	return machineUUID, ok
+}
@@ -0,0 +1,124 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	// registers the gif decoder
+	_ "image/gif"
+	"image/jpeg"
+	// registers the png decoder
+	_ "image/png"
+)
+
+// Supported formats, as named by image.Decode
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+)
+
+// thumbnailQuality is the jpeg quality of thumbnails
+const thumbnailQuality = 85
+
+// maxPixels bounds the images decoded, so that a small file cannot expand into a huge bitmap
+const maxPixels = 40 << 20
+
+// ErrUnsupported is returned for data that is not a jpeg, png or gif image
+var ErrUnsupported = errors.New("unsupported image format: use jpeg, png or gif")
+
+// ContentType returns the media type of a supported format
+func ContentType(format string) string {
+	return "image/" + format
+}
+
+// Extension returns the file extension of a supported format
+func Extension(format string) string {
+	if format == FormatJPEG {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+// Decode reads an image, checking its format and size before decoding it
+func Decode(data []byte) (img image.Image, format string, err error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrUnsupported
+	}
+	switch format {
+	case FormatJPEG, FormatPNG, FormatGIF:
+	default:
+		return nil, "", ErrUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxPixels {
+		return nil, "", fmt.Errorf("image of %dx%d pixels is too large", cfg.Width, cfg.Height)
+	}
+	img, _, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to decode %s image: %v", format, err)
+	}
+	return img, format, nil
+}
+
+// Thumbnail scales img down so that its longest side is at most size pixels, averaging the pixels
+// each thumbnail pixel covers. Smaller images keep their size
+func Thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, h*size/w
+		} else {
+			tw, th = w*size/h, size
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, (y+1)*h/th
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, (x+1)*w/tw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					p := src.RGBAAt(sx, sy)
+					r, g, b, a = r+uint32(p.R), g+uint32(p.G), b+uint32(p.B), a+uint32(p.A)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// EncodeThumbnail writes a thumbnail as a jpeg over a white background, jpeg having no transparency
+func EncodeThumbnail(img image.Image) ([]byte, error) {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,190 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level of a log entry
+type Level int
+
+// Log levels, from the most to the least verbose
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+// String returns the name of the level
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel converts a level name such as "debug" or "warn" to a Level
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(strings.TrimSpace(name), levelName) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(strings.TrimSpace(name), "warning") {
+		return WarnLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// Fields are the structured key/value pairs attached to an entry
+type Fields map[string]interface{}
+
+var (
+	mu            sync.RWMutex
+	out           io.Writer = os.Stdout
+	defaultLevel            = InfoLevel
+	packageLevels           = map[string]Level{}
+	exit                    = os.Exit
+)
+
+// Configure sets the default level and the per-package level overrides
+func Configure(level Level, levels map[string]Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLevel = level
+	packageLevels = make(map[string]Level, len(levels))
+	for pkg, l := range levels {
+		packageLevels[pkg] = l
+	}
+}
+
+// SetOutput sets the destination of all log entries
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// Logger writes json entries tagged with the package that created it
+type Logger struct {
+	pkg string
+}
+
+// New creates a logger for the given package name
+func New(pkg string) *Logger {
+	return &Logger{pkg: pkg}
+}
+
+// Enabled reports whether entries at level are written for this logger's package
+func (l *Logger) Enabled(level Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	if pkgLevel, ok := packageLevels[l.pkg]; ok {
+		return level >= pkgLevel
+	}
+	return level >= defaultLevel
+}
+
+// Debug writes a debug entry
+func (l *Logger) Debug(ctx context.Context, msg string, fields Fields) {
+	l.write(ctx, DebugLevel, msg, fields)
+}
+
+// Info writes an info entry
+func (l *Logger) Info(ctx context.Context, msg string, fields Fields) {
+	l.write(ctx, InfoLevel, msg, fields)
+}
+
+// Warn writes a warning entry
+func (l *Logger) Warn(ctx context.Context, msg string, fields Fields) {
+	l.write(ctx, WarnLevel, msg, fields)
+}
+
+// Error writes an error entry
+func (l *Logger) Error(ctx context.Context, msg string, fields Fields) {
+	l.write(ctx, ErrorLevel, msg, fields)
+}
+
+// Fatal writes an error entry and exits the process
+func (l *Logger) Fatal(ctx context.Context, msg string, fields Fields) {
+	l.write(ctx, ErrorLevel, msg, fields)
+	exit(1)
+}
+
+// Outcome logs the result of an operation: debug when it succeeded, warn when it failed
+func (l *Logger) Outcome(ctx context.Context, operation string, err error, fields Fields) {
+	if err == nil {
+		l.Debug(ctx, operation, fields)
+		return
+	}
+	entry := Fields{"err": err}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	l.Warn(ctx, operation, entry)
+}
+
+// Writer returns an io.Writer that logs every write as an entry at level,
+// used to route the standard library logger through this package
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		l.write(context.Background(), level, strings.TrimSpace(string(p)), nil)
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (l *Logger) write(ctx context.Context, level Level, msg string, fields Fields) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+5)
+	for k, v := range Redact(fields) {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["pkg"] = l.pkg
+	entry["msg"] = msg
+	if ctx != nil {
+		if requestID := RequestID(ctx); requestID != "" {
+			entry["request_id"] = requestID
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(entry); err != nil {
+		buf.Reset()
+		fmt.Fprintf(&buf, `{"level":"error","pkg":"logger","msg":"unable to encode log entry: %s"}`+"\n", err.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	_, _ = out.Write(buf.Bytes())
+}
@@ -0,0 +1,78 @@
+package logger
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces sensitive values in log output
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are field name fragments whose values are never logged
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "cookie", "hash"}
+
+// bcryptRegex matches bcrypt hashes passed as plain query arguments
+var bcryptRegex = regexp.MustCompile(`^\$2[abxy]?\$\d{2}\$`)
+
+// Secret is a string that is passed to the database as is but never printed
+type Secret string
+
+// Value implements driver.Valuer
+func (s Secret) Value() (driver.Value, error) {
+	return string(s), nil
+}
+
+// String implements fmt.Stringer
+func (s Secret) String() string {
+	return Redacted
+}
+
+// MarshalJSON hides the secret in json output
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + Redacted + `"`), nil
+}
+
+// IsSensitiveKey reports whether a field with this name holds a secret
+func IsSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, fragment := range sensitiveKeys {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns a copy of fields with sensitive values replaced
+func Redact(fields Fields) Fields {
+	redacted := make(Fields, len(fields))
+	for k, v := range fields {
+		if IsSensitiveKey(k) {
+			redacted[k] = Redacted
+			continue
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// RedactArgs returns a copy of query arguments with secrets and password hashes replaced
+func RedactArgs(args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case Secret:
+			redacted[i] = Redacted
+		case string:
+			if bcryptRegex.MatchString(v) {
+				redacted[i] = Redacted
+			} else {
+				redacted[i] = v
+			}
+		default:
+			redacted[i] = arg
+		}
+	}
+	return redacted
+}
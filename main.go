@@ -1,46 +1,209 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"github.com/jmoiron/sqlx"
 	"io/ioutil"
-	"log"
+	stdlog "log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/code-sleuth/vending-machine/blob"
+	"github.com/code-sleuth/vending-machine/bus"
+	"github.com/code-sleuth/vending-machine/config"
 	"github.com/code-sleuth/vending-machine/controllers"
 	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/device"
 	"github.com/code-sleuth/vending-machine/handlers"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/code-sleuth/vending-machine/metrics"
+	"github.com/code-sleuth/vending-machine/notify"
+	"github.com/code-sleuth/vending-machine/outbox"
+	"github.com/code-sleuth/vending-machine/webhook"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/rs/cors"
 )
 
+var log = logger.New("main")
+
 func main() {
-	// instantiate multiplexer/router
-	mux := mux.NewRouter()
+	ctx := context.Background()
+
+	configFile := flag.String("config", helpers.GetEnv("CONFIG_FILE", ""), "path to an optional yaml configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-config file] [config print | device emulate]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) > 0 {
+		if len(args) == 2 && args[0] == "config" && args[1] == "print" {
+			os.Exit(printConfig(*configFile))
+		}
+		if len(args) == 2 && args[0] == "device" && args[1] == "emulate" {
+			os.Exit(emulateDevices(*configFile))
+		}
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// load and validate configuration, refuse to start on invalid settings
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(ctx, "unable to load configuration", logger.Fields{"err": err})
+	}
+	logger.Configure(cfg.LoggerLevels())
+	// route the standard library logger, used by dependencies, through the structured logger
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(logger.New("stdlib").Writer(logger.InfoLevel))
+	helpers.ConfigureJWT(cfg.Auth.JWTSecret, cfg.Auth.JWTTTL)
+	helpers.ConfigureMachineKeys(cfg.Auth.MachineKeys)
 
 	// initialize database
-	database := initDB()
+	database := initDB(cfg.DB)
+
+	// initialize the coin mechanisms and dispensers
+	devices, err := device.New(cfg.Devices)
+	if err != nil {
+		log.Fatal(ctx, "unable to initialize devices", logger.Fields{"err": err})
+	}
+	closers := []func() error{database.Close, handlers.CloseCache}
+	if devices != nil {
+		closers = append(closers, devices.Close)
+	}
+
+	// initialize the notifiers the alerts are sent to
+	notifier, err := notify.New(cfg.Alerts)
+	if err != nil {
+		log.Fatal(ctx, "unable to initialize alert notifiers", logger.Fields{"err": err})
+	}
+	closers = append(closers, notifier.Close)
+
+	// initialize the store of the product images
+	blobs, err := blob.New(cfg.Images)
+	if err != nil {
+		log.Fatal(ctx, "unable to initialize image store", logger.Fields{"err": err})
+	}
+
+	// the bus the db service publishes state changes to and the streams read from, closed after the
+	// server so that open streams end
+	events := bus.New(cfg.Streams.BufferSize)
+	closers = append([]func() error{events.Close}, closers...)
 
 	// initialize db service
-	dbService := db.New(database)
+	dbService := db.New(database, cfg, devices, notifier, blobs, events)
+
+	// release reservations the machines never confirmed
+	sweepCtx, stopSweep := context.WithCancel(ctx)
+	sweepDone := make(chan struct{})
+	go func() {
+		defer close(sweepDone)
+		sweepReservations(sweepCtx, dbService, cfg.Reservations.SweepInterval)
+	}()
+	closers = append([]func() error{func() error {
+		stopSweep()
+		<-sweepDone
+		return nil
+	}}, closers...)
+
+	// publish the events recorded in the outbox to its sinks
+	sinks := make([]outbox.Sink, 0, len(cfg.Outbox.Sinks))
+	for _, name := range cfg.Outbox.Sinks {
+		switch name {
+		case config.SinkWebhook:
+			sinks = append(sinks, webhook.NewSink(dbService))
+		case config.SinkStdout:
+			sinks = append(sinks, outbox.NewStdoutSink(os.Stdout))
+		case config.SinkNATS:
+			nats := outbox.NewNATSSink(cfg.Outbox.NATS)
+			sinks = append(sinks, nats)
+			closers = append(closers, nats.Close)
+		}
+	}
+	relayCtx, stopRelay := context.WithCancel(ctx)
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		outbox.NewRelay(dbService, cfg.Outbox, sinks...).Run(relayCtx)
+	}()
+	closers = append([]func() error{func() error {
+		stopRelay()
+		<-relayDone
+		return nil
+	}}, closers...)
+
+	// send the webhook deliveries due, retrying the failed ones
+	webhookCtx, stopWebhooks := context.WithCancel(ctx)
+	webhooksDone := make(chan struct{})
+	go func() {
+		defer close(webhooksDone)
+		webhook.NewWorker(dbService, cfg.Webhooks).Run(webhookCtx)
+	}()
+	closers = append([]func() error{func() error {
+		stopWebhooks()
+		<-webhooksDone
+		return nil
+	}}, closers...)
 
 	// initialize handlerService
-	handlerService := handlers.New(dbService)
+	handlerService := handlers.New(dbService, cfg, events)
 
 	// initialize cache (redis)
-	handlers.InitCache()
+	handlers.InitCache(cfg.Redis.URL)
+
+	handler := newHandler(handlerService, cfg)
+
+	srv := newServer(cfg.Server, handler)
+
+	// stop on SIGINT/SIGTERM so that deploys let in-flight requests finish
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	serverErrors := make(chan error, 1)
+	go func() {
+		log.Info(ctx, "listening", logger.Fields{"address": cfg.Server.ListenAddress})
+		serverErrors <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErrors:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(ctx, "server failed", logger.Fields{"err": err})
+		}
+	case sig := <-quit:
+		log.Info(ctx, "shutting down", logger.Fields{"signal": sig.String()})
+	}
+
+	if err := shutdown(srv, cfg.Server.ShutdownTimeout, closers...); err != nil {
+		log.Fatal(ctx, "unclean shutdown", logger.Fields{"err": err})
+	}
+	log.Info(ctx, "server stopped", nil)
+}
+
+// newHandler registers the routes of handlerService and wraps them in the middlewares every request
+// goes through
+func newHandler(handlerService handlers.Service, cfg *config.Config) http.Handler {
+	// instantiate multiplexer/router
+	mux := mux.NewRouter()
 
 	// register routes
 	controllerService := controllers.New(handlerService, mux)
 	controllerService.StartUp()
 
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000", "http://localhost"},
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
 		AllowCredentials: true,
-		Debug:            true,
+		Debug:            cfg.CORS.Debug,
 		AllowedMethods: []string{
 			http.MethodGet,
 			http.MethodPost,
@@ -52,39 +215,138 @@ func main() {
 		},
 		AllowedHeaders: []string{"*"},
 	})
-	handler := c.Handler(mux)
+	return c.Handler(logger.Middleware(metrics.Instrument(mux)))
+}
+
+// newServer function creates the http server with the configured timeouts
+func newServer(serverConfig *config.ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              serverConfig.ListenAddress,
+		Handler:           handler,
+		ReadTimeout:       serverConfig.ReadTimeout,
+		ReadHeaderTimeout: serverConfig.ReadHeaderTimeout,
+		WriteTimeout:      serverConfig.WriteTimeout,
+		IdleTimeout:       serverConfig.IdleTimeout,
+		ErrorLog:          stdlog.New(logger.New("http").Writer(logger.ErrorLevel), "", 0),
+	}
+}
+
+// shutdown stops accepting connections, waits up to timeout for in-flight requests to
+// drain and then releases the given resources in order
+func shutdown(srv *http.Server, timeout time.Duration, closers ...func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var shutdownErr error
+	if err := srv.Shutdown(ctx); err != nil {
+		shutdownErr = fmt.Errorf("server did not drain within %s: %v", timeout, err)
+	}
+	for _, closeFn := range closers {
+		if err := closeFn(); err != nil && shutdownErr == nil {
+			shutdownErr = err
+		}
+	}
+	return shutdownErr
+}
+
+// printConfig dumps the effective configuration with secrets redacted
+func printConfig(configFile string) int {
+	cfg, err := config.Read(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(string(out))
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// sweepReservations releases expired reservations every interval until ctx is done
+func sweepReservations(ctx context.Context, dbService db.Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := dbService.SweepReservations(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Error(ctx, "unable to sweep reservations", logger.Fields{"err": err})
+			}
+			if expired > 0 {
+				log.Info(ctx, "released expired reservations", logger.Fields{"expired": expired})
+			}
+		}
+	}
+}
+
+// emulateDevices serves simulated peripherals on a pseudo-terminal until interrupted, point the
+// serial driver at the printed path to run the server against them
+func emulateDevices(configFile string) int {
+	cfg, err := config.Read(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	master, slavePath, err := device.OpenPTY()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer master.Close()
+	fmt.Println(slavePath)
 
-	log.Println("listening on 3333")
-	if err := http.ListenAndServe(":3333", handler); err != nil {
-		log.Fatal(err)
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		master.Close()
+	}()
+	simulator := device.NewSimulator(cfg.Devices.Simulator)
+	devices, _ := simulator.Devices("")
+	if err := device.Serve(ctx, master, devices); err != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
+	return 0
 }
 
 // initDB function
-func initDB() *sqlx.DB {
-	dbURL := os.Getenv("DB_URL")
-	dbConn, err := sqlx.Connect("postgres", dbURL)
+func initDB(dbConfig *config.DBConfig) *sqlx.DB {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	dbConn, err := sqlx.ConnectContext(ctx, dbConfig.Dialect, dbConfig.DSN())
 	if err != nil {
-		log.Panicf("unable to connect to database: %v", err)
+		log.Fatal(context.Background(), "unable to connect to database", logger.Fields{"err": err})
 	}
 	dbSchema := loadDBScript()
 	dbConn.MustExec(dbSchema)
 
 	dbConn.SetConnMaxLifetime(60 * time.Second)
-	log.Println("database initialized successfully")
+	log.Info(context.Background(), "database initialized successfully", nil)
 	return dbConn
 }
 
 func loadDBScript() string {
 	currentDirectory, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(context.Background(), "unable to get working directory", logger.Fields{"err": err})
 	}
 
 	file := fmt.Sprintf("%s/%s", currentDirectory, "db/sql/init_schema.sql")
 	fileBites, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(context.Background(), "unable to read schema script", logger.Fields{"err": err, "file": file})
 	}
 	return string(fileBites)
 }
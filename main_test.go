@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/bus"
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/handlers"
+	"github.com/code-sleuth/vending-machine/helpers"
+)
+
+// newTestServer starts the server main builds around handler on a local port
+func newTestServer(handler http.Handler) *httptest.Server {
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config = newServer(&config.ServerConfig{
+		ReadTimeout:       5 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		IdleTimeout:       5 * time.Second,
+	}, handler)
+	ts.Start()
+	return ts
+}
+
+// sessionCache serves the redis commands of the session checks on a local port, every session token
+// being one of username, and returns its url
+func sessionCache(t *testing.T, username string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveRedis(conn, username)
+		}
+	}()
+	return "redis://" + listener.Addr().String()
+}
+
+// serveRedis answers PING and GET on conn, and OK to any other command
+func serveRedis(conn net.Conn, username string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+		args := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			arg, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args = append(args, strings.TrimSpace(arg))
+		}
+		reply := "+OK\r\n"
+		switch {
+		case len(args) > 0 && strings.EqualFold(args[0], "PING"):
+			reply = "+PONG\r\n"
+		case len(args) > 0 && strings.EqualFold(args[0], "GET"):
+			reply = fmt.Sprintf("$%d\r\n%s\r\n", len(username), username)
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// buyDB is a database of a single buyer. When buying is set its purchases only go through once the
+// server is shutting down, and record tells when they do
+type buyDB struct {
+	db.Service
+	buying       chan<- struct{}
+	shuttingDown <-chan struct{}
+	record       func(event string)
+	// auditErr fails the audit entries
+	auditErr error
+
+	mu        sync.Mutex
+	purchases int
+	audits    int
+}
+
+func (b *buyDB) GetUser(_ context.Context, userUUID string) (*db.User, error) {
+	return &db.User{UUID: userUUID, Username: "buyer", Role: "buyer", Deposit: 100}, nil
+}
+
+func (b *buyDB) Buy(_ context.Context, _, productUUID string, numberOfProducts int, _ string) (*db.BuyResponse, error) {
+	if b.buying != nil {
+		close(b.buying)
+		<-b.shuttingDown
+		// the purchase is still updating the stock and the deposit when the server stops
+		time.Sleep(200 * time.Millisecond)
+		b.record("buy completed")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.purchases++
+	return &db.BuyResponse{ProductUUID: productUUID, AmountSpent: 65, ProductName: "cola", ProductsPurchased: numberOfProducts}, nil
+}
+
+func (b *buyDB) RecordAudit(_ context.Context, entry *db.AuditEntry) (*db.AuditEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.audits++
+	if b.auditErr != nil {
+		return nil, b.auditErr
+	}
+	return entry, nil
+}
+
+// newBuyServer starts the server main builds over database, with the session of its buyer
+func newBuyServer(t *testing.T, database db.Service) *httptest.Server {
+	t.Helper()
+	cfg, err := config.Read("")
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	helpers.ConfigureJWT("test secret", time.Minute)
+	handlers.InitCache(sessionCache(t, "buyer"))
+	t.Cleanup(func() {
+		_ = handlers.CloseCache()
+	})
+	return newTestServer(newHandler(handlers.New(database, cfg, bus.New(1)), cfg))
+}
+
+// buyRequest is the buyer's purchase of 2 p1, authenticated as main's router expects
+func buyRequest(t *testing.T, ts *httptest.Server) *http.Request {
+	t.Helper()
+	token, err := helpers.GenerateJWT("u1", "buyer")
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/users/buy/u1/p1/2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Token", token)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: "session"})
+	return req
+}
+
+func TestShutdownDrainsInFlightBuy(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	buying, shuttingDown := make(chan struct{}), make(chan struct{})
+	ts := newBuyServer(t, &buyDB{buying: buying, shuttingDown: shuttingDown, record: record})
+	defer ts.Close()
+	ts.Config.RegisterOnShutdown(func() {
+		close(shuttingDown)
+	})
+	req := buyRequest(t, ts)
+
+	type result struct {
+		status int
+		body   db.BuyResponse
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		var r result
+		r.status, r.err = res.StatusCode, json.NewDecoder(res.Body).Decode(&r.body)
+		done <- r
+	}()
+
+	select {
+	case <-buying:
+	case r := <-done:
+		t.Fatalf("the buy request never reached the database: %d %v", r.status, r.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the buy request never reached the database")
+	}
+
+	err := shutdown(ts.Config, 5*time.Second,
+		func() error {
+			record("db closed")
+			return nil
+		},
+		func() error {
+			record("redis closed")
+			return handlers.CloseCache()
+		})
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("in-flight buy failed: %v", res.err)
+	}
+	if res.status != http.StatusOK || res.body.ProductsPurchased != 2 || res.body.ProductUUID != "p1" {
+		t.Fatalf("in-flight buy answered %d %+v, want the purchase of 2 p1", res.status, res.body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"buy completed", "db closed", "redis closed"}
+	if len(events) != len(want) {
+		t.Fatalf("events %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("events %v, want %v", events, want)
+		}
+	}
+
+	if _, err := http.Get(ts.URL + "/api/users/buy/u1/p1/2"); err == nil {
+		t.Fatal("the server still accepts connections after shutdown")
+	}
+}
+
+func TestFailedAuditDoesNotRepeatBuy(t *testing.T) {
+	database := &buyDB{auditErr: errors.New("audit_log: connection refused")}
+	ts := newBuyServer(t, database)
+	defer ts.Close()
+
+	// a client retrying on server errors, as proxies and mobile clients do
+	var res *http.Response
+	for attempt := 0; attempt < 3; attempt++ {
+		var err error
+		if res, err = http.DefaultClient.Do(buyRequest(t, ts)); err != nil {
+			t.Fatalf("buy: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode < http.StatusInternalServerError {
+			break
+		}
+	}
+
+	database.mu.Lock()
+	defer database.mu.Unlock()
+	if database.purchases != 1 {
+		t.Fatalf("the buyer was charged %d times for one purchase whose audit entry failed", database.purchases)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("buy answered %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if database.audits != 1 {
+		t.Fatalf("%d audit entries attempted, want 1", database.audits)
+	}
+}
+
+func TestShutdownReportsRequestsThatDoNotDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/users/buy", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	ts := newTestServer(mux)
+	defer ts.Close()
+	defer close(release)
+
+	go func() {
+		res, err := http.Post(ts.URL+"/api/users/buy", "application/json", nil)
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	closed := false
+	err := shutdown(ts.Config, 100*time.Millisecond, func() error {
+		closed = true
+		return nil
+	})
+	if err == nil {
+		t.Fatal("shutdown returned no error although a request did not drain")
+	}
+	if !closed {
+		t.Fatal("the resources were not released after the drain deadline")
+	}
+}
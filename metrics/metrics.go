@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/logger"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "vending"
+
+var (
+	// HTTPRequests counts handled requests per route template, method and status
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	// HTTPDuration observes request latency per route template, method and status
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// DBQueryDuration observes the duration of queries run through the db helpers
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database query duration by helper and outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"helper", "outcome"})
+
+	// RedisDuration observes the duration of redis commands
+	RedisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Redis command duration by command and outcome.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command", "outcome"})
+
+	// Deposits counts accepted coins per denomination
+	Deposits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deposits_total",
+		Help:      "Number of accepted coin deposits by denomination.",
+	}, []string{"denomination"})
+
+	// Purchases counts successful purchases
+	Purchases = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "purchases_total",
+		Help:      "Number of successful purchases.",
+	})
+
+	// UnitsSold counts units sold per product
+	UnitsSold = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "units_sold_total",
+		Help:      "Number of product units sold by product.",
+	}, []string{"product_id"})
+
+	// FailedPurchases counts rejected purchases per reason
+	FailedPurchases = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failed_purchases_total",
+		Help:      "Number of failed purchases by reason.",
+	}, []string{"reason"})
+
+	// StreamSubscribers counts the open event streams per transport
+	StreamSubscribers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_subscribers",
+		Help:      "Number of open event streams by transport.",
+	}, []string{"transport"})
+
+	// StreamEventsDropped counts the events dropped for streams that fell behind
+	StreamEventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_events_dropped_total",
+		Help:      "Number of events dropped for slow stream subscribers by transport.",
+	}, []string{"transport"})
+
+	// ChangeShortfalls counts purchases where the full change could not be paid out
+	ChangeShortfalls = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "change_shortfalls_total",
+		Help:      "Number of purchases where the change could not be paid out in full.",
+	})
+)
+
+// Failed purchase reasons
+const (
+	ReasonProductNotFound   = "product_not_found"
+	ReasonUserNotFound      = "user_not_found"
+	ReasonInsufficientStock = "insufficient_stock"
+	ReasonInsufficientFunds = "insufficient_funds"
+	ReasonUpdateFailed      = "update_failed"
+	ReasonVendFailed        = "vend_failed"
+	ReasonInvalidVoucher    = "invalid_voucher"
+)
+
+// Outcome returns the outcome label for an error
+func Outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// ObserveSince records the time elapsed since start on the given histogram
+func ObserveSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// Handler returns the handler that exposes the metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Instrument wraps the router and records request count and latency per route template
+func Instrument(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		recorder := logger.NewStatusRecorder(w)
+		router.ServeHTTP(recorder, r)
+
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": r.Method,
+			"status": strconv.Itoa(recorder.Status),
+		}
+		HTTPRequests.With(labels).Inc()
+		ObserveSince(HTTPDuration.With(labels), start)
+	})
+}
@@ -0,0 +1,25 @@
+package notify
+
+import (
+	"context"
+
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+// LogNotifier writes messages to the service log
+type LogNotifier struct{}
+
+// NewLogNotifier creates a notifier writing to the service log
+func NewLogNotifier() *LogNotifier {
+	return &LogNotifier{}
+}
+
+// Notify logs msg as a warning, with its fields
+func (n *LogNotifier) Notify(ctx context.Context, msg *Message) error {
+	fields := logger.Fields{"event": msg.Event, "alert_level": msg.Level, "text": msg.Text}
+	for key, value := range msg.Fields {
+		fields[key] = value
+	}
+	log.Warn(ctx, msg.Subject, fields)
+	return nil
+}
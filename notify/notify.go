@@ -0,0 +1,122 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+var log = logger.New("notify")
+
+// Message is an alert sent to the operators of the machines
+type Message struct {
+	Event   string                 `json:"event"`
+	Level   string                 `json:"level"`
+	Subject string                 `json:"subject"`
+	Text    string                 `json:"text"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+	Time    time.Time              `json:"time"`
+}
+
+// Notifier delivers messages to one destination
+type Notifier interface {
+	Notify(ctx context.Context, msg *Message) error
+}
+
+// ErrQueueFull is returned when a message is dropped because too many are waiting to be sent
+var ErrQueueFull = errors.New("notification queue is full")
+
+// ErrClosed is returned when a message is dropped because the dispatcher is closed
+var ErrClosed = errors.New("notification dispatcher is closed")
+
+// Dispatcher sends messages to its notifiers from a background goroutine so that callers never
+// wait on a slow destination
+type Dispatcher struct {
+	notifiers []Notifier
+	queue     chan *Message
+	done      chan struct{}
+	// mu guards closed, the queue is only closed once no Notify is sending to it
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New creates a dispatcher for the configured notifiers
+func New(cfg *config.AlertsConfig) (*Dispatcher, error) {
+	notifiers := make([]Notifier, 0, len(cfg.Notifiers))
+	for _, name := range cfg.Notifiers {
+		switch name {
+		case config.NotifierLog:
+			notifiers = append(notifiers, NewLogNotifier())
+		case config.NotifierWebhook:
+			notifiers = append(notifiers, NewWebhookNotifier(cfg.Webhook.URL, cfg.Webhook.Timeout))
+		case config.NotifierSMTP:
+			notifiers = append(notifiers, NewSMTPNotifier(cfg.SMTP))
+		default:
+			return nil, fmt.Errorf("unknown notifier '%s'", name)
+		}
+	}
+	return NewDispatcher(cfg.QueueSize, notifiers...), nil
+}
+
+// NewDispatcher starts a dispatcher holding up to size pending messages
+func NewDispatcher(size int, notifiers ...Notifier) *Dispatcher {
+	d := &Dispatcher{
+		notifiers: notifiers,
+		queue:     make(chan *Message, size),
+		done:      make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Notify queues msg for every notifier, it never blocks. A message notified once the dispatcher is
+// closed, by a request that outlived the shutdown, is dropped
+func (d *Dispatcher) Notify(ctx context.Context, msg *Message) error {
+	if msg.Time.IsZero() {
+		msg.Time = time.Now().UTC()
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		log.Warn(ctx, "notification dropped", logger.Fields{"err": ErrClosed, "event": msg.Event, "subject": msg.Subject})
+		return ErrClosed
+	}
+	select {
+	case d.queue <- msg:
+		return nil
+	default:
+		log.Warn(ctx, "notification dropped", logger.Fields{"err": ErrQueueFull, "event": msg.Event, "subject": msg.Subject})
+		return ErrQueueFull
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for msg := range d.queue {
+		for _, notifier := range d.notifiers {
+			if err := notifier.Notify(context.Background(), msg); err != nil {
+				log.Error(context.Background(), "notification failed", logger.Fields{
+					"err": err, "notifier": fmt.Sprintf("%T", notifier), "event": msg.Event, "subject": msg.Subject,
+				})
+			}
+		}
+	}
+}
+
+// Close sends the queued messages and stops the dispatcher, messages notified after Close are dropped
+// with ErrClosed
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+	<-d.done
+	return nil
+}
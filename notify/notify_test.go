@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// countingNotifier counts the messages it is sent
+type countingNotifier struct {
+	mu   sync.Mutex
+	sent int
+}
+
+func (c *countingNotifier) Notify(context.Context, *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent++
+	return nil
+}
+
+func TestDispatcherSendsQueuedMessagesOnClose(t *testing.T) {
+	notifier := new(countingNotifier)
+	d := NewDispatcher(10, notifier)
+	for i := 0; i < 3; i++ {
+		if err := d.Notify(context.Background(), &Message{Event: "low_stock"}); err != nil {
+			t.Fatalf("notify: %v", err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if notifier.sent != 3 {
+		t.Fatalf("%d messages sent, want 3", notifier.sent)
+	}
+}
+
+func TestDispatcherDropsMessagesAfterClose(t *testing.T) {
+	d := NewDispatcher(10, new(countingNotifier))
+	if err := d.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := d.Notify(context.Background(), &Message{Event: "audit_failure"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("err = %v, want %v", err, ErrClosed)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
+
+func TestDispatcherCloseDuringNotify(t *testing.T) {
+	d := NewDispatcher(1, new(countingNotifier))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := d.Notify(context.Background(), &Message{Event: "device_mismatch"})
+				if err != nil && !errors.Is(err, ErrClosed) && !errors.Is(err, ErrQueueFull) {
+					t.Errorf("notify: %v", err)
+				}
+			}
+		}()
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/config"
+)
+
+// SMTPNotifier mails messages, it is meant for a relay or a local stand-in such as MailHog
+type SMTPNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+// NewSMTPNotifier creates a notifier mailing through the configured server, authenticating
+// only when a username is set
+func NewSMTPNotifier(cfg config.SMTPNotifierConfig) *SMTPNotifier {
+	n := &SMTPNotifier{
+		addr: cfg.Addr,
+		from: cfg.From,
+		to:   cfg.To,
+	}
+	if cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(cfg.Addr)
+		n.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	return n
+}
+
+// Notify mails msg as plain text to every recipient
+func (n *SMTPNotifier) Notify(ctx context.Context, msg *Message) error {
+	return smtp.SendMail(n.addr, n.auth, n.from, n.to, n.compose(msg))
+}
+
+// compose builds the mail for msg, its fields listed after the text in a stable order
+func (n *SMTPNotifier) compose(msg *Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&b, "Subject: [%s] %s\r\n", msg.Level, oneLine(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", msg.Time.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(msg.Text)
+	b.WriteString("\r\n")
+	keys := make([]string, 0, len(msg.Fields))
+	for key := range msg.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		b.WriteString("\r\n")
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %v\r\n", key, msg.Fields[key])
+	}
+	return []byte(b.String())
+}
+
+// oneLine keeps a header value on a single line
+func oneLine(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
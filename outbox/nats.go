@@ -0,0 +1,176 @@
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/db"
+)
+
+// NATSSink publishes each event as a json message on the subject <subject>.<event type> of a NATS
+// server, speaking its text protocol over a single connection opened on the first publication
+type NATSSink struct {
+	cfg config.NATSSinkConfig
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewNATSSink creates a sink publishing to the server of cfg
+func NewNATSSink(cfg config.NATSSinkConfig) *NATSSink {
+	return &NATSSink{cfg: cfg}
+}
+
+// Name of the sink
+func (s *NATSSink) Name() string {
+	return "nats"
+}
+
+// Publish sends the event and waits for the server to confirm it, the connection is dropped on any
+// error and opened again by the next publication
+func (s *NATSSink) Publish(ctx context.Context, event *db.OutboxEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err = s.connect(ctx); err != nil {
+			s.drop()
+			return err
+		}
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "PUB %s.%s %d\r\n", s.cfg.Subject, event.Type, len(payload))
+	msg.Write(payload)
+	msg.WriteString("\r\n")
+	if err = s.roundTrip(ctx, msg.Bytes()); err != nil {
+		s.drop()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server
+func (s *NATSSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.reader = nil, nil
+	return err
+}
+
+// connect dials the server, reads its greeting and introduces the sink, with the credentials of the url
+func (s *NATSSink) connect(ctx context.Context) error {
+	u, err := url.Parse(s.cfg.URL)
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{Timeout: s.cfg.Timeout}
+	if s.conn, err = dialer.DialContext(ctx, "tcp", u.Host); err != nil {
+		return err
+	}
+	s.reader = bufio.NewReader(s.conn)
+	if err = s.conn.SetDeadline(s.deadline(ctx)); err != nil {
+		return err
+	}
+
+	greeting, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "INFO ") {
+		return fmt.Errorf("nats: unexpected greeting '%s'", greeting)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(greeting, "INFO ")), &info); err != nil {
+		return fmt.Errorf("nats: invalid server info: %v", err)
+	}
+	if info.TLSRequired {
+		return errors.New("nats: the server requires tls, which the sink does not support")
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "vending-machine", "lang": "go"}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options["user"], options["pass"] = u.User.Username(), password
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	return s.roundTrip(ctx, []byte("CONNECT "+string(connect)+"\r\n"))
+}
+
+// roundTrip writes commands followed by a PING and reads until the matching PONG: the server handles
+// the commands of a connection in order, the PONG confirms those before it
+func (s *NATSSink) roundTrip(ctx context.Context, commands []byte) error {
+	if err := s.conn.SetDeadline(s.deadline(ctx)); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(append(commands, "PING\r\n"...)); err != nil {
+		return err
+	}
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// readLine reads a line sent by the server, without its line ending
+func (s *NATSSink) readLine() (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// deadline bounds an exchange with the server by the timeout of the sink and by ctx
+func (s *NATSSink) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(s.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// drop closes a connection that failed
+func (s *NATSSink) drop() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.conn, s.reader = nil, nil
+}
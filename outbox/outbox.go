@@ -0,0 +1,115 @@
+// Package outbox relays the events recorded in the outbox table to the sinks: an event is published at
+// least once, and the events of an aggregate in the order they were recorded
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+var log = logger.New("outbox")
+
+// pruneInterval is how often the published events past their retention are removed
+const pruneInterval = time.Hour
+
+// Sink publishes the events of the outbox. An event whose publication failed, in this sink or another,
+// is published again: sinks must tolerate duplicates, the id of the event tells them apart
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, event *db.OutboxEvent) error
+}
+
+// Relay publishes the events of the outbox to its sinks
+type Relay struct {
+	db        db.Service
+	sinks     []Sink
+	cfg       *config.OutboxConfig
+	lastPrune time.Time
+}
+
+// NewRelay creates a relay publishing the events of dbService to sinks
+func NewRelay(dbService db.Service, cfg *config.OutboxConfig, sinks ...Sink) *Relay {
+	return &Relay{db: dbService, sinks: sinks, cfg: cfg}
+}
+
+// Run publishes the events every poll interval until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// a full batch is followed at once by the next one
+			for {
+				if r.Poll(ctx) < r.cfg.BatchSize || ctx.Err() != nil {
+					break
+				}
+			}
+			r.prune(ctx)
+		}
+	}
+}
+
+// Poll publishes a batch of the events due and returns how many it claimed. The batch holds at most an
+// event per aggregate, its events are published concurrently
+func (r *Relay) Poll(ctx context.Context) int {
+	events, err := r.db.ClaimOutboxEvents(ctx, r.cfg.BatchSize, r.cfg.Lease)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Error(ctx, "unable to claim outbox events", logger.Fields{"err": err})
+		}
+		return 0
+	}
+	var wg sync.WaitGroup
+	for _, event := range events {
+		wg.Add(1)
+		go func(event *db.OutboxEvent) {
+			defer wg.Done()
+			r.publish(ctx, event)
+		}(event)
+	}
+	wg.Wait()
+	return len(events)
+}
+
+// publish sends a claimed event to every sink and records the outcome, an event a sink failed to
+// publish is due again after a backoff
+func (r *Relay) publish(ctx context.Context, event *db.OutboxEvent) {
+	var publishErr error
+	for _, sink := range r.sinks {
+		if err := sink.Publish(ctx, event); err != nil {
+			publishErr = fmt.Errorf("%s: %v", sink.Name(), err)
+			break
+		}
+	}
+	var retryAt time.Time
+	if publishErr != nil {
+		retryAt = time.Now().Add(helpers.Backoff(event.Attempts, r.cfg.BackoffBase, r.cfg.BackoffMax))
+		log.Warn(ctx, "unable to publish outbox event", logger.Fields{
+			"err": publishErr, "event": event.Type, "eventUUID": event.UUID, "attempt": event.Attempts, "retry_at": retryAt,
+		})
+	}
+	if err := r.db.CompleteOutboxEvent(ctx, event, publishErr, retryAt); err != nil && ctx.Err() == nil {
+		log.Error(ctx, "unable to record outbox event", logger.Fields{"err": err, "eventUUID": event.UUID})
+	}
+}
+
+// prune removes the events published past their retention, at most every pruneInterval
+func (r *Relay) prune(ctx context.Context) {
+	if time.Since(r.lastPrune) < pruneInterval {
+		return
+	}
+	r.lastPrune = time.Now()
+	if _, err := r.db.PruneOutbox(ctx, time.Now().Add(-r.cfg.Retention)); err != nil && ctx.Err() == nil {
+		log.Error(ctx, "unable to prune outbox", logger.Fields{"err": err})
+	}
+}
@@ -0,0 +1,38 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/code-sleuth/vending-machine/db"
+)
+
+// StdoutSink writes each event as a line of json
+type StdoutSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewStdoutSink creates a sink writing to w, the standard output of the service
+func NewStdoutSink(w io.Writer) *StdoutSink {
+	return &StdoutSink{w: w}
+}
+
+// Name of the sink
+func (s *StdoutSink) Name() string {
+	return "stdout"
+}
+
+// Publish writes the event, lines of concurrent events are never interleaved
+func (s *StdoutSink) Publish(_ context.Context, event *db.OutboxEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
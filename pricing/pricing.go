@@ -0,0 +1,391 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rule kinds
+const (
+	// KindScheduledPrice replaces the list price of a product from StartsAt on
+	KindScheduledPrice = "scheduled_price"
+	// KindHappyHour lowers the price of a product during a time of day
+	KindHappyHour = "happy_hour"
+	// KindQuantityDiscount sells Quantity units of a product for Price, "3 for 100"
+	KindQuantityDiscount = "quantity_discount"
+	// KindBundle sells a set of products bought together for Price
+	KindBundle = "bundle"
+	// KindVoucher is the kind of the discount of a voucher code, which is not a rule of its own
+	KindVoucher = "voucher"
+)
+
+// Rule is a price change or a promotion. Price is the unit price of a scheduled price or a happy hour,
+// the price of Quantity units of a quantity discount and the price of one set of Items of a bundle.
+// A happy hour may take PercentOff the price instead. A rule applies between StartsAt and EndsAt when
+// they are set and, when DailyStart and DailyEnd are set, between those times of day ("HH:MM")
+type Rule struct {
+	UUID        string         `json:"uuid"`
+	Kind        string         `json:"kind"`
+	Name        string         `json:"name"`
+	SellerID    string         `json:"seller_id"`
+	ProductUUID string         `json:"product_id,omitempty"`
+	Price       int            `json:"price,omitempty"`
+	PercentOff  int            `json:"percent_off,omitempty"`
+	Quantity    int            `json:"quantity,omitempty"`
+	Items       map[string]int `json:"items,omitempty"`
+	StartsAt    *time.Time     `json:"starts_at,omitempty"`
+	EndsAt      *time.Time     `json:"ends_at,omitempty"`
+	DailyStart  string         `json:"daily_start,omitempty"`
+	DailyEnd    string         `json:"daily_end,omitempty"`
+	Active      bool           `json:"active"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// Products returns the products a rule prices, sorted
+func (r *Rule) Products() []string {
+	if r.Kind != KindBundle {
+		return []string{r.ProductUUID}
+	}
+	products := make([]string, 0, len(r.Items))
+	for product := range r.Items {
+		products = append(products, product)
+	}
+	sort.Strings(products)
+	return products
+}
+
+// Validate checks that a rule has the fields its kind needs
+func (r *Rule) Validate() error {
+	var problems []string
+	if strings.TrimSpace(r.Name) == "" {
+		problems = append(problems, "name is required")
+	}
+	if r.Price < 0 || r.PercentOff < 0 || r.PercentOff > 100 {
+		problems = append(problems, "price must not be negative and percent_off must be between 0 and 100")
+	}
+	switch r.Kind {
+	case KindScheduledPrice:
+		if r.StartsAt == nil {
+			problems = append(problems, "a scheduled price needs starts_at")
+		}
+		if r.Price <= 0 {
+			problems = append(problems, "a scheduled price needs a positive price")
+		}
+	case KindHappyHour:
+		if r.DailyStart == "" || r.DailyEnd == "" {
+			problems = append(problems, "a happy hour needs daily_start and daily_end")
+		}
+		if (r.Price > 0) == (r.PercentOff > 0) {
+			problems = append(problems, "a happy hour needs either a price or percent_off")
+		}
+	case KindQuantityDiscount:
+		if r.Quantity < 2 || r.Price <= 0 {
+			problems = append(problems, "a quantity discount needs a quantity of at least 2 and a positive price")
+		}
+	case KindBundle:
+		if len(r.Items) < 2 || r.Price <= 0 {
+			problems = append(problems, "a bundle needs at least 2 products and a positive price")
+		}
+		for product, quantity := range r.Items {
+			if product == "" || quantity <= 0 {
+				problems = append(problems, "bundle items need a product and a positive quantity")
+				break
+			}
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("invalid kind '%s': use one of %s, %s, %s, %s", r.Kind,
+			KindScheduledPrice, KindHappyHour, KindQuantityDiscount, KindBundle))
+	}
+	if r.Kind != KindBundle && r.ProductUUID == "" {
+		problems = append(problems, "product_id is required")
+	}
+	if r.Kind == KindBundle && r.ProductUUID != "" {
+		problems = append(problems, "a bundle lists its products in items, not in product_id")
+	}
+	if r.StartsAt != nil && r.EndsAt != nil && !r.EndsAt.After(*r.StartsAt) {
+		problems = append(problems, "ends_at must be after starts_at")
+	}
+	if (r.DailyStart == "") != (r.DailyEnd == "") {
+		problems = append(problems, "daily_start and daily_end are set together")
+	} else if r.DailyStart != "" {
+		start, err1 := minuteOfDay(r.DailyStart)
+		end, err2 := minuteOfDay(r.DailyEnd)
+		if err1 != nil || err2 != nil {
+			problems = append(problems, "daily_start and daily_end must be times of day such as 17:30")
+		} else if start == end {
+			problems = append(problems, "daily_start and daily_end must differ")
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid price rule: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// minuteOfDay parses a "HH:MM" time of day
+func minuteOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Line is a quantity of a product to price, UnitPrice is its catalog price
+type Line struct {
+	ProductUUID string
+	Quantity    int
+	UnitPrice   int
+}
+
+// Applied is a promotion that lowered the price of a sale by Discount
+type Applied struct {
+	RuleUUID string `json:"rule_id"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Discount int    `json:"discount"`
+}
+
+// PricedLine is a priced line: UnitPrice is the list price after any scheduled price change and
+// Amount what the units cost after the promotions
+type PricedLine struct {
+	ProductUUID string     `json:"product_id"`
+	Quantity    int        `json:"quantity"`
+	UnitPrice   int        `json:"unit_price"`
+	Amount      int        `json:"amount"`
+	Discount    int        `json:"discount"`
+	Promotions  []*Applied `json:"promotions,omitempty"`
+}
+
+// Quote is the price of a basket, its lines in the order they were given
+type Quote struct {
+	Lines      []*PricedLine `json:"lines"`
+	Amount     int           `json:"amount"`
+	Discount   int           `json:"discount"`
+	Promotions []*Applied    `json:"promotions,omitempty"`
+}
+
+// Engine prices baskets with the rules that apply at a time, times of day are read in its location
+type Engine struct {
+	location *time.Location
+}
+
+// New creates an engine reading times of day in location, UTC when nil
+func New(location *time.Location) *Engine {
+	if location == nil {
+		location = time.UTC
+	}
+	return &Engine{location: location}
+}
+
+// applies reports whether a rule is in force at now
+func (e *Engine) applies(r *Rule, now time.Time) bool {
+	if !r.Active {
+		return false
+	}
+	if r.StartsAt != nil && now.Before(*r.StartsAt) {
+		return false
+	}
+	if r.EndsAt != nil && !now.Before(*r.EndsAt) {
+		return false
+	}
+	if r.DailyStart == "" {
+		return true
+	}
+	start, err1 := minuteOfDay(r.DailyStart)
+	end, err2 := minuteOfDay(r.DailyEnd)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	local := now.In(e.location)
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	// the window runs past midnight
+	return minute >= start || minute < end
+}
+
+// lineState is a line being priced
+type lineState struct {
+	priced  *PricedLine
+	unit    int // price of a unit after the happy hour
+	left    int // units not sold in a bundle
+	amount  int
+	applied map[string]*Applied
+	order   []string
+}
+
+func (l *lineState) apply(r *Rule, discount int) {
+	if discount == 0 {
+		return
+	}
+	a, ok := l.applied[r.UUID]
+	if !ok {
+		a = &Applied{RuleUUID: r.UUID, Kind: r.Kind, Name: r.Name}
+		l.applied[r.UUID] = a
+		l.order = append(l.order, r.UUID)
+	}
+	a.Discount += discount
+}
+
+// Quote prices lines with the rules in force at now. The list price of a product is its latest scheduled
+// price, a happy hour lowers it, bundles are then formed as long as they are cheaper than their units and
+// the units left get the best quantity discount
+func (e *Engine) Quote(lines []Line, rules []*Rule, now time.Time) *Quote {
+	var inForce []*Rule
+	for _, r := range rules {
+		if e.applies(r, now) {
+			inForce = append(inForce, r)
+		}
+	}
+
+	states := make(map[string]*lineState, len(lines))
+	quote := &Quote{Lines: make([]*PricedLine, 0, len(lines))}
+	for _, line := range lines {
+		l := &lineState{
+			priced:  &PricedLine{ProductUUID: line.ProductUUID, Quantity: line.Quantity, UnitPrice: line.UnitPrice},
+			left:    line.Quantity,
+			applied: make(map[string]*Applied),
+		}
+		states[line.ProductUUID] = l
+		quote.Lines = append(quote.Lines, l.priced)
+	}
+
+	// the latest scheduled price sets the list price
+	for _, l := range states {
+		var latest *Rule
+		for _, r := range inForce {
+			if r.Kind != KindScheduledPrice || r.ProductUUID != l.priced.ProductUUID {
+				continue
+			}
+			if latest == nil || r.StartsAt.After(*latest.StartsAt) {
+				latest = r
+			}
+		}
+		if latest != nil {
+			l.priced.UnitPrice = latest.Price
+		}
+		l.unit = l.priced.UnitPrice
+	}
+
+	// the cheapest happy hour lowers the unit price
+	for _, l := range states {
+		var best *Rule
+		bestUnit := l.unit
+		for _, r := range inForce {
+			if r.Kind != KindHappyHour || r.ProductUUID != l.priced.ProductUUID {
+				continue
+			}
+			unit := r.Price
+			if r.PercentOff > 0 {
+				unit = (l.priced.UnitPrice*(100-r.PercentOff) + 50) / 100
+			}
+			if unit < bestUnit {
+				best, bestUnit = r, unit
+			}
+		}
+		if best != nil {
+			l.apply(best, (l.unit-bestUnit)*l.priced.Quantity)
+			l.unit = bestUnit
+		}
+	}
+
+	// bundles, the largest saving per set first
+	var bundles []*Rule
+	for _, r := range inForce {
+		if r.Kind == KindBundle {
+			bundles = append(bundles, r)
+		}
+	}
+	saving := func(r *Rule) int {
+		value := 0
+		for product, quantity := range r.Items {
+			l, ok := states[product]
+			if !ok {
+				return 0
+			}
+			value += quantity * l.unit
+		}
+		return value - r.Price
+	}
+	sort.SliceStable(bundles, func(i, j int) bool { return saving(bundles[i]) > saving(bundles[j]) })
+	for _, r := range bundles {
+		if saving(r) <= 0 {
+			continue
+		}
+		sets := -1
+		for product, quantity := range r.Items {
+			if n := states[product].left / quantity; sets < 0 || n < sets {
+				sets = n
+			}
+		}
+		if sets <= 0 {
+			continue
+		}
+		// the bundle price is shared over its products in proportion to their value
+		products := r.Products()
+		value := saving(r) + r.Price
+		shared := 0
+		for i, product := range products {
+			l := states[product]
+			units := sets * r.Items[product]
+			full := units * l.unit
+			share := sets * r.Price * r.Items[product] * l.unit / value
+			if i == len(products)-1 {
+				share = sets*r.Price - shared
+			}
+			shared += share
+			l.left -= units
+			l.amount += share
+			l.apply(r, full-share)
+		}
+	}
+
+	// the best quantity discount on the units left
+	for _, l := range states {
+		full := l.left * l.unit
+		best, bestAmount := (*Rule)(nil), full
+		for _, r := range inForce {
+			if r.Kind != KindQuantityDiscount || r.ProductUUID != l.priced.ProductUUID {
+				continue
+			}
+			amount := l.left/r.Quantity*r.Price + l.left%r.Quantity*l.unit
+			if amount < bestAmount {
+				best, bestAmount = r, amount
+			}
+		}
+		if best != nil {
+			l.apply(best, full-bestAmount)
+		}
+		l.amount += bestAmount
+	}
+
+	totals := make(map[string]*Applied)
+	var order []string
+	for _, priced := range quote.Lines {
+		l := states[priced.ProductUUID]
+		priced.Amount = l.amount
+		priced.Discount = priced.Quantity*priced.UnitPrice - l.amount
+		for _, id := range l.order {
+			a := l.applied[id]
+			priced.Promotions = append(priced.Promotions, a)
+			total, ok := totals[id]
+			if !ok {
+				total = &Applied{RuleUUID: a.RuleUUID, Kind: a.Kind, Name: a.Name}
+				totals[id] = total
+				order = append(order, id)
+			}
+			total.Discount += a.Discount
+		}
+		quote.Amount += priced.Amount
+		quote.Discount += priced.Discount
+	}
+	for _, id := range order {
+		quote.Promotions = append(quote.Promotions, totals[id])
+	}
+	return quote
+}
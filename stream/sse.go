@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/helpers"
+)
+
+// sseConn streams server-sent events
+type sseConn struct {
+	*conn
+}
+
+// ServeSSE answers the request with an event stream, keeping the headers already set on w. On failure
+// the error is also answered to the client
+func ServeSSE(w http.ResponseWriter, writeTimeout time.Duration) (Conn, error) {
+	header := w.Header().Clone()
+	c, err := hijack(w, writeTimeout)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return nil, err
+	}
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// the stream ends with the connection
+	header.Set("Connection", "close")
+	header.Set("X-Accel-Buffering", "no")
+	if err = writeResponseHead(c, http.StatusOK, header); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	go func() {
+		// the client sends nothing more, a read only returns once it closed the connection
+		_, _ = io.Copy(ioutil.Discard, c.reader)
+		c.leave()
+	}()
+	return &sseConn{c}, nil
+}
+
+// Send writes an event, body being a single line of json
+func (s *sseConn) Send(name string, body []byte) error {
+	return s.write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, body)))
+}
+
+// Ping writes a comment, which clients ignore
+func (s *sseConn) Ping() error {
+	return s.write([]byte(":\n\n"))
+}
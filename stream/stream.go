@@ -0,0 +1,154 @@
+// Package stream sends the events of the bus to clients as server-sent events or over a websocket. The
+// connection is taken over from the http server, whose timeouts would otherwise end a long-lived stream:
+// each write is bounded instead, and a client too slow to take one is disconnected
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/bus"
+)
+
+// Transports
+const (
+	TransportSSE       = "sse"
+	TransportWebSocket = "websocket"
+)
+
+// EventLagged tells a client that events were dropped because it fell behind, the state it shows should
+// be reloaded
+const EventLagged = "lagged"
+
+// Conn is a stream to a client
+type Conn interface {
+	// Send writes an event named name with a json body
+	Send(name string, body []byte) error
+	// Ping keeps an idle stream open
+	Ping() error
+	// Gone is closed once the client closed the stream
+	Gone() <-chan struct{}
+	Close() error
+}
+
+// Lagged is the body of a lagged event
+type Lagged struct {
+	Type    string `json:"type"`
+	Dropped int    `json:"dropped"`
+}
+
+// conn is the connection taken over from the http server, writes are serialized and bounded by
+// writeTimeout
+type conn struct {
+	net.Conn
+	reader       *bufio.Reader
+	writeTimeout time.Duration
+
+	mu   sync.Mutex
+	gone chan struct{}
+	once sync.Once
+}
+
+// hijack takes the connection of a request over from the http server
+func hijack(w http.ResponseWriter, writeTimeout time.Duration) (*conn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("streaming is not supported by the connection")
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// the deadlines set by the http server no longer apply
+	if err = netConn.SetDeadline(time.Time{}); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	return &conn{Conn: netConn, reader: rw.Reader, writeTimeout: writeTimeout, gone: make(chan struct{})}, nil
+}
+
+// write sends p within the write timeout
+func (c *conn) write(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return err
+	}
+	_, err := c.Conn.Write(p)
+	return err
+}
+
+// Gone is closed once the client closed the stream
+func (c *conn) Gone() <-chan struct{} {
+	return c.gone
+}
+
+// leave records that the client closed the stream
+func (c *conn) leave() {
+	c.once.Do(func() {
+		close(c.gone)
+	})
+}
+
+// writeResponseHead writes the status line and the headers of a response
+func writeResponseHead(c *conn, status int, header http.Header) error {
+	head := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	for name, values := range header {
+		for _, value := range values {
+			head += name + ": " + value + "\r\n"
+		}
+	}
+	return c.write([]byte(head + "\r\n"))
+}
+
+// Pump sends the events of sub to c until the client goes away, the subscription ends or a write fails,
+// pinging the client every heartbeat. It returns the number of events dropped because the client fell
+// behind
+func Pump(c Conn, sub *bus.Subscription, heartbeat time.Duration) (dropped int, err error) {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Gone():
+			return dropped, nil
+		case <-sub.Done():
+			return dropped, nil
+		case <-ticker.C:
+			if err = c.Ping(); err != nil {
+				return dropped, err
+			}
+		case <-sub.Ready():
+			events, lost := sub.Take()
+			if lost > 0 {
+				dropped += lost
+				body, err := json.Marshal(&Lagged{Type: EventLagged, Dropped: lost})
+				if err != nil {
+					return dropped, err
+				}
+				if err = c.Send(EventLagged, body); err != nil {
+					return dropped, err
+				}
+			}
+			for i := range events {
+				if err = SendEvent(c, &events[i]); err != nil {
+					return dropped, err
+				}
+			}
+		}
+	}
+}
+
+// SendEvent sends an event of the bus, named after its type
+func SendEvent(c Conn, event *bus.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return c.Send(event.Type, body)
+}
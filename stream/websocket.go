@@ -0,0 +1,206 @@
+package stream
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/helpers"
+)
+
+// websocketGUID is appended to the key of the client to compute the accept header of the handshake
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxFrameSize bounds the frames read from a client, which has nothing to send but control frames
+const maxFrameSize = 4 << 10
+
+// Websocket opcodes
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+// Websocket close codes
+const (
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+)
+
+var (
+	errUnmasked = errors.New("websocket: client frames must be masked")
+	errTooBig   = errors.New("websocket: frame too big")
+)
+
+// wsConn streams events as websocket text messages
+type wsConn struct {
+	*conn
+}
+
+// Upgrade upgrades the request to a websocket. On failure the error is also answered to the client
+func Upgrade(w http.ResponseWriter, r *http.Request, writeTimeout time.Duration) (Conn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		err := errors.New("websocket upgrade expected")
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return nil, err
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		err := errors.New("unsupported websocket version: use 13")
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		helpers.ErrorResponse(w, http.StatusUpgradeRequired, err.Error())
+		return nil, err
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		err = errors.New("invalid websocket key")
+		helpers.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return nil, err
+	}
+
+	header := w.Header().Clone()
+	c, err := hijack(w, writeTimeout)
+	if err != nil {
+		helpers.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return nil, err
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(accept[:]))
+	if err = writeResponseHead(c, http.StatusSwitchingProtocols, header); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	ws := &wsConn{c}
+	go ws.readLoop()
+	return ws, nil
+}
+
+// headerHasToken reports whether the comma separated values of a header hold token
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Send writes body as a text message
+func (ws *wsConn) Send(_ string, body []byte) error {
+	return ws.writeFrame(opText, body)
+}
+
+// Ping writes a ping frame, the client answers it by itself
+func (ws *wsConn) Ping() error {
+	return ws.writeFrame(opPing, nil)
+}
+
+// Close closes the websocket then the connection
+func (ws *wsConn) Close() error {
+	_ = ws.writeClose(closeNormal)
+	return ws.conn.Close()
+}
+
+// readLoop answers the control frames of the client until it closes the websocket, the messages it
+// sends are ignored
+func (ws *wsConn) readLoop() {
+	defer ws.leave()
+	for {
+		op, payload, err := ws.readFrame()
+		switch {
+		case err == errUnmasked:
+			_ = ws.writeClose(closeProtocolError)
+			return
+		case err == errTooBig:
+			_ = ws.writeClose(closeTooBig)
+			return
+		case err != nil:
+			return
+		}
+		switch op {
+		case opClose:
+			_ = ws.writeClose(closeNormal)
+			return
+		case opPing:
+			if err = ws.writeFrame(opPong, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFrame reads a frame of the client and unmasks its payload
+func (ws *wsConn) readFrame() (op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(ws.reader, head[:]); err != nil {
+		return 0, nil, err
+	}
+	op = head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return 0, nil, errUnmasked
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(ws.reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(ws.reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxFrameSize {
+		return 0, nil, errTooBig
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.reader, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// writeFrame writes an unfragmented, unmasked frame
+func (ws *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|op)
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	return ws.write(append(frame, payload...))
+}
+
+// writeClose writes a close frame with code
+func (ws *wsConn) writeClose(code uint16) error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	return ws.writeFrame(opClose, payload[:])
+}
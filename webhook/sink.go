@@ -0,0 +1,27 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/code-sleuth/vending-machine/db"
+)
+
+// Sink publishes the events of the outbox to the webhook subscriptions by queueing their deliveries
+type Sink struct {
+	db db.Service
+}
+
+// NewSink creates a sink queueing deliveries in dbService
+func NewSink(dbService db.Service) *Sink {
+	return &Sink{db: dbService}
+}
+
+// Name of the sink
+func (s *Sink) Name() string {
+	return "webhook"
+}
+
+// Publish queues a delivery of event for each subscription to its type
+func (s *Sink) Publish(ctx context.Context, event *db.OutboxEvent) error {
+	return s.db.QueueWebhookEvent(ctx, event)
+}
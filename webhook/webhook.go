@@ -0,0 +1,166 @@
+// Package webhook sends the events recorded by the db service to the webhook subscriptions, signing
+// each delivery and retrying failed ones with an exponential backoff
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/db"
+	"github.com/code-sleuth/vending-machine/helpers"
+	"github.com/code-sleuth/vending-machine/logger"
+)
+
+var log = logger.New("webhook")
+
+// Headers of a delivery
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderEventID   = "X-Webhook-Id"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// maxErrorLength bounds the error recorded for a failed attempt
+const maxErrorLength = 1024
+
+// Sign returns the signature of a body posted at timestamp: the hex hmac-sha256, keyed with the secret
+// of the subscription, of the unix timestamp, a dot and the body
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery received at now, refusing timestamps further than
+// tolerance from it so that a captured delivery cannot be replayed later
+func Verify(secret, signature string, timestamp int64, body []byte, tolerance time.Duration, now time.Time) bool {
+	sent := time.Unix(timestamp, 0)
+	if sent.Before(now.Add(-tolerance)) || sent.After(now.Add(tolerance)) {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body)))
+}
+
+// Sender posts deliveries to their subscription
+type Sender struct {
+	client *http.Client
+}
+
+// NewSender creates a sender, each attempt bounded by timeout
+func NewSender(timeout time.Duration) *Sender {
+	return &Sender{client: &http.Client{Timeout: timeout}}
+}
+
+// Send posts the payload of a claimed delivery, signed with the secret of its subscription, and
+// returns the status of the response, failing on any status other than 2xx
+func (s *Sender) Send(ctx context.Context, d *db.WebhookDelivery) (statusCode int, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.EventType)
+	req.Header.Set(HeaderEventID, d.EventUUID)
+	req.Header.Set(HeaderDelivery, d.UUID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(d.Secret, timestamp, d.Payload))
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// drain the body so that the connection is reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Worker sends the deliveries due to the webhook subscriptions
+type Worker struct {
+	db     db.Service
+	sender *Sender
+	cfg    *config.WebhooksConfig
+}
+
+// NewWorker creates a worker sending the deliveries of dbService
+func NewWorker(dbService db.Service, cfg *config.WebhooksConfig) *Worker {
+	return &Worker{db: dbService, sender: NewSender(cfg.Timeout), cfg: cfg}
+}
+
+// Run sends the deliveries due every poll interval until ctx is done
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Poll(ctx)
+		}
+	}
+}
+
+// Poll sends a batch of the deliveries due, concurrently, and returns how many it sent
+func (w *Worker) Poll(ctx context.Context) int {
+	// a delivery is claimed for twice an attempt, long enough to record its outcome
+	deliveries, err := w.db.ClaimWebhookDeliveries(ctx, w.cfg.BatchSize, 2*w.cfg.Timeout)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Error(ctx, "unable to claim webhook deliveries", logger.Fields{"err": err})
+		}
+		return 0
+	}
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func(d *db.WebhookDelivery) {
+			defer wg.Done()
+			w.deliver(ctx, d)
+		}(d)
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+// deliver attempts a claimed delivery and records the outcome, scheduling the next attempt of a
+// failed delivery until it runs out of attempts
+func (w *Worker) deliver(ctx context.Context, d *db.WebhookDelivery) {
+	start := time.Now()
+	statusCode, err := w.sender.Send(ctx, d)
+	outcome := &db.WebhookOutcome{StatusCode: statusCode, Duration: time.Since(start), Delivered: err == nil}
+	fields := logger.Fields{"delivery": d.UUID, "event": d.EventType, "attempt": d.Attempts, "status": statusCode}
+	if err != nil {
+		outcome.Error = err.Error()
+		if len(outcome.Error) > maxErrorLength {
+			outcome.Error = outcome.Error[:maxErrorLength]
+		}
+		if d.Attempts < w.cfg.MaxAttempts {
+			retryAt := time.Now().Add(helpers.Backoff(d.Attempts, w.cfg.BackoffBase, w.cfg.BackoffMax))
+			outcome.RetryAt = &retryAt
+		}
+		fields["err"], fields["retry_at"] = err, outcome.RetryAt
+		log.Warn(ctx, "webhook delivery failed", fields)
+	}
+	if err := w.db.CompleteWebhookDelivery(ctx, d, outcome); err != nil && ctx.Err() == nil {
+		fields["err"] = err
+		log.Error(ctx, "unable to record webhook delivery", fields)
+	}
+}
@@ -0,0 +1,265 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/code-sleuth/vending-machine/config"
+	"github.com/code-sleuth/vending-machine/db"
+)
+
+const testSecret = "whsec_test"
+
+// deliveryStore keeps the deliveries of a single subscription in memory, claiming and completing them
+// as the db service does
+type deliveryStore struct {
+	db.Service
+	mu         sync.Mutex
+	url        string
+	deliveries []*db.WebhookDelivery
+}
+
+func (s *deliveryStore) queue(eventType string, payload string) *db.WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	d := &db.WebhookDelivery{
+		UUID:             fmt.Sprintf("delivery-%d", len(s.deliveries)+1),
+		SubscriptionUUID: "webhook-1",
+		EventUUID:        "event-1",
+		EventType:        eventType,
+		Payload:          []byte(payload),
+		Status:           db.DeliveryPending,
+		NextAttemptAt:    &now,
+	}
+	s.deliveries = append(s.deliveries, d)
+	return d
+}
+
+func (s *deliveryStore) ClaimWebhookDeliveries(_ context.Context, limit int, lease time.Duration) ([]*db.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	claimed := make([]*db.WebhookDelivery, 0)
+	for _, d := range s.deliveries {
+		if len(claimed) == limit {
+			break
+		}
+		if d.Status != db.DeliveryPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		d.Attempts++
+		next := now.Add(lease)
+		d.NextAttemptAt = &next
+		c := *d
+		c.URL, c.Secret = s.url, testSecret
+		claimed = append(claimed, &c)
+	}
+	return claimed, nil
+}
+
+func (s *deliveryStore) CompleteWebhookDelivery(_ context.Context, delivery *db.WebhookDelivery, outcome *db.WebhookOutcome) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.find(delivery.UUID)
+	d.AttemptLog = append(d.AttemptLog, &db.WebhookAttempt{Attempt: delivery.Attempts, StatusCode: outcome.StatusCode, Error: outcome.Error})
+	d.LastStatusCode, d.LastError = outcome.StatusCode, outcome.Error
+	switch {
+	case outcome.Delivered:
+		d.Status = db.DeliveryDelivered
+	case outcome.RetryAt != nil:
+		d.NextAttemptAt = outcome.RetryAt
+	default:
+		d.Status = db.DeliveryFailed
+	}
+	return nil
+}
+
+// queueCopy queues a copy of a delivery as a replay of it, the way db.ReplayWebhookDelivery copies the
+// stored delivery
+func (s *deliveryStore) queueCopy(deliveryUUID string) *db.WebhookDelivery {
+	s.mu.Lock()
+	original := s.find(deliveryUUID)
+	s.mu.Unlock()
+	replay := s.queue(original.EventType, string(original.Payload))
+	replay.EventUUID, replay.ReplayOf = original.EventUUID, original.UUID
+	return replay
+}
+
+func (s *deliveryStore) find(deliveryUUID string) *db.WebhookDelivery {
+	for _, d := range s.deliveries {
+		if d.UUID == deliveryUUID {
+			return d
+		}
+	}
+	return nil
+}
+
+// received is a delivery as a subscriber got it
+type received struct {
+	event    string
+	eventID  string
+	delivery string
+	body     string
+	verified bool
+}
+
+// receiver is a subscriber answering with statuses in turn, then 200, verifying the signature of
+// every delivery
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received []received
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	timestamp, _ := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.received = append(rc.received, received{
+		event:    r.Header.Get(HeaderEvent),
+		eventID:  r.Header.Get(HeaderEventID),
+		delivery: r.Header.Get(HeaderDelivery),
+		body:     string(body),
+		verified: Verify(testSecret, r.Header.Get(HeaderSignature), timestamp, body, 5*time.Minute, time.Now()),
+	})
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) deliveries() []received {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]received(nil), rc.received...)
+}
+
+// newWorker returns a worker sending the deliveries of a store to rc
+func newWorker(t *testing.T, rc *receiver, maxAttempts int) (*Worker, *deliveryStore) {
+	t.Helper()
+	ts := httptest.NewServer(rc)
+	t.Cleanup(ts.Close)
+	store := &deliveryStore{url: ts.URL}
+	return NewWorker(store, &config.WebhooksConfig{
+		BatchSize:   10,
+		Timeout:     2 * time.Second,
+		MaxAttempts: maxAttempts,
+		BackoffBase: 20 * time.Millisecond,
+		BackoffMax:  time.Second,
+	}), store
+}
+
+// pollUntil polls w until n deliveries were sent or a second went by
+func pollUntil(t *testing.T, w *Worker, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for sent := 0; sent < n; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d deliveries sent", sent, n)
+		}
+		sent += w.Poll(context.Background())
+	}
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	body := []byte(`{"type":"purchase.completed"}`)
+	now := time.Now()
+	signature := Sign(testSecret, now.Unix(), body)
+	if !Verify(testSecret, signature, now.Unix(), body, time.Minute, now) {
+		t.Fatal("a signed body does not verify")
+	}
+	if Verify("another secret", signature, now.Unix(), body, time.Minute, now) {
+		t.Fatal("a signature verifies with another secret")
+	}
+	if Verify(testSecret, signature, now.Unix(), []byte(`{"type":"purchase.refunded"}`), time.Minute, now) {
+		t.Fatal("a signature verifies another body")
+	}
+	if Verify(testSecret, signature, now.Unix()+1, body, time.Minute, now) {
+		t.Fatal("a signature verifies another timestamp")
+	}
+	if Verify(testSecret, signature, now.Unix(), body, time.Minute, now.Add(2*time.Minute)) {
+		t.Fatal("a signature verifies outside the tolerance")
+	}
+}
+
+func TestWorkerRetriesFailedDelivery(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable}}
+	w, store := newWorker(t, rc, 3)
+	queued := store.queue(db.EventPurchaseCompleted, `{"amount":65}`)
+
+	pollUntil(t, w, 2)
+
+	got := rc.deliveries()
+	if len(got) != 2 {
+		t.Fatalf("%d deliveries received, want 2", len(got))
+	}
+	for _, r := range got {
+		if !r.verified {
+			t.Fatalf("delivery %+v does not verify", r)
+		}
+		if r.event != db.EventPurchaseCompleted || r.delivery != queued.UUID || r.body != `{"amount":65}` {
+			t.Fatalf("received %+v", r)
+		}
+	}
+	d := store.find(queued.UUID)
+	if d.Status != db.DeliveryDelivered || d.Attempts != 2 || len(d.AttemptLog) != 2 ||
+		d.AttemptLog[0].StatusCode != http.StatusServiceUnavailable || d.AttemptLog[1].StatusCode != http.StatusOK {
+		t.Fatalf("delivery ended %s after %d attempts, logged %v", d.Status, d.Attempts, d.AttemptLog)
+	}
+}
+
+func TestWorkerGivesUpAfterMaxAttempts(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	w, store := newWorker(t, rc, 2)
+	queued := store.queue(db.EventPurchaseCompleted, `{"amount":65}`)
+
+	pollUntil(t, w, 2)
+	time.Sleep(100 * time.Millisecond)
+	if sent := w.Poll(context.Background()); sent != 0 {
+		t.Fatalf("%d deliveries sent after the last attempt", sent)
+	}
+	if d := store.find(queued.UUID); d.Status != db.DeliveryFailed || d.LastStatusCode != http.StatusBadGateway {
+		t.Fatalf("delivery ended %s with status %d", d.Status, d.LastStatusCode)
+	}
+}
+
+// TestWorkerResendsQueuedCopy checks that the worker sends a copied delivery with the payload and the
+// event of the original, under its own delivery id. The copy is queued by the test: the query of
+// db.ReplayWebhookDelivery needs a database and is not run here
+func TestWorkerResendsQueuedCopy(t *testing.T) {
+	rc := new(receiver)
+	w, store := newWorker(t, rc, 3)
+	queued := store.queue(db.EventDepositReceived, `{"deposit":50,"user":"u1"}`)
+	pollUntil(t, w, 1)
+
+	replay := store.queueCopy(queued.UUID)
+	pollUntil(t, w, 1)
+
+	got := rc.deliveries()
+	if len(got) != 2 {
+		t.Fatalf("%d deliveries received, want 2", len(got))
+	}
+	original, replayed := got[0], got[1]
+	if !replayed.verified {
+		t.Fatalf("replayed delivery %+v does not verify", replayed)
+	}
+	if replayed.body != original.body || replayed.eventID != original.eventID || replayed.event != original.event {
+		t.Fatalf("replayed %+v, want the stored payload of %+v", replayed, original)
+	}
+	if replayed.delivery != replay.UUID || replayed.delivery == original.delivery {
+		t.Fatalf("replayed as delivery %s, want the new delivery %s", replayed.delivery, replay.UUID)
+	}
+	if d := store.find(replay.UUID); d.Status != db.DeliveryDelivered || d.ReplayOf != queued.UUID {
+		t.Fatalf("replay ended %s as a replay of '%s'", d.Status, d.ReplayOf)
+	}
+}